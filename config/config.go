@@ -1,71 +1,549 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"rapidrtmp/internal/storage"
+	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/pkg/models"
 )
 
 // Config holds all application configuration
 type Config struct {
 	// HTTP Server
-	HTTPAddr string
-	
+	HTTPAddr           string
+	CORSAllowedOrigins []string // Origins allowed for cross-origin requests ("*" for any)
+
+	// HTTPS, enabled by a certificate and key or by autocert domains
+	TLSCert             string   // PEM certificate file
+	TLSKey              string   // PEM private key file
+	TLSAutocertDomains  []string // Domains to obtain Let's Encrypt certificates for
+	TLSAutocertCacheDir string   // Where obtained certificates are cached
+	HTTP2Enabled        bool     // Negotiate HTTP/2 over TLS
+
 	// RTMP Server
 	RTMPAddr       string
 	RTMPIngestAddr string // Public RTMP URL for publishers
-	
+	AppInStreamKey bool   // Namespace stream keys by RTMP app, e.g. "live/key"
+
+	// RTMPS (RTMP over TLS), enabled when a certificate and key are set
+	RTMPSAddr string
+	RTMPSCert string // PEM certificate file
+	RTMPSKey  string // PEM private key file
+	RTMPSOnly bool   // Don't open the plaintext RTMP listener
+
+	RTMPChunkSize       int // Outgoing chunk size in bytes (128-65536)
+	RTMPBandwidthWindow int // Peer bandwidth window in bytes sent to publishers (64KiB-1GiB)
+
+	// Connection limits against abusive clients
+	RTMPMaxConnections int           // Concurrent RTMP and RTMPS connections (0 means unlimited)
+	RTMPPublishTimeout time.Duration // Close connections that haven't published by then (0 disables)
+
+	// Ingest limits; publishers exceeding them are disconnected
+	MaxIngestBitrate    int    // Bits per second averaged over 5 seconds (0 means unlimited)
+	MaxIngestResolution string // e.g. "1920x1080" or "1080p" (empty means unlimited)
+
+	// Relaying to upstream RTMP servers
+	RelayTargets             []string // Upstream URLs every stream is forwarded to; may contain {streamKey}
+	RelayAllowPublishTargets bool     // Let publish token requests choose a stream's upstreams
+
+	// WebRTC playback over WHEP (experimental)
+	WHEPEnabled    bool
+	WHEPICEServers []string // STUN or TURN URLs used to reach viewers behind NAT
+
 	// Storage
-	StorageType    string // "local" or "gcs"
-	StorageDir     string // For local storage
-	GCSProjectID   string // For GCS
-	GCSBucketName  string // For GCS
-	GCSBaseDir     string // Base directory in GCS bucket
-	
+	StorageType     string        // "local", "gcs" or "memory"
+	StorageDir      string        // For local storage
+	MemoryMaxMB     int           // Size cap for memory storage
+	GCSProjectID    string        // For GCS
+	GCSBucketName   string        // For GCS
+	GCSBaseDir      string        // Base directory in GCS bucket
+	GCSOpTimeout    time.Duration // Deadline for each GCS operation attempt
+	StorageScan     bool          // Count media segments already in storage at startup
+	StorageRecovery string        // What to do at startup with streams left in storage: "off", "list" or "auto"
+	TenantStorage   []string      // "tenant=location" pairs giving tenants their own directory (local) or bucket (gcs)
+
 	// HLS
-	HLSSegmentDuration time.Duration
-	HLSMaxSegments     int
-	
+	HLSSegmentDuration     time.Duration
+	HLSMaxSegments         int           // Segments listed in the live playlist
+	HLSStorageRetention    int           // Segments kept in storage (0 keeps just the playlist window)
+	HLSDVRWindow           time.Duration // Media kept behind the live edge for ?dvr=1 playlists (0 disables)
+	HLSContainer           string        // Segment format: "ts" or "fmp4"
+	HLSSegmentPattern      string        // Media segment file name, with {seq} for the sequence number
+	HLSInitSegmentName     string        // Init segment file name
+	HLSPathTemplate        string        // Storage path of media segments, e.g. "{streamKey}/{date}/segment_{seq}.ts"; overrides HLSSegmentPattern
+	HLSPlaylistContentType string        // Content-Type of playlists, in storage and over HTTP
+	HLSTSContentType       string        // Content-Type of MPEG-TS segments
+	HLSFMP4ContentType     string        // Content-Type of fMP4 media segments, e.g. "video/iso.segment"
+	HLSInitContentType     string        // Content-Type of fMP4 init segments
+	RecordingEnabled       bool          // Keep segments in storage after a stream stops
+	CleanupGrace           time.Duration // Delay before a stopped stream's segments are deleted
+	RecordingRetention     time.Duration // Age at which recordings are deleted from storage (0 keeps them)
+	HLSUploadConcurrency   int           // Segment writes to storage running at once, across streams
+	HLSContinueOnReconnect bool          // Continue a republished stream's playlist with a discontinuity instead of starting over
+	HLSKeyFrameTimeout     time.Duration // Warn when a stream sends no keyframe this long after it starts (0 disables)
+	LLHLS                  bool          // Advertise low-latency HLS server control: blocking reloads and delta updates
+	LLPartDuration         time.Duration // LL-HLS part target
+	LLPartHoldBack         time.Duration // Distance from the live edge LL-HLS players start at (0: three parts)
+
+	// Thumbnails
+	ThumbnailInterval time.Duration // How often to refresh live previews (0 disables)
+
 	// Auth
 	DefaultTokenExpiration time.Duration
 	MaxTokenExpiration     time.Duration
-	
+	PlaybackAuthEnabled    bool          // Require playback tokens for /live routes
+	PlaybackPublicStreams  []string      // Stream keys that stay public when playback auth is enabled
+	PublishAuthURL         string        // External service that approves publishes (empty disables)
+	PublishAuthTimeout     time.Duration // Timeout for publish authorization requests
+	PublishRatePerMinute   int           // Publish token requests allowed per IP per minute (0 disables)
+	PublishRateBurst       int           // Publish token requests allowed in a burst
+	RequireAdminAPI        bool          // Require AdminAPIKey for stream listing and management
+	AdminAPIKey            string        // Key expected in the X-Admin-Key header
+
 	// Limits
 	MaxConcurrentStreams int
 	MaxViewersPerStream  int
+
+	// Webhooks
+	WebhookURL    string // Receives stream lifecycle events (empty disables)
+	WebhookSecret string // HMAC key for signing webhook payloads
+
+	// Metrics
+	MetricsPerStream bool // Label frame metrics by stream key (disable for high-churn deployments)
+
+	// Viewers
+	ViewerTimeout time.Duration // Inactivity before an HLS viewer is considered gone
+
+	// Streams
+	StreamIdleTimeout      time.Duration // Time without frames before a live stream is reaped (0 disables)
+	MaxPublishDuration     time.Duration // Live streams are stopped after this long (0 means unlimited)
+	SubscriberBuffer       int           // Frames buffered per internal consumer, e.g. the segmenter
+	ViewerSubscriberBuffer int           // Frames buffered per viewer subscription
+
+	// Lifecycle
+	ShutdownTimeout time.Duration // Time allowed to drain streams and requests on shutdown
+
+	// Diagnostics
+	Debug           bool   // Expose /debug endpoints that dump internal state
+	AccessLog       bool   // Log one line per HTTP request
+	AccessLogFormat string // "text" or "json"
 }
 
+// RTMP tuning bounds
+// Chunks below 128 bytes are not allowed by the spec, and many clients fail on
+// chunks above 64KiB. Bandwidth windows outside these bounds either stall
+// publishers waiting for acks or stop meaning anything.
+const (
+	MinRTMPChunkSize       = 128
+	MaxRTMPChunkSize       = 65536
+	MinRTMPBandwidthWindow = 64 * 1024
+	MaxRTMPBandwidthWindow = 1024 * 1024 * 1024
+)
+
 // Load loads configuration from environment variables with defaults
 func Load() *Config {
+	return load(source{})
+}
+
+// LoadFromFile loads configuration from a YAML or JSON file layered under
+// environment variables: env vars take precedence over file values, which
+// take precedence over defaults. Keys use the environment variable names
+// (e.g. HTTP_ADDR or http_addr).
+func LoadFromFile(path string) (*Config, error) {
+	return Flags(nil).Load(path)
+}
+
+// load builds a Config from the given source
+func load(src source) *Config {
+	contentTypes := storage.DefaultContentTypes()
+
 	return &Config{
-		HTTPAddr:               getEnv("HTTP_ADDR", ":8080"),
-		RTMPAddr:               getEnv("RTMP_ADDR", ":1935"),
-		RTMPIngestAddr:         getEnv("RTMP_INGEST_ADDR", "rtmp://localhost:1935"),
-		StorageType:            getEnv("STORAGE_TYPE", "local"), // "local" or "gcs"
-		StorageDir:             getEnv("STORAGE_DIR", "./data/streams"),
-		GCSProjectID:           getEnv("GCS_PROJECT_ID", ""),
-		GCSBucketName:          getEnv("GCS_BUCKET_NAME", ""),
-		GCSBaseDir:             getEnv("GCS_BASE_DIR", "streams"),
-		HLSSegmentDuration:     getDurationEnv("HLS_SEGMENT_DURATION", 2*time.Second),
-		HLSMaxSegments:         getIntEnv("HLS_MAX_SEGMENTS", 10),
-		DefaultTokenExpiration: getDurationEnv("DEFAULT_TOKEN_EXPIRATION", 1*time.Hour),
-		MaxTokenExpiration:     getDurationEnv("MAX_TOKEN_EXPIRATION", 24*time.Hour),
-		MaxConcurrentStreams:   getIntEnv("MAX_CONCURRENT_STREAMS", 100),
-		MaxViewersPerStream:    getIntEnv("MAX_VIEWERS_PER_STREAM", 1000),
-	}
-}
-
-// Helper functions to get environment variables with defaults
-
-func getEnv(key, defaultValue string) string {
+		HTTPAddr:                 src.getEnv("HTTP_ADDR", ":8080"),
+		CORSAllowedOrigins:       src.getListEnv("CORS_ALLOWED_ORIGINS", []string{"*"}),
+		TLSCert:                  src.getEnv("TLS_CERT", ""),
+		TLSKey:                   src.getEnv("TLS_KEY", ""),
+		TLSAutocertDomains:       src.getListEnv("TLS_AUTOCERT_DOMAINS", nil),
+		TLSAutocertCacheDir:      src.getEnv("TLS_AUTOCERT_CACHE_DIR", "./data/autocert"),
+		HTTP2Enabled:             src.getBoolEnv("HTTP2_ENABLED", true),
+		RTMPAddr:                 src.getEnv("RTMP_ADDR", ":1935"),
+		RTMPIngestAddr:           src.getEnv("RTMP_INGEST_ADDR", "rtmp://localhost:1935"),
+		AppInStreamKey:           src.getBoolEnv("RTMP_APP_IN_STREAM_KEY", false),
+		RTMPSAddr:                src.getEnv("RTMPS_ADDR", ":1936"),
+		RTMPSCert:                src.getEnv("RTMPS_CERT", ""),
+		RTMPSKey:                 src.getEnv("RTMPS_KEY", ""),
+		RTMPSOnly:                src.getBoolEnv("RTMPS_ONLY", false),
+		RTMPChunkSize:            src.getIntEnv("RTMP_CHUNK_SIZE", 128),
+		RTMPBandwidthWindow:      src.getIntEnv("RTMP_BANDWIDTH_WINDOW", 6*1024*1024),
+		RTMPMaxConnections:       src.getIntEnv("RTMP_MAX_CONNECTIONS", 0),
+		RTMPPublishTimeout:       src.getDurationEnv("RTMP_PUBLISH_TIMEOUT", 10*time.Second),
+		MaxIngestBitrate:         src.getIntEnv("MAX_INGEST_BITRATE", 0),
+		MaxIngestResolution:      src.getEnv("MAX_INGEST_RESOLUTION", ""),
+		RelayTargets:             src.getListEnv("RELAY_TARGETS", nil),
+		RelayAllowPublishTargets: src.getBoolEnv("RELAY_ALLOW_PUBLISH_TARGETS", false),
+		WHEPEnabled:              src.getBoolEnv("WHEP_ENABLED", false),
+		WHEPICEServers:           src.getListEnv("WHEP_ICE_SERVERS", nil),
+		StorageType:              src.getEnv("STORAGE_TYPE", "local"), // "local", "gcs" or "memory"
+		StorageDir:               src.getEnv("STORAGE_DIR", "./data/streams"),
+		MemoryMaxMB:              src.getIntEnv("MEMORY_STORAGE_MAX_MB", 512),
+		StorageScan:              src.getBoolEnv("STORAGE_USAGE_SCAN", false),
+		StorageRecovery:          src.getEnv("STORAGE_RECOVERY", "off"),
+		TenantStorage:            src.getListEnv("TENANT_STORAGE", nil),
+		GCSProjectID:             src.getEnv("GCS_PROJECT_ID", ""),
+		GCSBucketName:            src.getEnv("GCS_BUCKET_NAME", ""),
+		GCSBaseDir:               src.getEnv("GCS_BASE_DIR", "streams"),
+		GCSOpTimeout:             src.getDurationEnv("GCS_OP_TIMEOUT", 10*time.Second),
+		HLSSegmentDuration:       src.getDurationEnv("HLS_SEGMENT_DURATION", 2*time.Second),
+		HLSMaxSegments:           src.getIntEnv("HLS_MAX_SEGMENTS", 10),
+		HLSStorageRetention:      src.getIntEnv("HLS_STORAGE_RETENTION", 0),
+		HLSDVRWindow:             src.getDurationEnv("HLS_DVR_WINDOW", 0),
+		HLSContainer:             src.getEnv("HLS_CONTAINER", "ts"),
+		HLSSegmentPattern:        src.getEnv("HLS_SEGMENT_PATTERN", defaultSegmentPattern(src.getEnv("HLS_CONTAINER", "ts"))),
+		HLSInitSegmentName:       src.getEnv("HLS_INIT_SEGMENT_NAME", "init.mp4"),
+		HLSPathTemplate:          src.getEnv("HLS_PATH_TEMPLATE", ""),
+		HLSPlaylistContentType:   src.getEnv("HLS_PLAYLIST_CONTENT_TYPE", contentTypes.Playlist),
+		HLSTSContentType:         src.getEnv("HLS_TS_CONTENT_TYPE", contentTypes.TSSegment),
+		HLSFMP4ContentType:       src.getEnv("HLS_FMP4_CONTENT_TYPE", contentTypes.FMP4Segment),
+		HLSInitContentType:       src.getEnv("HLS_INIT_CONTENT_TYPE", contentTypes.Init),
+		RecordingEnabled:         src.getBoolEnv("RECORDING_ENABLED", false),
+		CleanupGrace:             src.getDurationEnv("STREAM_CLEANUP_GRACE", 30*time.Second),
+		RecordingRetention:       src.getDurationEnv("RECORDING_RETENTION", 0),
+		HLSUploadConcurrency:     src.getIntEnv("HLS_UPLOAD_CONCURRENCY", 4),
+		HLSContinueOnReconnect:   src.getBoolEnv("HLS_CONTINUE_ON_RECONNECT", true),
+		HLSKeyFrameTimeout:       src.getDurationEnv("HLS_KEYFRAME_TIMEOUT", 10*time.Second),
+		LLHLS:                    src.getBoolEnv("LL_HLS", false),
+		LLPartDuration:           src.getDurationEnv("LL_PART_DURATION", time.Second),
+		LLPartHoldBack:           src.getDurationEnv("LL_PART_HOLD_BACK", 0),
+		ThumbnailInterval:        src.getDurationEnv("THUMBNAIL_INTERVAL", 10*time.Second),
+		DefaultTokenExpiration:   src.getDurationEnv("DEFAULT_TOKEN_EXPIRATION", 1*time.Hour),
+		MaxTokenExpiration:       src.getDurationEnv("MAX_TOKEN_EXPIRATION", 24*time.Hour),
+		PlaybackAuthEnabled:      src.getBoolEnv("PLAYBACK_AUTH_ENABLED", false),
+		PlaybackPublicStreams:    src.getListEnv("PLAYBACK_PUBLIC_STREAMS", nil),
+		PublishAuthURL:           src.getEnv("PUBLISH_AUTH_URL", ""),
+		RequireAdminAPI:          src.getBoolEnv("REQUIRE_ADMIN_API", false),
+		AdminAPIKey:              src.getEnv("ADMIN_API_KEY", ""),
+		PublishAuthTimeout:       src.getDurationEnv("PUBLISH_AUTH_TIMEOUT", 5*time.Second),
+		PublishRatePerMinute:     src.getIntEnv("PUBLISH_RATE_PER_MINUTE", 10),
+		PublishRateBurst:         src.getIntEnv("PUBLISH_RATE_BURST", 5),
+		MaxConcurrentStreams:     src.getIntEnv("MAX_CONCURRENT_STREAMS", 100),
+		MaxViewersPerStream:      src.getIntEnv("MAX_VIEWERS_PER_STREAM", 1000),
+		WebhookURL:               src.getEnv("WEBHOOK_URL", ""),
+		WebhookSecret:            src.getEnv("WEBHOOK_SECRET", ""),
+		MetricsPerStream:         src.getBoolEnv("METRICS_PER_STREAM", true),
+		ViewerTimeout:            src.getDurationEnv("VIEWER_TIMEOUT", 30*time.Second),
+		StreamIdleTimeout:        src.getDurationEnv("STREAM_IDLE_TIMEOUT", 30*time.Second),
+		SubscriberBuffer:         src.getIntEnv("SUBSCRIBER_BUFFER", streammanager.DefaultSubscriberBuffer),
+		ViewerSubscriberBuffer:   src.getIntEnv("VIEWER_SUBSCRIBER_BUFFER", streammanager.DefaultSubscriberBuffer),
+		MaxPublishDuration:       src.getDurationEnv("MAX_PUBLISH_DURATION", 0),
+		ShutdownTimeout:          src.getDurationEnv("SHUTDOWN_TIMEOUT", 15*time.Second),
+		Debug:                    src.getBoolEnv("DEBUG", false),
+		AccessLog:                src.getBoolEnv("ACCESS_LOG", true),
+		AccessLogFormat:          src.getEnv("ACCESS_LOG_FORMAT", "text"),
+	}
+}
+
+// defaultSegmentPattern names segments with the usual extension for the container
+func defaultSegmentPattern(container string) string {
+	if container == "fmp4" {
+		return "segment_{seq}.m4s"
+	}
+	return "segment_{seq}.ts"
+}
+
+// Validate checks for missing or impossible configuration combinations
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.HTTPAddr == "" {
+		errs = append(errs, errors.New("HTTP_ADDR must not be empty"))
+	}
+	if c.RTMPAddr == "" {
+		errs = append(errs, errors.New("RTMP_ADDR must not be empty"))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("TLS_CERT and TLS_KEY must be set together"))
+	}
+	if c.TLSCert != "" && len(c.TLSAutocertDomains) > 0 {
+		errs = append(errs, errors.New("TLS_CERT/TLS_KEY and TLS_AUTOCERT_DOMAINS are mutually exclusive"))
+	}
+	if len(c.TLSAutocertDomains) > 0 && c.TLSAutocertCacheDir == "" {
+		errs = append(errs, errors.New("TLS_AUTOCERT_CACHE_DIR must be set when TLS_AUTOCERT_DOMAINS is used"))
+	}
+	if (c.RTMPSCert == "") != (c.RTMPSKey == "") {
+		errs = append(errs, errors.New("RTMPS_CERT and RTMPS_KEY must be set together"))
+	}
+	if c.RTMPSEnabled() && c.RTMPSAddr == "" {
+		errs = append(errs, errors.New("RTMPS_ADDR must not be empty when RTMPS is enabled"))
+	}
+	if c.RTMPSOnly && !c.RTMPSEnabled() {
+		errs = append(errs, errors.New("RTMPS_ONLY requires RTMPS_CERT and RTMPS_KEY"))
+	}
+	if c.RTMPChunkSize < MinRTMPChunkSize || c.RTMPChunkSize > MaxRTMPChunkSize {
+		errs = append(errs, fmt.Errorf("RTMP_CHUNK_SIZE must be between %d and %d bytes, got %d",
+			MinRTMPChunkSize, MaxRTMPChunkSize, c.RTMPChunkSize))
+	}
+	if c.RTMPBandwidthWindow < MinRTMPBandwidthWindow || c.RTMPBandwidthWindow > MaxRTMPBandwidthWindow {
+		errs = append(errs, fmt.Errorf("RTMP_BANDWIDTH_WINDOW must be between %d and %d bytes, got %d",
+			MinRTMPBandwidthWindow, MaxRTMPBandwidthWindow, c.RTMPBandwidthWindow))
+	}
+	if c.RTMPMaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("RTMP_MAX_CONNECTIONS must not be negative, got %d", c.RTMPMaxConnections))
+	}
+	if c.RTMPPublishTimeout < 0 {
+		errs = append(errs, fmt.Errorf("RTMP_PUBLISH_TIMEOUT must not be negative, got %s", c.RTMPPublishTimeout))
+	}
+	if c.MaxIngestBitrate < 0 {
+		errs = append(errs, fmt.Errorf("MAX_INGEST_BITRATE must not be negative, got %d", c.MaxIngestBitrate))
+	}
+	if _, _, err := c.MaxIngestDimensions(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.StorageType {
+	case "local":
+		if c.StorageDir == "" {
+			errs = append(errs, errors.New("STORAGE_DIR must be set when STORAGE_TYPE=local"))
+		}
+	case "gcs":
+		if c.GCSProjectID == "" || c.GCSBucketName == "" {
+			errs = append(errs, errors.New("GCS_PROJECT_ID and GCS_BUCKET_NAME must be set when STORAGE_TYPE=gcs"))
+		}
+		if c.GCSOpTimeout <= 0 {
+			errs = append(errs, fmt.Errorf("GCS_OP_TIMEOUT must be positive, got %s", c.GCSOpTimeout))
+		}
+	case "memory":
+		if c.MemoryMaxMB <= 0 {
+			errs = append(errs, fmt.Errorf("MEMORY_STORAGE_MAX_MB must be positive when STORAGE_TYPE=memory, got %d", c.MemoryMaxMB))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("STORAGE_TYPE must be \"local\", \"gcs\" or \"memory\", got %q", c.StorageType))
+	}
+	if _, err := c.TenantStorageLocations(); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.StorageRecovery {
+	case "off", "list", "auto":
+	default:
+		errs = append(errs, fmt.Errorf("STORAGE_RECOVERY must be \"off\", \"list\" or \"auto\", got %q", c.StorageRecovery))
+	}
+
+	if c.HLSSegmentDuration <= 0 {
+		errs = append(errs, fmt.Errorf("HLS_SEGMENT_DURATION must be positive, got %s", c.HLSSegmentDuration))
+	}
+	if c.HLSMaxSegments < 3 {
+		errs = append(errs, fmt.Errorf("HLS_MAX_SEGMENTS must be at least 3, got %d", c.HLSMaxSegments))
+	}
+	if c.HLSStorageRetention < 0 {
+		errs = append(errs, fmt.Errorf("HLS_STORAGE_RETENTION must not be negative, got %d", c.HLSStorageRetention))
+	}
+	if c.HLSUploadConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("HLS_UPLOAD_CONCURRENCY must be at least 1, got %d", c.HLSUploadConcurrency))
+	}
+	if c.HLSKeyFrameTimeout < 0 {
+		errs = append(errs, fmt.Errorf("HLS_KEYFRAME_TIMEOUT must not be negative, got %s", c.HLSKeyFrameTimeout))
+	}
+	if c.HLSDVRWindow < 0 {
+		errs = append(errs, fmt.Errorf("HLS_DVR_WINDOW must not be negative, got %s", c.HLSDVRWindow))
+	}
+	if c.HLSContainer != "ts" && c.HLSContainer != "fmp4" {
+		errs = append(errs, fmt.Errorf("HLS_CONTAINER must be \"ts\" or \"fmp4\", got %q", c.HLSContainer))
+	}
+	if err := c.ContentTypes().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("HLS content types: %w", err))
+	}
+	if strings.Count(c.HLSSegmentPattern, "{seq}") != 1 || strings.Contains(c.HLSSegmentPattern, "/") {
+		errs = append(errs, fmt.Errorf("HLS_SEGMENT_PATTERN must be a file name containing {seq} exactly once, got %q", c.HLSSegmentPattern))
+	}
+	if c.HLSPathTemplate != "" && !strings.HasPrefix(c.HLSPathTemplate, "{streamKey}/") {
+		errs = append(errs, fmt.Errorf("HLS_PATH_TEMPLATE must start with {streamKey}/, got %q", c.HLSPathTemplate))
+	}
+	if c.HLSInitSegmentName == "" || strings.Contains(c.HLSInitSegmentName, "/") {
+		errs = append(errs, fmt.Errorf("HLS_INIT_SEGMENT_NAME must be a file name, got %q", c.HLSInitSegmentName))
+	}
+	if c.CleanupGrace < 0 {
+		errs = append(errs, fmt.Errorf("STREAM_CLEANUP_GRACE must not be negative, got %s", c.CleanupGrace))
+	}
+	if c.RecordingRetention < 0 {
+		errs = append(errs, fmt.Errorf("RECORDING_RETENTION must not be negative, got %s", c.RecordingRetention))
+	}
+	if c.LLHLS {
+		if c.LLPartDuration <= 0 || c.LLPartDuration >= c.HLSSegmentDuration {
+			errs = append(errs, fmt.Errorf("LL_PART_DURATION must be positive and shorter than HLS_SEGMENT_DURATION, got %s", c.LLPartDuration))
+		}
+		if c.LLPartHoldBack != 0 && c.LLPartHoldBack < 2*c.LLPartDuration {
+			errs = append(errs, fmt.Errorf("LL_PART_HOLD_BACK must be at least twice LL_PART_DURATION, got %s", c.LLPartHoldBack))
+		}
+	}
+
+	if c.DefaultTokenExpiration <= 0 || c.MaxTokenExpiration <= 0 {
+		errs = append(errs, errors.New("DEFAULT_TOKEN_EXPIRATION and MAX_TOKEN_EXPIRATION must be positive"))
+	} else if c.DefaultTokenExpiration > c.MaxTokenExpiration {
+		errs = append(errs, fmt.Errorf("DEFAULT_TOKEN_EXPIRATION (%s) exceeds MAX_TOKEN_EXPIRATION (%s)",
+			c.DefaultTokenExpiration, c.MaxTokenExpiration))
+	}
+
+	if c.PublishAuthURL != "" && c.PublishAuthTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("PUBLISH_AUTH_TIMEOUT must be positive, got %s", c.PublishAuthTimeout))
+	}
+
+	if c.PublishRatePerMinute < 0 {
+		errs = append(errs, fmt.Errorf("PUBLISH_RATE_PER_MINUTE must not be negative, got %d", c.PublishRatePerMinute))
+	}
+	if c.PublishRatePerMinute > 0 && c.PublishRateBurst < 1 {
+		errs = append(errs, fmt.Errorf("PUBLISH_RATE_BURST must be at least 1, got %d", c.PublishRateBurst))
+	}
+
+	if c.ThumbnailInterval < 0 {
+		errs = append(errs, fmt.Errorf("THUMBNAIL_INTERVAL must not be negative, got %s", c.ThumbnailInterval))
+	}
+	if c.ViewerTimeout < 0 {
+		errs = append(errs, fmt.Errorf("VIEWER_TIMEOUT must not be negative, got %s", c.ViewerTimeout))
+	}
+	if c.SubscriberBuffer < streammanager.MinSubscriberBuffer {
+		errs = append(errs, fmt.Errorf("SUBSCRIBER_BUFFER must be at least %d frames, got %d", streammanager.MinSubscriberBuffer, c.SubscriberBuffer))
+	}
+	if c.ViewerSubscriberBuffer < streammanager.MinSubscriberBuffer {
+		errs = append(errs, fmt.Errorf("VIEWER_SUBSCRIBER_BUFFER must be at least %d frames, got %d", streammanager.MinSubscriberBuffer, c.ViewerSubscriberBuffer))
+	}
+	if c.StreamIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("STREAM_IDLE_TIMEOUT must not be negative, got %s", c.StreamIdleTimeout))
+	}
+	if c.MaxPublishDuration < 0 {
+		errs = append(errs, fmt.Errorf("MAX_PUBLISH_DURATION must not be negative, got %s", c.MaxPublishDuration))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("SHUTDOWN_TIMEOUT must be positive, got %s", c.ShutdownTimeout))
+	}
+	if c.RequireAdminAPI && c.AdminAPIKey == "" {
+		errs = append(errs, errors.New("ADMIN_API_KEY must be set when REQUIRE_ADMIN_API is enabled"))
+	}
+	if c.AccessLogFormat != "text" && c.AccessLogFormat != "json" {
+		errs = append(errs, fmt.Errorf("ACCESS_LOG_FORMAT must be \"text\" or \"json\", got %q", c.AccessLogFormat))
+	}
+
+	return errors.Join(errs...)
+}
+
+// RTMPSEnabled reports whether a certificate and key are configured for RTMPS
+func (c *Config) RTMPSEnabled() bool {
+	return c.RTMPSCert != "" && c.RTMPSKey != ""
+}
+
+// ContentTypes returns the media types HLS files are stored and served with
+func (c *Config) ContentTypes() storage.ContentTypes {
+	return storage.ContentTypes{
+		Playlist:    c.HLSPlaylistContentType,
+		TSSegment:   c.HLSTSContentType,
+		FMP4Segment: c.HLSFMP4ContentType,
+		Init:        c.HLSInitContentType,
+	}
+}
+
+// TenantStorageLocations parses TenantStorage into tenant -> location: a
+// directory for local storage or a bucket, in GCSProjectID, for GCS
+func (c *Config) TenantStorageLocations() (map[string]string, error) {
+	if len(c.TenantStorage) == 0 {
+		return nil, nil
+	}
+	if c.StorageType == "memory" {
+		return nil, errors.New("TENANT_STORAGE is not supported with STORAGE_TYPE=memory")
+	}
+
+	locations := make(map[string]string, len(c.TenantStorage))
+	for _, entry := range c.TenantStorage {
+		tenant, location, ok := strings.Cut(entry, "=")
+		tenant, location = strings.TrimSpace(tenant), strings.TrimSpace(location)
+		if !ok || location == "" {
+			return nil, fmt.Errorf("TENANT_STORAGE entries must be tenant=location, got %q", entry)
+		}
+		if err := models.ValidateTenant(tenant); err != nil {
+			return nil, fmt.Errorf("TENANT_STORAGE: %w", err)
+		}
+		if _, dup := locations[tenant]; dup {
+			return nil, fmt.Errorf("TENANT_STORAGE lists tenant %q more than once", tenant)
+		}
+		locations[tenant] = location
+	}
+	return locations, nil
+}
+
+// MaxIngestDimensions parses MaxIngestResolution, either "WIDTHxHEIGHT" or
+// a height such as "1080p" for 16:9 video; zeros mean unlimited
+func (c *Config) MaxIngestDimensions() (width, height int, err error) {
+	value := strings.ToLower(strings.TrimSpace(c.MaxIngestResolution))
+	if value == "" {
+		return 0, 0, nil
+	}
+
+	if h, ok := strings.CutSuffix(value, "p"); ok {
+		height, err = strconv.Atoi(h)
+		width = (height*16 + 8) / 9
+	} else if w, h, ok := strings.Cut(value, "x"); ok {
+		width, err = strconv.Atoi(w)
+		if err == nil {
+			height, err = strconv.Atoi(h)
+		}
+	} else {
+		err = errors.New("missing separator")
+	}
+	if err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("MAX_INGEST_RESOLUTION must be WIDTHxHEIGHT or a height like 1080p, got %q", c.MaxIngestResolution)
+	}
+	return width, height, nil
+}
+
+// source resolves configuration values from command-line flags and
+// environment variables, falling back to values read from a config file
+type source struct {
+	flags    Flags             // Values given on the command line
+	file     map[string]string // Normalized key -> value from the config file
+	used     map[string]bool   // File keys that were consumed by load
+	settings *[]setting        // If set, collects the keys load reads, for RegisterFlags
+}
+
+// declare records a key load reads, with its type and default
+func (src source) declare(key, kind, defaultValue string) {
+	if src.settings != nil {
+		*src.settings = append(*src.settings, setting{key: key, kind: kind, defaultValue: defaultValue})
+	}
+}
+
+// lookup returns the value for a key, preferring flags, then the
+// environment, then the file
+func (src source) lookup(key string) string {
+	fileValue, inFile := src.file[key]
+	if inFile {
+		src.used[key] = true
+	}
+
+	if value, ok := src.flags[key]; ok {
+		return value
+	}
+
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
+	return fileValue
+}
+
+// Helper functions to get configuration values with defaults
+
+func (src source) getEnv(key, defaultValue string) string {
+	src.declare(key, "string", defaultValue)
+	if value := src.lookup(key); value != "" {
+		return value
+	}
 	return defaultValue
 }
 
-func getIntEnv(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
+func (src source) getIntEnv(key string, defaultValue int) int {
+	src.declare(key, "int", strconv.Itoa(defaultValue))
+	if value := src.lookup(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
 			return intValue
 		}
@@ -73,11 +551,49 @@ func getIntEnv(key string, defaultValue int) int {
 	return defaultValue
 }
 
-func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
-	if value := os.Getenv(key); value != "" {
-		if duration, err := time.ParseDuration(value); err == nil {
+func (src source) getBoolEnv(key string, defaultValue bool) bool {
+	src.declare(key, "bool", strconv.FormatBool(defaultValue))
+	if value := src.lookup(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+func (src source) getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	src.declare(key, "duration", defaultValue.String())
+	if value := src.lookup(key); value != "" {
+		if duration, err := parseDuration(value); err == nil {
 			return duration
 		}
 	}
 	return defaultValue
 }
+
+// parseDuration parses a duration as time.ParseDuration does, or a whole
+// number of days such as "7d"
+func parseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+func (src source) getListEnv(key string, defaultValue []string) []string {
+	src.declare(key, "list", strings.Join(defaultValue, ","))
+	if value := src.lookup(key); value != "" {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		if len(items) > 0 {
+			return items
+		}
+	}
+	return defaultValue
+}
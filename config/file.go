@@ -0,0 +1,71 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile reads a flat YAML or JSON config file into normalized
+// key/value pairs. Keys are matched against environment variable names,
+// so "http_addr", "http-addr" and "HTTP_ADDR" are equivalent. List values
+// are joined with commas.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// Keep numbers as written; float64 would print 6291456 as 6.291456e+06
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q (use .yaml, .yml or .json)", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		normalized := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+
+		switch v := value.(type) {
+		case nil:
+			continue
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = formatValue(item)
+			}
+			values[normalized] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("config key %q must be a scalar or list, not a map", key)
+		default:
+			values[normalized] = formatValue(v)
+		}
+	}
+
+	return values, nil
+}
+
+// formatValue renders a scalar config value the way it would be written in
+// an environment variable, so floats never come out in exponent form
+func formatValue(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestReadConfigFileNumbers(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"json", "config.json", `{"rtmp_bandwidth_window": 8388608, "max_bitrate": 12.5, "ports": [1935, 10000000]}`},
+		{"yaml", "config.yaml", "rtmp_bandwidth_window: 8388608\nmax_bitrate: 12.5\nports: [1935, 10000000]\n"},
+	}
+
+	want := map[string]string{
+		"RTMP_BANDWIDTH_WINDOW": "8388608",
+		"MAX_BITRATE":           "12.5",
+		"PORTS":                 "1935,10000000",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := readConfigFile(writeConfigFile(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatalf("readConfigFile: %v", err)
+			}
+			for key, value := range want {
+				if values[key] != value {
+					t.Errorf("%s = %q, want %q", key, values[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFromFileLargeInteger(t *testing.T) {
+	t.Setenv("RTMP_BANDWIDTH_WINDOW", "")
+
+	cfg, err := LoadFromFile(writeConfigFile(t, "config.json", `{"RTMP_BANDWIDTH_WINDOW": 8388608}`))
+	if err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+	if cfg.RTMPBandwidthWindow != 8388608 {
+		t.Errorf("RTMPBandwidthWindow = %d, want 8388608", cfg.RTMPBandwidthWindow)
+	}
+}
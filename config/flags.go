@@ -0,0 +1,117 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Flags holds settings given on the command line, keyed by environment
+// variable name. They take precedence over environment variables, which take
+// precedence over the config file and defaults.
+type Flags map[string]string
+
+// setting describes one configuration key, as read by load
+type setting struct {
+	key          string
+	kind         string // "string", "int", "bool", "duration" or "list"
+	defaultValue string
+}
+
+// RegisterFlags defines a flag on fs for every setting, named after its
+// environment variable: --http-addr sets HTTP_ADDR. The returned Flags is
+// filled in when fs is parsed.
+func RegisterFlags(fs *flag.FlagSet) Flags {
+	var settings []setting
+	load(source{settings: &settings})
+
+	flags := make(Flags)
+	seen := make(map[string]bool, len(settings))
+	for _, s := range settings {
+		if seen[s.key] {
+			continue // Read more than once, e.g. to derive another default
+		}
+		seen[s.key] = true
+
+		usage := fmt.Sprintf("Sets %s, a `%s`", s.key, s.kind)
+		switch s.kind {
+		case "bool":
+			usage = "Sets " + s.key
+		case "list":
+			usage = fmt.Sprintf("Sets %s, a comma-separated `list`", s.key)
+		}
+		fs.Var(&flagValue{flags: flags, setting: s, value: s.defaultValue}, flagName(s.key), usage)
+	}
+	return flags
+}
+
+// Load loads configuration from the flags, environment variables and, if
+// path is not empty, a YAML or JSON config file, in that order of precedence
+func (f Flags) Load(path string) (*Config, error) {
+	if path == "" {
+		return load(source{flags: f}), nil
+	}
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	src := source{file: values, flags: f, used: make(map[string]bool)}
+	cfg := load(src)
+
+	// Reject unknown keys so typos don't silently fall back to defaults
+	for key := range values {
+		if !src.used[key] {
+			return nil, fmt.Errorf("unknown configuration key %q in %s", key, path)
+		}
+	}
+
+	return cfg, nil
+}
+
+// flagName is the command-line flag for an environment variable name
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// flagValue records a setting given on the command line
+type flagValue struct {
+	flags   Flags
+	setting setting
+	value   string
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+// Set checks the value parses as the setting's type, since unlike the
+// environment a mistyped flag can be reported before starting
+func (v *flagValue) Set(value string) error {
+	var err error
+	switch v.setting.kind {
+	case "int":
+		_, err = strconv.Atoi(value)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "duration":
+		_, err = parseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s", v.setting.kind)
+	}
+
+	v.value = value
+	v.flags[v.setting.key] = value
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as a bare --flag
+func (v *flagValue) IsBoolFlag() bool {
+	return v.setting.kind == "bool"
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gortmp "github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"rapidrtmp/config"
+	"rapidrtmp/httpServer"
+	"rapidrtmp/internal/auth"
+	"rapidrtmp/internal/metrics"
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/rtmp"
+	"rapidrtmp/internal/segmenter"
+	"rapidrtmp/internal/storage"
+	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/pkg/client"
+)
+
+// FLV tag types
+const (
+	flvTagAudio = 8
+	flvTagVideo = 9
+)
+
+// Chunk streams for media messages, as OBS and FFmpeg use them
+const (
+	audioChunkStreamID = 4
+	videoChunkStreamID = 6
+)
+
+// tsPacketSize is the fixed MPEG-TS packet length; every packet starts with tsSyncByte
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// TestEndToEnd publishes an FLV file over RTMP to in-process RTMP and HTTP
+// servers and checks that it comes out the other end as HLS: a playlist
+// listing segments and a first segment that is well-formed MPEG-TS.
+//
+// The FLV is generated with FFmpeg, or read from E2E_FLV if set.
+func TestEndToEnd(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not on PATH")
+	}
+	if testing.Short() {
+		t.Skip("publishes in real time")
+	}
+
+	flvPath := os.Getenv("E2E_FLV")
+	if flvPath == "" {
+		flvPath = generateFLV(t)
+	}
+	tags, err := readFLV(flvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rtmpAddr, httpBase := startServers(t)
+
+	const streamKey = "e2e"
+	resp, err := client.RequestPublishToken(httpBase, streamKey, 0)
+	if err != nil {
+		t.Fatalf("RequestPublishToken: %v", err)
+	}
+
+	// Publish in the background while the playlist is polled
+	published := make(chan error, 1)
+	go func() {
+		published <- publish(rtmpAddr, "live", streamKey+"?token="+url.QueryEscape(resp.Token), tags)
+	}()
+
+	playlistURL := fmt.Sprintf("%s/live/%s/index.m3u8", httpBase, streamKey)
+	segmentName, err := waitForSegment(playlistURL, 30*time.Second, published)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fetch(fmt.Sprintf("%s/live/%s/%s", httpBase, streamKey, segmentName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTransportStream(data); err != nil {
+		t.Fatalf("segment %s: %v", segmentName, err)
+	}
+
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// generateFLV encodes a few seconds of test video and audio to an FLV file
+func generateFLV(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sample.flv")
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "testsrc=size=320x240:rate=30",
+		"-f", "lavfi", "-i", "sine=frequency=440:sample_rate=44100",
+		"-t", "4", "-c:v", "libx264", "-g", "30", "-pix_fmt", "yuv420p", "-c:a", "aac",
+		"-f", "flv", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("ffmpeg cannot generate an H.264/AAC sample: %v\n%s", err, out)
+	}
+	return path
+}
+
+// startServers wires up the RTMP and HTTP servers as main does and returns
+// the RTMP address and HTTP base URL
+func startServers(t *testing.T) (rtmpAddr, httpBase string) {
+	t.Helper()
+
+	cfg := config.Load()
+	cfg.PlaybackAuthEnabled = false
+	cfg.RequireAdminAPI = false
+	cfg.PublishRatePerMinute = 0
+	cfg.ViewerTimeout = 0
+
+	store, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStorage: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := metrics.New(false)
+	streamManager := streammanager.New(m)
+	authManager := auth.New()
+	seg := segmenter.New(ctx, store, muxer.NewFFmpegMuxer(), streamManager, m, segmenter.Config{
+		SegmentDuration: time.Second,
+		PlaylistWindow:  segmenter.MinPlaylistWindow,
+	})
+
+	rtmpAddr, httpAddr := freeAddr(t), freeAddr(t)
+	httpSrv := httpServer.New(cfg, streamManager, authManager, seg, nil, m)
+	rtmpSrv := rtmp.New(rtmpAddr, streamManager, authManager, seg, m, rtmp.Config{})
+
+	go func() {
+		if err := rtmpSrv.ListenAndServe(); err != nil {
+			t.Errorf("RTMP server: %v", err)
+		}
+	}()
+	go func() {
+		if err := httpSrv.Run(httpAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("HTTP server: %v", err)
+		}
+	}()
+
+	t.Cleanup(func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer shutdownCancel()
+
+		rtmpSrv.Close()
+		httpSrv.Shutdown(shutdownCtx)
+		if err := seg.Shutdown(shutdownCtx); err != nil {
+			t.Errorf("segmenter shutdown: %v", err)
+		}
+		cancel()
+	})
+
+	httpBase = "http://" + httpAddr
+	waitForServer(t, httpBase+"/api/ping")
+	return rtmpAddr, httpBase
+}
+
+// freeAddr returns a loopback address with a port nothing is listening on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitForServer polls target until the HTTP server answers
+func waitForServer(t *testing.T, target string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := fetch(target); err == nil {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("HTTP server did not start: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// flvTag is one audio or video tag from an FLV file
+type flvTag struct {
+	tagType   byte
+	timestamp uint32
+	data      []byte
+}
+
+// readFLV reads the audio and video tags of an FLV file
+func readFLV(path string) ([]flvTag, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open FLV: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read FLV header: %w", err)
+	}
+	if string(header[:3]) != "FLV" {
+		return nil, fmt.Errorf("%s is not an FLV file", path)
+	}
+	if _, err := r.Discard(int(binary.BigEndian.Uint32(header[5:9])) - len(header)); err != nil {
+		return nil, fmt.Errorf("failed to skip FLV header: %w", err)
+	}
+
+	var tags []flvTag
+	tagHeader := make([]byte, 15) // PreviousTagSize, then the 11-byte tag header
+	for {
+		if _, err := io.ReadFull(r, tagHeader); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break // Trailing PreviousTagSize or end of file
+			}
+			return nil, fmt.Errorf("failed to read FLV tag: %w", err)
+		}
+
+		tagType := tagHeader[4] & 0x1f
+		size := uint32(tagHeader[5])<<16 | uint32(tagHeader[6])<<8 | uint32(tagHeader[7])
+		timestamp := uint32(tagHeader[11])<<24 | uint32(tagHeader[8])<<16 | uint32(tagHeader[9])<<8 | uint32(tagHeader[10])
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("truncated FLV tag at %dms: %w", timestamp, err)
+		}
+
+		// Script tags (onMetaData) aren't needed by the server
+		if tagType == flvTagAudio || tagType == flvTagVideo {
+			tags = append(tags, flvTag{tagType: tagType, timestamp: timestamp, data: data})
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%s has no audio or video tags", path)
+	}
+	return tags, nil
+}
+
+// publish sends the tags to the RTMP server as a live stream, paced by their timestamps
+func publish(addr, app, publishingName string, tags []flvTag) error {
+	conn, err := gortmp.Dial("rtmp", addr, &gortmp.ConnConfig{})
+	if err != nil {
+		return fmt.Errorf("failed to dial RTMP server: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{
+			App:   app,
+			Type:  "nonprivate",
+			TCURL: "rtmp://" + addr + "/" + app,
+		},
+	}); err != nil {
+		return fmt.Errorf("RTMP connect failed: %w", err)
+	}
+
+	stream, err := conn.CreateStream(nil, 4096)
+	if err != nil {
+		return fmt.Errorf("RTMP createStream failed: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Publish(&rtmpmsg.NetStreamPublish{
+		PublishingName: publishingName,
+		PublishingType: "live",
+	}); err != nil {
+		return fmt.Errorf("RTMP publish failed: %w", err)
+	}
+
+	start := time.Now()
+	for _, tag := range tags {
+		if wait := time.Duration(tag.timestamp)*time.Millisecond - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		var msg rtmpmsg.Message
+		chunkStreamID := videoChunkStreamID
+		if tag.tagType == flvTagAudio {
+			msg = &rtmpmsg.AudioMessage{Payload: bytes.NewReader(tag.data)}
+			chunkStreamID = audioChunkStreamID
+		} else {
+			msg = &rtmpmsg.VideoMessage{Payload: bytes.NewReader(tag.data)}
+		}
+
+		if err := stream.Write(chunkStreamID, tag.timestamp, msg); err != nil {
+			return fmt.Errorf("failed to send tag at %dms: %w", tag.timestamp, err)
+		}
+	}
+	return nil
+}
+
+// waitForSegment polls the playlist until it lists a segment and returns the
+// first segment's URI
+func waitForSegment(playlistURL string, timeout time.Duration, published <-chan error) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-published:
+			if err != nil {
+				return "", err
+			}
+			published = nil // Publishing finished; keep waiting for the last segment
+		default:
+		}
+
+		if data, err := fetch(playlistURL); err == nil {
+			segment, err := firstSegment(string(data))
+			if err != nil {
+				return "", err
+			}
+			if segment != "" {
+				return segment, nil
+			}
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+	return "", fmt.Errorf("no segment in %s after %s", playlistURL, timeout)
+}
+
+// firstSegment checks that a media playlist is well-formed and returns its
+// first segment URI, or "" if it lists none yet
+func firstSegment(playlist string) (string, error) {
+	lines := strings.Split(strings.TrimSpace(playlist), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "#EXTM3U" {
+		return "", errors.New("playlist does not start with #EXTM3U")
+	}
+	if !strings.Contains(playlist, "#EXT-X-TARGETDURATION:") {
+		return "", errors.New("playlist has no #EXT-X-TARGETDURATION")
+	}
+
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#EXTINF:") {
+			continue
+		}
+		if i+1 >= len(lines) || strings.HasPrefix(lines[i+1], "#") {
+			return "", errors.New("#EXTINF is not followed by a segment URI")
+		}
+		return strings.TrimSpace(lines[i+1]), nil
+	}
+	return "", nil
+}
+
+// checkTransportStream checks that data looks like MPEG-TS
+func checkTransportStream(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("segment is empty")
+	}
+	if len(data)%tsPacketSize != 0 {
+		return fmt.Errorf("size %d is not a multiple of the %d-byte TS packet size", len(data), tsPacketSize)
+	}
+	for offset := 0; offset < len(data); offset += tsPacketSize {
+		if data[offset] != tsSyncByte {
+			return fmt.Errorf("missing TS sync byte at offset %d", offset)
+		}
+	}
+	return nil
+}
+
+// fetch GETs a URL and returns the body of a 200 response
+func fetch(target string) ([]byte, error) {
+	resp, err := http.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", target, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
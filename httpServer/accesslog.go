@@ -0,0 +1,87 @@
+package httpServer
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"rapidrtmp/internal/requestid"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamKeyContextKey is set by handlers that take the stream key from the
+// request body, so the access log can name it
+const streamKeyContextKey = "streamKey"
+
+// accessEntry is one access log line
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"durationMs"`
+	ClientIP   string    `json:"clientIp"`
+	StreamKey  string    `json:"streamKey,omitempty"`
+}
+
+// requestIDMiddleware assigns each request an ID, taken from X-Request-ID
+// when the client sent a usable one, echoes it in the response and carries
+// it in the request context for downstream log lines
+func (s *Server) requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+
+		c.Header(requestid.Header, id)
+		c.Request = c.Request.WithContext(requestid.NewContext(c.Request.Context(), id))
+
+		c.Next()
+	}
+}
+
+// accessLogMiddleware logs one entry per request once it has been served
+func (s *Server) accessLogMiddleware(format string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		// Handlers may rewrite the path, so capture it first
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		entry := accessEntry{
+			Time:       start,
+			RequestID:  requestid.FromContext(c.Request.Context()),
+			Method:     c.Request.Method,
+			Path:       path,
+			Status:     c.Writer.Status(),
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			ClientIP:   c.ClientIP(),
+			StreamKey:  s.accessLogStreamKey(c),
+		}
+
+		if format == "json" {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return
+			}
+			// Bypass the log prefix so each line is a JSON object
+			log.Writer().Write(append(line, '\n'))
+			return
+		}
+
+		log.Printf("[req %s] %s %s %d %.1fms ip=%s stream=%s",
+			entry.RequestID, entry.Method, entry.Path, entry.Status, entry.DurationMs, entry.ClientIP, entry.StreamKey)
+	}
+}
+
+// accessLogStreamKey returns the stream key a request addressed, by path or body
+func (s *Server) accessLogStreamKey(c *gin.Context) string {
+	if c.Param("streamKey") != "" {
+		return s.streamKeyParam(c)
+	}
+	return c.GetString(streamKeyContextKey)
+}
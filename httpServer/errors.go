@@ -0,0 +1,59 @@
+package httpServer
+
+import (
+	"errors"
+	"net/http"
+
+	"rapidrtmp/internal/auth"
+	"rapidrtmp/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorStatus maps each error code to the HTTP status it is sent with
+var errorStatus = map[models.ErrorCode]int{
+	models.ErrorInvalidRequest:   http.StatusBadRequest,
+	models.ErrorInvalidStreamKey: http.StatusBadRequest,
+	models.ErrorStreamNotFound:   http.StatusNotFound,
+	models.ErrorNotFound:         http.StatusNotFound,
+	models.ErrorTokenRequired:    http.StatusUnauthorized,
+	models.ErrorInvalidToken:     http.StatusForbidden,
+	models.ErrorTokenExpired:     http.StatusForbidden,
+	models.ErrorTokenNotFound:    http.StatusNotFound,
+	models.ErrorUnauthorized:     http.StatusUnauthorized,
+	models.ErrorForbidden:        http.StatusForbidden,
+	models.ErrorRateLimited:      http.StatusTooManyRequests,
+	models.ErrorUnavailable:      http.StatusServiceUnavailable,
+	models.ErrorInternal:         http.StatusInternalServerError,
+}
+
+// errorResponse builds the error envelope and its status
+func errorResponse(code models.ErrorCode, message string) (int, models.ErrorResponse) {
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	return status, models.ErrorResponse{Error: models.ErrorDetail{Code: code, Message: message}}
+}
+
+// writeError sends an error response from a handler
+func writeError(c *gin.Context, code models.ErrorCode, message string) {
+	c.JSON(errorResponse(code, message))
+}
+
+// abortWithError sends an error response from middleware and stops the chain
+func abortWithError(c *gin.Context, code models.ErrorCode, message string) {
+	c.AbortWithStatusJSON(errorResponse(code, message))
+}
+
+// tokenErrorCode classifies a token validation error
+func tokenErrorCode(err error) models.ErrorCode {
+	switch {
+	case errors.Is(err, auth.ErrTokenExpired):
+		return models.ErrorTokenExpired
+	case errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrTokenStreamMismatch):
+		return models.ErrorInvalidToken
+	default:
+		return models.ErrorInternal
+	}
+}
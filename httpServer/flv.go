@@ -0,0 +1,67 @@
+package httpServer
+
+import (
+	"net/http"
+
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleFLVStream plays a live stream as HTTP-FLV: one long-lived response
+// carrying the stream from its current GOP, for ffmpeg and players without
+// HLS support. It ends when the stream stops or the client disconnects.
+func (s *Server) handleFLVStream(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	stream, exists := s.streamManager.GetStream(streamKey)
+	if !exists || stream.GetState() != models.StreamStateLive {
+		writeError(c, models.ErrorStreamNotFound, "stream not live")
+		return
+	}
+
+	frames, unsubscribe := s.streamManager.Subscribe(streamKey, streammanager.SubscribeOptions{
+		Policy:  streammanager.DropGOP,
+		Kind:    streammanager.SubscriberViewer,
+		WithGOP: true,
+	})
+	defer unsubscribe()
+
+	if s.metrics != nil {
+		s.metrics.RecordViewerStart()
+		defer s.metrics.RecordViewerStop()
+	}
+
+	c.Header("Content-Type", "video/x-flv")
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Status(http.StatusOK)
+
+	w := muxer.NewFLVStreamWriter(c.Writer)
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case frame, ok := <-frames:
+			if !ok {
+				return // Stream stopped
+			}
+
+			var audioConfig []byte
+			if codec := stream.GetAudioCodec(); codec != nil {
+				audioConfig = codec.AudioConfig
+			}
+			if err := w.WriteFrame(frame, audioConfig); err != nil {
+				return // Client went away
+			}
+
+			// Flush once caught up, not after every frame of the initial GOP
+			if len(frames) == 0 {
+				c.Writer.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package httpServer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gzipWriters reuses compressors across playlist responses, which are
+// polled by every viewer every few seconds
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "x-gzip" {
+			continue
+		}
+
+		// "gzip;q=0" explicitly refuses it
+		q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// gzipETag returns the entity tag of the gzipped representation, which must
+// differ from the identity one
+func gzipETag(etag string) string {
+	if etag == "" {
+		return ""
+	}
+	return strings.TrimSuffix(etag, `"`) + `-gzip"`
+}
+
+// writePlaylist sends an M3U8 body, gzipped as negotiated
+// Segments are already compressed media and are never gzipped.
+// A HEAD request gets the headers, Content-Length included, without the body.
+func writePlaylist(c *gin.Context, playlist, contentType string, gzipped bool) {
+	body := []byte(playlist)
+	if gzipped {
+		var buf bytes.Buffer
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(&buf)
+		gz.Write(body)
+		gz.Close()
+		gzipWriters.Put(gz)
+
+		c.Header("Content-Encoding", "gzip")
+		body = buf.Bytes()
+	}
+
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Length", strconv.Itoa(len(body)))
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// negotiatePlaylistEncoding marks the response as varying by Accept-Encoding
+// and reports whether to gzip it
+func negotiatePlaylistEncoding(c *gin.Context) bool {
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+	return acceptsGzip(c.GetHeader("Accept-Encoding"))
+}
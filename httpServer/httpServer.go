@@ -1,39 +1,133 @@
 package httpServer
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"rapidrtmp/config"
 	"rapidrtmp/internal/auth"
 	"rapidrtmp/internal/metrics"
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/relay"
 	"rapidrtmp/internal/segmenter"
+	"rapidrtmp/internal/storage"
 	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/internal/thumbnail"
+	"rapidrtmp/internal/version"
+	"rapidrtmp/internal/whep"
 	"rapidrtmp/pkg/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+// playbackCookieName is the cookie that carries a viewer's playback token
+const playbackCookieName = "rapidrtmp_playback_token"
+
+// adminKeyHeader carries the admin API key when REQUIRE_ADMIN_API is set
+const adminKeyHeader = "X-Admin-Key"
+
+// streamEventInterval is the minimum interval between stats pushes to event subscribers
+const streamEventInterval = 250 * time.Millisecond
+
 // Server wraps the HTTP server with dependencies
 type Server struct {
 	router         *gin.Engine
+	httpServer     *http.Server
+	mu             sync.Mutex
 	streamManager  *streammanager.Manager
 	authManager    *auth.Manager
 	segmenter      *segmenter.Segmenter
+	thumbnailer    *thumbnail.Thumbnailer
 	metrics        *metrics.Metrics
-	rtmpIngestAddr string // e.g., "rtmp://localhost:1935"
+	viewers        *viewerTracker
+	storageCheck   *storageCheck  // Cached storage probe for /ready
+	ffmpegCheck    *storageCheck  // Cached FFmpeg probe for /ready
+	publishLimiter *ipRateLimiter // Optional, limits publish token requests per IP
+	relay          *relay.Relay   // Optional, set when publish requests may choose relay targets
+	whep           *whep.Server   // Optional, set when WebRTC playback is enabled
+	rtmpIngestAddr string         // e.g., "rtmp://localhost:1935"
+	corsOrigins    []string       // Allowed CORS origins ("*" allows any)
+	disableHTTP2   bool           // Serve HTTPS as HTTP/1.1 only
+	debug          bool           // Expose /debug endpoints
+
+	// Stream keys are "app/name" rather than a single path segment
+	appInStreamKey bool
+
+	// Content-Type of HLS files, matching what storage writes them with
+	contentTypes storage.ContentTypes
+
+	// Admin API access; empty leaves the admin routes open
+	adminAPIKey string
+
+	// Access logging
+	accessLog       bool
+	accessLogFormat string
+
+	// Playback authorization
+	playbackAuth  bool
+	publicStreams map[string]bool // Stream keys exempt from playback auth
 }
 
 // New creates a new HTTP server
-func New(streamManager *streammanager.Manager, authManager *auth.Manager, seg *segmenter.Segmenter, m *metrics.Metrics, rtmpIngestAddr string) *Server {
+func New(cfg *config.Config, streamManager *streammanager.Manager, authManager *auth.Manager, seg *segmenter.Segmenter, thumbnailer *thumbnail.Thumbnailer, m *metrics.Metrics) *Server {
 	s := &Server{
-		streamManager:  streamManager,
-		authManager:    authManager,
-		segmenter:      seg,
-		metrics:        m,
-		rtmpIngestAddr: rtmpIngestAddr,
+		streamManager:   streamManager,
+		authManager:     authManager,
+		segmenter:       seg,
+		thumbnailer:     thumbnailer,
+		metrics:         m,
+		rtmpIngestAddr:  cfg.RTMPIngestAddr,
+		appInStreamKey:  cfg.AppInStreamKey,
+		corsOrigins:     cfg.CORSAllowedOrigins,
+		disableHTTP2:    !cfg.HTTP2Enabled,
+		debug:           cfg.Debug,
+		accessLog:       cfg.AccessLog,
+		accessLogFormat: cfg.AccessLogFormat,
+		playbackAuth:    cfg.PlaybackAuthEnabled,
+		publicStreams:   make(map[string]bool),
+		contentTypes:    cfg.ContentTypes(),
+	}
+
+	if cfg.RequireAdminAPI {
+		s.adminAPIKey = cfg.AdminAPIKey
+	}
+
+	for _, streamKey := range cfg.PlaybackPublicStreams {
+		s.publicStreams[streamKey] = true
+	}
+
+	if seg != nil {
+		s.storageCheck = newStorageCheck(seg.CheckStorage, storageCheckInterval)
+	}
+
+	s.ffmpegCheck = newStorageCheck(func(context.Context) error {
+		return muxer.CheckFFmpegAvailable()
+	}, ffmpegCheckInterval)
+
+	if cfg.ViewerTimeout > 0 {
+		s.viewers = newViewerTracker(streamManager, m, cfg.ViewerTimeout)
+		go s.viewers.run()
+	}
+
+	if cfg.PublishRatePerMinute > 0 {
+		s.publishLimiter = newIPRateLimiter(cfg.PublishRatePerMinute, cfg.PublishRateBurst)
+		go s.publishLimiter.run()
 	}
 
 	s.setupRoutes()
@@ -42,40 +136,225 @@ func New(streamManager *streammanager.Manager, authManager *auth.Manager, seg *s
 
 // setupRoutes configures all HTTP routes
 func (s *Server) setupRoutes() {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery())
 
-	// Add metrics middleware
+	// Tag every request with an ID for correlating log lines
+	router.Use(s.requestIDMiddleware())
+	if s.accessLog {
+		router.Use(s.accessLogMiddleware(s.accessLogFormat))
+	}
+
+	// Add metrics and CORS middleware
 	router.Use(s.metricsMiddleware())
+	router.Use(s.corsMiddleware())
 
 	// Observability endpoints
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	router.GET("/health", s.handleHealth)
 	router.GET("/ready", s.handleReady)
 
+	// Internal state dumps for troubleshooting, off unless DEBUG is set
+	if s.debug {
+		if s.adminAPIKey != "" {
+			router.GET("/debug/streams", s.adminAuthMiddleware(), s.handleDebugStreams)
+		} else {
+			router.GET("/debug/streams", s.handleDebugStreams)
+		}
+	}
+
+	// Stream keys span two path segments when namespaced by RTMP app
+	streamPath := "/:streamKey"
+	if s.appInStreamKey {
+		streamPath = "/:app/:streamKey"
+	}
+
 	api := router.Group("/api")
 	{
 		api.GET("/ping", s.handlePing)
-		api.POST("/v1/publish", s.handlePublish)
-		api.GET("/v1/streams", s.handleListStreams)
-		api.GET("/v1/streams/:streamKey", s.handleGetStream)
-		api.POST("/v1/streams/:streamKey/stop", s.handleStopStream)
+		api.GET("/v1/version", s.handleVersion)
+		if s.publishLimiter != nil {
+			api.POST("/v1/publish", s.rateLimitMiddleware(s.publishLimiter), s.handlePublish)
+		} else {
+			api.POST("/v1/publish", s.handlePublish)
+		}
+	}
+
+	// Stream inspection and management, which expose stream keys and
+	// publisher IPs, optionally behind the admin API key
+	admin := api.Group("/v1")
+	if s.adminAPIKey != "" {
+		admin.Use(s.adminAuthMiddleware())
+	}
+	{
+		// Playback tokens are the playback gate; without the admin key,
+		// issuing them is rate limited like publishing
+		if s.adminAPIKey == "" && s.publishLimiter != nil {
+			admin.POST("/playback-token", s.rateLimitMiddleware(s.publishLimiter), s.handlePlaybackToken)
+		} else {
+			admin.POST("/playback-token", s.handlePlaybackToken)
+		}
+		admin.POST("/tokens/revoke", s.handleRevokeToken)
+		admin.GET("/stats", s.handleStats)
+		admin.GET("/streams", s.handleListStreams)
+		admin.GET("/streams"+streamPath, s.handleGetStream)
+		admin.GET("/streams"+streamPath+"/events", s.handleStreamEvents)
+		admin.GET("/streams"+streamPath+"/history", s.handleStreamHistory)
+		admin.GET("/streams"+streamPath+"/metrics", s.handleStreamMetrics)
+		admin.POST("/streams"+streamPath+"/stop", s.handleStopStream)
+		admin.POST("/streams"+streamPath+"/rotate-token", s.streamKeyMiddleware(), s.handleRotateToken)
+		admin.POST("/streams"+streamPath+"/metadata", s.streamKeyMiddleware(), s.handleAddMetadata)
+		admin.POST("/streams"+streamPath+"/cue", s.streamKeyMiddleware(), s.handleInsertCue)
+		admin.DELETE("/streams"+streamPath, s.streamKeyMiddleware(), s.handleDeleteStream)
 	}
 
-	live := router.Group("/live/:streamKey")
+	live := router.Group("/live" + streamPath)
+	live.Use(s.streamKeyMiddleware(), s.playbackAuthMiddleware())
 	{
 		live.GET("/index.m3u8", s.handlePlaylist)
 		live.HEAD("/index.m3u8", s.handlePlaylist) // respond to HEAD for players that probe
-		// MPEG-TS doesn't need init segments - removed
+		live.GET("/master.m3u8", s.handleMasterPlaylist)
+		live.HEAD("/master.m3u8", s.handleMasterPlaylist)
+		live.GET("/thumb.jpg", s.handleThumbnail)
+		live.GET("/stream.flv", s.handleFLVStream)
+		// Also serves the init segment when segments are fMP4
 		live.GET("/:filename", s.handleMediaSegment)
 		live.HEAD("/:filename", s.handleMediaSegment)
+		// Segments in directories, e.g. date partitions from HLS_PATH_TEMPLATE
+		live.GET("/:filename/*rest", s.handleMediaSegment)
+		live.HEAD("/:filename/*rest", s.handleMediaSegment)
+		// WebRTC playback over WHEP, when enabled
+		live.POST("/whep", s.handleWHEPOffer)
+		live.DELETE("/whep/:session", s.handleWHEPDelete)
 	}
 
 	s.router = router
 }
 
+// validateStreamKey checks a stream key, including both halves of an
+// app-namespaced "app/name" key
+func (s *Server) validateStreamKey(streamKey string) error {
+	if !s.appInStreamKey {
+		return models.ValidateStreamKey(streamKey)
+	}
+
+	app, name, ok := strings.Cut(streamKey, "/")
+	if !ok {
+		return fmt.Errorf("%w: must be in the form app/name", models.ErrInvalidStreamKey)
+	}
+	if err := models.ValidateStreamKey(app); err != nil {
+		return err
+	}
+	return models.ValidateStreamKey(name)
+}
+
+// streamKeyMiddleware rejects requests whose path names an invalid stream key
+// before the key is used to build storage paths
+func (s *Server) streamKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := s.validateStreamKey(s.streamKeyParam(c)); err != nil {
+			abortWithError(c, models.ErrorInvalidStreamKey, err.Error())
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// adminAuthMiddleware rejects requests without the admin API key in the
+// X-Admin-Key header
+func (s *Server) adminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(adminKeyHeader)
+		if key == "" {
+			abortWithError(c, models.ErrorUnauthorized, "admin API key required")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.adminAPIKey)) != 1 {
+			abortWithError(c, models.ErrorForbidden, "invalid admin API key")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// escapeStreamKey escapes each path segment of a stream key for use in a URL
+func escapeStreamKey(streamKey string) string {
+	segments := strings.Split(streamKey, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// streamKeyParam returns the stream key addressed by the request path
+func (s *Server) streamKeyParam(c *gin.Context) string {
+	if s.appInStreamKey {
+		return c.Param("app") + "/" + c.Param("streamKey")
+	}
+	return c.Param("streamKey")
+}
+
 // Run starts the HTTP server
+// It returns http.ErrServerClosed once Shutdown has been called
 func (s *Server) Run(addr string) error {
-	return s.router.Run(addr)
+	return s.newHTTPServer(addr).ListenAndServe()
+}
+
+// RunTLS starts the HTTPS server with a PEM certificate and key
+// HTTP/2 is negotiated automatically unless disabled in config
+func (s *Server) RunTLS(addr, certFile, keyFile string) error {
+	return s.newHTTPServer(addr).ListenAndServeTLS(certFile, keyFile)
+}
+
+// RunAutocert starts the HTTPS server with certificates obtained from Let's
+// Encrypt for the given domains and cached in cacheDir. Certificates are
+// validated with the TLS-ALPN-01 challenge, so addr must be reachable on
+// port 443 from the internet.
+func (s *Server) RunAutocert(addr string, domains []string, cacheDir string) error {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+
+	srv := s.newHTTPServer(addr)
+	srv.TLSConfig = manager.TLSConfig()
+	if s.disableHTTP2 {
+		srv.TLSConfig.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// newHTTPServer creates the underlying http.Server and records it for Shutdown
+func (s *Server) newHTTPServer(addr string) *http.Server {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: s.router,
+	}
+	if s.disableHTTP2 {
+		// A non-nil empty map turns off automatic HTTP/2 over TLS
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	s.mu.Lock()
+	s.httpServer = srv
+	s.mu.Unlock()
+
+	return srv
+}
+
+// Shutdown stops accepting new requests and waits for in-flight ones to finish
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.httpServer
+	s.mu.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
 }
 
 // Middleware
@@ -104,8 +383,88 @@ func (s *Server) metricsMiddleware() gin.HandlerFunc {
 	}
 }
 
+// corsMiddleware sets CORS headers for allowed origins and answers preflight requests
+func (s *Server) corsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if allowOrigin := s.allowedOrigin(c.GetHeader("Origin")); allowOrigin != "" {
+			c.Header("Access-Control-Allow-Origin", allowOrigin)
+			if allowOrigin != "*" {
+				c.Header("Vary", "Origin")
+			}
+			c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, DELETE, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, Range, X-Request-ID, X-Admin-Key")
+			c.Header("Access-Control-Expose-Headers", "Content-Length, Content-Range, Location, X-Request-ID")
+		}
+
+		// Preflight requests never reach the route handlers
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request origin,
+// or an empty string if the origin is not allowed
+func (s *Server) allowedOrigin(origin string) string {
+	for _, allowed := range s.corsOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// playbackAuthMiddleware requires a valid playback token for non-public streams.
+// The token is accepted from the query string and remembered in a cookie so that
+// players can fetch segments via relative URLs without repeating it.
+func (s *Server) playbackAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		streamKey := s.streamKeyParam(c)
+		if !s.playbackAuth || s.publicStreams[streamKey] {
+			c.Next()
+			return
+		}
+
+		token := c.Query("token")
+		fromQuery := token != ""
+		if !fromQuery {
+			// WHEP clients send the token as a bearer token
+			token, _ = strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		if token == "" {
+			token, _ = c.Cookie(playbackCookieName)
+		}
+
+		if token == "" {
+			abortWithError(c, models.ErrorTokenRequired, "playback token required")
+			return
+		}
+
+		if err := s.authManager.ValidatePlaybackToken(token, streamKey); err != nil {
+			abortWithError(c, tokenErrorCode(err), err.Error())
+			return
+		}
+
+		if fromQuery {
+			c.SetCookie(playbackCookieName, token, 0, "/live/"+escapeStreamKey(streamKey)+"/", "", c.Request.TLS != nil, true)
+		}
+
+		c.Next()
+	}
+}
+
 // Handler implementations
 
+func (s *Server) handleVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, version.Get())
+}
+
 func (s *Server) handleHealth(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"status": "healthy",
@@ -134,20 +493,39 @@ func (s *Server) handleReady(c *gin.Context) {
 		ready = false
 	}
 
+	// Check that segments can actually be stored, e.g. GCS is reachable or
+	// the local disk is writable
+	if s.storageCheck != nil {
+		if err := s.storageCheck.result(c.Request.Context()); err != nil {
+			checks["storage"] = err.Error()
+			ready = false
+		} else {
+			checks["storage"] = "ok"
+		}
+	}
+
+	// Check FFmpeg, which the segmenter needs to produce segments
+	if err := s.ffmpegCheck.result(c.Request.Context()); err != nil {
+		checks["ffmpeg"] = err.Error()
+		ready = false
+	} else {
+		checks["ffmpeg"] = "ok"
+	}
+
 	status := http.StatusOK
 	if !ready {
 		status = http.StatusServiceUnavailable
 	}
 
 	c.JSON(status, gin.H{
-		"ready":  ready,
-		"checks": checks,
-		"time":   time.Now().Unix(),
+		"ready":   ready,
+		"checks":  checks,
+		"version": version.Get(),
+		"time":    time.Now().Unix(),
 	})
 }
 
 func (s *Server) handlePing(c *gin.Context) {
-	c.Header("Access-Control-Allow-Origin", "*")
 	c.JSON(http.StatusOK, gin.H{
 		"message": "pong",
 		"time":    time.Now().Unix(),
@@ -157,34 +535,265 @@ func (s *Server) handlePing(c *gin.Context) {
 func (s *Server) handlePublish(c *gin.Context) {
 	var req models.PublishRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		writeError(c, models.ErrorInvalidRequest, err.Error())
 		return
 	}
+	c.Set(streamKeyContextKey, req.StreamKey)
+
+	if err := s.validateStreamKey(req.StreamKey); err != nil {
+		writeError(c, models.ErrorInvalidStreamKey, err.Error())
+		return
+	}
+
+	if req.ExpiresIn < 0 {
+		writeError(c, models.ErrorInvalidRequest, "expiresIn must not be negative")
+		return
+	}
+
+	// Per-stream HLS overrides travel with the token and only apply once it
+	// authorizes a publish; check them now so the caller learns of mistakes
+	if req.HasHLSOverrides() && s.segmenter != nil {
+		if err := s.segmenter.PublishConfig(req.PublishOptions).Validate(); err != nil {
+			writeError(c, models.ErrorInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	if req.Tenant != "" {
+		if err := models.ValidateTenant(req.Tenant); err != nil {
+			writeError(c, models.ErrorInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	if req.AudioTrack != nil {
+		if req.AudioTrack.Of != "" {
+			if err := s.validateStreamKey(req.AudioTrack.Of); err != nil {
+				writeError(c, models.ErrorInvalidRequest, "audioTrack.of: "+err.Error())
+				return
+			}
+			if req.AudioTrack.Of == req.StreamKey {
+				writeError(c, models.ErrorInvalidRequest, "audioTrack.of: a stream can't be an audio rendition of itself")
+				return
+			}
+		}
+		if err := segmenter.AudioTrackFromRequest(*req.AudioTrack).Validate(); err != nil {
+			writeError(c, models.ErrorInvalidRequest, err.Error())
+			return
+		}
+	}
 
-	// Default expiration to 1 hour
-	if req.ExpiresIn == 0 {
-		req.ExpiresIn = 3600
+	if len(req.RelayTargets) > 0 {
+		s.mu.Lock()
+		r := s.relay
+		s.mu.Unlock()
+		if r == nil {
+			writeError(c, models.ErrorInvalidRequest, "relay targets are not enabled")
+			return
+		}
+		if err := relay.ValidateTargets(req.RelayTargets); err != nil {
+			writeError(c, models.ErrorInvalidRequest, err.Error())
+			return
+		}
 	}
 
 	// Generate publish token
 	clientIP := c.ClientIP()
-	token, err := s.authManager.GeneratePublishToken(req.StreamKey, req.ExpiresIn, clientIP)
+	token, err := s.authManager.GeneratePublishToken(req.StreamKey, req.ExpiresIn, clientIP, req.PublishOptions)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		writeError(c, models.ErrorInternal, "failed to generate token")
 		return
 	}
 
-	// Build publish URL
-	publishURL := fmt.Sprintf("%s/live/%s?token=%s", s.rtmpIngestAddr, req.StreamKey, token.Token)
+	c.JSON(http.StatusOK, s.publishResponse(token))
+}
 
-	c.JSON(http.StatusOK, models.PublishResponse{
+// SetRelay lets publish token requests choose the upstream servers a stream
+// is relayed to
+func (s *Server) SetRelay(r *relay.Relay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.relay = r
+}
+
+// publishResponse describes a publish token and the URL to publish with it
+func (s *Server) publishResponse(token *models.PublishToken) models.PublishResponse {
+	// Namespaced keys already carry their app; otherwise publish to "live"
+	publishURL := fmt.Sprintf("%s/live/%s?token=%s", s.rtmpIngestAddr, token.StreamKey, token.Token)
+	if s.appInStreamKey {
+		publishURL = fmt.Sprintf("%s/%s?token=%s", s.rtmpIngestAddr, token.StreamKey, token.Token)
+	}
+
+	return models.PublishResponse{
 		PublishURL: publishURL,
-		StreamKey:  req.StreamKey,
+		StreamKey:  token.StreamKey,
 		Token:      token.Token,
 		ExpiresAt:  token.ExpiresAt.Format(time.RFC3339),
+		ExpiresIn:  tokenLifetime(token),
+	}
+}
+
+// tokenLifetime is how many seconds a token was issued for, which may be less
+// than requested once capped at the maximum expiration
+func tokenLifetime(token *models.PublishToken) int {
+	return int(token.ExpiresAt.Sub(token.CreatedAt) / time.Second)
+}
+
+// handleRotateToken issues a new publish token for a stream and schedules the
+// old one's revocation. A live publisher stays connected.
+func (s *Server) handleRotateToken(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	var req models.RotateTokenRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeError(c, models.ErrorInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	grace := auth.DefaultRotationGrace
+	if req.RevokeAfter != nil {
+		if *req.RevokeAfter < 0 {
+			writeError(c, models.ErrorInvalidRequest, "revokeAfter must not be negative")
+			return
+		}
+		grace = time.Duration(*req.RevokeAfter) * time.Second
+	}
+
+	if req.ExpiresIn < 0 {
+		writeError(c, models.ErrorInvalidRequest, "expiresIn must not be negative")
+		return
+	}
+
+	token, replaced, err := s.authManager.RotatePublishToken(streamKey, req.Token, req.ExpiresIn, c.ClientIP(), grace)
+	if err != nil {
+		writeError(c, tokenErrorCode(err), err.Error())
+		return
+	}
+
+	resp := models.RotateTokenResponse{PublishResponse: s.publishResponse(token)}
+	if replaced != "" {
+		resp.PreviousRevokesAt = time.Now().Add(grace).Format(time.RFC3339)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleAddMetadata inserts timed metadata into a live stream's playlist
+func (s *Server) handleAddMetadata(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	var req models.MetadataRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, models.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	if s.segmenter == nil {
+		writeError(c, models.ErrorStreamNotFound, fmt.Sprintf("stream %s is not live", streamKey))
+		return
+	}
+
+	md, err := s.segmenter.AddMetadata(streamKey, models.TimedMetadata{
+		ID:         req.ID,
+		Class:      req.Class,
+		Duration:   req.Duration,
+		Attributes: req.Attributes,
+	})
+	if errors.Is(err, segmenter.ErrNotLive) {
+		writeError(c, models.ErrorStreamNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(c, models.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, md)
+}
+
+// handleInsertCue queues an ad break marker for a live stream's next segment
+func (s *Server) handleInsertCue(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	var req models.Cue
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, models.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	if s.segmenter == nil {
+		writeError(c, models.ErrorStreamNotFound, fmt.Sprintf("stream %s is not live", streamKey))
+		return
+	}
+
+	cue, err := s.segmenter.InsertCue(streamKey, req)
+	if errors.Is(err, segmenter.ErrNotLive) {
+		writeError(c, models.ErrorStreamNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(c, models.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusAccepted, cue)
+}
+
+// handleRevokeToken revokes a token, optionally disconnecting the live
+// stream published with it
+func (s *Server) handleRevokeToken(c *gin.Context) {
+	var req models.RevokeTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, models.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	if !s.authManager.RevokeToken(c.Request.Context(), req.Token, req.Disconnect) {
+		writeError(c, models.ErrorTokenNotFound, "token not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "token revoked"})
+}
+
+func (s *Server) handlePlaybackToken(c *gin.Context) {
+	var req models.PlaybackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, models.ErrorInvalidRequest, err.Error())
+		return
+	}
+	c.Set(streamKeyContextKey, req.StreamKey)
+
+	if err := s.validateStreamKey(req.StreamKey); err != nil {
+		writeError(c, models.ErrorInvalidStreamKey, err.Error())
+		return
+	}
+
+	if req.ExpiresIn < 0 {
+		writeError(c, models.ErrorInvalidRequest, "expiresIn must not be negative")
+		return
+	}
+
+	token, err := s.authManager.GeneratePlaybackToken(req.StreamKey, req.ExpiresIn, c.ClientIP())
+	if err != nil {
+		writeError(c, models.ErrorInternal, "failed to generate token")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.PlaybackResponse{
+		PlaybackURL: "/live/" + escapeStreamKey(req.StreamKey) + "/index.m3u8?token=" + url.QueryEscape(token.Token),
+		StreamKey:   req.StreamKey,
+		Token:       token.Token,
+		ExpiresAt:   token.ExpiresAt.Format(time.RFC3339),
+		ExpiresIn:   tokenLifetime(token),
 	})
 }
 
+func (s *Server) handleStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.streamManager.Stats())
+}
+
 func (s *Server) handleListStreams(c *gin.Context) {
 	streams := s.streamManager.GetLiveStreams()
 
@@ -200,23 +809,190 @@ func (s *Server) handleListStreams(c *gin.Context) {
 }
 
 func (s *Server) handleGetStream(c *gin.Context) {
-	streamKey := c.Param("streamKey")
+	streamKey := s.streamKeyParam(c)
 
 	stream, exists := s.streamManager.GetStream(streamKey)
 	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "stream not found"})
+		writeError(c, models.ErrorStreamNotFound, "stream not found")
 		return
 	}
 
 	c.JSON(http.StatusOK, s.streamToInfo(stream))
 }
 
+// handleStreamEvents pushes stream stats to the client as Server-Sent Events.
+// Updates are driven by stream changes and debounced to streamEventInterval.
+func (s *Server) handleStreamEvents(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	stream, exists := s.streamManager.GetStream(streamKey)
+	if !exists {
+		writeError(c, models.ErrorStreamNotFound, "stream not found")
+		return
+	}
+
+	updates, unwatch, err := s.streamManager.WatchStream(streamKey)
+	if err != nil {
+		writeError(c, models.ErrorStreamNotFound, err.Error())
+		return
+	}
+	defer unwatch()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	// Send the current snapshot immediately
+	c.SSEvent("stats", s.streamToInfo(stream))
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(streamEventInterval)
+	defer ticker.Stop()
+
+	pending := false
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+
+		case <-updates:
+			pending = true
+
+		case <-ticker.C:
+			// A reconnecting publisher replaces the stream object; follow it
+			// by key and end the feed once the stream is deleted
+			current, exists := s.streamManager.GetStream(streamKey)
+			if !exists {
+				return
+			}
+			if current != stream {
+				stream = current
+				pending = true
+			}
+
+			if !pending {
+				continue
+			}
+			pending = false
+
+			c.SSEvent("stats", s.streamToInfo(stream))
+			c.Writer.Flush()
+		}
+	}
+}
+
+func (s *Server) handleStreamHistory(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	stream, exists := s.streamManager.GetStream(streamKey)
+	if !exists {
+		writeError(c, models.ErrorStreamNotFound, "stream not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.StreamHistoryResponse{
+		StreamKey: streamKey,
+		History:   stream.GetStateHistory(),
+	})
+}
+
+// handleStreamMetrics returns a JSON snapshot of one stream's ingest and playlist numbers
+func (s *Server) handleStreamMetrics(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	stream, exists := s.streamManager.GetStream(streamKey)
+	if !exists {
+		writeError(c, models.ErrorStreamNotFound, "stream not found")
+		return
+	}
+
+	stats := stream.GetStats()
+	resp := models.StreamMetricsResponse{
+		StreamKey:         streamKey,
+		State:             string(stream.GetState()),
+		BytesReceived:     stats.BytesReceived,
+		FramesReceived:    stats.FramesReceived,
+		KeyFramesReceived: stats.KeyFramesReceived,
+		DroppedFrames:     stats.DroppedFrames,
+		Bitrate:           stats.Bitrate,
+	}
+	if !stats.LastFrameTime.IsZero() {
+		resp.LastFrameTime = stats.LastFrameTime.Format(time.RFC3339Nano)
+	}
+
+	if s.segmenter != nil {
+		if playlist, ok := s.segmenter.GetPlaylistStats(streamKey); ok {
+			resp.Segments = playlist.Segments
+			resp.TargetDuration = playlist.TargetDuration
+		}
+		resp.StoredBytes, resp.StoredSegments = s.segmenter.StorageUsage(streamKey)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleDebugStreams dumps the stream manager's and segmenter's view of every
+// stream, including segmenter sessions whose stream is no longer registered
+func (s *Server) handleDebugStreams(c *gin.Context) {
+	streams := make(map[string]*models.DebugStream)
+
+	for _, stream := range s.streamManager.GetAllStreams() {
+		stats := stream.GetStats()
+		info := &models.DebugStream{
+			StreamKey:      stream.Key,
+			State:          string(stream.GetState()),
+			BytesReceived:  stats.BytesReceived,
+			FramesReceived: stats.FramesReceived,
+			DroppedFrames:  stats.DroppedFrames,
+			Bitrate:        stats.Bitrate,
+			Subscribers:    s.streamManager.SubscriberCount(stream.Key),
+		}
+		if !stats.LastFrameTime.IsZero() {
+			info.LastFrameTime = stats.LastFrameTime.Format(time.RFC3339Nano)
+		}
+		if video, ok := s.streamManager.GetVideoConfig(stream.Key); ok {
+			info.HasSPSPPS = len(video.SPS) > 0 && len(video.PPS) > 0
+		}
+		streams[stream.Key] = info
+	}
+
+	if s.segmenter != nil {
+		for _, streamKey := range s.segmenter.ActiveStreams() {
+			if _, exists := streams[streamKey]; !exists {
+				streams[streamKey] = &models.DebugStream{StreamKey: streamKey}
+			}
+		}
+		for streamKey, info := range streams {
+			playlist, ok := s.segmenter.GetPlaylistStats(streamKey)
+			if !ok {
+				continue
+			}
+			info.Segmenting = true
+			info.Segments = playlist.Segments
+			info.PlaylistEnded = playlist.Ended
+			if playlist.Segments > 0 {
+				last := playlist.LastSequence
+				info.LastSegmentSequence = &last
+			}
+		}
+	}
+
+	resp := models.DebugStreamsResponse{Streams: make([]models.DebugStream, 0, len(streams))}
+	for _, info := range streams {
+		resp.Streams = append(resp.Streams, *info)
+	}
+	sort.Slice(resp.Streams, func(i, j int) bool {
+		return resp.Streams[i].StreamKey < resp.Streams[j].StreamKey
+	})
+
+	c.JSON(http.StatusOK, resp)
+}
+
 func (s *Server) handleStopStream(c *gin.Context) {
-	streamKey := c.Param("streamKey")
+	streamKey := s.streamKeyParam(c)
 
 	err := s.streamManager.StopStream(streamKey)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		writeError(c, models.ErrorStreamNotFound, err.Error())
 		return
 	}
 
@@ -226,111 +1002,345 @@ func (s *Server) handleStopStream(c *gin.Context) {
 	})
 }
 
+func (s *Server) handleDeleteStream(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	stream, exists := s.streamManager.GetStream(streamKey)
+	if !exists {
+		writeError(c, models.ErrorStreamNotFound, fmt.Sprintf("stream %s not found", streamKey))
+		return
+	}
+
+	// Stop a live stream before removing it
+	if stream.GetState() != models.StreamStateStopped {
+		s.streamManager.StopStream(streamKey)
+	}
+	s.streamManager.DeleteStream(streamKey)
+
+	// Stop segmentation and remove stored playlist, segments and thumbnails
+	if s.segmenter != nil {
+		if err := s.segmenter.PurgeStream(c.Request.Context(), streamKey); err != nil {
+			writeError(c, models.ErrorInternal, err.Error())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "stream deleted",
+		"streamKey": streamKey,
+	})
+}
+
 func (s *Server) handlePlaylist(c *gin.Context) {
-	streamKey := c.Param("streamKey")
+	streamKey := s.streamKeyParam(c)
+
+	// ?dvr=1 returns the extended window so players can seek back during a
+	// live stream; _HLS_skip asks for an LL-HLS delta update
+	opts := segmenter.PlaylistOptions{
+		DVR:  c.Query("dvr") == "1",
+		Skip: c.Query("_HLS_skip") == "YES" || c.Query("_HLS_skip") == "v2",
+	}
+
+	// LL-HLS blocking reload: hold the request until the segment is listed.
+	// Segments aren't split into parts, so _HLS_part waits for the whole one.
+	if param := c.Query("_HLS_msn"); param != "" {
+		msn, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			writeError(c, models.ErrorInvalidRequest, "_HLS_msn must be a media sequence number")
+			return
+		}
+		if !s.waitForSegment(c, streamKey, msn) {
+			return
+		}
+	} else if c.Query("_HLS_part") != "" {
+		writeError(c, models.ErrorInvalidRequest, "_HLS_part requires _HLS_msn")
+		return
+	}
 
 	// Get playlist from segmenter
-	playlist, err := s.segmenter.GetPlaylist(streamKey)
+	playlist, etag, err := s.segmenter.GetPlaylistWithETag(c.Request.Context(), streamKey, opts)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "playlist not available"})
+		writeError(c, models.ErrorNotFound, "playlist not available")
 		return
 	}
 
-	// Set caching headers for low-latency
-	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
-	c.Header("Pragma", "no-cache")
-	c.Header("Expires", "0")
-	c.Header("Access-Control-Allow-Origin", "*")
+	gzipped := negotiatePlaylistEncoding(c)
+	if gzipped {
+		etag = gzipETag(etag)
+	}
+
+	// Always revalidate for low latency, but let unchanged playlists be a cheap 304
+	c.Header("Cache-Control", "no-cache, must-revalidate")
+	c.Header("ETag", etag)
+
+	s.trackViewer(c, streamKey)
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	writePlaylist(c, playlist, s.contentTypes.Playlist, gzipped)
+}
+
+// waitForSegment blocks a playlist request until segment msn is listed,
+// giving up after three target durations as LL-HLS prescribes. It reports
+// whether the request should go on to be served; if not, it has been answered.
+func (s *Server) waitForSegment(c *gin.Context, streamKey string, msn uint64) bool {
+	stats, ok := s.segmenter.GetPlaylistStats(streamKey)
+	if !ok {
+		return true // Not live; serve whatever playlist remains
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Duration(stats.TargetDuration)*time.Second)
+	defer cancel()
+
+	err := s.segmenter.WaitForSegment(ctx, streamKey, msn)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, segmenter.ErrSequenceTooFar):
+		writeError(c, models.ErrorInvalidRequest, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(c, models.ErrorUnavailable, fmt.Sprintf("segment %d of stream %s is not available yet", msn, streamKey))
+	default:
+		// The client went away; there is no one to answer
+	}
+	return false
+}
+
+// handleMasterPlaylist serves a multivariant playlist pointing at index.m3u8
+func (s *Server) handleMasterPlaylist(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+
+	playlist, err := s.segmenter.GetMasterPlaylist(streamKey)
+	if err != nil {
+		writeError(c, models.ErrorNotFound, "playlist not available")
+		return
+	}
 
-	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist))
+	// Bandwidth and codec info can still change early in a stream
+	c.Header("Cache-Control", "no-cache")
+	writePlaylist(c, playlist, s.contentTypes.Playlist, negotiatePlaylistEncoding(c))
 }
 
-func (s *Server) handleInitSegment(c *gin.Context) {
-	streamKey := c.Param("streamKey")
+func (s *Server) handleInitSegment(c *gin.Context, name string) {
+	streamKey := s.streamKeyParam(c)
 
-	// Get init segment from segmenter
-	initData, err := s.segmenter.GetInitSegment(streamKey)
+	// A HEAD probe only needs the length, which storage reports without a read
+	head := c.Request.Method == http.MethodHead
+
+	var initReader io.ReadSeeker
+	var size int64
+	var err error
+	if head {
+		size, err = s.segmenter.InitSegmentSize(c.Request.Context(), streamKey, name)
+	} else {
+		initReader, err = s.segmenter.OpenInitSegment(c.Request.Context(), streamKey, name)
+	}
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "init segment not available"})
+		writeError(c, models.ErrorNotFound, "init segment not available")
 		return
 	}
+	defer closeIfCloser(initReader)
 
 	// Disable caching for init segment to ensure fresh data on stream restart
 	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
 	c.Header("Pragma", "no-cache")
 	c.Header("Expires", "0")
-	c.Header("Access-Control-Allow-Origin", "*")
 
-	c.Data(http.StatusOK, "video/mp4", initData)
+	c.Header("Content-Type", s.contentTypes.Init)
+	if head {
+		serveHead(c, size, time.Time{})
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, name, time.Time{}, initReader)
 }
 
-func (s *Server) handleMediaSegment(c *gin.Context) {
-	streamKey := c.Param("streamKey")
-	filename := c.Param("filename")
+func (s *Server) handleThumbnail(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
 
-	// Only handle .ts files
-	if len(filename) < 4 || filename[len(filename)-3:] != ".ts" {
-		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	if s.thumbnailer == nil {
+		writeError(c, models.ErrorNotFound, "thumbnails not enabled")
 		return
 	}
 
-	// Remove .ts extension
-	filename = filename[:len(filename)-3]
-
-	// Extract segment number from "segment_N"
-	if len(filename) < 9 || filename[:8] != "segment_" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid segment format"})
+	thumbData, err := s.thumbnailer.GetThumbnail(c.Request.Context(), streamKey)
+	if err != nil {
+		writeError(c, models.ErrorNotFound, "thumbnail not available")
 		return
 	}
 
-	segmentNumStr := filename[8:]
+	// Thumbnails are refreshed periodically, allow brief caching
+	c.Header("Cache-Control", "public, max-age=5")
 
-	// Parse segment number
-	segmentNum, err := strconv.ParseUint(segmentNumStr, 10, 64)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid segment number: %s", segmentNumStr)})
+	c.Data(http.StatusOK, "image/jpeg", thumbData)
+}
+
+func (s *Server) handleMediaSegment(c *gin.Context) {
+	streamKey := s.streamKeyParam(c)
+	// rest keeps its leading slash, so this is the path below the stream
+	uri := c.Param("filename") + c.Param("rest")
+
+	naming := s.segmenter.Naming()
+	container := s.segmenter.Container()
+	if _, ok := naming.ParseInitName(uri); ok && container == muxer.ContainerFMP4 {
+		s.handleInitSegment(c, uri)
 		return
 	}
 
-	// Get segment from segmenter
-	segmentData, err := s.segmenter.GetSegment(streamKey, segmentNum)
+	segmentNum, ok := naming.ParseSegmentURI(uri)
+	if !ok {
+		writeError(c, models.ErrorNotFound, "not found")
+		return
+	}
+
+	// A HEAD probe of a TS segment only needs the length, which storage
+	// reports without a read. fMP4 segments may be trimmed below, so their
+	// served length is only known once opened.
+	head := c.Request.Method == http.MethodHead && container != muxer.ContainerFMP4
+
+	var segmentReader io.ReadSeeker
+	var size int64
+	var modTime time.Time
+	var err error
+	if head {
+		size, modTime, err = s.segmenter.SegmentSize(c.Request.Context(), streamKey, uri)
+	} else {
+		segmentReader, modTime, err = s.segmenter.OpenSegment(c.Request.Context(), streamKey, uri)
+	}
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "segment not found"})
+		writeError(c, models.ErrorNotFound, "segment not found")
 		return
 	}
+	defer closeIfCloser(segmentReader)
 
 	// If segment starts with full MP4 (ftyp/moov), trim to start at first moof box for CMAF streaming
-	if len(segmentData) >= 12 && segmentData[4] == 'f' && segmentData[5] == 't' && segmentData[6] == 'y' && segmentData[7] == 'p' {
-		// This is a full MP4 file, scan for 'moof' box
-		// MP4 boxes have format: [4 bytes size][4 bytes type][data]
-		// We're looking for a box with type 'moof'
-		for i := 8; i <= len(segmentData)-8; i++ {
-			// Check if this position has a box with type 'moof' at offset +4
-			if i+7 < len(segmentData) && segmentData[i+4] == 'm' && segmentData[i+5] == 'o' && segmentData[i+6] == 'o' && segmentData[i+7] == 'f' {
-				// Found moof box, trim to start from here
-				segmentData = segmentData[i:]
-				break
-			}
+	if !head {
+		segmentReader, err = trimToFirstMoof(segmentReader)
+		if err != nil {
+			writeError(c, models.ErrorInternal, "failed to read segment")
+			return
 		}
 	}
 
-	// Live segments: avoid caching to prevent stalling on stale fragments
-	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
-	c.Header("Pragma", "no-cache")
-	c.Header("Expires", "0")
-	c.Header("Access-Control-Allow-Origin", "*")
+	// Live segments: always revalidate to prevent stalling on stale fragments
+	// from a previous run of the stream; the ETag makes that revalidation cheap
+	c.Header("Cache-Control", "no-cache, must-revalidate")
+	if !modTime.IsZero() {
+		// Segments are immutable once written; a restarted stream reuses
+		// sequence numbers, so the creation time is part of the tag
+		c.Header("ETag", fmt.Sprintf(`"%d-%x"`, segmentNum, modTime.UnixNano()))
+	}
+
+	s.trackViewer(c, streamKey)
+
+	// ServeContent handles Range, HEAD and If-Modified-Since
+	if container == muxer.ContainerFMP4 {
+		c.Header("Content-Type", s.contentTypes.FMP4Segment)
+	} else {
+		c.Header("Content-Type", s.contentTypes.TSSegment)
+	}
+	if head {
+		serveHead(c, size, modTime)
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, path.Base(uri), modTime, segmentReader)
+}
 
-	c.Data(http.StatusOK, "video/MP2T", segmentData)
+// serveHead answers a HEAD request for a file of the given size without
+// reading it, with the headers ServeContent would send for a GET.
+// Content-Type and ETag must already be set.
+func serveHead(c *gin.Context, size int64, modTime time.Time) {
+	if !modTime.IsZero() {
+		c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if etag := c.Writer.Header().Get("ETag"); etag != "" && etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusOK)
+}
+
+// trimToFirstMoof returns a reader positioned for serving. Segments that are
+// full MP4 files (ftyp/moov) are trimmed to start at the first moof box;
+// anything else is rewound and returned as is.
+func trimToFirstMoof(rs io.ReadSeeker) (io.ReadSeeker, error) {
+	header := make([]byte, 12)
+	n, err := io.ReadFull(rs, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	if n < 12 || string(header[4:8]) != "ftyp" {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return rs, nil
+	}
+
+	// This is a full MP4 file, scan for 'moof' box
+	rest, err := io.ReadAll(rs)
+	if err != nil {
+		return nil, err
+	}
+	segmentData := append(header, rest...)
+
+	// MP4 boxes have format: [4 bytes size][4 bytes type][data]
+	// We're looking for a box with type 'moof'
+	for i := 8; i <= len(segmentData)-8; i++ {
+		if string(segmentData[i+4:i+8]) == "moof" {
+			// Found moof box, trim to start from here
+			segmentData = segmentData[i:]
+			break
+		}
+	}
+
+	return bytes.NewReader(segmentData), nil
+}
+
+// etagMatches reports whether an If-None-Match header matches etag,
+// using the weak comparison that RFC 9110 requires for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// closeIfCloser closes readers backed by open files
+func closeIfCloser(r io.Reader) {
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
 }
 
 // Helper functions
 
+// trackViewer records HLS activity from the requesting client
+func (s *Server) trackViewer(c *gin.Context, streamKey string) {
+	if s.viewers == nil {
+		return
+	}
+	s.viewers.touch(streamKey, c.ClientIP())
+}
+
 func (s *Server) streamToInfo(stream *models.Stream) models.StreamInfo {
 	info := models.StreamInfo{
 		StreamKey: stream.Key,
 		Active:    stream.GetState() == models.StreamStateLive,
 		State:     string(stream.GetState()),
-		Viewers:   stream.GetViewerCount(),
+		Viewers:   stream.GetViewerCount() + s.streamManager.ViewerSubscriberCount(stream.Key), // HLS viewers + direct frame subscribers
 		Metadata:  stream.Metadata,
 	}
 
@@ -338,15 +1348,30 @@ func (s *Server) streamToInfo(stream *models.Stream) models.StreamInfo {
 		info.StartedAt = stream.StartedAt.Format(time.RFC3339)
 		info.Duration = int(time.Since(stream.StartedAt).Seconds())
 	}
+	info.Uptime = int(stream.Uptime().Seconds())
+	info.Reconnects = stream.Reconnects()
+
+	if videoCodec := stream.GetVideoCodec(); videoCodec != nil {
+		info.VideoCodec = videoCodec.Codec
+		if videoCodec.Width > 0 && videoCodec.Height > 0 {
+			info.Resolution = fmt.Sprintf("%dx%d", videoCodec.Width, videoCodec.Height)
+		}
+		info.FrameRate = videoCodec.FrameRate
+		info.Bitrate = videoCodec.Bitrate
+	}
+
+	if audioCodec := stream.GetAudioCodec(); audioCodec != nil {
+		info.AudioCodec = audioCodec.Codec
+	}
+	info.Codecs = stream.Codecs()
 
-	if stream.VideoCodec != nil {
-		info.VideoCodec = stream.VideoCodec.Codec
-		info.Resolution = fmt.Sprintf("%dx%d", stream.VideoCodec.Width, stream.VideoCodec.Height)
-		info.Bitrate = stream.VideoCodec.Bitrate
+	// Fall back to the measured ingest bitrate when the codec doesn't report one
+	if info.Bitrate == 0 {
+		info.Bitrate = stream.GetStats().Bitrate
 	}
 
-	if stream.AudioCodec != nil {
-		info.AudioCodec = stream.AudioCodec.Codec
+	if s.thumbnailer != nil && s.thumbnailer.HasThumbnail(stream.Key) {
+		info.ThumbnailURL = "/live/" + escapeStreamKey(stream.Key) + "/thumb.jpg"
 	}
 
 	return info
@@ -355,7 +1380,7 @@ func (s *Server) streamToInfo(stream *models.Stream) models.StreamInfo {
 // Legacy function for backward compatibility
 func SetupRouter() *gin.Engine {
 	// Create default dependencies
-	streamManager := streammanager.New()
+	streamManager := streammanager.New(nil)
 	authManager := auth.New()
 	// Note: segmenter would need storage, which we don't have here
 	// This function is mainly for backward compatibility
@@ -364,6 +1389,7 @@ func SetupRouter() *gin.Engine {
 		streamManager:  streamManager,
 		authManager:    authManager,
 		rtmpIngestAddr: "rtmp://localhost:1935",
+		corsOrigins:    []string{"*"},
 	}
 	server.setupRoutes()
 	return server.router
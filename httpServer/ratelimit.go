@@ -0,0 +1,89 @@
+package httpServer
+
+import (
+	"sync"
+	"time"
+
+	"rapidrtmp/pkg/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTTL is how long an idle client's bucket is kept before it is forgotten
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// ipRateLimiter applies a token bucket per client IP
+type ipRateLimiter struct {
+	rate  rate.Limit
+	burst int
+
+	clients map[string]*clientLimiter
+	mu      sync.Mutex
+}
+
+// clientLimiter is one client's bucket and when it was last used
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPRateLimiter allows perMinute requests per IP on average, with bursts up to burst
+func newIPRateLimiter(perMinute, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:    rate.Limit(float64(perMinute) / 60),
+		burst:   burst,
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+// allow reports whether a request from ip may proceed, consuming a token if so
+func (l *ipRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, exists := l.clients[ip]
+	if !exists {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = time.Now()
+
+	return client.limiter.Allow()
+}
+
+// run periodically forgets clients that have gone idle
+func (l *ipRateLimiter) run() {
+	ticker := time.NewTicker(rateLimiterIdleTTL / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.sweep()
+	}
+}
+
+// sweep removes buckets unused for longer than rateLimiterIdleTTL
+func (l *ipRateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-rateLimiterIdleTTL)
+	for ip, client := range l.clients {
+		if client.lastSeen.Before(cutoff) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// rateLimitMiddleware rejects requests with 429 once a client IP exceeds its rate
+func (s *Server) rateLimitMiddleware(limiter *ipRateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !limiter.allow(c.ClientIP()) {
+			c.Header("Retry-After", "60")
+			abortWithError(c, models.ErrorRateLimited, "rate limit exceeded")
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,50 @@
+package httpServer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// storageCheckInterval is how long a storage probe result is reused, so
+// frequent readiness polling doesn't turn into a stream of storage writes
+const storageCheckInterval = 5 * time.Second
+
+// ffmpegCheckInterval is how long an FFmpeg probe result is reused, so
+// readiness polling doesn't start an ffmpeg process on every request
+const ffmpegCheckInterval = 30 * time.Second
+
+// storageCheck caches the result of a storage probe. It also caches the
+// FFmpeg probe, which has the same shape.
+type storageCheck struct {
+	probe     func(ctx context.Context) error
+	interval  time.Duration
+	mu        sync.Mutex // Held while probing so concurrent callers share one probe
+	checkedAt time.Time
+	err       error
+}
+
+func newStorageCheck(probe func(ctx context.Context) error, interval time.Duration) *storageCheck {
+	return &storageCheck{
+		probe:    probe,
+		interval: interval,
+	}
+}
+
+// result returns the latest probe result, probing again once it is stale
+func (c *storageCheck) result(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < c.interval {
+		return c.err
+	}
+
+	err := c.probe(ctx)
+	if ctx.Err() != nil {
+		return err // The caller gave up; that says nothing about storage
+	}
+	c.err = err
+	c.checkedAt = time.Now()
+	return c.err
+}
@@ -0,0 +1,120 @@
+package httpServer
+
+import (
+	"sync"
+	"time"
+
+	"rapidrtmp/internal/metrics"
+	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/pkg/models"
+)
+
+// viewerTracker estimates HLS viewers from playlist/segment requests.
+// A viewer is identified by client IP and is considered gone once it
+// hasn't fetched anything for the configured timeout.
+type viewerTracker struct {
+	streamManager *streammanager.Manager
+	metrics       *metrics.Metrics
+	timeout       time.Duration
+
+	viewers map[string]*streamViewers // streamKey -> viewers of that stream
+	mu      sync.Mutex
+}
+
+// streamViewers holds the viewers of one stream key and the stream they
+// are counted on. A publisher reconnect replaces the stream, so the count
+// is carried over to the new one the first time it is seen.
+type streamViewers struct {
+	stream   *models.Stream
+	lastSeen map[string]time.Time // viewerID -> last seen
+}
+
+// bind makes stream the one the viewers are counted on, adding the
+// current viewers to it if it replaced an earlier stream
+func (v *streamViewers) bind(stream *models.Stream) {
+	if v.stream == stream {
+		return
+	}
+	v.stream = stream
+	for range v.lastSeen {
+		stream.IncrementViewers()
+	}
+}
+
+func newViewerTracker(streamManager *streammanager.Manager, m *metrics.Metrics, timeout time.Duration) *viewerTracker {
+	return &viewerTracker{
+		streamManager: streamManager,
+		metrics:       m,
+		timeout:       timeout,
+		viewers:       make(map[string]*streamViewers),
+	}
+}
+
+// touch records activity from a viewer, counting them on first sight
+func (t *viewerTracker) touch(streamKey, viewerID string) {
+	stream, exists := t.streamManager.GetStream(streamKey)
+	if !exists {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	viewers, exists := t.viewers[streamKey]
+	if !exists {
+		viewers = &streamViewers{lastSeen: make(map[string]time.Time)}
+		t.viewers[streamKey] = viewers
+	}
+	viewers.bind(stream)
+
+	if _, seen := viewers.lastSeen[viewerID]; !seen {
+		stream.IncrementViewers()
+		if t.metrics != nil {
+			t.metrics.RecordViewerStart()
+		}
+	}
+
+	viewers.lastSeen[viewerID] = time.Now()
+}
+
+// run periodically expires inactive viewers
+func (t *viewerTracker) run() {
+	ticker := time.NewTicker(t.timeout / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.sweep()
+	}
+}
+
+// sweep removes viewers that haven't been seen within the timeout
+func (t *viewerTracker) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-t.timeout)
+	for streamKey, viewers := range t.viewers {
+		stream, exists := t.streamManager.GetStream(streamKey)
+		if exists {
+			viewers.bind(stream)
+		}
+
+		for viewerID, lastSeen := range viewers.lastSeen {
+			if lastSeen.After(cutoff) {
+				continue
+			}
+
+			delete(viewers.lastSeen, viewerID)
+			if exists {
+				stream.DecrementViewers()
+			}
+			if t.metrics != nil {
+				t.metrics.RecordViewerStop()
+			}
+		}
+
+		if len(viewers.lastSeen) == 0 {
+			delete(t.viewers, streamKey)
+		}
+	}
+}
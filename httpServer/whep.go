@@ -0,0 +1,85 @@
+package httpServer
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"rapidrtmp/internal/whep"
+	"rapidrtmp/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSDPOfferSize bounds WHEP offer bodies; real offers are a few KB
+const maxSDPOfferSize = 64 * 1024
+
+// SetWHEP enables WebRTC playback at /live/{streamKey}/whep
+func (s *Server) SetWHEP(w *whep.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.whep = w
+}
+
+// whepServer returns the WHEP server, or nil when WebRTC playback is disabled
+func (s *Server) whepServer() *whep.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.whep
+}
+
+// handleWHEPOffer answers a WHEP client's SDP offer, creating a session
+// whose resource URL is returned in the Location header
+func (s *Server) handleWHEPOffer(c *gin.Context) {
+	w := s.whepServer()
+	if w == nil {
+		writeError(c, models.ErrorNotFound, "WebRTC playback not enabled")
+		return
+	}
+
+	if mediaType, _, _ := strings.Cut(c.ContentType(), ";"); mediaType != "application/sdp" {
+		writeError(c, models.ErrorInvalidRequest, "offer must be sent as application/sdp")
+		return
+	}
+
+	offer, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSDPOfferSize))
+	if err != nil || len(offer) == 0 {
+		writeError(c, models.ErrorInvalidRequest, "failed to read SDP offer")
+		return
+	}
+
+	streamKey := s.streamKeyParam(c)
+	id, answer, err := w.Offer(c.Request.Context(), streamKey, string(offer))
+	if err != nil {
+		switch {
+		case errors.Is(err, whep.ErrStreamNotLive):
+			writeError(c, models.ErrorStreamNotFound, "stream not live")
+		case errors.Is(err, whep.ErrInvalidOffer):
+			writeError(c, models.ErrorInvalidRequest, err.Error())
+		default:
+			log.Printf("WHEP offer for stream %s failed: %v", streamKey, err)
+			writeError(c, models.ErrorInternal, "failed to create WebRTC session")
+		}
+		return
+	}
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+id)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// handleWHEPDelete ends a WHEP session
+func (s *Server) handleWHEPDelete(c *gin.Context) {
+	w := s.whepServer()
+	if w == nil {
+		writeError(c, models.ErrorNotFound, "WebRTC playback not enabled")
+		return
+	}
+
+	if err := w.Close(s.streamKeyParam(c), c.Param("session")); err != nil {
+		writeError(c, models.ErrorNotFound, "session not found")
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -1,35 +1,95 @@
 package auth
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"rapidrtmp/internal/requestid"
 	"rapidrtmp/pkg/models"
 	"sync"
 	"time"
 )
 
+// Token validation errors, distinguishable with errors.Is
+var (
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrTokenExpired        = errors.New("token expired")
+	ErrTokenStreamMismatch = errors.New("token not valid for this stream")
+)
+
 // Manager handles authentication and authorization
 type Manager struct {
 	tokens map[string]*models.PublishToken // token -> PublishToken
 	mu     sync.RWMutex
 
 	// Config
-	defaultExpiration time.Duration
-	maxExpiration     time.Duration
+	defaultExpiration         time.Duration
+	maxExpiration             time.Duration
+	defaultPlaybackExpiration time.Duration
+
+	// External publish authorization (nginx-rtmp on_publish style)
+	publishWebhookURL    string
+	publishWebhookClient *http.Client
+
+	// Live publishes by stream key, so a token can be traced to its connection
+	publishes  map[string]*activePublish
+	disconnect func(streamKey string) // Stops a live stream when its token is revoked
+}
+
+// activePublish is a live stream and the token currently authorizing it
+type activePublish struct {
+	token string
+}
+
+// DefaultRotationGrace is how long a rotated-out token stays valid
+const DefaultRotationGrace = 30 * time.Second
+
+// Expired tokens are kept for tokenRetention so they are reported as expired
+// rather than invalid, and swept every tokenSweepInterval
+const (
+	tokenRetention     = 1 * time.Minute
+	tokenSweepInterval = 1 * time.Minute
+)
+
+// publishAuthRequest is the body POSTed to the publish authorization webhook
+type publishAuthRequest struct {
+	StreamKey string `json:"streamKey"`
+	Token     string `json:"token"`
+	ClientIP  string `json:"clientIp"`
 }
 
 // New creates a new auth manager
 func New() *Manager {
-	return &Manager{
-		tokens:            make(map[string]*models.PublishToken),
-		defaultExpiration: 1 * time.Hour,
-		maxExpiration:     24 * time.Hour,
+	m := &Manager{
+		tokens:                    make(map[string]*models.PublishToken),
+		publishes:                 make(map[string]*activePublish),
+		defaultExpiration:         1 * time.Hour,
+		maxExpiration:             24 * time.Hour,
+		defaultPlaybackExpiration: 5 * time.Minute,
 	}
+	go m.run()
+	return m
+}
+
+// GeneratePublishToken creates a new publish token for a stream, carrying
+// the per-stream settings applied to the publish it authorizes
+func (m *Manager) GeneratePublishToken(streamKey string, expiresIn int, publisherIP string, opts models.PublishOptions) (*models.PublishToken, error) {
+	return m.generateToken(models.TokenTypePublish, streamKey, expiresIn, m.defaultExpiration, publisherIP, opts)
+}
+
+// GeneratePlaybackToken creates a short-lived token for watching a stream
+func (m *Manager) GeneratePlaybackToken(streamKey string, expiresIn int, viewerIP string) (*models.PublishToken, error) {
+	return m.generateToken(models.TokenTypePlayback, streamKey, expiresIn, m.defaultPlaybackExpiration, viewerIP, models.PublishOptions{})
 }
 
-// GeneratePublishToken creates a new publish token for a stream
-func (m *Manager) GeneratePublishToken(streamKey string, expiresIn int, publisherIP string) (*models.PublishToken, error) {
+// generateToken creates and stores a new token of the given type
+func (m *Manager) generateToken(tokenType models.TokenType, streamKey string, expiresIn int, defaultExpiration time.Duration, clientIP string, opts models.PublishOptions) (*models.PublishToken, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -40,52 +100,143 @@ func (m *Manager) GeneratePublishToken(streamKey string, expiresIn int, publishe
 	}
 	tokenString := hex.EncodeToString(tokenBytes)
 
-	// Calculate expiration
+	// Calculate expiration, capped at max expiration; seconds are compared
+	// before converting so huge values can't overflow the duration
 	var expiration time.Duration
-	if expiresIn > 0 {
-		expiration = time.Duration(expiresIn) * time.Second
-	} else {
-		expiration = m.defaultExpiration
-	}
-
-	// Cap at max expiration
-	if expiration > m.maxExpiration {
+	switch {
+	case expiresIn <= 0:
+		expiration = min(defaultExpiration, m.maxExpiration)
+	case int64(expiresIn) > int64(m.maxExpiration/time.Second):
 		expiration = m.maxExpiration
+	default:
+		expiration = time.Duration(expiresIn) * time.Second
 	}
 
+	now := time.Now()
 	token := &models.PublishToken{
 		Token:       tokenString,
+		Type:        tokenType,
 		StreamKey:   streamKey,
-		CreatedAt:   time.Now(),
-		ExpiresAt:   time.Now().Add(expiration),
-		PublisherIP: publisherIP,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(expiration),
+		PublisherIP: clientIP,
 		IsUsed:      false,
+		Options:     opts,
 	}
 
 	m.tokens[tokenString] = token
 
-	// Start cleanup goroutine for this token
-	go m.cleanupToken(tokenString, expiration)
-
 	return token, nil
 }
 
+// SetExpiration sets the lifetime of publish tokens requested without one,
+// and the longest lifetime any token may be given
+func (m *Manager) SetExpiration(defaultExpiration, maxExpiration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.defaultExpiration = defaultExpiration
+	m.maxExpiration = maxExpiration
+}
+
+// SetPublishWebhook enables authorizing publishes against an external service.
+// The service receives a JSON POST and must respond 200 to allow the publish.
+func (m *Manager) SetPublishWebhook(url string, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.publishWebhookURL = url
+	m.publishWebhookClient = &http.Client{Timeout: timeout}
+}
+
+// AuthorizePublish decides whether a client may publish to a stream.
+// A valid publish token or an approving webhook response is sufficient;
+// the token is marked used when it is the one that authorized the publish,
+// and its per-stream settings are returned. Publishes authorized any other
+// way get none.
+// ctx bounds the webhook call, and its request ID is forwarded to the webhook.
+func (m *Manager) AuthorizePublish(ctx context.Context, streamKey, token, clientIP string) (models.PublishOptions, error) {
+	var tokenErr error
+	if token != "" {
+		if tokenErr = m.ValidateToken(token, streamKey, clientIP); tokenErr == nil {
+			return m.useToken(token), nil
+		}
+	}
+
+	m.mu.RLock()
+	webhookURL := m.publishWebhookURL
+	client := m.publishWebhookClient
+	m.mu.RUnlock()
+
+	if webhookURL != "" {
+		if err := authorizeViaWebhook(ctx, client, webhookURL, streamKey, token, clientIP); err != nil {
+			if tokenErr != nil {
+				return models.PublishOptions{}, errors.Join(tokenErr, err)
+			}
+			return models.PublishOptions{}, err
+		}
+		return models.PublishOptions{}, nil
+	}
+
+	if tokenErr != nil {
+		return models.PublishOptions{}, tokenErr
+	}
+
+	// For now, allow publishing without token for testing
+	// In production, you should enforce token validation
+	log.Printf("%sWarning: No token provided for stream %s", requestid.LogPrefix(ctx), streamKey)
+	return models.PublishOptions{}, nil
+}
+
+// authorizeViaWebhook asks the external service to approve a publish.
+// Fails closed: any error or non-200 response denies the publish.
+func authorizeViaWebhook(ctx context.Context, client *http.Client, url, streamKey, token, clientIP string) error {
+	body, err := json.Marshal(publishAuthRequest{
+		StreamKey: streamKey,
+		Token:     token,
+		ClientIP:  clientIP,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode publish auth request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create publish auth request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("publish auth webhook failed: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("publish rejected by auth webhook (status %d)", resp.StatusCode)
+	}
+	return nil
+}
+
 // ValidateToken checks if a token is valid for publishing to a stream
 func (m *Manager) ValidateToken(tokenString string, streamKey string, publisherIP string) error {
 	m.mu.RLock()
 	token, exists := m.tokens[tokenString]
 	m.mu.RUnlock()
 
-	if !exists {
-		return fmt.Errorf("invalid token")
+	if !exists || token.Type != models.TokenTypePublish {
+		return ErrInvalidToken
 	}
 
 	if !token.IsValid() {
-		return fmt.Errorf("token expired or already used")
+		return fmt.Errorf("%w or already used", ErrTokenExpired)
 	}
 
 	if token.StreamKey != streamKey {
-		return fmt.Errorf("token not valid for this stream")
+		return ErrTokenStreamMismatch
 	}
 
 	// Optionally validate IP (can be disabled for testing)
@@ -96,6 +247,28 @@ func (m *Manager) ValidateToken(tokenString string, streamKey string, publisherI
 	return nil
 }
 
+// ValidatePlaybackToken checks if a token is valid for watching a stream.
+// Unlike publish tokens, playback tokens can be used repeatedly until they expire.
+func (m *Manager) ValidatePlaybackToken(tokenString string, streamKey string) error {
+	m.mu.RLock()
+	token, exists := m.tokens[tokenString]
+	m.mu.RUnlock()
+
+	if !exists || token.Type != models.TokenTypePlayback {
+		return ErrInvalidToken
+	}
+
+	if !token.IsValid() {
+		return ErrTokenExpired
+	}
+
+	if token.StreamKey != streamKey {
+		return ErrTokenStreamMismatch
+	}
+
+	return nil
+}
+
 // MarkTokenUsed marks a token as used
 func (m *Manager) MarkTokenUsed(tokenString string) {
 	m.mu.Lock()
@@ -106,37 +279,150 @@ func (m *Manager) MarkTokenUsed(tokenString string) {
 	}
 }
 
-// RevokeToken revokes a token
-func (m *Manager) RevokeToken(tokenString string) {
+// useToken marks a token used and returns its per-stream settings
+func (m *Manager) useToken(tokenString string) models.PublishOptions {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	delete(m.tokens, tokenString)
+	token, exists := m.tokens[tokenString]
+	if !exists {
+		return models.PublishOptions{}
+	}
+	token.IsUsed = true
+	return token.Options
 }
 
-// cleanupToken removes a token after it expires
-func (m *Manager) cleanupToken(tokenString string, expiration time.Duration) {
-	time.Sleep(expiration + 1*time.Minute) // Wait a bit longer than expiration
-
+// SetDisconnectFunc sets how a live stream is stopped when the token it
+// published with is revoked with disconnect requested
+func (m *Manager) SetDisconnectFunc(disconnect func(streamKey string)) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	m.disconnect = disconnect
+}
+
+// BindPublish records that a stream went live under a token. The returned
+// release func forgets it again; it is a no-op once another publish of the
+// same stream key has been bound.
+func (m *Manager) BindPublish(streamKey, tokenString string) (release func()) {
+	publish := &activePublish{token: tokenString}
+
+	m.mu.Lock()
+	m.publishes[streamKey] = publish
+	m.mu.Unlock()
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if m.publishes[streamKey] == publish {
+			delete(m.publishes, streamKey)
+		}
+	}
+}
+
+// RevokeToken revokes a token and reports whether it existed. With disconnect,
+// a live stream bound to the token is also stopped, which disconnects its
+// publisher.
+func (m *Manager) RevokeToken(ctx context.Context, tokenString string, disconnect bool) bool {
+	m.mu.Lock()
+	_, exists := m.tokens[tokenString]
 	delete(m.tokens, tokenString)
+
+	var streamKey string
+	for key, publish := range m.publishes {
+		if publish.token == tokenString {
+			streamKey = key
+			exists = true
+			break
+		}
+	}
+	stop := m.disconnect
+	m.mu.Unlock()
+
+	if disconnect && streamKey != "" && stop != nil {
+		log.Printf("%sToken for stream %s revoked, disconnecting publisher", requestid.LogPrefix(ctx), streamKey)
+		stop(streamKey)
+	}
+	return exists
 }
 
-// CleanupExpiredTokens removes all expired tokens (call periodically)
-func (m *Manager) CleanupExpiredTokens() {
+// RotatePublishToken issues a new publish token for a stream and revokes the
+// old one after grace. A live publish bound to the old token is rebound to
+// the new one, so ingest continues and a later revocation of the new token
+// can still disconnect it. oldToken defaults to the live publish's token;
+// the token scheduled for revocation is returned, "" if there was none.
+func (m *Manager) RotatePublishToken(streamKey, oldToken string, expiresIn int, clientIP string, grace time.Duration) (*models.PublishToken, string, error) {
+	m.mu.RLock()
+	publish := m.publishes[streamKey]
+	if oldToken == "" && publish != nil {
+		oldToken = publish.token
+	}
+	old, exists := m.tokens[oldToken]
+	// An expired token may already be gone while its publish is still live
+	bound := publish != nil && publish.token == oldToken
+	m.mu.RUnlock()
+
+	if oldToken != "" && !exists && !bound {
+		return nil, "", ErrInvalidToken
+	}
+	if exists && (old.Type != models.TokenTypePublish || old.StreamKey != streamKey) {
+		return nil, "", ErrTokenStreamMismatch
+	}
+
+	// The new token publishes with the same settings as the one it replaces
+	var opts models.PublishOptions
+	if exists {
+		opts = old.Options
+	}
+	token, err := m.GeneratePublishToken(streamKey, expiresIn, clientIP, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mu.Lock()
+	if publish, ok := m.publishes[streamKey]; ok && publish.token == oldToken {
+		publish.token = token.Token
+	}
+	m.mu.Unlock()
+
+	if oldToken != "" {
+		time.AfterFunc(grace, func() {
+			m.RevokeToken(context.Background(), oldToken, false)
+		})
+	}
+
+	return token, oldToken, nil
+}
+
+// run periodically removes tokens that expired more than tokenRetention ago
+func (m *Manager) run() {
+	ticker := time.NewTicker(tokenSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.sweep(time.Now().Add(-tokenRetention))
+	}
+}
+
+// sweep removes tokens that expired before cutoff
+func (m *Manager) sweep(cutoff time.Time) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	now := time.Now()
 	for tokenString, token := range m.tokens {
-		if now.After(token.ExpiresAt) {
+		if token.ExpiresAt.Before(cutoff) {
 			delete(m.tokens, tokenString)
 		}
 	}
 }
 
+// CleanupExpiredTokens removes all expired tokens now, without waiting for
+// the background sweep
+func (m *Manager) CleanupExpiredTokens() {
+	m.sweep(time.Now())
+}
+
 // GetTokenCount returns the number of active tokens
 func (m *Manager) GetTokenCount() int {
 	m.mu.RLock()
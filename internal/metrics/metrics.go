@@ -8,46 +8,71 @@ import (
 // Metrics holds all Prometheus metrics
 type Metrics struct {
 	// Stream metrics
-	ActiveStreams    prometheus.Gauge
-	TotalStreams     prometheus.Counter
-	StreamsStarted   prometheus.Counter
-	StreamsStopped   prometheus.Counter
-	StreamDuration   prometheus.Histogram
+	ActiveStreams  prometheus.Gauge
+	TotalStreams   prometheus.Counter
+	StreamsStarted prometheus.Counter
+	StreamsStopped prometheus.Counter
+	StreamDuration prometheus.Histogram
+	StreamsReaped  prometheus.Counter
+	StreamsCapped  prometheus.Counter
+	IngestRejected *prometheus.CounterVec
 
 	// Frame metrics
-	FramesReceived   *prometheus.CounterVec
-	FramesDropped    *prometheus.CounterVec
-	FrameSize        *prometheus.HistogramVec
-	KeyFrames        prometheus.Counter
+	FramesReceived *prometheus.CounterVec
+	FramesDropped  *prometheus.CounterVec
+	FrameSize      *prometheus.HistogramVec
+	KeyFrames      prometheus.Counter
 
 	// Segment metrics
 	SegmentsCreated  prometheus.Counter
 	SegmentDuration  prometheus.Histogram
 	SegmentSize      prometheus.Histogram
+	SegmentsDropped  *prometheus.CounterVec
+	IngestToSegment  prometheus.Histogram
+	AVResyncs        prometheus.Counter
+	KeyFrameTimeouts prometheus.Counter
+	SegmentUpload    prometheus.Histogram
+	MuxDuration      *prometheus.HistogramVec
+	MuxErrors        *prometheus.CounterVec
 
 	// Viewer metrics
-	ActiveViewers    prometheus.Gauge
-	TotalViewers     prometheus.Counter
-	ViewerSessions   prometheus.Counter
+	ActiveViewers  prometheus.Gauge
+	TotalViewers   prometheus.Counter
+	ViewerSessions prometheus.Counter
 
 	// HTTP metrics
-	HTTPRequests     *prometheus.CounterVec
-	HTTPDuration     *prometheus.HistogramVec
+	HTTPRequests *prometheus.CounterVec
+	HTTPDuration *prometheus.HistogramVec
 
 	// RTMP metrics
-	RTMPConnections  prometheus.Counter
-	RTMPDisconnects  prometheus.Counter
-	RTMPErrors       prometheus.Counter
+	RTMPConnections   prometheus.Counter
+	RTMPDisconnects   prometheus.Counter
+	RTMPErrors        prometheus.Counter
 	RTMPBytesReceived prometheus.Counter
+	RTMPRejected      *prometheus.CounterVec
 
 	// System metrics
 	BytesStored      prometheus.Gauge
 	SegmentsStored   prometheus.Gauge
+	RecordingsPurged prometheus.Counter
+
+	// Segment progress, computed when scraped
+	segmentProgress *segmentCollector
+
+	// perStreamLabels controls whether per-stream series use the real stream key
+	perStreamLabels bool
 }
 
+// aggregateStreamLabel replaces the stream_key label when per-stream labels are disabled
+const aggregateStreamLabel = "all"
+
 // New creates and registers all metrics
-func New() *Metrics {
+// When perStreamLabels is false, per-stream series are aggregated under a
+// single stream_key value to bound cardinality on high-churn servers
+func New(perStreamLabels bool) *Metrics {
 	m := &Metrics{
+		perStreamLabels: perStreamLabels,
+
 		// Stream metrics
 		ActiveStreams: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "rapidrtmp_active_streams",
@@ -70,6 +95,21 @@ func New() *Metrics {
 			Help:    "Duration of streams in seconds",
 			Buckets: prometheus.ExponentialBuckets(10, 2, 10), // 10s to ~2.8h
 		}),
+		StreamsReaped: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "rapidrtmp_streams_reaped_total",
+			Help: "Total number of streams stopped for receiving no frames",
+		}),
+		StreamsCapped: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "rapidrtmp_streams_duration_capped_total",
+			Help: "Total number of streams stopped for exceeding the maximum publish duration",
+		}),
+		IngestRejected: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rapidrtmp_ingest_rejected_total",
+				Help: "Total number of publishers disconnected for exceeding an ingest limit",
+			},
+			[]string{"reason"}, // "bitrate" or "resolution"
+		),
 
 		// Frame metrics
 		FramesReceived: promauto.NewCounterVec(
@@ -114,6 +154,46 @@ func New() *Metrics {
 			Help:    "Size of HLS segments in bytes",
 			Buckets: prometheus.ExponentialBuckets(10240, 2, 10), // 10KB to ~5MB
 		}),
+		SegmentsDropped: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rapidrtmp_segments_dropped_total",
+				Help: "Total number of segments that could not be produced",
+			},
+			[]string{"reason"},
+		),
+		IngestToSegment: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rapidrtmp_ingest_to_segment_seconds",
+			Help:    "Time from a segment's first frame arriving over RTMP to the segment being stored",
+			Buckets: []float64{0.25, 0.5, 1, 1.5, 2, 3, 4, 6, 8, 12, 20},
+		}),
+		AVResyncs: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "rapidrtmp_av_resyncs_total",
+			Help: "Total number of times a stream's audio was realigned with its video after drifting",
+		}),
+		KeyFrameTimeouts: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "rapidrtmp_keyframe_timeouts_total",
+			Help: "Total number of streams that sent no keyframe within the keyframe timeout of segmentation starting",
+		}),
+		SegmentUpload: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rapidrtmp_segment_upload_seconds",
+			Help:    "Time to write a segment to storage, per successful attempt",
+			Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8},
+		}),
+		MuxDuration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "rapidrtmp_mux_duration_seconds",
+				Help:    "Time FFmpeg took to build an init segment, or to deliver a live segment once the keyframe ending it was written",
+				Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8},
+			},
+			[]string{"stage"}, // "init" or "segment"
+		),
+		MuxErrors: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rapidrtmp_mux_errors_total",
+				Help: "Total number of FFmpeg failures while muxing",
+			},
+			[]string{"stage"},
+		),
 
 		// Viewer metrics
 		ActiveViewers: promauto.NewGauge(prometheus.GaugeOpts{
@@ -163,17 +243,31 @@ func New() *Metrics {
 			Name: "rapidrtmp_rtmp_bytes_received_total",
 			Help: "Total bytes received via RTMP",
 		}),
+		RTMPRejected: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rapidrtmp_rtmp_connections_rejected_total",
+				Help: "Total number of RTMP connections refused or closed before publishing",
+			},
+			[]string{"reason"}, // "max_connections" or "publish_timeout"
+		),
 
 		// System metrics
 		BytesStored: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "rapidrtmp_bytes_stored",
-			Help: "Total bytes stored on disk",
+			Help: "Bytes of HLS media segments in storage",
 		}),
 		SegmentsStored: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "rapidrtmp_segments_stored",
-			Help: "Number of segments currently stored",
+			Help: "Number of HLS media segments in storage",
 		}),
+		RecordingsPurged: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "rapidrtmp_recordings_purged_total",
+			Help: "Total number of recordings deleted for exceeding the retention period",
+		}),
+
+		segmentProgress: newSegmentCollector(perStreamLabels),
 	}
+	prometheus.MustRegister(m.segmentProgress)
 
 	return m
 }
@@ -192,13 +286,28 @@ func (m *Metrics) RecordStreamStop(durationSeconds float64) {
 	m.StreamDuration.Observe(durationSeconds)
 }
 
+// RecordStreamReaped records an idle stream being stopped by the reaper
+func (m *Metrics) RecordStreamReaped() {
+	m.StreamsReaped.Inc()
+}
+
+// RecordStreamDurationCapped records a stream being stopped at the maximum publish duration
+func (m *Metrics) RecordStreamDurationCapped() {
+	m.StreamsCapped.Inc()
+}
+
+// RecordIngestRejected records a publisher disconnected for exceeding an ingest limit
+func (m *Metrics) RecordIngestRejected(reason string) {
+	m.IngestRejected.WithLabelValues(reason).Inc()
+}
+
 // RecordFrame records a frame received
 func (m *Metrics) RecordFrame(streamKey string, isVideo bool, size int) {
 	frameType := "audio"
 	if isVideo {
 		frameType = "video"
 	}
-	m.FramesReceived.WithLabelValues(streamKey, frameType).Inc()
+	m.FramesReceived.WithLabelValues(m.streamLabel(streamKey), frameType).Inc()
 	m.FrameSize.WithLabelValues(frameType).Observe(float64(size))
 }
 
@@ -209,7 +318,19 @@ func (m *Metrics) RecordKeyFrame() {
 
 // RecordFrameDropped records a dropped frame
 func (m *Metrics) RecordFrameDropped(streamKey, reason string) {
-	m.FramesDropped.WithLabelValues(streamKey, reason).Inc()
+	m.FramesDropped.WithLabelValues(m.streamLabel(streamKey), reason).Inc()
+}
+
+// DeleteStreamMetrics removes all per-stream series for a stream
+// Call this when a stream ends so ephemeral stream keys don't accumulate
+func (m *Metrics) DeleteStreamMetrics(streamKey string) {
+	if !m.perStreamLabels {
+		return // Aggregated series are shared by all streams
+	}
+
+	labels := prometheus.Labels{"stream_key": streamKey}
+	m.FramesReceived.DeletePartialMatch(labels)
+	m.FramesDropped.DeletePartialMatch(labels)
 }
 
 // RecordSegment records a segment created
@@ -217,12 +338,48 @@ func (m *Metrics) RecordSegment(durationSeconds float64, sizeBytes int64) {
 	m.SegmentsCreated.Inc()
 	m.SegmentDuration.Observe(durationSeconds)
 	m.SegmentSize.Observe(float64(sizeBytes))
-	m.SegmentsStored.Inc()
 }
 
-// RecordSegmentDeleted records a segment deleted
-func (m *Metrics) RecordSegmentDeleted() {
-	m.SegmentsStored.Dec()
+// RecordIngestToSegment records how long a segment's oldest frame took from
+// arrival to the segment being stored
+func (m *Metrics) RecordIngestToSegment(latencySeconds float64) {
+	m.IngestToSegment.Observe(latencySeconds)
+}
+
+// RecordAVResync records audio being realigned with video after drifting
+func (m *Metrics) RecordAVResync() {
+	m.AVResyncs.Inc()
+}
+
+// RecordKeyFrameTimeout records a stream that sent no keyframe within the keyframe timeout
+func (m *Metrics) RecordKeyFrameTimeout() {
+	m.KeyFrameTimeouts.Inc()
+}
+
+// RecordSegmentUpload records how long a segment write to storage took
+func (m *Metrics) RecordSegmentUpload(seconds float64) {
+	m.SegmentUpload.Observe(seconds)
+}
+
+// RecordMux records how long an FFmpeg muxing stage took
+func (m *Metrics) RecordMux(stage string, seconds float64) {
+	m.MuxDuration.WithLabelValues(stage).Observe(seconds)
+}
+
+// RecordMuxError records FFmpeg failing in a muxing stage
+func (m *Metrics) RecordMuxError(stage string) {
+	m.MuxErrors.WithLabelValues(stage).Inc()
+}
+
+// RecordSegmentDropped records a segment that could not be produced
+func (m *Metrics) RecordSegmentDropped(reason string) {
+	m.SegmentsDropped.WithLabelValues(reason).Inc()
+}
+
+// SetStorageUsage records the media segments currently in storage
+func (m *Metrics) SetStorageUsage(bytes int64, segments int) {
+	m.BytesStored.Set(float64(bytes))
+	m.SegmentsStored.Set(float64(segments))
 }
 
 // RecordHTTPRequest records an HTTP request
@@ -241,6 +398,11 @@ func (m *Metrics) RecordRTMPDisconnect() {
 	m.RTMPDisconnects.Inc()
 }
 
+// RecordRTMPRejected records an RTMP connection refused or closed before publishing
+func (m *Metrics) RecordRTMPRejected(reason string) {
+	m.RTMPRejected.WithLabelValues(reason).Inc()
+}
+
 // RecordRTMPError records an RTMP error
 func (m *Metrics) RecordRTMPError() {
 	m.RTMPErrors.Inc()
@@ -263,6 +425,19 @@ func (m *Metrics) RecordViewerStop() {
 	m.ActiveViewers.Dec()
 }
 
+// RecordRecordingPurged records an expired recording being deleted
+func (m *Metrics) RecordRecordingPurged() {
+	m.RecordingsPurged.Inc()
+}
+
+// streamLabel returns the stream_key label value to use for a stream
+func (m *Metrics) streamLabel(streamKey string) string {
+	if m.perStreamLabels {
+		return streamKey
+	}
+	return aggregateStreamLabel
+}
+
 // statusCodeToString converts an HTTP status code to a string
 func (m *Metrics) statusCodeToString(code int) string {
 	switch {
@@ -278,4 +453,3 @@ func (m *Metrics) statusCodeToString(code int) string {
 		return "unknown"
 	}
 }
-
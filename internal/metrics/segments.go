@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// segmentProgress is how far a stream's segmentation has got
+type segmentProgress struct {
+	sequence   uint64
+	hasSegment bool
+	at         time.Time // When the newest segment was listed, or segmentation started
+}
+
+// segmentCollector exports the newest segment of each stream being
+// segmented. The time since that segment is computed at scrape time, so a
+// stream whose segmentation has stalled shows it rising.
+type segmentCollector struct {
+	perStreamLabels bool
+	sequenceDesc    *prometheus.Desc
+	sinceDesc       *prometheus.Desc
+
+	mu      sync.Mutex
+	streams map[string]segmentProgress
+}
+
+func newSegmentCollector(perStreamLabels bool) *segmentCollector {
+	return &segmentCollector{
+		perStreamLabels: perStreamLabels,
+		sequenceDesc: prometheus.NewDesc(
+			"rapidrtmp_stream_last_segment_sequence",
+			"Media sequence number of the stream's newest segment (per-stream labels only)",
+			[]string{"stream_key"}, nil,
+		),
+		sinceDesc: prometheus.NewDesc(
+			"rapidrtmp_stream_seconds_since_last_segment",
+			"Seconds since the stream's newest segment was listed, or since segmentation started; the longest of all streams when aggregated",
+			[]string{"stream_key"}, nil,
+		),
+		streams: make(map[string]segmentProgress),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *segmentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sequenceDesc
+	ch <- c.sinceDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *segmentCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if !c.perStreamLabels {
+		// A sequence number can't be aggregated; the stalest stream can
+		if len(c.streams) == 0 {
+			return
+		}
+		var longest time.Duration
+		for _, p := range c.streams {
+			longest = max(longest, now.Sub(p.at))
+		}
+		ch <- prometheus.MustNewConstMetric(c.sinceDesc, prometheus.GaugeValue, longest.Seconds(), aggregateStreamLabel)
+		return
+	}
+
+	for streamKey, p := range c.streams {
+		if p.hasSegment {
+			ch <- prometheus.MustNewConstMetric(c.sequenceDesc, prometheus.GaugeValue, float64(p.sequence), streamKey)
+		}
+		ch <- prometheus.MustNewConstMetric(c.sinceDesc, prometheus.GaugeValue, now.Sub(p.at).Seconds(), streamKey)
+	}
+}
+
+// StartSegmentProgress starts tracking a stream's segmentation
+func (m *Metrics) StartSegmentProgress(streamKey string) {
+	c := m.segmentProgress
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.streams[streamKey] = segmentProgress{at: time.Now()}
+}
+
+// RecordSegmentProgress records the newest segment listed for a stream. It
+// is ignored unless the stream is tracked, so a final segment flushed after
+// segmentation stopped doesn't leave a stale series behind.
+func (m *Metrics) RecordSegmentProgress(streamKey string, sequence uint64) {
+	c := m.segmentProgress
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, tracked := c.streams[streamKey]; !tracked {
+		return
+	}
+	c.streams[streamKey] = segmentProgress{sequence: sequence, hasSegment: true, at: time.Now()}
+}
+
+// StopSegmentProgress stops tracking a stream once its segmentation ends
+func (m *Metrics) StopSegmentProgress(streamKey string) {
+	c := m.segmentProgress
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.streams, streamKey)
+}
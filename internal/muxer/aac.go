@@ -0,0 +1,185 @@
+package muxer
+
+import (
+	"fmt"
+)
+
+// FLV audio sound formats (the SoundFormat nibble of an audio tag)
+const (
+	FLVSoundFormatPCMPlatform     = 0 // Linear PCM, platform endian
+	FLVSoundFormatADPCM           = 1
+	FLVSoundFormatMP3             = 2
+	FLVSoundFormatPCM             = 3 // Linear PCM, little endian
+	FLVSoundFormatNellymoser16kHz = 4
+	FLVSoundFormatNellymoser8kHz  = 5
+	FLVSoundFormatNellymoser      = 6
+	FLVSoundFormatG711ALaw        = 7
+	FLVSoundFormatG711MuLaw       = 8
+	FLVSoundFormatAAC             = 10
+	FLVSoundFormatSpeex           = 11
+	FLVSoundFormatMP38kHz         = 14
+)
+
+// SupportsAudioCodec reports whether audio frames of a codec can be muxed
+// into HLS segments. Only AAC is; other audio would produce segments that
+// players can't decode.
+func SupportsAudioCodec(codec string) bool {
+	return codec == "aac"
+}
+
+// adtsHeaderSize is the ADTS header length without CRC; a CRC adds 2 bytes
+const adtsHeaderSize = 7
+
+// AACFrameSamples is the number of samples per channel in an AAC-LC frame
+const AACFrameSamples = 1024
+
+// aacSampleRates maps the MPEG-4 sampling frequency index to Hz
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// AudioSpecificConfig is the MPEG-4 audio configuration for an AAC stream
+// It is sent once as the AAC sequence header and describes every raw frame
+type AudioSpecificConfig struct {
+	ObjectType      uint8 // Audio object type, e.g. 2 for AAC-LC
+	SampleRateIndex uint8
+	SampleRate      int
+	ChannelConfig   uint8
+}
+
+// ParseAudioSpecificConfig decodes the leading fields of an AudioSpecificConfig
+func ParseAudioSpecificConfig(data []byte) (*AudioSpecificConfig, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("AudioSpecificConfig too short: %d bytes", len(data))
+	}
+
+	r := &bitReader{data: data}
+	config := &AudioSpecificConfig{}
+
+	config.ObjectType = uint8(r.readBits(5))
+	if config.ObjectType == 31 {
+		config.ObjectType = uint8(32 + r.readBits(6))
+	}
+
+	config.SampleRateIndex = uint8(r.readBits(4))
+	if config.SampleRateIndex == 0x0F {
+		config.SampleRate = int(r.readBits(24))
+	} else if int(config.SampleRateIndex) < len(aacSampleRates) {
+		config.SampleRate = aacSampleRates[config.SampleRateIndex]
+	} else {
+		return nil, fmt.Errorf("invalid AAC sampling frequency index %d", config.SampleRateIndex)
+	}
+
+	config.ChannelConfig = uint8(r.readBits(4))
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse AudioSpecificConfig: %w", r.err)
+	}
+	return config, nil
+}
+
+// Bytes encodes the config as a two-byte AudioSpecificConfig
+// Only indexed sample rates and object types below 31 can be represented
+func (c *AudioSpecificConfig) Bytes() []byte {
+	return []byte{
+		c.ObjectType<<3 | c.SampleRateIndex>>1,
+		(c.SampleRateIndex&0x01)<<7 | c.ChannelConfig<<3,
+	}
+}
+
+// CodecString returns the RFC 6381 codec identifier used in HLS CODECS
+// attributes, e.g. "mp4a.40.2" for AAC-LC
+func (c *AudioSpecificConfig) CodecString() string {
+	return fmt.Sprintf("mp4a.40.%d", c.ObjectType)
+}
+
+// ParseFLVAudioPacket parses the body of an FLV/RTMP audio tag
+// For AAC it reports whether the packet is the sequence header (AudioSpecificConfig)
+// and returns the payload after the two-byte AAC tag header
+func ParseFLVAudioPacket(data []byte) (soundFormat uint8, isSequenceHeader bool, payload []byte, err error) {
+	if len(data) < 1 {
+		return 0, false, nil, fmt.Errorf("empty audio packet")
+	}
+
+	soundFormat = data[0] >> 4
+	if soundFormat != FLVSoundFormatAAC {
+		return soundFormat, false, data[1:], nil
+	}
+
+	if len(data) < 2 {
+		return soundFormat, false, nil, fmt.Errorf("AAC audio packet too short: %d bytes", len(data))
+	}
+
+	// AACPacketType: 0 = sequence header, 1 = raw frame
+	return soundFormat, data[1] == 0, data[2:], nil
+}
+
+// HasADTSHeader reports whether data starts with an ADTS sync word
+func HasADTSHeader(data []byte) bool {
+	return len(data) >= adtsHeaderSize && data[0] == 0xFF && data[1]&0xF6 == 0xF0
+}
+
+// ParseADTSHeader decodes an ADTS header, returning the equivalent
+// AudioSpecificConfig and the header length (7, or 9 with CRC)
+func ParseADTSHeader(data []byte) (*AudioSpecificConfig, int, error) {
+	if !HasADTSHeader(data) {
+		return nil, 0, fmt.Errorf("missing ADTS sync word")
+	}
+
+	headerLen := adtsHeaderSize
+	if data[1]&0x01 == 0 { // protection_absent == 0 means a CRC follows
+		headerLen += 2
+	}
+
+	frameLen := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+	if frameLen < headerLen || frameLen > len(data) {
+		return nil, 0, fmt.Errorf("invalid ADTS frame length %d (have %d bytes)", frameLen, len(data))
+	}
+
+	config := &AudioSpecificConfig{
+		ObjectType:      (data[2]>>6)&0x03 + 1, // ADTS stores profile = object type - 1
+		SampleRateIndex: (data[2] >> 2) & 0x0F,
+		ChannelConfig:   (data[2]&0x01)<<2 | data[3]>>6,
+	}
+	if int(config.SampleRateIndex) >= len(aacSampleRates) {
+		return nil, 0, fmt.Errorf("invalid AAC sampling frequency index %d", config.SampleRateIndex)
+	}
+	config.SampleRate = aacSampleRates[config.SampleRateIndex]
+
+	return config, headerLen, nil
+}
+
+// StripADTS removes ADTS headers from one or more concatenated ADTS frames,
+// returning the raw AAC access units
+func StripADTS(data []byte) ([][]byte, error) {
+	var frames [][]byte
+	for len(data) > 0 {
+		_, headerLen, err := ParseADTSHeader(data)
+		if err != nil {
+			return nil, err
+		}
+
+		frameLen := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		frames = append(frames, data[headerLen:frameLen])
+		data = data[frameLen:]
+	}
+	return frames, nil
+}
+
+// WrapADTS prefixes a raw AAC access unit with an ADTS header (no CRC),
+// as required when carrying AAC in MPEG-TS
+func WrapADTS(config *AudioSpecificConfig, raw []byte) []byte {
+	frameLen := len(raw) + adtsHeaderSize
+	profile := config.ObjectType - 1
+
+	out := make([]byte, adtsHeaderSize, frameLen)
+	out[0] = 0xFF
+	out[1] = 0xF1 // MPEG-4, layer 0, no CRC
+	out[2] = profile<<6 | (config.SampleRateIndex&0x0F)<<2 | (config.ChannelConfig>>2)&0x01
+	out[3] = (config.ChannelConfig&0x03)<<6 | byte(frameLen>>11)&0x03
+	out[4] = byte(frameLen >> 3)
+	out[5] = byte(frameLen&0x07)<<5 | 0x1F // Buffer fullness 0x7FF (VBR)
+	out[6] = 0xFC                          // Buffer fullness cont. + one raw data block
+
+	return append(out, raw...)
+}
@@ -106,10 +106,10 @@ func ParseAVCDecoderConfigurationRecord(data []byte) (*AVCDecoderConfigurationRe
 }
 
 // ParseFLVVideoPacket extracts codec data and frame type from FLV video packet
-// Returns: isSequenceHeader, isKeyFrame, avcData, error
-func ParseFLVVideoPacket(data []byte) (isSequenceHeader bool, isKeyFrame bool, avcData []byte, err error) {
+// Returns: isSequenceHeader, isKeyFrame, compositionTime (PTS - DTS in ms), avcData, error
+func ParseFLVVideoPacket(data []byte) (isSequenceHeader bool, isKeyFrame bool, compositionTime int32, avcData []byte, err error) {
 	if len(data) < 5 {
-		return false, false, nil, fmt.Errorf("video packet too short: %d bytes", len(data))
+		return false, false, 0, nil, fmt.Errorf("video packet too short: %d bytes", len(data))
 	}
 
 	// Byte 0: Frame type (4 bits) + Codec ID (4 bits)
@@ -118,7 +118,7 @@ func ParseFLVVideoPacket(data []byte) (isSequenceHeader bool, isKeyFrame bool, a
 
 	// Check if it's H.264/AVC (codec ID 7)
 	if codecID != 7 {
-		return false, false, nil, fmt.Errorf("not H.264/AVC codec: %d", codecID)
+		return false, false, 0, nil, fmt.Errorf("not H.264/AVC codec: %d", codecID)
 	}
 
 	// Frame types:
@@ -134,13 +134,16 @@ func ParseFLVVideoPacket(data []byte) (isSequenceHeader bool, isKeyFrame bool, a
 	avcPacketType := data[1]
 	isSequenceHeader = avcPacketType == 0
 
-	// Bytes 2-4: Composition time (PTS offset)
-	// compositionTime := int32(data[2])<<16 | int32(data[3])<<8 | int32(data[4])
+	// Bytes 2-4: Composition time (PTS offset), signed 24-bit
+	compositionTime = int32(data[2])<<16 | int32(data[3])<<8 | int32(data[4])
+	if compositionTime&0x800000 != 0 {
+		compositionTime -= 1 << 24 // Sign-extend negative offsets
+	}
 
 	// The actual AVC data starts at byte 5
 	avcData = data[5:]
 
-	return isSequenceHeader, isKeyFrame, avcData, nil
+	return isSequenceHeader, isKeyFrame, compositionTime, avcData, nil
 }
 
 // PrependSPSPPSAnnexB prepends SPS and PPS to frame data in Annex-B format
@@ -0,0 +1,50 @@
+package muxer
+
+import "time"
+
+// maxAVDrift is how far audio timestamps may run ahead of or behind video
+// timestamps, measured at a keyframe, before audio is shifted back in line.
+// Publishers interleave the tracks much more tightly than this, so a larger
+// delta means their audio and video clocks have diverged.
+const maxAVDrift = 500 * time.Millisecond
+
+// avSync keeps a stream's audio in step with its video. Drift is measured
+// at keyframes, where segments are cut, and corrected by offsetting the
+// timestamps of the audio that follows: audio that ran ahead loses the frames
+// that would now overlap, and audio that fell behind resumes after a gap.
+type avSync struct {
+	offset    int64 // Milliseconds added to audio DTS
+	lastAudio int64 // Corrected DTS of the last audio frame passed through
+	hasAudio  bool
+	fresh     bool // Audio arrived since the last keyframe, so lastAudio is current
+}
+
+// keyframe measures the drift of the audio track against a video keyframe's
+// DTS, correcting it when it is over maxAVDrift. It returns the drift
+// corrected in milliseconds, positive when audio was ahead, or 0.
+func (s *avSync) keyframe(videoDTS int64) int64 {
+	if !s.fresh {
+		return 0 // No audio, or it paused; nothing to compare
+	}
+	s.fresh = false
+
+	drift := s.lastAudio - videoDTS
+	if drift >= -maxAVDrift.Milliseconds() && drift <= maxAVDrift.Milliseconds() {
+		return 0
+	}
+
+	s.offset -= drift
+	return drift
+}
+
+// audio returns the corrected DTS of an audio frame, and false if the frame
+// must be dropped because a correction moved it behind audio already sent
+func (s *avSync) audio(dts int64) (int64, bool) {
+	corrected := dts + s.offset
+	if s.hasAudio && corrected < s.lastAudio {
+		return 0, false
+	}
+
+	s.lastAudio, s.hasAudio, s.fresh = corrected, true, true
+	return corrected, true
+}
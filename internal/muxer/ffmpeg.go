@@ -2,15 +2,42 @@ package muxer
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os/exec"
 	"sync"
-
-	"rapidrtmp/pkg/models"
+	"time"
 )
 
+// ErrFFmpegTimeout is returned when an FFmpeg run exceeds its context deadline
+// The process is killed before the error is returned
+var ErrFFmpegTimeout = errors.New("ffmpeg timed out")
+
+// ffmpegWaitDelay bounds how long Wait blocks on FFmpeg's pipes after the
+// process is killed, so a stuck pipe can't hang the caller
+const ffmpegWaitDelay = time.Second
+
+// newFFmpegCommand builds an FFmpeg command that is killed when ctx is done
+func newFFmpegCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.WaitDelay = ffmpegWaitDelay
+	return cmd
+}
+
+// ffmpegContextErr reports why ctx ended, mapping deadlines to ErrFFmpegTimeout
+// It returns nil while ctx is still live
+func ffmpegContextErr(ctx context.Context) error {
+	switch err := ctx.Err(); {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrFFmpegTimeout
+	case err != nil:
+		return fmt.Errorf("ffmpeg cancelled: %w", err)
+	}
+	return nil
+}
+
 // FFmpegMuxer uses FFmpeg to mux H.264/AAC frames into fMP4 segments
 type FFmpegMuxer struct {
 	mu sync.Mutex
@@ -23,7 +50,8 @@ func NewFFmpegMuxer() *FFmpegMuxer {
 
 // CreateInitSegment creates an fMP4 initialization segment
 // This contains the ftyp and moov boxes needed for CMAF/HLS
-func (m *FFmpegMuxer) CreateInitSegment(videoCodecData, audioCodecData []byte) ([]byte, error) {
+// FFmpeg is killed if ctx is cancelled or its deadline passes
+func (m *FFmpegMuxer) CreateInitSegment(ctx context.Context, videoCodecData, audioCodecData []byte) ([]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -35,7 +63,7 @@ func (m *FFmpegMuxer) CreateInitSegment(videoCodecData, audioCodecData []byte) (
 
 	// Use FFmpeg to create an fMP4 init segment by processing actual H.264 data
 	// videoCodecData should contain SPS/PPS and at least one frame in Annex-B format
-	cmd := exec.Command("ffmpeg",
+	cmd := newFFmpegCommand(ctx,
 		"-hide_banner",
 		"-loglevel", "warning", // Show warnings and errors
 		"-f", "h264", // Input format
@@ -58,6 +86,9 @@ func (m *FFmpegMuxer) CreateInitSegment(videoCodecData, audioCodecData []byte) (
 	}
 
 	if err := cmd.Start(); err != nil {
+		if ctxErr := ffmpegContextErr(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
 		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
@@ -70,6 +101,9 @@ func (m *FFmpegMuxer) CreateInitSegment(videoCodecData, audioCodecData []byte) (
 	}
 
 	waitErr := cmd.Wait()
+	if err := ffmpegContextErr(ctx); err != nil {
+		return nil, fmt.Errorf("init segment: %w", err)
+	}
 	stderrOutput := stderr.String()
 
 	if len(stderrOutput) > 0 {
@@ -96,156 +130,54 @@ func (m *FFmpegMuxer) CreateInitSegment(videoCodecData, audioCodecData []byte) (
 	return initData, nil
 }
 
-// CreateMediaSegment muxes frames into an fMP4 media segment
-func (m *FFmpegMuxer) CreateMediaSegment(frames []*models.Frame) ([]byte, error) {
+// CreateThumbnail decodes a single keyframe and encodes it as a JPEG image
+// keyFrameData should be Annex-B H.264 with SPS/PPS prepended
+// FFmpeg is killed if ctx is cancelled or its deadline passes
+func (m *FFmpegMuxer) CreateThumbnail(ctx context.Context, keyFrameData []byte) ([]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if len(frames) == 0 {
-		return nil, fmt.Errorf("no frames to mux")
-	}
-
-	// Separate video and audio frames
-	var videoFrames, audioFrames []*models.Frame
-	for _, frame := range frames {
-		if frame.IsVideo {
-			videoFrames = append(videoFrames, frame)
-		} else {
-			audioFrames = append(audioFrames, frame)
-		}
-	}
-
-	if len(videoFrames) == 0 {
-		return nil, fmt.Errorf("no video frames in segment")
+	if len(keyFrameData) == 0 {
+		return nil, fmt.Errorf("no keyframe data provided")
 	}
 
-	// Calculate approximate framerate and duration
-	framerate := "30" // Default, could be detected from timestamps
-	duration := fmt.Sprintf("%.3f", float64(len(videoFrames))/30.0)
-
-	// Create MPEG-TS segments with video only for now
-	// TODO: Add audio support when needed
-	cmd := exec.Command("ffmpeg",
+	cmd := newFFmpegCommand(ctx,
 		"-hide_banner",
 		"-loglevel", "error", // Only show errors
 		"-f", "h264", // Input is raw H.264
-		"-r", framerate, // Set input framerate
 		"-i", "pipe:0", // Read from stdin
-		"-t", duration, // Duration
-		"-c:v", "copy", // Don't re-encode
-		"-f", "mpegts", // Output as MPEG-TS
-		"-mpegts_copyts", "1", // Copy timestamps
-		"-mpegts_flags", "initial_discontinuity", // Mark as new segment
-		"-y",     // Overwrite output
+		"-frames:v", "1", // Decode a single frame
+		"-c:v", "mjpeg", // Encode as JPEG
+		"-q:v", "5", // Reasonable quality for previews
+		"-f", "image2", // Single image output
 		"pipe:1", // Write to stdout
 	)
 
 	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(keyFrameData)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get stdin pipe: %w", err)
-	}
-
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
-	}
-
-	// Write frames to FFmpeg (they should already be in Annex-B format from RTMP handler)
-	writeErr := make(chan error, 1)
-	go func() {
-		defer stdin.Close()
-		for _, frame := range videoFrames {
-			// Frames are already in Annex-B format with SPS/PPS prepended to keyframes
-			if _, err := stdin.Write(frame.Payload); err != nil {
-				writeErr <- err
-				return
-			}
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ffmpegContextErr(ctx); ctxErr != nil {
+			return nil, fmt.Errorf("thumbnail: %w", ctxErr)
 		}
-		writeErr <- nil
-	}()
-
-	// Wait for write to complete or error
-	if err := <-writeErr; err != nil {
-		log.Printf("Error writing video frames to ffmpeg: %v", err)
+		return nil, fmt.Errorf("ffmpeg thumbnail failed: %w (stderr: %s)", err, stderr.String())
 	}
 
-	if err := cmd.Wait(); err != nil {
-		errMsg := stderr.String()
-		if len(errMsg) > 0 {
-			log.Printf("FFmpeg error: %s", errMsg)
-		}
-		// Check if we got any output despite the error
-		if stdout.Len() == 0 {
-			return nil, fmt.Errorf("ffmpeg failed: %w", err)
-		}
-		// Sometimes FFmpeg returns error but still produces valid output
-		log.Printf("FFmpeg returned error but produced %d bytes output, using it anyway", stdout.Len())
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg produced no thumbnail output")
 	}
 
-	segmentData := stdout.Bytes()
-	if len(segmentData) == 0 {
-		return nil, fmt.Errorf("ffmpeg produced no output")
-	}
-
-	// MPEG-TS segments are ready to use - no stripping needed!
-	log.Printf("Created TS segment: %d frames -> %d bytes", len(videoFrames), len(segmentData))
-	return segmentData, nil
-}
-
-// stripInitBoxes removes ftyp and moov boxes from MP4 data, leaving only moof/mdat
-// This converts a full MP4 into a CMAF media segment
-func (m *FFmpegMuxer) stripInitBoxes(mp4Data []byte) []byte {
-	if len(mp4Data) < 8 {
-		return mp4Data
-	}
-
-	offset := 0
-	for offset+8 <= len(mp4Data) {
-		// Read box size and type
-		boxSize := int(mp4Data[offset])<<24 | int(mp4Data[offset+1])<<16 |
-			int(mp4Data[offset+2])<<8 | int(mp4Data[offset+3])
-		boxType := string(mp4Data[offset+4 : offset+8])
-
-		if boxSize == 0 || boxSize > len(mp4Data)-offset {
-			// Invalid or extended size, return from this point
-			return mp4Data[offset:]
-		}
-
-		// Skip ftyp, moov, and sidx boxes - only keep moof+mdat for CMAF
-		if boxType == "ftyp" || boxType == "moov" || boxType == "sidx" {
-			offset += boxSize
-			continue
-		}
-
-		// Found moof (start of fragment), return from here
-		if boxType == "moof" {
-			return mp4Data[offset:]
-		}
-
-		// If we hit mdat without moof, something's wrong - return from here
-		if boxType == "mdat" {
-			log.Printf("WARNING: Found mdat without moof at offset %d", offset)
-			return mp4Data[offset:]
-		}
-
-		// Unknown box, skip it
-		offset += boxSize
-	}
-
-	// No moof found, return original
-	return mp4Data
-}
-
-// MuxFramesToMP4 is a simpler interface that wraps CreateMediaSegment
-func (m *FFmpegMuxer) MuxFramesToMP4(frames []*models.Frame) ([]byte, error) {
-	return m.CreateMediaSegment(frames)
+	return stdout.Bytes(), nil
 }
 
 // CheckFFmpegAvailable checks if FFmpeg is installed and available
 func CheckFFmpegAvailable() error {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("ffmpeg not found in PATH: %w", err)
+	}
+
 	cmd := exec.Command("ffmpeg", "-version")
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
@@ -259,37 +191,5 @@ func CheckFFmpegAvailable() error {
 		return fmt.Errorf("ffmpeg produced no output")
 	}
 
-	log.Println("FFmpeg is available and working")
-	return nil
-}
-
-// ExtractCodecData attempts to extract SPS/PPS from the first few video frames
-func ExtractCodecData(frames []*models.Frame) []byte {
-	for _, frame := range frames {
-		if frame.IsVideo && frame.IsKeyFrame && len(frame.Payload) > 0 {
-			// Look for SPS/PPS NAL units (type 7 and 8)
-			// This is a simplified approach - proper parsing would use H.264 parser
-			payload := frame.Payload
-
-			// H.264 NAL units start with 0x00 0x00 0x00 0x01 or 0x00 0x00 0x01
-			// We'll just return the first keyframe as it likely contains codec data
-			if len(payload) > 100 {
-				return payload[:100] // First 100 bytes likely contain SPS/PPS
-			}
-			return payload
-		}
-	}
-	return nil
-}
-
-// WriteRawH264 is a helper to write raw H.264 data for debugging
-func WriteRawH264(w io.Writer, frames []*models.Frame) error {
-	for _, frame := range frames {
-		if frame.IsVideo {
-			if _, err := w.Write(frame.Payload); err != nil {
-				return err
-			}
-		}
-	}
 	return nil
 }
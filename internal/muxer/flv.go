@@ -0,0 +1,280 @@
+package muxer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"rapidrtmp/pkg/models"
+)
+
+// FLV tag types
+const (
+	flvTagTypeAudio = 8
+	flvTagTypeVideo = 9
+)
+
+// FLV header flags
+const (
+	flvFlagVideo = 0x01
+	flvFlagAudio = 0x04
+)
+
+// flvAACTagHeader is the first byte of every AAC audio tag:
+// AAC, 44kHz, 16-bit, stereo (the real parameters come from the AudioSpecificConfig)
+const flvAACTagHeader = 0xAF
+
+// writeFLVHeader writes the FLV file header followed by the AVC and AAC
+// sequence headers, each when its config is set, stamped with timestamp
+func writeFLVHeader(w io.Writer, avcConfig, audioConfig []byte, timestamp uint32) error {
+	withVideo := len(avcConfig) > 0
+	withAudio := len(audioConfig) > 0
+	var flags byte
+	if withVideo {
+		flags |= flvFlagVideo
+	}
+	if withAudio {
+		flags |= flvFlagAudio
+	}
+
+	header := []byte{
+		'F', 'L', 'V', 0x01, // Signature + version
+		flags,
+		0x00, 0x00, 0x00, 0x09, // Header size
+		0x00, 0x00, 0x00, 0x00, // PreviousTagSize0
+	}
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write FLV header: %w", err)
+	}
+
+	if withVideo {
+		if err := writeFLVTag(w, flvTagTypeVideo, timestamp, avcSequenceHeader(avcConfig)); err != nil {
+			return err
+		}
+	}
+	if withAudio {
+		if err := writeFLVTag(w, flvTagTypeAudio, timestamp, AACSequenceHeader(audioConfig)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AVCSequenceHeader returns the FLV video tag body announcing the SPS/PPS
+// prepended to keyFrame, which must precede the stream's video frames
+func AVCSequenceHeader(keyFrame *models.Frame) ([]byte, error) {
+	avcConfig, err := buildAVCDecoderConfigurationRecord([]*models.Frame{keyFrame})
+	if err != nil {
+		return nil, err
+	}
+	return avcSequenceHeader(avcConfig), nil
+}
+
+// avcSequenceHeader wraps an AVCDecoderConfigurationRecord in a video tag body:
+// keyframe + AVC, packet type 0, composition time 0
+func avcSequenceHeader(avcConfig []byte) []byte {
+	return append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcConfig...)
+}
+
+// AACSequenceHeader returns the FLV audio tag body carrying an AudioSpecificConfig
+func AACSequenceHeader(audioConfig []byte) []byte {
+	return append([]byte{flvAACTagHeader, 0x00}, audioConfig...)
+}
+
+// writeFLVFrame writes one frame as an FLV tag, using body as scratch space
+// Audio frames are only written when withAudio is set and they carry raw AAC
+func writeFLVFrame(w io.Writer, body *bytes.Buffer, frame *models.Frame, withAudio bool) error {
+	if !frame.IsVideo && !withAudio {
+		return nil
+	}
+	if !FLVTagBody(body, frame) {
+		return nil
+	}
+
+	tagType := byte(flvTagTypeVideo)
+	if !frame.IsVideo {
+		tagType = flvTagTypeAudio
+	}
+	return writeFLVTag(w, tagType, uint32(frame.DTS), body.Bytes())
+}
+
+// FLVTagBody writes the FLV tag body of a frame into body, replacing its
+// contents: H.264 as length-prefixed NAL units without SPS/PPS, which belong
+// in the sequence header, or raw AAC. It reports false for audio that isn't AAC.
+func FLVTagBody(body *bytes.Buffer, frame *models.Frame) bool {
+	body.Reset()
+
+	if !frame.IsVideo {
+		if frame.Codec != "aac" {
+			return false
+		}
+		body.Write([]byte{flvAACTagHeader, 0x01}) // Raw AAC frame
+		body.Write(frame.Payload)
+		return true
+	}
+
+	// Frame type (1 = keyframe, 2 = inter frame) + codec ID 7 (AVC)
+	if frame.IsKeyFrame {
+		body.WriteByte(0x17)
+	} else {
+		body.WriteByte(0x27)
+	}
+
+	// AVC NALU packet + signed 24-bit composition time
+	cts := uint32(frame.CompositionTime) & 0xFFFFFF
+	body.Write([]byte{0x01, byte(cts >> 16), byte(cts >> 8), byte(cts)})
+
+	// NAL units as 4-byte length-prefixed AVCC; SPS/PPS live in the sequence header
+	for _, nal := range SplitAnnexB(frame.Payload) {
+		nalType := nal[0] & 0x1F
+		if nalType == NALUnitTypeSPS || nalType == NALUnitTypePPS {
+			continue
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(nal)))
+		body.Write(length[:])
+		body.Write(nal)
+	}
+
+	return true
+}
+
+// writeFLVTag writes a single FLV tag followed by its PreviousTagSize
+func writeFLVTag(w io.Writer, tagType byte, timestamp uint32, data []byte) error {
+	header := []byte{
+		tagType,
+		byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data)), // Data size
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), // Timestamp (lower 24 bits)
+		byte(timestamp >> 24), // Timestamp extended
+		0x00, 0x00, 0x00,      // Stream ID
+	}
+
+	var trailer [4]byte
+	binary.BigEndian.PutUint32(trailer[:], uint32(len(header)+len(data)))
+
+	for _, b := range [][]byte{header, data, trailer[:]} {
+		if _, err := w.Write(b); err != nil {
+			return fmt.Errorf("failed to write FLV tag: %w", err)
+		}
+	}
+	return nil
+}
+
+// buildAVCDecoderConfigurationRecord builds an AVCC record from the SPS/PPS
+// prepended to the first keyframe in frames
+func buildAVCDecoderConfigurationRecord(frames []*models.Frame) ([]byte, error) {
+	var sps, pps [][]byte
+	for _, frame := range frames {
+		if !frame.IsVideo || !frame.IsKeyFrame {
+			continue
+		}
+		for _, nal := range SplitAnnexB(frame.Payload) {
+			switch nal[0] & 0x1F {
+			case NALUnitTypeSPS:
+				sps = append(sps, nal)
+			case NALUnitTypePPS:
+				pps = append(pps, nal)
+			}
+		}
+		if len(sps) > 0 && len(pps) > 0 {
+			break
+		}
+		sps, pps = nil, nil
+	}
+
+	if len(sps) == 0 || len(pps) == 0 || len(sps[0]) < 4 {
+		return nil, fmt.Errorf("no SPS/PPS found in keyframes")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x01)                       // Configuration version
+	buf.Write(sps[0][1:4])                    // Profile, compatibility, level
+	buf.WriteByte(0xFF)                       // Reserved + 4-byte NALU length
+	buf.WriteByte(0xE0 | byte(len(sps)&0x1F)) // Reserved + SPS count
+	for _, s := range sps {
+		binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+		buf.Write(s)
+	}
+	buf.WriteByte(byte(len(pps)))
+	for _, p := range pps {
+		binary.Write(&buf, binary.BigEndian, uint16(len(p)))
+		buf.Write(p)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// FLVStreamWriter writes a live stream's frames as one continuous FLV
+// stream, e.g. for HTTP-FLV playback. The stream starts at a keyframe with
+// timestamps from 0, and sequence headers are sent again whenever the codec
+// parameters change.
+type FLVStreamWriter struct {
+	w           io.Writer
+	started     bool   // The FLV header and AVC sequence header were written
+	withAudio   bool   // The header announced audio
+	baseDTS     int64  // DTS of the first keyframe
+	audioConfig []byte // AudioSpecificConfig last written
+	body        bytes.Buffer
+}
+
+// NewFLVStreamWriter creates a writer producing an FLV stream on w
+func NewFLVStreamWriter(w io.Writer) *FLVStreamWriter {
+	return &FLVStreamWriter{w: w}
+}
+
+// WriteFrame writes one frame, skipping frames until the first keyframe.
+// audioConfig is the stream's AudioSpecificConfig, nil while unknown; audio
+// is only written when it was known at that first keyframe.
+func (s *FLVStreamWriter) WriteFrame(frame *models.Frame, audioConfig []byte) error {
+	if !s.started {
+		if !frame.IsVideo || !frame.IsKeyFrame {
+			return nil
+		}
+		avcConfig, err := buildAVCDecoderConfigurationRecord([]*models.Frame{frame})
+		if err != nil {
+			return nil // Undecodable without SPS/PPS; try the next keyframe
+		}
+
+		s.baseDTS = frame.DTS
+		s.withAudio = len(audioConfig) > 0
+		if err := writeFLVHeader(s.w, avcConfig, audioConfig, 0); err != nil {
+			return err
+		}
+		s.audioConfig = audioConfig
+		s.started = true
+	} else if frame.IsVideo && frame.IsKeyFrame && frame.CodecChanged {
+		if header, err := AVCSequenceHeader(frame); err == nil {
+			if err := writeFLVTag(s.w, flvTagTypeVideo, s.timestamp(frame), header); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !frame.IsVideo {
+		if !s.withAudio {
+			return nil
+		}
+		if !bytes.Equal(audioConfig, s.audioConfig) && len(audioConfig) > 0 {
+			if err := writeFLVTag(s.w, flvTagTypeAudio, s.timestamp(frame), AACSequenceHeader(audioConfig)); err != nil {
+				return err
+			}
+			s.audioConfig = audioConfig
+		}
+	}
+
+	if !FLVTagBody(&s.body, frame) {
+		return nil
+	}
+	tagType := byte(flvTagTypeVideo)
+	if !frame.IsVideo {
+		tagType = flvTagTypeAudio
+	}
+	return writeFLVTag(s.w, tagType, s.timestamp(frame), s.body.Bytes())
+}
+
+// timestamp is a frame's DTS relative to the first keyframe
+func (s *FLVStreamWriter) timestamp(frame *models.Frame) uint32 {
+	return uint32(max(frame.DTS-s.baseDTS, 0))
+}
@@ -0,0 +1,240 @@
+package muxer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"testing"
+
+	"rapidrtmp/pkg/models"
+)
+
+// Annex-B NAL units for synthetic H.264 frames
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x02, 0x80, 0xBF, 0xE5, 0x84}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	testNon = []byte{0x41, 0x9A, 0x02, 0x00, 0x11}
+)
+
+// annexB joins NAL units with 4-byte start codes
+func annexB(nals ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, nal := range nals {
+		buf.Write([]byte{0x00, 0x00, 0x00, 0x01})
+		buf.Write(nal)
+	}
+	return buf.Bytes()
+}
+
+// testVideoFrame builds a video frame; keyframes carry SPS/PPS like RTMP ingest produces
+func testVideoFrame(dts int64, cts int32, keyFrame bool) *models.Frame {
+	payload := annexB(testNon)
+	if keyFrame {
+		payload = annexB(testSPS, testPPS, testIDR)
+	}
+	return &models.Frame{
+		StreamKey:       "test",
+		IsVideo:         true,
+		DTS:             dts,
+		CompositionTime: cts,
+		Payload:         payload,
+		Codec:           "h264",
+		IsKeyFrame:      keyFrame,
+	}
+}
+
+// flvVideoTag is a parsed FLV video tag carrying coded frame data
+type flvVideoTag struct {
+	timestamp       int64
+	compositionTime int32
+	keyFrame        bool
+}
+
+// readFLVVideoTags parses an FLV stream and returns its video NALU tags,
+// skipping sequence headers
+func readFLVVideoTags(t *testing.T, data []byte) []flvVideoTag {
+	t.Helper()
+
+	if len(data) < 13 || string(data[:3]) != "FLV" {
+		t.Fatalf("missing FLV header")
+	}
+	data = data[13:]
+
+	var tags []flvVideoTag
+	for len(data) > 0 {
+		if len(data) < 11 {
+			t.Fatalf("truncated tag header: %d bytes", len(data))
+		}
+		tagType := data[0]
+		size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		timestamp := int64(data[7])<<24 | int64(data[4])<<16 | int64(data[5])<<8 | int64(data[6])
+		if len(data) < 11+size+4 {
+			t.Fatalf("truncated tag body: want %d bytes, have %d", size, len(data)-11)
+		}
+		body := data[11 : 11+size]
+		if prev := binary.BigEndian.Uint32(data[11+size:]); int(prev) != 11+size {
+			t.Fatalf("PreviousTagSize = %d, want %d", prev, 11+size)
+		}
+		data = data[11+size+4:]
+
+		if tagType != flvTagTypeVideo {
+			continue
+		}
+		isSequenceHeader, keyFrame, cts, _, err := ParseFLVVideoPacket(body)
+		if err != nil {
+			t.Fatalf("ParseFLVVideoPacket: %v", err)
+		}
+		if isSequenceHeader {
+			continue
+		}
+		tags = append(tags, flvVideoTag{timestamp: timestamp, compositionTime: cts, keyFrame: keyFrame})
+	}
+	return tags
+}
+
+func TestParseFLVVideoPacketCompositionTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   []byte
+		wantKey  bool
+		wantSeq  bool
+		wantCTS  int32
+		wantData []byte
+	}{
+		{"keyframe without offset", []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xAA}, true, false, 0, []byte{0xAA}},
+		{"inter frame positive offset", []byte{0x27, 0x01, 0x00, 0x00, 0x50, 0xBB}, false, false, 80, []byte{0xBB}},
+		{"largest positive offset", []byte{0x27, 0x01, 0x7F, 0xFF, 0xFF}, false, false, 1<<23 - 1, []byte{}},
+		{"negative offset", []byte{0x27, 0x01, 0xFF, 0xFF, 0xD8}, false, false, -40, []byte{}},
+		{"most negative offset", []byte{0x27, 0x01, 0x80, 0x00, 0x00}, false, false, -1 << 23, []byte{}},
+		{"sequence header", []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}, true, true, 0, []byte{0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isSeq, isKey, cts, data, err := ParseFLVVideoPacket(tt.packet)
+			if err != nil {
+				t.Fatalf("ParseFLVVideoPacket: %v", err)
+			}
+			if isSeq != tt.wantSeq || isKey != tt.wantKey {
+				t.Errorf("sequence header, keyframe = %v, %v, want %v, %v", isSeq, isKey, tt.wantSeq, tt.wantKey)
+			}
+			if cts != tt.wantCTS {
+				t.Errorf("composition time = %d, want %d", cts, tt.wantCTS)
+			}
+			if !bytes.Equal(data, tt.wantData) {
+				t.Errorf("data = %x, want %x", data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestParseFLVVideoPacketErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"too short", []byte{0x17, 0x01, 0x00, 0x00}},
+		{"not AVC", []byte{0x12, 0x01, 0x00, 0x00, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, _, err := ParseFLVVideoPacket(tt.packet); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// TestFLVStreamWriterCompositionTime checks that B-frame sequences reach
+// FFmpeg with each frame's DTS as the tag timestamp and PTS - DTS as its
+// composition time, so presentation order differs from decode order
+func TestFLVStreamWriterCompositionTime(t *testing.T) {
+	type frame struct {
+		name     string
+		dts      int64
+		cts      int32
+		keyFrame bool
+	}
+	tests := []struct {
+		name         string
+		frames       []frame // In decode order
+		wantPTS      []int64 // Per frame, relative to the first keyframe's DTS
+		displayOrder []string
+	}{
+		{
+			name: "IPBB",
+			frames: []frame{
+				{"I", 1000, 40, true},
+				{"P", 1040, 120, false},
+				{"B1", 1080, 0, false},
+				{"B2", 1120, 0, false},
+			},
+			wantPTS:      []int64{40, 160, 80, 120},
+			displayOrder: []string{"I", "B1", "B2", "P"},
+		},
+		{
+			name: "IPBB with negative offsets",
+			frames: []frame{
+				{"I", 0, 0, true},
+				{"P", 40, 80, false},
+				{"B1", 80, -40, false},
+				{"B2", 120, -40, false},
+			},
+			wantPTS:      []int64{0, 120, 40, 80},
+			displayOrder: []string{"I", "B1", "B2", "P"},
+		},
+		{
+			name: "no B-frames",
+			frames: []frame{
+				{"I", 500, 0, true},
+				{"P1", 540, 0, false},
+				{"P2", 580, 0, false},
+			},
+			wantPTS:      []int64{0, 40, 80},
+			displayOrder: []string{"I", "P1", "P2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := NewFLVStreamWriter(&out)
+			for _, f := range tt.frames {
+				if err := w.WriteFrame(testVideoFrame(f.dts, f.cts, f.keyFrame), nil); err != nil {
+					t.Fatalf("WriteFrame(%s): %v", f.name, err)
+				}
+			}
+
+			tags := readFLVVideoTags(t, out.Bytes())
+			if len(tags) != len(tt.frames) {
+				t.Fatalf("got %d video tags, want %d", len(tags), len(tt.frames))
+			}
+
+			names := make(map[int64]string)
+			var pts []int64
+			for i, tag := range tags {
+				got := tag.timestamp + int64(tag.compositionTime)
+				if got != tt.wantPTS[i] {
+					t.Errorf("%s: PTS = %d, want %d", tt.frames[i].name, got, tt.wantPTS[i])
+				}
+				if tag.keyFrame != tt.frames[i].keyFrame {
+					t.Errorf("%s: keyframe = %v, want %v", tt.frames[i].name, tag.keyFrame, tt.frames[i].keyFrame)
+				}
+				if i > 0 && tag.timestamp < tags[i-1].timestamp {
+					t.Errorf("%s: DTS %d decreases from %d", tt.frames[i].name, tag.timestamp, tags[i-1].timestamp)
+				}
+				names[got] = tt.frames[i].name
+				pts = append(pts, got)
+			}
+
+			sort.Slice(pts, func(i, j int) bool { return pts[i] < pts[j] })
+			for i, p := range pts {
+				if names[p] != tt.displayOrder[i] {
+					t.Errorf("display position %d = %s, want %s", i, names[p], tt.displayOrder[i])
+				}
+			}
+		})
+	}
+}
@@ -3,10 +3,15 @@ package muxer
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 )
 
+// ErrInvalidNAL is returned for AVCC data whose NAL unit lengths don't match
+// the data, e.g. a truncated or corrupted frame
+var ErrInvalidNAL = errors.New("invalid NAL unit")
+
 // H.264 NAL unit types
 const (
 	NALUnitTypeSPS = 7
@@ -34,9 +39,12 @@ var (
 //	[0x00 0x00 0x00 0x01][NAL unit][0x00 0x00 0x00 0x01][NAL unit]...
 //
 // skipSPSPPS: if true, skip SPS/PPS NAL units (useful when they're prepended separately)
+//
+// Malformed data fails with ErrInvalidNAL rather than converting what parses,
+// since a frame missing slices corrupts the output.
 func ConvertAVCCToAnnexB(avccData []byte, skipSPSPPS ...bool) ([]byte, error) {
 	if len(avccData) == 0 {
-		return nil, fmt.Errorf("empty AVCC data")
+		return nil, fmt.Errorf("%w: empty AVCC data", ErrInvalidNAL)
 	}
 
 	skipConfig := len(skipSPSPPS) > 0 && skipSPSPPS[0]
@@ -49,7 +57,8 @@ func ConvertAVCCToAnnexB(avccData []byte, skipSPSPPS ...bool) ([]byte, error) {
 	for offset < len(avccData) {
 		// Need at least 4 bytes for length prefix
 		if offset+4 > len(avccData) {
-			break
+			return nil, fmt.Errorf("%w: %d trailing bytes at offset %d are too short for a length prefix",
+				ErrInvalidNAL, len(avccData)-offset, offset)
 		}
 
 		// Read 4-byte length prefix (big-endian)
@@ -62,16 +71,9 @@ func ConvertAVCCToAnnexB(avccData []byte, skipSPSPPS ...bool) ([]byte, error) {
 			continue
 		}
 
-		if offset+int(nalSize) > len(avccData) {
-			// Log more details about the failure
-			log.Printf("AVCC parse failed: nalSize=%d, offset=%d, bufferSize=%d, remaining=%d",
-				nalSize, offset-4, len(avccData), len(avccData)-offset)
-			if nalCount > 0 {
-				// Return what we have so far instead of failing completely
-				log.Printf("Returning partial conversion: %d NAL units successfully parsed", nalCount)
-				return annexB.Bytes(), nil
-			}
-			return nil, fmt.Errorf("invalid NAL size %d at offset %d (exceeds buffer)", nalSize, offset-4)
+		if uint64(offset)+uint64(nalSize) > uint64(len(avccData)) {
+			return nil, fmt.Errorf("%w: size %d at offset %d exceeds the %d remaining bytes",
+				ErrInvalidNAL, nalSize, offset-4, len(avccData)-offset)
 		}
 
 		// Get NAL unit data
@@ -103,7 +105,7 @@ func ConvertAVCCToAnnexB(avccData []byte, skipSPSPPS ...bool) ([]byte, error) {
 		if skippedSPSPPS > 0 {
 			return nil, fmt.Errorf("only SPS/PPS found in AVCC data (all %d NAL units were config)", skippedSPSPPS)
 		}
-		return nil, fmt.Errorf("no NAL units found in AVCC data")
+		return nil, fmt.Errorf("%w: no NAL units found in AVCC data", ErrInvalidNAL)
 	}
 
 	result := annexB.Bytes()
@@ -233,6 +235,38 @@ func ExtractSPSandPPS(data []byte) (sps, pps []byte, err error) {
 	return sps, pps, nil
 }
 
+// SplitAnnexB splits Annex-B data into NAL units with start codes removed
+func SplitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+
+	appendNAL := func(nal []byte) {
+		// Trailing zeros belong to the next 4-byte start code
+		nal = bytes.TrimRight(nal, "\x00")
+		if len(nal) > 0 {
+			nals = append(nals, nal)
+		}
+	}
+
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0x00 && data[i+1] == 0x00 && data[i+2] == 0x01 {
+			if start >= 0 {
+				appendNAL(data[start:i])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+
+	if start >= 0 && start < len(data) {
+		appendNAL(data[start:])
+	}
+
+	return nals
+}
+
 // GetNALUnitType returns the type of the first NAL unit in the data
 func GetNALUnitType(data []byte) (nalType uint8, err error) {
 	if IsAVCCFormat(data) {
@@ -0,0 +1,543 @@
+package muxer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rapidrtmp/pkg/models"
+)
+
+// liveRestartBackoff is the minimum time between FFmpeg starts for one stream,
+// so a publisher that keeps crashing FFmpeg can't turn into a spawn loop
+const liveRestartBackoff = time.Second
+
+// liveCloseTimeout bounds how long Close waits for FFmpeg to flush the final segment
+const liveCloseTimeout = 10 * time.Second
+
+// maxTimestampGap is the largest forward jump in video timestamps treated as
+// the same timeline; a larger jump, or any jump backwards, restarts FFmpeg at
+// the next keyframe so the new timeline starts a new segment
+const maxTimestampGap = 10 * time.Second
+
+// Container is the segment format a LiveMuxer produces
+type Container string
+
+const (
+	// ContainerTS produces self-contained MPEG-TS segments
+	ContainerTS Container = "ts"
+	// ContainerFMP4 produces fragmented MP4 segments that share an init segment
+	ContainerFMP4 Container = "fmp4"
+)
+
+// LiveSegment is a finished segment produced by a LiveMuxer
+type LiveSegment struct {
+	Data     []byte
+	Duration time.Duration // Media duration reported by FFmpeg
+	Init     []byte        // ContainerFMP4 only: the ftyp and moov boxes needed to decode Data
+
+	// Discontinuity is set on the first segment of a restarted FFmpeg
+	// process, whose timestamps and encoding needn't follow on from the
+	// previous segment
+	Discontinuity bool
+}
+
+// LiveMuxer feeds a stream's frames to one long-running FFmpeg process that
+// cuts segments at keyframes, instead of spawning FFmpeg per segment.
+//
+// Frames are written to FFmpeg's stdin as a continuous FLV stream and FFmpeg's
+// segment muxer reports each finished segment on stdout. Because the process
+// always starts on a keyframe carrying SPS/PPS and only cuts on keyframes,
+// every segment begins with a decodable IDR frame. If FFmpeg exits
+// unexpectedly, frames are dropped until the next keyframe and a new process
+// is started from there.
+type LiveMuxer struct {
+	name            string // Used in log messages
+	container       Container
+	segmentDuration time.Duration
+	onSegment       func(LiveSegment)
+	onResync        func(drift time.Duration) // Optional, called when audio is realigned with video
+	onError         func(err error)           // Optional, called when FFmpeg fails
+	audioOnly       bool                      // Mux only audio, e.g. for an alternate audio rendition
+
+	mu          sync.Mutex
+	proc        *liveProcess
+	audioConfig []byte    // AudioSpecificConfig to use from the next keyframe
+	lastStart   time.Time // When the current or most recent process started
+	lastDTS     int64     // DTS of the last video frame, or audio frame if audioOnly, sent to FFmpeg
+	hasLastDTS  bool
+	av          avSync // Audio timestamp correction for the current process
+	body        bytes.Buffer
+	closed      bool
+}
+
+// liveProcess is one FFmpeg segmenting process
+type liveProcess struct {
+	cmd         *exec.Cmd
+	stdin       io.WriteCloser
+	dir         string // Temporary directory FFmpeg writes segments into
+	container   Container
+	audioConfig []byte // AudioSpecificConfig the process was started with
+	avcConfig   []byte // AVCDecoderConfigurationRecord the process was started with
+	restarted   bool   // Not the stream's first process, so its first segment is a discontinuity
+	onError     func(err error)
+	killed      atomic.Bool // Set by kill, whose exit status isn't a failure of its own
+	done        chan struct{}
+}
+
+// NewLiveMuxer creates a muxer that emits container segments of roughly segmentDuration
+// onSegment is called from a background goroutine, in segment order
+func NewLiveMuxer(name string, container Container, segmentDuration time.Duration, onSegment func(LiveSegment)) *LiveMuxer {
+	return &LiveMuxer{
+		name:            name,
+		container:       container,
+		segmentDuration: segmentDuration,
+		onSegment:       onSegment,
+	}
+}
+
+// SetAudioConfig sets the AAC AudioSpecificConfig for the stream
+// A change takes effect at the next keyframe by restarting FFmpeg
+func (m *LiveMuxer) SetAudioConfig(config []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.audioConfig = config
+}
+
+// SetResyncHandler registers fn to be called, with the drift corrected, each
+// time audio timestamps are realigned with video. Call it before writing frames.
+func (m *LiveMuxer) SetResyncHandler(fn func(drift time.Duration)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onResync = fn
+}
+
+// SetAudioOnly makes the muxer drop video and cut audio-only segments, which
+// can start at any audio frame. Call it before writing frames.
+func (m *LiveMuxer) SetAudioOnly() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.audioOnly = true
+}
+
+// SetErrorHandler registers fn to be called each time FFmpeg fails: it exits
+// unexpectedly, stalls, can't be started or written to, or produces an
+// unreadable segment. Call it before writing frames.
+func (m *LiveMuxer) SetErrorHandler(fn func(err error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onError = fn
+}
+
+// WriteFrame sends a frame to FFmpeg, starting or restarting the process at
+// keyframes as needed. Frames that arrive while no process can run are dropped.
+func (m *LiveMuxer) WriteFrame(frame *models.Frame) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return fmt.Errorf("live muxer for %s is closed", m.name)
+	}
+
+	if m.proc != nil && m.proc.exited() {
+		log.Printf("FFmpeg for stream %s exited unexpectedly, restarting at next keyframe", m.name)
+		m.proc = nil
+	}
+
+	if m.audioOnly {
+		return m.writeAudioOnly(frame)
+	}
+
+	isKeyFrame := frame.IsVideo && frame.IsKeyFrame
+
+	// A new audio config needs a new FLV header, so restart at a keyframe boundary
+	if m.proc != nil && isKeyFrame && !bytes.Equal(m.proc.audioConfig, m.audioConfig) {
+		log.Printf("Audio config changed for stream %s, restarting FFmpeg", m.name)
+		m.proc.finish()
+		m.proc = nil
+	}
+
+	// Likewise for new SPS/PPS, e.g. the encoder changing resolution; the
+	// ingest marks header changes, and in-band parameter sets are compared
+	if m.proc != nil && isKeyFrame {
+		if avcConfig, err := buildAVCDecoderConfigurationRecord([]*models.Frame{frame}); frame.CodecChanged || (err == nil && !bytes.Equal(m.proc.avcConfig, avcConfig)) {
+			log.Printf("Video codec parameters changed for stream %s, restarting FFmpeg", m.name)
+			m.proc.finish()
+			m.proc = nil
+		}
+	}
+
+	// Or a timestamp jump, e.g. an encoder restarting without reconnecting
+	if m.proc != nil && isKeyFrame && m.hasLastDTS {
+		if gap := frame.DTS - m.lastDTS; gap < 0 || gap > maxTimestampGap.Milliseconds() {
+			log.Printf("Timestamps for stream %s jumped by %dms, restarting FFmpeg", m.name, gap)
+			m.proc.finish()
+			m.proc = nil
+		}
+	}
+
+	if m.proc == nil {
+		if !isKeyFrame {
+			return nil // Wait for a keyframe to start from
+		}
+		if !m.lastStart.IsZero() && time.Since(m.lastStart) < liveRestartBackoff {
+			return nil
+		}
+		if err := m.start(frame); err != nil {
+			m.reportError(err)
+			return err
+		}
+	}
+
+	frame, ok := m.syncFrame(frame)
+	if !ok {
+		return nil
+	}
+
+	if err := writeFLVFrame(m.proc.stdin, &m.body, frame, len(m.proc.audioConfig) > 0); err != nil {
+		log.Printf("Failed to write frame to FFmpeg for stream %s: %v", m.name, err)
+		m.reportError(err)
+		m.proc.kill()
+		m.proc = nil
+		return err
+	}
+	if frame.IsVideo {
+		m.lastDTS, m.hasLastDTS = frame.DTS, true
+	}
+
+	return nil
+}
+
+// writeAudioOnly sends an audio frame to FFmpeg in audio-only mode. Every AAC
+// frame is a sync point, so the process can start or restart at any of them.
+// Caller holds m.mu.
+func (m *LiveMuxer) writeAudioOnly(frame *models.Frame) error {
+	if frame.IsVideo {
+		return nil
+	}
+
+	if m.proc != nil && !bytes.Equal(m.proc.audioConfig, m.audioConfig) {
+		log.Printf("Audio config changed for stream %s, restarting FFmpeg", m.name)
+		m.proc.finish()
+		m.proc = nil
+	}
+
+	if m.proc != nil && m.hasLastDTS {
+		if gap := frame.DTS - m.lastDTS; gap < 0 || gap > maxTimestampGap.Milliseconds() {
+			log.Printf("Timestamps for stream %s jumped by %dms, restarting FFmpeg", m.name, gap)
+			m.proc.finish()
+			m.proc = nil
+		}
+	}
+
+	if m.proc == nil {
+		if len(m.audioConfig) == 0 {
+			return nil // Wait for the AAC sequence header
+		}
+		if !m.lastStart.IsZero() && time.Since(m.lastStart) < liveRestartBackoff {
+			return nil
+		}
+		if err := m.start(frame); err != nil {
+			m.reportError(err)
+			return err
+		}
+	}
+
+	if err := writeFLVFrame(m.proc.stdin, &m.body, frame, true); err != nil {
+		log.Printf("Failed to write frame to FFmpeg for stream %s: %v", m.name, err)
+		m.reportError(err)
+		m.proc.kill()
+		m.proc = nil
+		return err
+	}
+	m.lastDTS, m.hasLastDTS = frame.DTS, true
+
+	return nil
+}
+
+// reportError passes an FFmpeg failure to the error handler. Caller holds m.mu.
+func (m *LiveMuxer) reportError(err error) {
+	if m.onError != nil {
+		m.onError(err)
+	}
+}
+
+// syncFrame corrects audio/video drift, returning the frame to write (a copy
+// when its timestamp changes, since frames are shared between subscribers)
+// or false for an audio frame to drop. Caller holds m.mu.
+func (m *LiveMuxer) syncFrame(frame *models.Frame) (*models.Frame, bool) {
+	if frame.IsVideo {
+		if frame.IsKeyFrame {
+			if drift := m.av.keyframe(frame.DTS); drift != 0 {
+				log.Printf("Audio for stream %s drifted %dms from video, resyncing at keyframe", m.name, drift)
+				if m.onResync != nil {
+					m.onResync(time.Duration(drift) * time.Millisecond)
+				}
+			}
+		}
+		return frame, true
+	}
+
+	dts, ok := m.av.audio(frame.DTS)
+	if !ok || dts == frame.DTS {
+		return frame, ok
+	}
+	corrected := *frame
+	corrected.DTS = dts
+	return &corrected, true
+}
+
+// start launches FFmpeg and writes the FLV header for a stream starting at
+// keyFrame, or at any audio frame if audioOnly
+// Caller holds m.mu
+func (m *LiveMuxer) start(keyFrame *models.Frame) error {
+	restarted := !m.lastStart.IsZero()
+	m.lastStart = time.Now()
+	m.av = avSync{} // A new process starts a new timeline
+
+	var avcConfig []byte
+	if !m.audioOnly {
+		var err error
+		avcConfig, err = buildAVCDecoderConfigurationRecord([]*models.Frame{keyFrame})
+		if err != nil {
+			return fmt.Errorf("cannot start FFmpeg for stream %s: %w", m.name, err)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "rapidrtmp-live-")
+	if err != nil {
+		return fmt.Errorf("failed to create segment directory: %w", err)
+	}
+
+	audioConfig := m.audioConfig
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error", // Only show errors
+		"-f", "flv", // Input is H.264 (+ AAC) in FLV with timestamps
+		"-i", "pipe:0", // Read from stdin
+	}
+	if m.audioOnly {
+		args = append(args, "-vn")
+	} else {
+		args = append(args, "-c:v", "copy") // Don't re-encode
+	}
+	if len(audioConfig) > 0 {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-an")
+	}
+	args = append(args, "-f", "segment") // Cut the output into segments
+	pattern := "seg_%d.ts"
+	if m.container == ContainerFMP4 {
+		// Each segment is a complete fragmented MP4; readSegment splits off its header
+		args = append(args,
+			"-segment_format", "mp4",
+			"-segment_format_options", "movflags=+frag_keyframe+empty_moov+default_base_moof",
+		)
+		pattern = "seg_%d.mp4"
+	} else {
+		args = append(args, "-segment_format", "mpegts") // Each segment is MPEG-TS
+	}
+	args = append(args,
+		"-segment_time", strconv.FormatFloat(m.segmentDuration.Seconds(), 'f', 3, 64), // Cut at the first keyframe after this
+		"-reset_timestamps", "0", // Keep timestamps continuous across segments
+		"-segment_list", "pipe:1", // Report finished segments on stdout
+		"-segment_list_type", "csv", // As "filename,start,end" lines
+		filepath.Join(dir, pattern),
+	)
+
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to get stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	proc := &liveProcess{
+		cmd:         cmd,
+		stdin:       stdin,
+		dir:         dir,
+		container:   m.container,
+		audioConfig: audioConfig,
+		avcConfig:   avcConfig,
+		restarted:   restarted,
+		onError:     m.onError,
+		done:        make(chan struct{}),
+	}
+	go proc.readSegments(m.name, stdout, &stderr, m.onSegment)
+
+	if err := writeFLVHeader(stdin, avcConfig, audioConfig, uint32(keyFrame.DTS)); err != nil {
+		proc.kill()
+		return fmt.Errorf("failed to write FLV header to ffmpeg: %w", err)
+	}
+
+	m.proc = proc
+	log.Printf("Started FFmpeg segmenter for stream %s (pid %d)", m.name, cmd.Process.Pid)
+	return nil
+}
+
+// Close stops FFmpeg after it has flushed the final segment
+func (m *LiveMuxer) Close() {
+	m.mu.Lock()
+	m.closed = true
+	proc := m.proc
+	m.proc = nil
+	m.mu.Unlock()
+
+	if proc != nil {
+		proc.finish()
+	}
+}
+
+// readSegments hands each segment FFmpeg reports to onSegment, then reaps the process
+func (p *liveProcess) readSegments(name string, stdout io.Reader, stderr *bytes.Buffer, onSegment func(LiveSegment)) {
+	defer close(p.done)
+	defer os.RemoveAll(p.dir)
+
+	discontinuity := p.restarted
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		segment, err := p.readSegment(scanner.Text())
+		if err != nil {
+			log.Printf("Failed to read FFmpeg segment for stream %s: %v", name, err)
+			p.reportError(err)
+			continue
+		}
+		segment.Discontinuity, discontinuity = discontinuity, false
+		onSegment(segment)
+	}
+
+	if err := p.cmd.Wait(); err != nil {
+		log.Printf("FFmpeg segmenter for stream %s exited: %v (stderr: %s)", name, err, stderr.String())
+		if !p.killed.Load() {
+			p.reportError(err)
+		}
+	}
+}
+
+// reportError passes a failure to the muxer's error handler, if any
+func (p *liveProcess) reportError(err error) {
+	if p.onError != nil {
+		p.onError(err)
+	}
+}
+
+// readSegment loads and removes the segment file named by a csv segment list entry
+func (p *liveProcess) readSegment(entry string) (LiveSegment, error) {
+	fields := strings.Split(entry, ",")
+	if len(fields) < 3 {
+		return LiveSegment{}, fmt.Errorf("malformed segment list entry %q", entry)
+	}
+
+	path := filepath.Join(p.dir, filepath.Base(fields[0]))
+	defer os.Remove(path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return LiveSegment{}, err
+	}
+
+	start, startErr := strconv.ParseFloat(fields[1], 64)
+	end, endErr := strconv.ParseFloat(fields[2], 64)
+	var duration time.Duration
+	if startErr == nil && endErr == nil && end > start {
+		duration = time.Duration((end - start) * float64(time.Second))
+	}
+
+	segment := LiveSegment{Data: data, Duration: duration}
+	if p.container == ContainerFMP4 {
+		segment.Init, segment.Data, err = splitFMP4(data)
+		if err != nil {
+			return LiveSegment{}, err
+		}
+	}
+	return segment, nil
+}
+
+// splitFMP4 splits a fragmented MP4 file into its header (ftyp, moov) and its
+// fragments (moof, mdat, ...) by walking the top-level boxes
+func splitFMP4(data []byte) (init, media []byte, err error) {
+	offset := 0
+	for offset+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		boxType := string(data[offset+4 : offset+8])
+
+		if boxType == "moof" {
+			if offset == 0 {
+				return nil, nil, fmt.Errorf("fragmented MP4 has no header before the first moof")
+			}
+			return data[:offset], data[offset:], nil
+		}
+
+		switch size {
+		case 0: // Box extends to the end of the file
+			size = len(data) - offset
+		case 1: // 64-bit size follows the type
+			if offset+16 > len(data) {
+				return nil, nil, fmt.Errorf("truncated %s box at offset %d", boxType, offset)
+			}
+			size = int(binary.BigEndian.Uint64(data[offset+8 : offset+16]))
+		}
+		if size < 8 {
+			return nil, nil, fmt.Errorf("invalid %s box size %d at offset %d", boxType, size, offset)
+		}
+		offset += size
+	}
+	return nil, nil, fmt.Errorf("fragmented MP4 has no moof box")
+}
+
+// exited reports whether the process has already gone away
+func (p *liveProcess) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish closes stdin so FFmpeg writes out the last segment, killing it if
+// it doesn't exit in time
+func (p *liveProcess) finish() {
+	p.stdin.Close()
+
+	select {
+	case <-p.done:
+	case <-time.After(liveCloseTimeout):
+		log.Printf("FFmpeg (pid %d) did not exit after %s, killing it", p.cmd.Process.Pid, liveCloseTimeout)
+		p.reportError(fmt.Errorf("ffmpeg did not exit within %s", liveCloseTimeout))
+		p.kill()
+	}
+}
+
+// kill terminates the process immediately and waits for it to be reaped
+func (p *liveProcess) kill() {
+	p.killed.Store(true)
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	<-p.done
+}
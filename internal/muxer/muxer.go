@@ -0,0 +1,52 @@
+package muxer
+
+import (
+	"context"
+	"time"
+
+	"rapidrtmp/pkg/models"
+)
+
+// Muxer builds fMP4 init segments from a stream's codec data
+// FFmpegMuxer is the production implementation; the segmenter depends only on
+// this interface so other backends (or fakes) can be swapped in
+type Muxer interface {
+	// CreateInitSegment builds the ftyp/moov init segment from codec data
+	CreateInitSegment(ctx context.Context, videoCodecData, audioCodecData []byte) ([]byte, error)
+}
+
+var _ Muxer = (*FFmpegMuxer)(nil)
+
+// StreamMuxer cuts one live stream's frames into segments, reporting each
+// finished segment to the callback it was created with
+// LiveMuxer is the production implementation
+type StreamMuxer interface {
+	// WriteFrame queues a frame for muxing
+	WriteFrame(frame *models.Frame) error
+
+	// SetAudioConfig sets the AAC AudioSpecificConfig for the stream
+	SetAudioConfig(config []byte)
+
+	// SetAudioOnly drops video and muxes only audio
+	SetAudioOnly()
+
+	// SetResyncHandler registers a callback for audio realigned with video
+	SetResyncHandler(fn func(drift time.Duration))
+
+	// SetErrorHandler registers a callback for muxing failures
+	SetErrorHandler(fn func(err error))
+
+	// Close flushes the last segment and stops muxing
+	Close()
+}
+
+var _ StreamMuxer = (*LiveMuxer)(nil)
+
+// StreamMuxerFactory creates the StreamMuxer for a stream
+// onSegment is called in segment order
+type StreamMuxerFactory func(name string, container Container, segmentDuration time.Duration, onSegment func(LiveSegment)) StreamMuxer
+
+// NewStreamMuxer is the StreamMuxerFactory for LiveMuxer
+func NewStreamMuxer(name string, container Container, segmentDuration time.Duration, onSegment func(LiveSegment)) StreamMuxer {
+	return NewLiveMuxer(name, container, segmentDuration, onSegment)
+}
@@ -0,0 +1,258 @@
+package muxer
+
+import (
+	"fmt"
+)
+
+// SPSInfo holds the stream properties decoded from an H.264 Sequence Parameter Set
+type SPSInfo struct {
+	ProfileIdc      uint8
+	ConstraintFlags uint8 // constraint_set0..5 flags + reserved_zero_2bits
+	LevelIdc        uint8
+	Width           int     // Display width after cropping
+	Height          int     // Display height after cropping
+	FrameRate       float64 // Frames per second from VUI timing (0 if absent)
+}
+
+// CodecString returns the RFC 6381 codec identifier used in HLS CODECS
+// attributes, e.g. "avc1.64001f" for High profile level 3.1
+func (i *SPSInfo) CodecString() string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", i.ProfileIdc, i.ConstraintFlags, i.LevelIdc)
+}
+
+// ParseSPS decodes width, height and frame rate from an H.264 SPS NAL unit
+// (including its one-byte NAL header, as stored in the AVCDecoderConfigurationRecord)
+func ParseSPS(sps []byte) (*SPSInfo, error) {
+	if len(sps) < 4 {
+		return nil, fmt.Errorf("SPS too short: %d bytes", len(sps))
+	}
+	if nalType := sps[0] & 0x1F; nalType != NALUnitTypeSPS {
+		return nil, fmt.Errorf("not an SPS NAL unit (type %d)", nalType)
+	}
+
+	r := &bitReader{data: removeEmulationPrevention(sps[1:])}
+	info := &SPSInfo{}
+
+	info.ProfileIdc = uint8(r.readBits(8))
+	info.ConstraintFlags = uint8(r.readBits(8))
+	info.LevelIdc = uint8(r.readBits(8))
+	r.readUE() // seq_parameter_set_id
+
+	// Chroma subsampling determines the cropping units
+	chromaFormatIdc := uint32(1)
+	separateColourPlane := false
+	switch info.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = r.readUE()
+		if chromaFormatIdc == 3 {
+			separateColourPlane = r.readFlag()
+		}
+		r.readUE()        // bit_depth_luma_minus8
+		r.readUE()        // bit_depth_chroma_minus8
+		r.skipBits(1)     // qpprime_y_zero_transform_bypass_flag
+		if r.readFlag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.readFlag() { // seq_scaling_list_present_flag
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					r.skipScalingList(size)
+				}
+			}
+		}
+	}
+
+	r.readUE()          // log2_max_frame_num_minus4
+	switch r.readUE() { // pic_order_cnt_type
+	case 0:
+		r.readUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skipBits(1) // delta_pic_order_always_zero_flag
+		r.readSE()    // offset_for_non_ref_pic
+		r.readSE()    // offset_for_top_to_bottom_field
+		cycle := r.readUE()
+		for i := uint32(0); i < cycle && r.err == nil; i++ {
+			r.readSE() // offset_for_ref_frame
+		}
+	}
+
+	r.readUE()    // max_num_ref_frames
+	r.skipBits(1) // gaps_in_frame_num_value_allowed_flag
+
+	picWidthInMbs := r.readUE() + 1
+	picHeightInMapUnits := r.readUE() + 1
+	frameMbsOnly := r.readFlag()
+	if !frameMbsOnly {
+		r.skipBits(1) // mb_adaptive_frame_field_flag
+	}
+	r.skipBits(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.readFlag() { // frame_cropping_flag
+		cropLeft = r.readUE()
+		cropRight = r.readUE()
+		cropTop = r.readUE()
+		cropBottom = r.readUE()
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse SPS: %w", r.err)
+	}
+
+	frameHeightFactor := uint32(2)
+	if frameMbsOnly {
+		frameHeightFactor = 1
+	}
+
+	// Crop units per H.264 spec 7.4.2.1.1
+	cropUnitX, cropUnitY := uint32(1), frameHeightFactor
+	if !separateColourPlane && chromaFormatIdc != 0 {
+		subWidthC, subHeightC := uint32(2), uint32(2)
+		switch chromaFormatIdc {
+		case 2:
+			subHeightC = 1
+		case 3:
+			subWidthC, subHeightC = 1, 1
+		}
+		cropUnitX = subWidthC
+		cropUnitY = subHeightC * frameHeightFactor
+	}
+
+	info.Width = int(picWidthInMbs*16 - (cropLeft+cropRight)*cropUnitX)
+	info.Height = int(frameHeightFactor*picHeightInMapUnits*16 - (cropTop+cropBottom)*cropUnitY)
+
+	// Frame rate lives in the optional VUI; a truncated VUI just leaves it unset
+	if r.readFlag() { // vui_parameters_present_flag
+		info.FrameRate = r.readVUIFrameRate()
+	}
+
+	return info, nil
+}
+
+// readVUIFrameRate skips to the VUI timing info and derives the frame rate
+func (r *bitReader) readVUIFrameRate() float64 {
+	if r.readFlag() { // aspect_ratio_info_present_flag
+		if r.readBits(8) == 255 { // aspect_ratio_idc == Extended_SAR
+			r.skipBits(32) // sar_width + sar_height
+		}
+	}
+	if r.readFlag() { // overscan_info_present_flag
+		r.skipBits(1) // overscan_appropriate_flag
+	}
+	if r.readFlag() { // video_signal_type_present_flag
+		r.skipBits(4)     // video_format + video_full_range_flag
+		if r.readFlag() { // colour_description_present_flag
+			r.skipBits(24) // colour_primaries, transfer_characteristics, matrix_coefficients
+		}
+	}
+	if r.readFlag() { // chroma_loc_info_present_flag
+		r.readUE() // chroma_sample_loc_type_top_field
+		r.readUE() // chroma_sample_loc_type_bottom_field
+	}
+	if !r.readFlag() { // timing_info_present_flag
+		return 0
+	}
+
+	numUnitsInTick := r.readBits(32)
+	timeScale := r.readBits(32)
+	if r.err != nil || numUnitsInTick == 0 {
+		return 0
+	}
+
+	// Each frame spans two field ticks
+	return float64(timeScale) / float64(2*numUnitsInTick)
+}
+
+// skipScalingList consumes a scaling_list() of the given size
+func (r *bitReader) skipScalingList(size int) {
+	lastScale, nextScale := int32(8), int32(8)
+	for j := 0; j < size && r.err == nil; j++ {
+		if nextScale != 0 {
+			delta := r.readSE()
+			nextScale = (lastScale + delta + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+}
+
+// removeEmulationPrevention strips the 0x03 bytes inserted after 0x0000 in NAL payloads
+func removeEmulationPrevention(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader reads big-endian bit fields and Exp-Golomb codes.
+// The first read past the end sets err; later reads return zero.
+type bitReader struct {
+	data []byte
+	pos  int // Bit offset
+	err  error
+}
+
+func (r *bitReader) readBits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			if r.err == nil {
+				r.err = fmt.Errorf("unexpected end of data at bit %d", r.pos)
+			}
+			return 0
+		}
+		bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) skipBits(n int) {
+	r.readBits(n)
+}
+
+func (r *bitReader) readFlag() bool {
+	return r.readBits(1) == 1
+}
+
+// readUE reads an unsigned Exp-Golomb code
+func (r *bitReader) readUE() uint32 {
+	leadingZeros := 0
+	for r.readBits(1) == 0 {
+		if r.err != nil || leadingZeros >= 31 {
+			if r.err == nil {
+				r.err = fmt.Errorf("invalid Exp-Golomb code at bit %d", r.pos)
+			}
+			return 0
+		}
+		leadingZeros++
+	}
+	return (1<<leadingZeros - 1) + r.readBits(leadingZeros)
+}
+
+// readSE reads a signed Exp-Golomb code
+func (r *bitReader) readSE() int32 {
+	v := r.readUE()
+	if v%2 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
@@ -0,0 +1,125 @@
+package muxer
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name      string
+		sps       string
+		width     int
+		height    int
+		frameRate float64
+		codec     string
+	}{
+		{
+			// 80x45 macroblocks, VUI timing 1/60, with emulation prevention bytes
+			name:      "baseline 720p30",
+			sps:       "6742c01eed00a00b742000000300200000079080",
+			width:     1280,
+			height:    720,
+			frameRate: 30,
+			codec:     "avc1.42c01e",
+		},
+		{
+			// 120x68 macroblocks cropped by 8 lines, VUI timing 1001/60000
+			name:      "high 1080p29.97",
+			sps:       "67640028acd940780227e58400000fa40003a98210",
+			width:     1920,
+			height:    1080,
+			frameRate: 29.97,
+			codec:     "avc1.640028",
+		},
+		{
+			// Field coded: 18 map units of two macroblock rows each, no VUI
+			name:      "main 576i without VUI",
+			sps:       "674d401eed01684890",
+			width:     720,
+			height:    576,
+			frameRate: 0,
+			codec:     "avc1.4d401e",
+		},
+		{
+			// 4:2:2 chroma crops in single lines vertically
+			name:      "high 4:2:2 1080p25",
+			sps:       "677a0028bcda01e0089f8984000003000400000300ca10",
+			width:     1920,
+			height:    1080,
+			frameRate: 25,
+			codec:     "avc1.7a0028",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParseSPS(mustDecodeHex(t, tt.sps))
+			if err != nil {
+				t.Fatalf("ParseSPS: %v", err)
+			}
+			if info.Width != tt.width || info.Height != tt.height {
+				t.Errorf("resolution = %dx%d, want %dx%d", info.Width, info.Height, tt.width, tt.height)
+			}
+			if math.Abs(info.FrameRate-tt.frameRate) > 0.01 {
+				t.Errorf("frame rate = %.3f, want %.3f", info.FrameRate, tt.frameRate)
+			}
+			if got := info.CodecString(); got != tt.codec {
+				t.Errorf("codec string = %q, want %q", got, tt.codec)
+			}
+		})
+	}
+}
+
+func TestParseSPSErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		sps  string
+	}{
+		{"empty", ""},
+		{"too short", "6742c0"},
+		{"not an SPS", "68ce3c80"},
+		{"truncated before dimensions", "67640028acd9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseSPS(mustDecodeHex(t, tt.sps)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRemoveEmulationPrevention(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"no escapes", "0102030405", "0102030405"},
+		{"escaped zero", "00000300", "000000"},
+		{"escaped one", "00000301", "000001"},
+		{"consecutive escapes", "0000030000030001", "000000000001"},
+		{"03 after a single zero is data", "000301", "000301"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hex.EncodeToString(removeEmulationPrevention(mustDecodeHex(t, tt.in)))
+			if got != tt.want {
+				t.Errorf("removeEmulationPrevention(%s) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package muxer
+
+import "time"
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	// PES timestamps are 33 bits of a 90kHz clock
+	pesClockRate     = 90000
+	pesTimestampWrap = int64(1) << 33
+)
+
+// TSDuration estimates the duration of an MPEG-TS segment from the decode
+// timestamps of its video. head and tail are the start and end of the
+// segment, so a large segment needn't be read whole; both may be the whole
+// segment. The last frame is assumed to last as long as the one before it.
+func TSDuration(head, tail []byte) (time.Duration, bool) {
+	first := videoTimestamps(head)
+	last := videoTimestamps(tail)
+	if len(first) == 0 || len(last) < 2 {
+		return 0, false
+	}
+
+	end := last[len(last)-1]
+	frame := end - last[len(last)-2]
+	if frame < 0 {
+		frame += pesTimestampWrap
+	}
+	span := end - first[0]
+	if span < 0 {
+		span += pesTimestampWrap
+	}
+
+	ticks := span + frame
+	return time.Duration(ticks) * time.Second / pesClockRate, true
+}
+
+// videoTimestamps returns the decode timestamp, or the presentation
+// timestamp when there is no separate DTS, of each video PES packet starting
+// in data. data may begin mid-packet.
+func videoTimestamps(data []byte) []int64 {
+	// Find the packet boundary: a sync byte with another a packet later
+	start := 0
+	for start+tsPacketSize < len(data) {
+		if data[start] == tsSyncByte && data[start+tsPacketSize] == tsSyncByte {
+			break
+		}
+		start++
+	}
+
+	var timestamps []int64
+	videoPID := -1
+	for i := start; i+tsPacketSize <= len(data); i += tsPacketSize {
+		pkt := data[i : i+tsPacketSize]
+		if pkt[0] != tsSyncByte {
+			break // Lost sync; what was read so far is still usable
+		}
+
+		unitStart := pkt[1]&0x40 != 0
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		if !unitStart || (videoPID >= 0 && pid != videoPID) {
+			continue
+		}
+
+		adaptation := (pkt[3] >> 4) & 0x3
+		if adaptation&0x1 == 0 {
+			continue // No payload
+		}
+		offset := 4
+		if adaptation&0x2 != 0 {
+			offset += 1 + int(pkt[4])
+		}
+		if offset+19 > len(pkt) {
+			continue
+		}
+
+		pes := pkt[offset:]
+		if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[3]&0xf0 != 0xe0 {
+			continue // Not a video PES header
+		}
+		videoPID = pid
+
+		switch pes[7] >> 6 {
+		case 0x3:
+			timestamps = append(timestamps, pesTimestamp(pes[14:19]))
+		case 0x2:
+			timestamps = append(timestamps, pesTimestamp(pes[9:14]))
+		}
+	}
+	return timestamps
+}
+
+// pesTimestamp decodes a 33-bit PTS or DTS field
+func pesTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
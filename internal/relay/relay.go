@@ -0,0 +1,390 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/pkg/models"
+)
+
+// StreamKeyPlaceholder in a target URL is replaced by the relayed stream's key
+const StreamKeyPlaceholder = "{streamKey}"
+
+// dialTimeout bounds connecting to an upstream server
+const dialTimeout = 10 * time.Second
+
+// Reconnect backoff after an upstream connection fails, doubled up to the max
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Chunk streams for media messages, as OBS and FFmpeg use them
+const (
+	audioChunkStreamID = 4
+	videoChunkStreamID = 6
+)
+
+// upstreamChunkSize is the chunk size requested for the published stream
+const upstreamChunkSize = 4096
+
+// Relay re-publishes live streams to upstream RTMP servers, e.g. YouTube or
+// a CDN, while they are also segmented locally. Each target gets its own
+// subscription and connection, so a slow or failing upstream neither holds
+// up the source nor the other targets.
+type Relay struct {
+	streamManager *streammanager.Manager
+	targets       []string // Targets for every stream; may contain StreamKeyPlaceholder
+	mu            sync.RWMutex
+
+	ctx    context.Context // Cancelled by Shutdown, closing upstream connections
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // Tracks running forwarders
+}
+
+// New creates a relay that forwards every stream to targets (none to only
+// forward streams whose publish brings its own targets)
+func New(streamManager *streammanager.Manager, targets []string) (*Relay, error) {
+	if err := ValidateTargets(targets); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Relay{
+		streamManager: streamManager,
+		targets:       targets,
+		ctx:           ctx,
+		cancel:        cancel,
+	}, nil
+}
+
+// ValidateTargets checks that each target is an rtmp:// or rtmps:// URL
+// with an app and a stream name
+func ValidateTargets(targets []string) error {
+	for _, raw := range targets {
+		if _, err := parseTarget(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start forwards a stream that just went live to its targets until the
+// stream stops. Targets given for this publish, e.g. by its token, replace
+// the defaults; none uses the defaults.
+func (r *Relay) Start(streamKey string, targets []string) {
+	if len(targets) == 0 {
+		r.mu.RLock()
+		targets = r.targets
+		r.mu.RUnlock()
+	}
+
+	if r.ctx.Err() != nil {
+		return
+	}
+
+	for _, raw := range targets {
+		raw = strings.ReplaceAll(raw, StreamKeyPlaceholder, url.PathEscape(streamKey))
+		upstream, err := parseTarget(raw)
+		if err != nil {
+			log.Printf("Not relaying stream %s: %v", streamKey, err)
+			continue
+		}
+
+		// Start from the cached GOP so the upstream gets a keyframe at once
+		frames, cleanup := r.streamManager.Subscribe(streamKey, streammanager.SubscribeOptions{
+			Policy:  streammanager.DropGOP,
+			Kind:    streammanager.SubscriberInternal,
+			WithGOP: true,
+		})
+
+		f := &forwarder{
+			relay:     r,
+			streamKey: streamKey,
+			upstream:  upstream,
+			frames:    frames,
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer cleanup()
+			f.run()
+		}()
+		log.Printf("Relaying stream %s to %s", streamKey, upstream)
+	}
+}
+
+// Shutdown disconnects all upstreams and waits for the forwarders to exit or
+// ctx to expire
+func (r *Relay) Shutdown(ctx context.Context) error {
+	r.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("relay shutdown: %w", ctx.Err())
+	}
+}
+
+// target is a parsed upstream URL
+type target struct {
+	scheme string // "rtmp" or "rtmps"
+	host   string // host:port
+	app    string
+	name   string // Publishing name, including any query such as a key
+}
+
+// String identifies the upstream in logs without its stream name, which is
+// usually a secret
+func (t target) String() string {
+	return fmt.Sprintf("%s://%s/%s", t.scheme, t.host, t.app)
+}
+
+// parseTarget splits rtmp://host[:port]/app/name into its parts
+func parseTarget(raw string) (target, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return target{}, fmt.Errorf("invalid relay target: %w", err)
+	}
+
+	t := target{scheme: u.Scheme}
+	defaultPort := "1935"
+	switch u.Scheme {
+	case "rtmp":
+	case "rtmps":
+		defaultPort = "443"
+	default:
+		return target{}, fmt.Errorf("relay target %s must use rtmp:// or rtmps://", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return target{}, fmt.Errorf("relay target %s has no host", u.Redacted())
+	}
+	t.host = u.Host
+	if u.Port() == "" {
+		t.host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	app, name, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if app == "" || name == "" {
+		return target{}, fmt.Errorf("relay target %s://%s must be of the form rtmp://host/app/stream", u.Scheme, u.Host)
+	}
+	t.app = app
+	t.name = name
+	if u.RawQuery != "" {
+		t.name += "?" + u.RawQuery
+	}
+	return t, nil
+}
+
+// forwarder publishes one stream to one upstream, reconnecting as needed
+type forwarder struct {
+	relay     *Relay
+	streamKey string
+	upstream  target
+	frames    <-chan *models.Frame
+}
+
+// run connects and forwards frames until the stream stops or the relay shuts down
+func (f *forwarder) run() {
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := f.publish()
+		if err == nil {
+			return // Stream stopped or relay shut down
+		}
+		log.Printf("Relay of stream %s to %s failed: %v", f.streamKey, f.upstream, err)
+
+		// A connection that held up for a while starts the backoff over
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		if !f.wait(delay) {
+			return
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// wait discards frames for d, reporting false if the stream stopped or the
+// relay shut down in the meantime
+func (f *forwarder) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-f.frames:
+			if !ok {
+				return false
+			}
+		case <-timer.C:
+			return true
+		case <-f.relay.ctx.Done():
+			return false
+		}
+	}
+}
+
+// publish runs one upstream connection. It returns nil once there is
+// nothing left to forward, or the error that ended the connection.
+func (f *forwarder) publish() error {
+	conn, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Close the connection on shutdown so a blocked write returns
+	stop := context.AfterFunc(f.relay.ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := conn.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{
+			App:   f.upstream.app,
+			Type:  "nonprivate",
+			TCURL: f.upstream.String(),
+		},
+	}); err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+
+	stream, err := conn.CreateStream(nil, upstreamChunkSize)
+	if err != nil {
+		return fmt.Errorf("createStream failed: %w", err)
+	}
+	defer stream.Close()
+
+	if err := stream.Publish(&rtmpmsg.NetStreamPublish{
+		PublishingName: f.upstream.name,
+		PublishingType: "live",
+	}); err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
+	log.Printf("Connected relay of stream %s to %s", f.streamKey, f.upstream)
+
+	w := &tagWriter{stream: stream}
+	for {
+		select {
+		case frame, ok := <-f.frames:
+			if !ok {
+				log.Printf("Stream %s ended, closing relay to %s", f.streamKey, f.upstream)
+				return nil
+			}
+			if err := w.write(frame, f.audioConfig()); err != nil {
+				return err
+			}
+		case <-f.relay.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// dial opens the RTMP connection to the upstream
+func (f *forwarder) dial() (*rtmp.ClientConn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn *rtmp.ClientConn
+	var err error
+	if f.upstream.scheme == "rtmps" {
+		conn, err = rtmp.DialWithTLSDialer(&tls.Dialer{NetDialer: dialer}, "rtmps", f.upstream.host, &rtmp.ConnConfig{})
+	} else {
+		conn, err = rtmp.DialWithDialer(dialer, "rtmp", f.upstream.host, &rtmp.ConnConfig{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+	return conn, nil
+}
+
+// audioConfig returns the stream's AAC AudioSpecificConfig, or nil before
+// the publisher has sent one
+func (f *forwarder) audioConfig() []byte {
+	stream, ok := f.relay.streamManager.GetStream(f.streamKey)
+	if !ok {
+		return nil
+	}
+	if codec := stream.GetAudioCodec(); codec != nil {
+		return codec.AudioConfig
+	}
+	return nil
+}
+
+// tagWriter re-wraps frames as FLV tags on one upstream connection, sending
+// sequence headers first and again whenever the codec parameters change
+type tagWriter struct {
+	stream      *rtmp.Stream
+	started     bool   // A keyframe and the AVC sequence header were sent
+	baseDTS     int64  // Timestamps restart at 0 on each connection
+	audioConfig []byte // AudioSpecificConfig last sent upstream
+	body        bytes.Buffer
+}
+
+// write sends one frame, waiting for a keyframe to start from
+func (w *tagWriter) write(frame *models.Frame, audioConfig []byte) error {
+	if !w.started {
+		if !frame.IsVideo || !frame.IsKeyFrame {
+			return nil
+		}
+		w.baseDTS = frame.DTS
+	}
+	timestamp := uint32(max(frame.DTS-w.baseDTS, 0))
+
+	if frame.IsVideo && frame.IsKeyFrame && (!w.started || frame.CodecChanged) {
+		header, err := muxer.AVCSequenceHeader(frame)
+		if err != nil {
+			return nil // Can't be decoded upstream without SPS/PPS; try the next keyframe
+		}
+		if err := w.stream.Write(videoChunkStreamID, timestamp, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(header)}); err != nil {
+			return fmt.Errorf("failed to send video sequence header: %w", err)
+		}
+		w.started = true
+	}
+
+	if len(audioConfig) > 0 && !bytes.Equal(audioConfig, w.audioConfig) {
+		header := muxer.AACSequenceHeader(audioConfig)
+		if err := w.stream.Write(audioChunkStreamID, timestamp, &rtmpmsg.AudioMessage{Payload: bytes.NewReader(header)}); err != nil {
+			return fmt.Errorf("failed to send audio sequence header: %w", err)
+		}
+		w.audioConfig = audioConfig
+	}
+
+	if !muxer.FLVTagBody(&w.body, frame) {
+		return nil
+	}
+	// The message is encoded before Write returns, so the buffer can be reused
+	payload := bytes.NewReader(w.body.Bytes())
+
+	var err error
+	if frame.IsVideo {
+		err = w.stream.Write(videoChunkStreamID, timestamp, &rtmpmsg.VideoMessage{Payload: payload})
+	} else {
+		if w.audioConfig == nil {
+			return nil // Raw AAC is useless upstream before its config
+		}
+		err = w.stream.Write(audioChunkStreamID, timestamp, &rtmpmsg.AudioMessage{Payload: payload})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send frame at %dms: %w", timestamp, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Package requestid carries a request's correlation ID through contexts so
+// log lines from the HTTP layer, auth and storage can be tied together.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Header is the HTTP header a request ID is read from and echoed in
+const Header = "X-Request-ID"
+
+// maxLength bounds IDs accepted from clients, which end up in every log line
+const maxLength = 128
+
+type contextKey struct{}
+
+// New returns a random request ID
+func New() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether a client-supplied ID is safe to log and echo:
+// non-empty, bounded, and printable ASCII without spaces
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, "" if there is none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// LogPrefix returns "[req <id>] " for prefixing log lines, "" if ctx carries
+// no request ID
+func LogPrefix(ctx context.Context) string {
+	if id := FromContext(ctx); id != "" {
+		return "[req " + id + "] "
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package rtmp
+
+import (
+	"log"
+	"time"
+)
+
+// admitConnection counts a new connection, or returns false if the server
+// already holds MaxConnections
+func (s *Server) admitConnection() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config.MaxConnections > 0 && s.connections >= s.config.MaxConnections {
+		return false
+	}
+	s.connections++
+	return true
+}
+
+// releaseConnection frees the slot of a closed connection
+func (s *Server) releaseConnection() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connections--
+}
+
+// startPublishTimer closes the connection unless it starts publishing within
+// the publish timeout, so clients that connect and stall, or only handshake,
+// don't hold a connection slot indefinitely
+func (h *ConnHandler) startPublishTimer() {
+	timeout := h.server.config.PublishTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	h.publishTimer = time.AfterFunc(timeout, func() {
+		h.mu.RLock()
+		publishing := h.stream != nil
+		h.mu.RUnlock()
+		if publishing {
+			return
+		}
+
+		log.Printf("Closing RTMP connection from %s: no publish within %s", h.conn.RemoteAddr(), timeout)
+		if h.metrics != nil {
+			h.metrics.RecordRTMPRejected("publish_timeout")
+		}
+		h.conn.Close()
+	})
+}
+
+// stopPublishTimer cancels the publish timeout (caller holds h.mu)
+func (h *ConnHandler) stopPublishTimer() {
+	if h.publishTimer != nil {
+		h.publishTimer.Stop()
+	}
+}
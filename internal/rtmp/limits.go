@@ -0,0 +1,78 @@
+package rtmp
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"rapidrtmp/pkg/models"
+)
+
+// statusPublishRejected tells a publisher its stream was refused by policy
+const statusPublishRejected rtmpmsg.NetStreamOnStatusCode = "NetStream.Publish.Rejected"
+
+// bitrateWarmup is how long a stream publishes before its bitrate is
+// enforced, so the rolling average covers a full window rather than the
+// burst of the first keyframe
+const bitrateWarmup = 5 * time.Second
+
+// checkResolution rejects a publish whose SPS describes video larger than
+// the configured cap. Width and height are compared regardless of
+// orientation, so a 1920x1080 cap also admits 1080x1920.
+func (h *ConnHandler) checkResolution(stream *models.Stream) error {
+	limits := h.server.config
+	if limits.MaxWidth <= 0 || limits.MaxHeight <= 0 {
+		return nil
+	}
+
+	codec := stream.GetVideoCodec()
+	if codec == nil || codec.Width == 0 || codec.Height == 0 {
+		return nil // SPS couldn't be parsed; nothing to enforce
+	}
+
+	long, short := max(codec.Width, codec.Height), min(codec.Width, codec.Height)
+	capLong, capShort := max(limits.MaxWidth, limits.MaxHeight), min(limits.MaxWidth, limits.MaxHeight)
+	if long <= capLong && short <= capShort {
+		return nil
+	}
+
+	return h.rejectPublish(stream, "resolution", fmt.Sprintf("Resolution %dx%d exceeds the %dx%d limit.",
+		codec.Width, codec.Height, limits.MaxWidth, limits.MaxHeight))
+}
+
+// checkBitrate rejects a publish whose rolling bitrate exceeds the configured cap
+func (h *ConnHandler) checkBitrate(stream *models.Stream) error {
+	limit := h.server.config.MaxBitrate
+	if limit <= 0 || stream.Uptime() < bitrateWarmup {
+		return nil
+	}
+
+	bitrate := stream.GetStats().Bitrate
+	if bitrate <= limit {
+		return nil
+	}
+
+	return h.rejectPublish(stream, "bitrate", fmt.Sprintf("Bitrate %d kbps exceeds the %d kbps limit.", bitrate/1000, limit/1000))
+}
+
+// rejectPublish tells the publisher why its stream is refused and returns an
+// error, which ends the connection; OnClose then stops the stream
+func (h *ConnHandler) rejectPublish(stream *models.Stream, reason, description string) error {
+	log.Printf("Rejecting publish of stream %s: %s", stream.Key, description)
+	if h.metrics != nil {
+		h.metrics.RecordIngestRejected(reason)
+	}
+
+	h.mu.RLock()
+	conn, streamID := h.rtmpConn, h.streamID
+	h.mu.RUnlock()
+
+	if conn != nil {
+		if err := notifyStatus(conn, streamID, rtmpmsg.NetStreamOnStatusLevelError, statusPublishRejected, description); err != nil {
+			log.Printf("Failed to send rejection status for stream %s: %v", stream.Key, err)
+		}
+	}
+	return fmt.Errorf("publish of stream %s rejected: %s", stream.Key, description)
+}
@@ -0,0 +1,92 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strconv"
+
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"rapidrtmp/pkg/models"
+)
+
+// timedDataMessages are the AMF data messages publishers use for timed
+// metadata, such as cue points marking ad breaks
+var timedDataMessages = []string{"onCuePoint", "onTextData"}
+
+func init() {
+	// go-rtmp drops data messages it has no decoder for before they reach
+	// the handler. A decoder that leaves the body unread lets them through
+	// to OnUnknownDataMessage, which decodes them itself.
+	for _, name := range timedDataMessages {
+		rtmpmsg.DataBodyDecoders[name] = func(io.Reader, rtmpmsg.AMFDecoder, *rtmpmsg.AMFConvertible) error {
+			return nil
+		}
+	}
+}
+
+// OnUnknownDataMessage is called for data messages other than
+// @setDataFrame; timed metadata is added to the stream's playlist
+func (h *ConnHandler) OnUnknownDataMessage(timestamp uint32, data *rtmpmsg.DataMessage) error {
+	h.mu.RLock()
+	stream := h.stream
+	streamKey := h.streamKey
+	h.mu.RUnlock()
+
+	if stream == nil || h.segmenter == nil || data.Encoding != rtmpmsg.EncodingTypeAMF0 {
+		return nil
+	}
+
+	attributes := make(map[string]string)
+	dec := rtmpmsg.NewAMFDecoder(data.Body, data.Encoding)
+	for i := 0; ; i++ {
+		var arg interface{}
+		if err := dec.Decode(&arg); err != nil {
+			break
+		}
+		flattenAMF(attributes, argName(i), arg)
+	}
+
+	md, err := h.segmenter.AddMetadata(streamKey, models.TimedMetadata{Class: data.Name, Attributes: attributes})
+	if err != nil {
+		log.Printf("Failed to add %s metadata to stream %s: %v", data.Name, streamKey, err)
+		return nil
+	}
+
+	log.Printf("Added %s metadata %s to stream %s", data.Name, md.ID, streamKey)
+	return nil
+}
+
+// argName names a data message argument that isn't an object
+func argName(i int) string {
+	if i == 0 {
+		return "value"
+	}
+	return "value-" + strconv.Itoa(i)
+}
+
+// flattenAMF adds a decoded AMF value to attrs. Object properties become
+// attributes of their own, so nested cue point parameters are kept; other
+// values are stored under name.
+func flattenAMF(attrs map[string]string, name string, v interface{}) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String {
+		iter := rv.MapRange()
+		for iter.Next() {
+			flattenAMF(attrs, iter.Key().String(), iter.Value().Interface())
+		}
+		return
+	}
+
+	switch v := v.(type) {
+	case nil:
+	case string:
+		attrs[name] = v
+	case float64:
+		attrs[name] = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		attrs[name] = fmt.Sprint(v)
+	}
+}
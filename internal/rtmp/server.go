@@ -1,39 +1,85 @@
 package rtmp
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/yutopp/go-rtmp"
 	rtmpmsg "github.com/yutopp/go-rtmp/message"
 
 	"rapidrtmp/internal/auth"
+	"rapidrtmp/internal/metrics"
 	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/relay"
+	"rapidrtmp/internal/requestid"
 	"rapidrtmp/internal/segmenter"
 	"rapidrtmp/internal/streammanager"
 	"rapidrtmp/pkg/models"
 )
 
+// Config tunes the RTMP protocol for the server's connections
+type Config struct {
+	ChunkSize       uint32 // Outgoing chunk size; 0 or 128 keeps the protocol default
+	BandwidthWindow int32  // Peer bandwidth window sent to publishers; 0 uses the default
+
+	// Ingest limits; publishers exceeding them are disconnected. Zero means unlimited.
+	MaxBitrate int // Bits per second, averaged over the stream's rolling window
+	MaxWidth   int // Resolution cap, applied in either orientation
+	MaxHeight  int
+
+	// Connection limits, against floods of idle or handshake-only clients. Zero means unlimited.
+	MaxConnections int           // Concurrent RTMP and RTMPS connections; further ones are closed at once
+	PublishTimeout time.Duration // Connections that haven't published by then are closed
+}
+
+// defaultBandwidthWindow is used when Config.BandwidthWindow is unset
+const defaultBandwidthWindow = 6 * 1024 * 1024 // 6MB
+
 // Server represents the RTMP server
 type Server struct {
 	addr          string
+	config        Config
 	streamManager *streammanager.Manager
 	authManager   *auth.Manager
 	segmenter     *segmenter.Segmenter
+	metrics       *metrics.Metrics
 	server        *rtmp.Server
 	mu            sync.RWMutex
+
+	// RTMPS listener, set by EnableTLS
+	tlsAddr   string
+	tlsConfig *tls.Config
+	tlsServer *rtmp.Server
+
+	appInStreamKey bool         // Prefix stream keys with the RTMP app name
+	relay          *relay.Relay // Optional, may be nil
+	connections    int          // Open connections, counted against MaxConnections
 }
 
 // New creates a new RTMP server
-func New(addr string, streamManager *streammanager.Manager, authManager *auth.Manager, seg *segmenter.Segmenter) *Server {
+// addr may be empty to serve only RTMPS (see EnableTLS)
+func New(addr string, streamManager *streammanager.Manager, authManager *auth.Manager, seg *segmenter.Segmenter, m *metrics.Metrics, cfg Config) *Server {
+	if cfg.BandwidthWindow == 0 {
+		cfg.BandwidthWindow = defaultBandwidthWindow
+	}
+
 	s := &Server{
 		addr:          addr,
+		config:        cfg,
 		streamManager: streamManager,
 		authManager:   authManager,
 		segmenter:     seg,
+		metrics:       m,
 	}
 
 	// Create RTMP server with handler
@@ -44,47 +90,182 @@ func New(addr string, streamManager *streammanager.Manager, authManager *auth.Ma
 	return s
 }
 
-// ListenAndServe starts the RTMP server
+// EnableTLS adds an RTMPS listener on addr using a PEM certificate and key
+// It runs alongside the plain RTMP listener, if any
+func (s *Server) EnableTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load RTMPS certificate: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tlsAddr = addr
+	s.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	s.tlsServer = rtmp.NewServer(&rtmp.ServerConfig{
+		OnConnect: s.onConnect,
+	})
+	return nil
+}
+
+// SetAppInStreamKey controls whether the RTMP app name is part of the stream key.
+// When enabled, publishing "key" to rtmp://host/live creates stream "live/key".
+func (s *Server) SetAppInStreamKey(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appInStreamKey = enabled
+}
+
+// SetRelay forwards published streams to upstream RTMP servers
+func (s *Server) SetRelay(r *relay.Relay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.relay = r
+}
+
+// streamKeyFor builds and validates the stream key for a publishing name under an app
+func (s *Server) streamKeyFor(app, name string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := models.ValidateStreamKey(name); err != nil {
+		return "", err
+	}
+
+	app = strings.Trim(app, "/")
+	if !s.appInStreamKey || app == "" {
+		return name, nil
+	}
+
+	if err := models.ValidateStreamKey(app); err != nil {
+		return "", fmt.Errorf("app name: %w", err)
+	}
+	return app + "/" + name, nil
+}
+
+// ListenAndServe starts the RTMP listener and, if enabled, the RTMPS listener
+// It returns nil once the server has been closed via Close
 func (s *Server) ListenAndServe() error {
-	log.Printf("Starting RTMP server on %s", s.addr)
+	s.mu.RLock()
+	tlsAddr, tlsConfig, tlsServer := s.tlsAddr, s.tlsConfig, s.tlsServer
+	s.mu.RUnlock()
 
-	listener, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	type endpoint struct {
+		server   *rtmp.Server
+		listener net.Listener
+	}
+	var endpoints []endpoint
+	closeAll := func() {
+		for _, e := range endpoints {
+			e.listener.Close()
+		}
+	}
+
+	if s.addr != "" {
+		log.Printf("Starting RTMP server on %s", s.addr)
+		listener, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+		}
+		endpoints = append(endpoints, endpoint{s.server, listener})
+		log.Printf("RTMP server listening on %s", s.addr)
+	}
+
+	if tlsServer != nil {
+		log.Printf("Starting RTMPS server on %s", tlsAddr)
+		listener, err := net.Listen("tcp", tlsAddr)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("failed to listen on %s: %w", tlsAddr, err)
+		}
+		endpoints = append(endpoints, endpoint{tlsServer, tls.NewListener(listener, tlsConfig)})
+		log.Printf("RTMPS server listening on %s", tlsAddr)
+	}
+
+	if len(endpoints) == 0 {
+		return errors.New("no RTMP or RTMPS listener configured")
 	}
 
-	log.Printf("RTMP server listening on %s", s.addr)
+	errCh := make(chan error, len(endpoints))
+	for _, e := range endpoints {
+		go func() {
+			errCh <- e.server.Serve(e.listener)
+		}()
+	}
 
-	return s.server.Serve(listener)
+	for range endpoints {
+		if err := <-errCh; err != nil && !errors.Is(err, rtmp.ErrClosed) {
+			closeAll()
+			return err
+		}
+	}
+	return nil
 }
 
 // onConnect handles new RTMP connections
 func (s *Server) onConnect(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
-	log.Printf("New RTMP connection from %s", conn.RemoteAddr())
+	if _, secure := conn.(*tls.Conn); secure {
+		log.Printf("New RTMPS connection from %s", conn.RemoteAddr())
+	} else {
+		log.Printf("New RTMP connection from %s", conn.RemoteAddr())
+	}
+
+	if s.metrics != nil {
+		s.metrics.RecordRTMPConnection()
+	}
+
+	if !s.admitConnection() {
+		log.Printf("Refusing RTMP connection from %s: %d connections open", conn.RemoteAddr(), s.config.MaxConnections)
+		if s.metrics != nil {
+			s.metrics.RecordRTMPRejected("max_connections")
+		}
+		// go-rtmp serves whatever is returned; a closed connection ends at the handshake
+		conn.Close()
+		return conn, nil
+	}
+
+	s.mu.RLock()
+	relay := s.relay
+	s.mu.RUnlock()
 
 	handler := &ConnHandler{
 		server:        s,
 		streamManager: s.streamManager,
 		authManager:   s.authManager,
 		segmenter:     s.segmenter,
+		relay:         relay,
+		metrics:       s.metrics,
 		conn:          conn,
 	}
+	handler.startPublishTimer()
 
 	return conn, &rtmp.ConnConfig{
 		Handler: handler,
 
 		ControlState: rtmp.StreamControlStateConfig{
-			DefaultBandwidthWindowSize: 6 * 1024 * 1024, // 6MB
+			DefaultBandwidthWindowSize: s.config.BandwidthWindow,
 		},
 	}
 }
 
-// Close gracefully shuts down the RTMP server
+// Close stops accepting new RTMP and RTMPS connections
 func (s *Server) Close() error {
+	s.mu.RLock()
+	tlsServer := s.tlsServer
+	s.mu.RUnlock()
+
+	var errs []error
 	if s.server != nil {
-		return s.server.Close()
+		errs = append(errs, s.server.Close())
 	}
-	return nil
+	if tlsServer != nil {
+		errs = append(errs, tlsServer.Close())
+	}
+	return errors.Join(errs...)
 }
 
 // ConnHandler handles RTMP connection events
@@ -95,27 +276,66 @@ type ConnHandler struct {
 	streamManager *streammanager.Manager
 	authManager   *auth.Manager
 	segmenter     *segmenter.Segmenter
+	relay         *relay.Relay
+	metrics       *metrics.Metrics
 	conn          net.Conn
+	rtmpConn      *rtmp.Conn // Set in OnServe, used to notify and disconnect the publisher
+	streamID      uint32     // Message stream of the current publish, for onStatus messages
+	app           string     // RTMP application from the connect command
 	streamKey     string
 	stream        *models.Stream
 	publishToken  string
-	sps           [][]byte // H.264 Sequence Parameter Sets
-	pps           [][]byte // H.264 Picture Parameter Sets
-	naluLength    int      // NALU length size from AVCC
+	release       func() // Unbinds the publish from its token in the auth manager
+	codec         codecState
+	rejectedAudio string      // Unsupported audio codec already reported for this publish
+	publishTimer  *time.Timer // Closes the connection if it doesn't publish in time
+	timestamps    timestampNormalizer
 	mu            sync.RWMutex
 }
 
 // OnServe is called when the connection starts serving
 func (h *ConnHandler) OnServe(conn *rtmp.Conn) {
 	log.Printf("Connection started serving")
+
+	h.mu.Lock()
+	h.rtmpConn = conn
+	h.mu.Unlock()
+
+	if chunkSize := h.server.config.ChunkSize; chunkSize > rtmp.DefaultChunkSize {
+		if err := setChunkSize(conn, chunkSize); err != nil {
+			log.Printf("Failed to set RTMP chunk size to %d: %v", chunkSize, err)
+		}
+	}
+}
+
+// setChunkSize switches the connection's outgoing chunk size and tells the peer
+// The peer's incoming chunk size is unaffected; it announces its own.
+func setChunkSize(conn *rtmp.Conn, chunkSize uint32) error {
+	streamer := conn.GetChunkStreamer()
+
+	// Nothing has been written yet, so the new size applies from the first message
+	if err := streamer.SelfState().SetChunkSize(chunkSize); err != nil {
+		return err
+	}
+	return conn.Write(context.Background(), controlChunkStreamID, 0, &rtmp.ChunkMessage{
+		StreamID: 0,
+		Message:  &rtmpmsg.SetChunkSize{ChunkSize: chunkSize},
+	})
 }
 
+// controlChunkStreamID is the chunk stream reserved for protocol control messages
+const controlChunkStreamID = 2
+
 // OnConnect is called when RTMP connect command is received
 func (h *ConnHandler) OnConnect(timestamp uint32, cmd *rtmpmsg.NetConnectionConnect) error {
 	log.Printf("OnConnect: app=%s, tcUrl=%s", cmd.Command.App, cmd.Command.TCURL)
 
-	// Extract app name (stream path)
+	// Remember the app name (stream path)
 	// The app is typically the path after the domain, e.g., "live" in rtmp://server/live/streamkey
+	h.mu.Lock()
+	h.app = cmd.Command.App
+	h.mu.Unlock()
+
 	return nil
 }
 
@@ -132,31 +352,36 @@ func (h *ConnHandler) OnPublish(ctx *rtmp.StreamContext, timestamp uint32, cmd *
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	// Only one publish per connection at a time; a new one replaces the old
+	if h.stream != nil {
+		log.Printf("New publish on connection replaces stream %s", h.streamKey)
+		h.stopPublishing()
+	}
+
 	// Parse stream key and token from publishing name
 	// Format: "streamkey?token=xxx" or just "streamkey"
-	streamKey, token := parseStreamKeyAndToken(cmd.PublishingName)
+	name, token := parseStreamKeyAndToken(cmd.PublishingName)
+	streamKey, err := h.server.streamKeyFor(h.app, name)
+	if err != nil {
+		log.Printf("Rejecting publish with invalid stream key %q: %v", cmd.PublishingName, err)
+		return err
+	}
 	h.streamKey = streamKey
 	h.publishToken = token
 
-	// Validate token if provided
-	if token != "" {
-		clientIP := h.conn.RemoteAddr().String()
-		if err := h.authManager.ValidateToken(token, streamKey, clientIP); err != nil {
-			log.Printf("Token validation failed for stream %s: %v", streamKey, err)
-			return fmt.Errorf("authentication failed: %w", err)
-		}
-
-		// Mark token as used
-		h.authManager.MarkTokenUsed(token)
-		log.Printf("Token validated successfully for stream %s", streamKey)
-	} else {
-		log.Printf("Warning: No token provided for stream %s", streamKey)
-		// For now, allow publishing without token for testing
-		// In production, you should enforce token validation
+	// Authorize via publish token and/or the external auth webhook. The
+	// publish gets a request ID so its auth log lines and webhook call can
+	// be correlated.
+	clientIP := h.conn.RemoteAddr().String()
+	authCtx := requestid.NewContext(context.Background(), requestid.New())
+	opts, err := h.authManager.AuthorizePublish(authCtx, streamKey, token, clientIP)
+	if err != nil {
+		log.Printf("%sPublish authorization failed for stream %s: %v", requestid.LogPrefix(authCtx), streamKey, err)
+		return fmt.Errorf("authentication failed: %w", err)
 	}
+	log.Printf("%sPublish authorized for stream %s", requestid.LogPrefix(authCtx), streamKey)
 
 	// Create or get stream in stream manager
-	clientIP := h.conn.RemoteAddr().String()
 	stream, err := h.streamManager.CreateStream(streamKey, clientIP)
 	if err != nil {
 		log.Printf("Failed to create stream %s: %v", streamKey, err)
@@ -164,22 +389,69 @@ func (h *ConnHandler) OnPublish(ctx *rtmp.StreamContext, timestamp uint32, cmd *
 	}
 
 	h.stream = stream
+	h.streamID = ctx.StreamID
+	h.stopPublishTimer()
 	stream.SetState(models.StreamStateLive)
+	go h.watchStream(stream, ctx.StreamID)
+
+	// Let the token be rotated or revoked while the stream is live
+	h.release = h.authManager.BindPublish(streamKey, token)
+
+	// Recover SPS/PPS from a previous session so keyframes are decodable
+	// before (or without) a fresh sequence header
+	if config, ok := h.streamManager.GetVideoConfig(streamKey); ok {
+		h.codec = codecState{sps: config.SPS, pps: config.PPS, naluLength: config.NALULength}
+		log.Printf("Restored SPS/PPS for stream %s from previous session", streamKey)
+	}
 
-	// Start HLS segmentation for this stream
+	// Start HLS segmentation for this stream, with the settings its token asked for
 	if h.segmenter != nil {
+		if err := h.applyPublishOptions(streamKey, opts); err != nil {
+			log.Printf("Rejecting publish of stream %s: %v", streamKey, err)
+			h.stopPublishing()
+			return err
+		}
 		if err := h.segmenter.StartSegmenting(streamKey); err != nil {
 			log.Printf("Failed to start segmentation for stream %s: %v", streamKey, err)
-		} else {
-			log.Printf("Started HLS segmentation for stream %s", streamKey)
+			h.stopPublishing()
+			return fmt.Errorf("failed to start segmentation: %w", err)
 		}
 	}
 
+	// Only now is the stream playable, so integrators are told it started
+	h.streamManager.AnnounceStream(streamKey)
+
+	// Forward to upstream servers, independently of the publisher's connection
+	if h.relay != nil {
+		h.relay.Start(streamKey, opts.RelayTargets)
+	}
+
 	log.Printf("Stream %s is now live from %s", streamKey, clientIP)
 
 	return nil
 }
 
+// applyPublishOptions sets the per-stream settings of the token that
+// authorized a publish, returning the stream to the server defaults for any
+// it didn't ask for
+func (h *ConnHandler) applyPublishOptions(streamKey string, opts models.PublishOptions) error {
+	if err := h.segmenter.SetStreamTenant(streamKey, opts.Tenant); err != nil {
+		return err
+	}
+
+	if opts.AudioTrack == nil {
+		h.segmenter.ClearAudioTrack(streamKey)
+	} else if err := h.segmenter.SetAudioTrack(streamKey, segmenter.AudioTrackFromRequest(*opts.AudioTrack)); err != nil {
+		return err
+	}
+
+	if !opts.HasHLSOverrides() {
+		h.segmenter.ClearStreamConfig(streamKey)
+		return nil
+	}
+	return h.segmenter.SetStreamConfig(streamKey, h.segmenter.PublishConfig(opts))
+}
+
 // OnSetDataFrame is called when metadata is received
 func (h *ConnHandler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDataFrame) error {
 	log.Printf("OnSetDataFrame received")
@@ -196,6 +468,23 @@ func (h *ConnHandler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSe
 	return nil
 }
 
+// maxMessageSize is the largest RTMP message body; its length is a 24-bit field
+const maxMessageSize = 1<<24 - 1
+
+// readMessage reads a media message body in full. go-rtmp hands over the
+// reassembled message as a reader, but a single Read may return only part
+// of it, so read until EOF rather than trusting one call.
+func readMessage(payload io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(payload, maxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	if len(data) > maxMessageSize {
+		return nil, fmt.Errorf("message exceeds %d bytes", maxMessageSize)
+	}
+	return data, nil
+}
+
 // OnAudio is called when audio data is received
 func (h *ConnHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 	h.mu.RLock()
@@ -207,33 +496,152 @@ func (h *ConnHandler) OnAudio(timestamp uint32, payload io.Reader) error {
 		return nil // Ignore audio before stream is created
 	}
 
-	// Read raw audio data
-	audioData := make([]byte, 4096) // Buffer for audio data
-	n, err := payload.Read(audioData)
-	if err != nil && err != io.EOF {
+	audioData, err := readMessage(payload)
+	if err != nil {
 		return err
 	}
+	n := len(audioData)
 
-	if n > 0 {
-		// Create frame and publish to stream manager
-		frame := &models.Frame{
-			StreamKey:  streamKey,
-			IsVideo:    false,
-			Timestamp:  timestamp,
-			Payload:    audioData[:n],
-			Codec:      "aac", // Assume AAC for now
-			IsKeyFrame: false,
-		}
+	if h.metrics != nil {
+		h.metrics.RecordRTMPBytes(uint64(n))
+	}
+
+	if n == 0 {
+		return nil
+	}
 
-		// Publish frame to subscribers
-		if err := h.streamManager.PublishFrame(frame); err != nil {
-			log.Printf("Failed to publish audio frame: %v", err)
+	soundFormat, isSequenceHeader, data, err := muxer.ParseFLVAudioPacket(audioData)
+	if err != nil {
+		log.Printf("Failed to parse audio packet for stream %s: %v", streamKey, err)
+		return nil
+	}
+
+	if h.metrics != nil {
+		h.metrics.RecordFrame(streamKey, false, n)
+	}
+
+	if codec := audioCodecName(soundFormat); !muxer.SupportsAudioCodec(codec) {
+		h.rejectAudio(streamKey, codec)
+		return nil
+	}
+
+	// AAC sequence header carries the AudioSpecificConfig; it is not a frame
+	if isSequenceHeader {
+		config, err := muxer.ParseAudioSpecificConfig(data)
+		if err != nil {
+			log.Printf("Failed to parse AAC config for stream %s: %v", streamKey, err)
+			return nil
 		}
+		h.updateAudioCodec(stream, config, append([]byte(nil), data...))
+		return nil
+	}
+
+	// Some publishers send ADTS-framed AAC; strip the headers so every frame is raw
+	if !muxer.HasADTSHeader(data) {
+		h.publishAudio(streamKey, timestamp, "aac", data)
+		return nil
+	}
+
+	rawFrames, err := muxer.StripADTS(data)
+	if err != nil {
+		log.Printf("Failed to strip ADTS headers for stream %s: %v", streamKey, err)
+		return nil
+	}
+	config, _, err := muxer.ParseADTSHeader(data)
+	if err != nil {
+		log.Printf("Failed to parse ADTS header for stream %s: %v", streamKey, err)
+		return nil
+	}
+	if stream.GetAudioCodec() == nil {
+		// No sequence header was sent; derive the config from the ADTS header
+		h.updateAudioCodec(stream, config, config.Bytes())
+	}
+	for i, raw := range rawFrames {
+		h.publishAudio(streamKey, adtsFrameTimestamp(timestamp, i, config.SampleRate), "aac", raw)
 	}
 
 	return nil
 }
 
+// adtsFrameTimestamp returns the timestamp of the i-th AAC frame of a message
+// holding several ADTS frames: the message timestamp is the first frame's,
+// and each frame after it starts AACFrameSamples samples later
+func adtsFrameTimestamp(timestamp uint32, i, sampleRate int) uint32 {
+	return timestamp + uint32(i*muxer.AACFrameSamples*1000/sampleRate)
+}
+
+// rejectAudio drops an audio frame the muxer can't handle, reporting the
+// codec once per publish so the publisher's misconfiguration is visible
+func (h *ConnHandler) rejectAudio(streamKey, codec string) {
+	if h.metrics != nil {
+		h.metrics.RecordFrameDropped(streamKey, "unsupported_audio_codec")
+	}
+
+	h.mu.Lock()
+	reported := h.rejectedAudio == codec
+	h.rejectedAudio = codec
+	h.mu.Unlock()
+
+	if !reported {
+		log.Printf("Stream %s sends %s audio, which is not supported; only AAC is muxed, so its audio is dropped", streamKey, codec)
+	}
+}
+
+// publishAudio publishes a single audio frame to the stream manager
+func (h *ConnHandler) publishAudio(streamKey string, timestamp uint32, codec string, payload []byte) {
+	frame := &models.Frame{
+		StreamKey:  streamKey,
+		IsVideo:    false,
+		Timestamp:  timestamp,
+		DTS:        h.normalizeTimestamp(timestamp, false),
+		Payload:    payload,
+		Codec:      codec,
+		IsKeyFrame: false,
+		ReceivedAt: time.Now(),
+	}
+
+	if err := h.streamManager.PublishFrame(frame); err != nil {
+		log.Printf("Failed to publish audio frame: %v", err)
+	}
+}
+
+// updateAudioCodec records the stream's AAC configuration
+func (h *ConnHandler) updateAudioCodec(stream *models.Stream, config *muxer.AudioSpecificConfig, raw []byte) {
+	stream.SetAudioCodec(&models.CodecInfo{
+		Codec:       "aac",
+		CodecString: config.CodecString(),
+		AudioConfig: raw,
+		SampleRate:  config.SampleRate,
+		Channels:    int(config.ChannelConfig),
+	})
+	log.Printf("Stream %s audio: AAC object type %d, %d Hz, %d channels",
+		stream.Key, config.ObjectType, config.SampleRate, config.ChannelConfig)
+}
+
+// audioCodecName maps an FLV sound format to a codec name
+func audioCodecName(soundFormat uint8) string {
+	switch soundFormat {
+	case muxer.FLVSoundFormatAAC:
+		return "aac"
+	case muxer.FLVSoundFormatMP3, muxer.FLVSoundFormatMP38kHz:
+		return "mp3"
+	case muxer.FLVSoundFormatSpeex:
+		return "speex"
+	case muxer.FLVSoundFormatNellymoser16kHz, muxer.FLVSoundFormatNellymoser8kHz, muxer.FLVSoundFormatNellymoser:
+		return "nellymoser"
+	case muxer.FLVSoundFormatPCMPlatform, muxer.FLVSoundFormatPCM:
+		return "pcm"
+	case muxer.FLVSoundFormatADPCM:
+		return "adpcm"
+	case muxer.FLVSoundFormatG711ALaw:
+		return "pcm_alaw"
+	case muxer.FLVSoundFormatG711MuLaw:
+		return "pcm_mulaw"
+	default:
+		return fmt.Sprintf("flv-audio-%d", soundFormat)
+	}
+}
+
 // OnVideo is called when video data is received
 func (h *ConnHandler) OnVideo(timestamp uint32, payload io.Reader) error {
 	h.mu.RLock()
@@ -245,104 +653,81 @@ func (h *ConnHandler) OnVideo(timestamp uint32, payload io.Reader) error {
 		return nil // Ignore video before stream is created
 	}
 
-	// Read raw video data
-	videoData := make([]byte, 65536) // Larger buffer for video data
-	n, err := payload.Read(videoData)
-	if err != nil && err != io.EOF {
+	videoData, err := readMessage(payload)
+	if err != nil {
 		return err
 	}
+	n := len(videoData)
+	receivedAt := time.Now()
+
+	if h.metrics != nil {
+		h.metrics.RecordRTMPBytes(uint64(n))
+	}
 
 	if n == 0 {
 		return nil
 	}
 
-	// Parse FLV video packet
-	isSequenceHeader, isKeyFrame, avcData, err := muxer.ParseFLVVideoPacket(videoData[:n])
+	// A sequence header updates the codec state, so hold h.mu throughout
+	h.mu.Lock()
+	hadParameterSets := h.codec.hasParameterSets()
+	frame, avcConfig, err := processVideoPacket(videoData, &h.codec)
+	codecChanged := h.codec.changed
+	h.mu.Unlock()
+
 	if err != nil {
-		log.Printf("Failed to parse FLV video packet: %v", err)
+		log.Printf("[%s] Skipping video packet: %v", streamKey, err)
+		if h.metrics != nil {
+			reason := "invalid_packet"
+			if errors.Is(err, muxer.ErrInvalidNAL) {
+				reason = "invalid_nal"
+			}
+			h.metrics.RecordFrameDropped(streamKey, reason)
+		}
 		return nil // Don't fail, just skip this packet
 	}
 
-	// DEBUG: Log first video packet details
-	h.mu.RLock()
-	hasSPS := len(h.sps) > 0
-	h.mu.RUnlock()
-	if !hasSPS {
-		// Log details of first few packets to debug OBS
-		log.Printf("[%s] First video packet: size=%d, isSeqHeader=%v, isKeyFrame=%v, avcDataSize=%d, header=[%02x %02x %02x %02x %02x]",
-			streamKey, n, isSequenceHeader, isKeyFrame, len(avcData),
-			videoData[0], videoData[1], videoData[2], videoData[3], videoData[4])
-	}
-
 	// Handle AVC sequence header (contains SPS/PPS)
-	if isSequenceHeader {
-		log.Printf("Received AVC sequence header for stream %s (%d bytes)", streamKey, len(avcData))
-
-		// Parse AVCDecoderConfigurationRecord to extract SPS/PPS
-		avcConfig, err := muxer.ParseAVCDecoderConfigurationRecord(avcData)
-		if err != nil {
-			log.Printf("Failed to parse AVCDecoderConfigurationRecord: %v", err)
-			return nil
+	if avcConfig != nil {
+		if hadParameterSets && !codecChanged && stream.GetVideoCodec() != nil {
+			return nil // Repeated header, nothing new
+		}
+		if codecChanged {
+			log.Printf("Video codec parameters changed for stream %s, starting a new init segment at the next keyframe", streamKey)
 		}
 
-		// Store SPS/PPS for later use
-		h.mu.Lock()
-		h.sps = avcConfig.SPS
-		h.pps = avcConfig.PPS
-		h.naluLength = int(avcConfig.NALUnitLength)
-		h.mu.Unlock()
+		h.streamManager.SetVideoConfig(streamKey, streammanager.VideoConfig{
+			SPS:        avcConfig.SPS,
+			PPS:        avcConfig.PPS,
+			NALULength: int(avcConfig.NALUnitLength),
+		})
 
 		log.Printf("Stored SPS/PPS for stream %s: %d SPS, %d PPS, NALU length=%d",
 			streamKey, len(avcConfig.SPS), len(avcConfig.PPS), avcConfig.NALUnitLength)
 
+		h.updateVideoCodec(stream, avcConfig)
+		if err := h.checkResolution(stream); err != nil {
+			return err
+		}
+
 		// Don't send sequence header as a frame, it's just configuration
 		return nil
 	}
 
-	// For keyframes, we need to skip embedded SPS/PPS since we'll prepend our own
-	// OBS often embeds SPS/PPS at the start of every keyframe
-	skipSPSPPS := isKeyFrame
-	if skipSPSPPS {
-		log.Printf("[%s] Processing keyframe, will skip embedded SPS/PPS (avcData size=%d)", streamKey, len(avcData))
+	if frame.IsKeyFrame && !hadParameterSets {
+		log.Printf("Warning: Keyframe received but no SPS/PPS stored for stream %s", streamKey)
 	}
 
-	// Convert AVCC to Annex-B
-	annexBData, err := muxer.ConvertAVCCToAnnexB(avcData, skipSPSPPS)
-	if err != nil {
-		log.Printf("Failed to convert AVCC to Annex-B: %v (avcData size=%d, first 16 bytes=[% x])",
-			err, len(avcData), avcData[:min(16, len(avcData))])
-		// When conversion fails, skip this frame entirely to avoid corruption
-		return nil
-	}
+	frame.StreamKey = streamKey
+	frame.Timestamp = timestamp
+	frame.DTS = h.normalizeTimestamp(timestamp, true)
+	frame.ReceivedAt = receivedAt
 
-	// For keyframes, prepend SPS/PPS
-	var frameData []byte
-	if isKeyFrame {
-		h.mu.RLock()
-		sps := h.sps
-		pps := h.pps
-		h.mu.RUnlock()
-
-		if len(sps) > 0 && len(pps) > 0 {
-			// Prepend SPS/PPS to keyframe
-			frameData = muxer.PrependSPSPPSAnnexB(annexBData, sps, pps)
-			log.Printf("Prepended SPS/PPS to keyframe for stream %s (total size: %d bytes)", streamKey, len(frameData))
-		} else {
-			log.Printf("Warning: Keyframe received but no SPS/PPS stored for stream %s", streamKey)
-			frameData = annexBData
+	if h.metrics != nil {
+		h.metrics.RecordFrame(streamKey, true, len(frame.Payload))
+		if frame.IsKeyFrame {
+			h.metrics.RecordKeyFrame()
 		}
-	} else {
-		frameData = annexBData
-	}
-
-	// Create frame and publish to stream manager
-	frame := &models.Frame{
-		StreamKey:  streamKey,
-		IsVideo:    true,
-		Timestamp:  timestamp,
-		Payload:    frameData,
-		Codec:      "h264",
-		IsKeyFrame: isKeyFrame,
 	}
 
 	// Publish frame to subscribers
@@ -350,16 +735,41 @@ func (h *ConnHandler) OnVideo(timestamp uint32, payload io.Reader) error {
 		log.Printf("Failed to publish video frame: %v", err)
 	}
 
-	return nil
+	return h.checkBitrate(stream)
 }
 
 // OnClose is called when the connection is closed
 func (h *ConnHandler) OnClose() {
 	log.Printf("Connection closed: %s", h.conn.RemoteAddr())
 
+	if h.metrics != nil {
+		h.metrics.RecordRTMPDisconnect()
+	}
+	h.server.releaseConnection()
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	h.stopPublishTimer()
+	h.stopPublishing()
+}
+
+// OnDeleteStream is called when the client deletes a stream without closing
+// the connection, e.g. to publish under a different key on the same connection
+func (h *ConnHandler) OnDeleteStream(timestamp uint32, cmd *rtmpmsg.NetStreamDeleteStream) error {
+	log.Printf("OnDeleteStream: streamID=%d", cmd.StreamID)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopPublishing()
+	return nil
+}
+
+// stopPublishing ends the connection's current publish, if any, and resets the
+// per-publish state so another publish can start on the same connection
+// Caller holds h.mu
+func (h *ConnHandler) stopPublishing() {
 	if h.stream != nil && h.streamKey != "" {
 		log.Printf("Stopping stream %s", h.streamKey)
 
@@ -368,29 +778,139 @@ func (h *ConnHandler) OnClose() {
 			h.segmenter.StopSegmenting(h.streamKey)
 		}
 
-		h.streamManager.StopStream(h.streamKey)
+		// The stream may already have been stopped by the API or a limit
+		if h.stream.GetState() != models.StreamStateStopped {
+			h.streamManager.StopStream(h.streamKey)
+		}
+	}
+	if h.release != nil {
+		h.release()
+	}
+
+	h.stream = nil
+	h.streamKey = ""
+	h.publishToken = ""
+	h.release = nil
+	h.codec = codecState{}
+	h.rejectedAudio = ""
+	h.timestamps = timestampNormalizer{}
+}
+
+// statusChunkStreamID is the chunk stream used for server-initiated onStatus messages
+const statusChunkStreamID = 5
+
+// watchStream waits for the published stream to stop. If it was stopped by
+// something other than this connection (the API, the idle reaper or the
+// publish duration limit), the publisher is told and disconnected.
+func (h *ConnHandler) watchStream(stream *models.Stream, streamID uint32) {
+	<-stream.Done()
+
+	h.mu.RLock()
+	current, conn := h.stream, h.rtmpConn
+	h.mu.RUnlock()
+
+	if current != stream || conn == nil {
+		return // This connection ended the publish itself
 	}
+
+	log.Printf("Stream %s was stopped by the server, disconnecting publisher", stream.Key)
+
+	if err := notifyUnpublished(conn, streamID); err != nil {
+		log.Printf("Failed to send unpublish status for stream %s: %v", stream.Key, err)
+	}
+	conn.Close()
+}
+
+// notifyUnpublished sends an onStatus NetStream.Unpublish.Success to the publisher
+func notifyUnpublished(conn *rtmp.Conn, streamID uint32) error {
+	return notifyStatus(conn, streamID, rtmpmsg.NetStreamOnStatusLevelStatus, rtmpmsg.NetStreamOnStatusCodeUnpublishSuccess, "Stream stopped by server.")
+}
+
+// notifyStatus sends an onStatus message on a publisher's message stream
+func notifyStatus(conn *rtmp.Conn, streamID uint32, level rtmpmsg.NetStreamOnStatusLevel, code rtmpmsg.NetStreamOnStatusCode, description string) error {
+	var body bytes.Buffer
+	status := &rtmpmsg.NetStreamOnStatus{
+		InfoObject: rtmpmsg.NetStreamOnStatusInfoObject{
+			Level:       level,
+			Code:        code,
+			Description: description,
+		},
+	}
+	if err := rtmpmsg.EncodeBodyAnyValues(rtmpmsg.NewAMFEncoder(&body, rtmpmsg.EncodingTypeAMF0), status); err != nil {
+		return err
+	}
+
+	return conn.Write(context.Background(), statusChunkStreamID, 0, &rtmp.ChunkMessage{
+		StreamID: streamID,
+		Message: &rtmpmsg.CommandMessage{
+			CommandName:   "onStatus",
+			TransactionID: 0,
+			Encoding:      rtmpmsg.EncodingTypeAMF0,
+			Body:          &body,
+		},
+	})
+}
+
+// updateVideoCodec fills in the stream's video codec info from a sequence header,
+// so resolution and frame rate are known even without onMetaData
+func (h *ConnHandler) updateVideoCodec(stream *models.Stream, avcConfig *muxer.AVCDecoderConfigurationRecord) {
+	codec := &models.CodecInfo{Codec: "h264"}
+	if len(avcConfig.SPS) > 0 {
+		codec.SPS = avcConfig.SPS[0]
+
+		spsInfo, err := muxer.ParseSPS(avcConfig.SPS[0])
+		if err != nil {
+			log.Printf("Failed to parse SPS for stream %s: %v", stream.Key, err)
+		} else {
+			codec.Width = spsInfo.Width
+			codec.Height = spsInfo.Height
+			codec.FrameRate = spsInfo.FrameRate
+			codec.CodecString = spsInfo.CodecString()
+			log.Printf("Stream %s video: %dx%d @ %.2f fps (profile %d, level %d)",
+				stream.Key, spsInfo.Width, spsInfo.Height, spsInfo.FrameRate, spsInfo.ProfileIdc, spsInfo.LevelIdc)
+		}
+	}
+	if len(avcConfig.PPS) > 0 {
+		codec.PPS = avcConfig.PPS[0]
+	}
+
+	stream.SetVideoCodec(codec)
+}
+
+// normalizeTimestamp maps a raw RTMP timestamp onto the connection's monotonic timeline
+func (h *ConnHandler) normalizeTimestamp(timestamp uint32, isVideo bool) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.timestamps.normalize(timestamp, isVideo)
 }
 
 // Helper functions
 
+// parseStreamKeyAndToken splits a publishing name such as
+// "streamkey?user=bob&token=xxx" into the stream key and publish token.
+// The token parameter may appear anywhere in the query, its name is matched
+// case-insensitively, and values are URL-decoded. Other parameters are ignored.
 func parseStreamKeyAndToken(publishingName string) (streamKey, token string) {
-	// Parse format: "streamkey?token=xxx"
-	// Find the '?' separator
-	for i, c := range publishingName {
-		if c == '?' {
-			streamKey = publishingName[:i]
-			// Parse query string for token
-			query := publishingName[i+1:]
-			// Simple parsing: look for "token="
-			if len(query) > 6 && query[:6] == "token=" {
-				token = query[6:]
-			}
-			return
+	streamKey, rawQuery, hasQuery := strings.Cut(publishingName, "?")
+	if !hasQuery || rawQuery == "" {
+		return streamKey, ""
+	}
+
+	// ParseQuery keeps every well-formed parameter even if others are malformed
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		log.Printf("Ignoring malformed publish query parameters for stream %s: %v", streamKey, err)
+	}
+
+	if token := query.Get("token"); token != "" {
+		return streamKey, token
+	}
+	for name, values := range query {
+		if strings.EqualFold(name, "token") && len(values) > 0 {
+			return streamKey, values[0]
 		}
 	}
 
-	// No token, just stream key
-	streamKey = publishingName
-	return
+	return streamKey, ""
 }
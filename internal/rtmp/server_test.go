@@ -0,0 +1,146 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseStreamKeyAndToken(t *testing.T) {
+	tests := []struct {
+		name           string
+		publishingName string
+		wantStreamKey  string
+		wantToken      string
+	}{
+		{"no query", "mystream", "mystream", ""},
+		{"empty query", "mystream?", "mystream", ""},
+		{"token only", "mystream?token=abc123", "mystream", "abc123"},
+		{"token after other params", "mystream?foo=1&token=abc123", "mystream", "abc123"},
+		{"token before other params", "mystream?token=abc123&user=alice", "mystream", "abc123"},
+		{"uppercase parameter name", "mystream?TOKEN=abc123", "mystream", "abc123"},
+		{"mixed case parameter name", "mystream?user=alice&Token=abc123", "mystream", "abc123"},
+		{"URL-encoded value", "mystream?token=a%2Bb%3Dc", "mystream", "a+b=c"},
+		{"missing token", "mystream?user=alice&foo=1", "mystream", ""},
+		{"empty token", "mystream?token=", "mystream", ""},
+		{"malformed param alongside token", "mystream?bad=%zz&token=abc123", "mystream", "abc123"},
+		{"repeated token uses the first", "mystream?token=first&token=second", "mystream", "first"},
+		{"empty stream key", "?token=abc123", "", "abc123"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamKey, token := parseStreamKeyAndToken(tt.publishingName)
+			if streamKey != tt.wantStreamKey {
+				t.Errorf("stream key = %q, want %q", streamKey, tt.wantStreamKey)
+			}
+			if token != tt.wantToken {
+				t.Errorf("token = %q, want %q", token, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestADTSFrameTimestamp(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamp  uint32
+		index      int
+		sampleRate int
+		want       uint32
+	}{
+		{"first frame keeps the message timestamp", 1000, 0, 44100, 1000},
+		{"second frame at 44.1kHz", 1000, 1, 44100, 1023},
+		{"third frame at 44.1kHz", 1000, 2, 44100, 1046},
+		{"second frame at 48kHz", 0, 1, 48000, 21},
+		{"fourth frame at 48kHz", 0, 3, 48000, 64},
+		{"second frame at 8kHz", 500, 1, 8000, 628},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := adtsFrameTimestamp(tt.timestamp, tt.index, tt.sampleRate); got != tt.want {
+				t.Errorf("adtsFrameTimestamp(%d, %d, %d) = %d, want %d", tt.timestamp, tt.index, tt.sampleRate, got, tt.want)
+			}
+		})
+	}
+}
+
+// endlessReader yields zeros forever, counting how many bytes were read
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	clear(p)
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestReadMessage(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65}, 1000)
+
+	tests := []struct {
+		name   string
+		reader func() io.Reader
+		want   []byte
+	}{
+		{"single read", func() io.Reader { return bytes.NewReader(payload) }, payload},
+		{"one byte per read", func() io.Reader { return iotest.OneByteReader(bytes.NewReader(payload)) }, payload},
+		{"half per read", func() io.Reader { return iotest.HalfReader(bytes.NewReader(payload)) }, payload},
+		{"split across chunks", func() io.Reader {
+			return io.MultiReader(bytes.NewReader(payload[:128]), bytes.NewReader(payload[128:4000]), bytes.NewReader(payload[4000:]))
+		}, payload},
+		{"EOF with the last data", func() io.Reader { return iotest.DataErrReader(bytes.NewReader(payload)) }, payload},
+		{"empty", func() io.Reader { return bytes.NewReader(nil) }, []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMessage(tt.reader())
+			if err != nil {
+				t.Fatalf("readMessage: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestReadMessageLimit(t *testing.T) {
+	t.Run("maximum size", func(t *testing.T) {
+		got, err := readMessage(io.LimitReader(&endlessReader{}, maxMessageSize))
+		if err != nil {
+			t.Fatalf("readMessage: %v", err)
+		}
+		if len(got) != maxMessageSize {
+			t.Errorf("read %d bytes, want %d", len(got), maxMessageSize)
+		}
+	})
+
+	t.Run("one byte over", func(t *testing.T) {
+		if _, err := readMessage(io.LimitReader(&endlessReader{}, maxMessageSize+1)); err == nil {
+			t.Error("expected an error for an oversized message")
+		}
+	})
+
+	t.Run("unbounded reader", func(t *testing.T) {
+		r := &endlessReader{}
+		if _, err := readMessage(r); err == nil {
+			t.Error("expected an error for an oversized message")
+		}
+		if r.read > maxMessageSize+1 {
+			t.Errorf("read %d bytes from an unbounded reader, want at most %d", r.read, maxMessageSize+1)
+		}
+	})
+
+	t.Run("read error", func(t *testing.T) {
+		errBroken := errors.New("connection reset")
+		if _, err := readMessage(iotest.ErrReader(errBroken)); !errors.Is(err, errBroken) {
+			t.Errorf("error = %v, want %v", err, errBroken)
+		}
+	})
+}
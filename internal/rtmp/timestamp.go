@@ -0,0 +1,68 @@
+package rtmp
+
+// wrapThreshold is the backwards jump that indicates a 32-bit timestamp wrapped
+// rather than a slightly out-of-order frame
+const wrapThreshold = 1 << 31
+
+// timestampNormalizer converts raw 32-bit RTMP timestamps into a monotonic
+// 64-bit timeline starting at zero. The first timestamp seen on any track is
+// the shared base so audio and video stay aligned.
+type timestampNormalizer struct {
+	base    uint32
+	hasBase bool
+	video   trackTimeline
+	audio   trackTimeline
+}
+
+// trackTimeline tracks wraparound for a single track
+type trackTimeline struct {
+	last           uint32 // Last raw timestamp
+	epoch          int64  // Accumulated wraparounds (multiples of 2^32)
+	lastNormalized int64
+	started        bool
+}
+
+// normalize returns the normalized timestamp in milliseconds for a raw RTMP timestamp
+func (n *timestampNormalizer) normalize(timestamp uint32, isVideo bool) int64 {
+	if !n.hasBase {
+		n.base = timestamp
+		n.hasBase = true
+	}
+
+	track := &n.audio
+	if isVideo {
+		track = &n.video
+	}
+
+	if !track.started {
+		// Measure the first frame against the base so a track that starts
+		// just after a wrap is still placed correctly
+		track.last = n.base
+		track.started = true
+	}
+
+	epoch := track.epoch
+	delta := int64(timestamp) - int64(track.last)
+	switch {
+	case delta < -wrapThreshold:
+		// Wrapped past 2^32
+		track.epoch += 1 << 32
+		epoch = track.epoch
+		track.last = timestamp
+	case delta > wrapThreshold:
+		// Late frame from before the most recent wrap
+		epoch -= 1 << 32
+	default:
+		track.last = timestamp
+	}
+
+	normalized := epoch + int64(timestamp) - int64(n.base)
+
+	// Never go backwards; players and muxers require monotonic timestamps
+	if normalized < track.lastNormalized {
+		normalized = track.lastNormalized
+	}
+	track.lastNormalized = normalized
+
+	return normalized
+}
@@ -0,0 +1,94 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/pkg/models"
+)
+
+// codecState is the H.264 decoder configuration of a publish, taken from
+// the most recent AVC sequence header
+type codecState struct {
+	sps        [][]byte // H.264 Sequence Parameter Sets
+	pps        [][]byte // H.264 Picture Parameter Sets
+	naluLength int      // NALU length size from AVCC
+	changed    bool     // Parameter sets replaced since the last keyframe
+}
+
+// matches reports whether config carries the parameter sets already in use
+func (c *codecState) matches(config *muxer.AVCDecoderConfigurationRecord) bool {
+	return equalNALUs(c.sps, config.SPS) && equalNALUs(c.pps, config.PPS) && c.naluLength == int(config.NALUnitLength)
+}
+
+// equalNALUs reports whether two lists of NAL units are identical
+func equalNALUs(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasParameterSets reports whether keyframes can be made self-contained
+func (c *codecState) hasParameterSets() bool {
+	return len(c.sps) > 0 && len(c.pps) > 0
+}
+
+// processVideoPacket turns the body of an FLV video tag into a frame.
+// A sequence header updates state and is returned as config with a nil frame.
+// Keyframes get the stored SPS/PPS prepended so each GOP decodes on its own,
+// and the first keyframe after the parameter sets change is marked with
+// CodecChanged so the segmenter starts a new init segment from it.
+// The caller fills in StreamKey, Timestamp and DTS.
+func processVideoPacket(data []byte, state *codecState) (frame *models.Frame, config *muxer.AVCDecoderConfigurationRecord, err error) {
+	isSequenceHeader, isKeyFrame, compositionTime, avcData, err := muxer.ParseFLVVideoPacket(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse FLV video packet: %w", err)
+	}
+
+	if isSequenceHeader {
+		config, err := muxer.ParseAVCDecoderConfigurationRecord(avcData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse AVCDecoderConfigurationRecord: %w", err)
+		}
+
+		// Encoders resend an unchanged header, e.g. on OBS scene switches
+		if state.hasParameterSets() && !state.matches(config) {
+			state.changed = true
+		}
+		state.sps = config.SPS
+		state.pps = config.PPS
+		state.naluLength = int(config.NALUnitLength)
+		return nil, config, nil
+	}
+
+	// OBS often embeds SPS/PPS at the start of every keyframe; skip them
+	// since we prepend our own
+	annexBData, err := muxer.ConvertAVCCToAnnexB(avcData, isKeyFrame)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert AVCC to Annex-B: %w (avcData size=%d, first 16 bytes=[% x])",
+			err, len(avcData), avcData[:min(16, len(avcData))])
+	}
+
+	payload := annexBData
+	codecChanged := false
+	if isKeyFrame && state.hasParameterSets() {
+		payload = muxer.PrependSPSPPSAnnexB(annexBData, state.sps, state.pps)
+		codecChanged, state.changed = state.changed, false
+	}
+
+	return &models.Frame{
+		IsVideo:         true,
+		CompositionTime: compositionTime,
+		Payload:         payload,
+		Codec:           "h264",
+		IsKeyFrame:      isKeyFrame,
+		CodecChanged:    codecChanged,
+	}, nil, nil
+}
@@ -0,0 +1,246 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"rapidrtmp/internal/metrics"
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/streammanager"
+)
+
+// Baseline 720p parameter sets
+const (
+	testSPS = "6742c01eed00a00b742000000300200000079080"
+	testPPS = "68ce3c80"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+// sequenceHeader builds an FLV video tag body carrying an AVC sequence header
+// with one SPS and one PPS and 4-byte NALU lengths
+func sequenceHeader(t *testing.T) []byte {
+	t.Helper()
+	sps, pps := mustDecodeHex(t, testSPS), mustDecodeHex(t, testPPS)
+
+	data := []byte{0x17, 0x00, 0x00, 0x00, 0x00} // Keyframe, AVC, sequence header
+	data = append(data, 0x01, sps[1], sps[2], sps[3], 0xff, 0xe1)
+	data = append(data, byte(len(sps)>>8), byte(len(sps)))
+	data = append(data, sps...)
+	data = append(data, 0x01, byte(len(pps)>>8), byte(len(pps)))
+	return append(data, pps...)
+}
+
+// naluPacket builds an FLV video tag body carrying AVCC data
+func naluPacket(keyFrame bool, avcc []byte) []byte {
+	frameType := byte(0x27)
+	if keyFrame {
+		frameType = 0x17
+	}
+	return append([]byte{frameType, 0x01, 0x00, 0x00, 0x00}, avcc...)
+}
+
+// withCompositionTime sets the composition time of an FLV video tag body
+func withCompositionTime(packet []byte, cts int32) []byte {
+	packet[2], packet[3], packet[4] = byte(cts>>16), byte(cts>>8), byte(cts)
+	return packet
+}
+
+// annexB joins SPS, PPS and IDR NAL units with 4-byte start codes
+func annexB(nalus ...[]byte) []byte {
+	var out []byte
+	for _, nalu := range nalus {
+		out = append(out, 0x00, 0x00, 0x00, 0x01)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+func TestProcessVideoPacket(t *testing.T) {
+	sps, pps := mustDecodeHex(t, testSPS), mustDecodeHex(t, testPPS)
+	idr := []byte{0x65, 0x88, 0x84, 0x00}
+	inter := []byte{0x41, 0x9a, 0x02}
+	avcc := func(nalu []byte) []byte {
+		return append([]byte{0x00, 0x00, 0x00, byte(len(nalu))}, nalu...)
+	}
+	// Non-IDR slices get a 3-byte start code
+	interAnnexB := append([]byte{0x00, 0x00, 0x01}, inter...)
+
+	tests := []struct {
+		name        string
+		packet      []byte
+		wantConfig  bool
+		wantPayload []byte
+		wantKey     bool
+		wantCTS     int32
+	}{
+		{
+			name:       "sequence header",
+			packet:     sequenceHeader(t),
+			wantConfig: true,
+		},
+		{
+			name:        "keyframe gets SPS and PPS",
+			packet:      naluPacket(true, avcc(idr)),
+			wantPayload: annexB(sps, pps, idr),
+			wantKey:     true,
+		},
+		{
+			name:        "inter frame",
+			packet:      naluPacket(false, avcc(inter)),
+			wantPayload: interAnnexB,
+		},
+		{
+			name:        "composition time",
+			packet:      withCompositionTime(naluPacket(false, avcc(inter)), 80),
+			wantPayload: interAnnexB,
+			wantCTS:     80,
+		},
+		{
+			name:        "negative composition time",
+			packet:      withCompositionTime(naluPacket(true, avcc(idr)), -40),
+			wantPayload: annexB(sps, pps, idr),
+			wantKey:     true,
+			wantCTS:     -40,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state codecState
+			if !tt.wantConfig {
+				if _, _, err := processVideoPacket(sequenceHeader(t), &state); err != nil {
+					t.Fatalf("sequence header: %v", err)
+				}
+			}
+
+			frame, config, err := processVideoPacket(tt.packet, &state)
+			if err != nil {
+				t.Fatalf("processVideoPacket: %v", err)
+			}
+
+			if tt.wantConfig {
+				if frame != nil {
+					t.Errorf("got frame %+v for a sequence header", frame)
+				}
+				if config == nil || len(config.SPS) != 1 || !bytes.Equal(config.SPS[0], sps) ||
+					len(config.PPS) != 1 || !bytes.Equal(config.PPS[0], pps) {
+					t.Fatalf("config = %+v, want the header's SPS and PPS", config)
+				}
+				if !state.hasParameterSets() || !state.matches(config) || state.naluLength != 4 {
+					t.Errorf("codec state = %+v, want the header's parameter sets with 4-byte NALU lengths", state)
+				}
+				return
+			}
+
+			if config != nil {
+				t.Errorf("got config %+v for a frame", config)
+			}
+			if frame == nil {
+				t.Fatal("no frame returned")
+			}
+			if !bytes.Equal(frame.Payload, tt.wantPayload) {
+				t.Errorf("payload = [% x], want [% x]", frame.Payload, tt.wantPayload)
+			}
+			if frame.IsKeyFrame != tt.wantKey || !frame.IsVideo || frame.Codec != "h264" {
+				t.Errorf("frame = %+v, want a video h264 frame with IsKeyFrame=%v", frame, tt.wantKey)
+			}
+			if frame.CompositionTime != tt.wantCTS {
+				t.Errorf("CompositionTime = %d, want %d", frame.CompositionTime, tt.wantCTS)
+			}
+		})
+	}
+}
+
+// truncatedAVCC holds AVCC data whose NAL unit lengths don't match the data
+var truncatedAVCC = []struct {
+	name string
+	avcc []byte
+}{
+	{"length exceeds data", []byte{0x00, 0x00, 0x00, 0x10, 0x65, 0x88, 0x84, 0x00}},
+	{"second NAL cut short", []byte{0x00, 0x00, 0x00, 0x02, 0x65, 0x88, 0x00, 0x00, 0x00, 0x08, 0x41}},
+	{"trailing bytes shorter than a length prefix", []byte{0x00, 0x00, 0x00, 0x02, 0x65, 0x88, 0x00, 0x00}},
+	{"empty", nil},
+}
+
+func TestProcessVideoPacketInvalidNAL(t *testing.T) {
+	for _, tt := range truncatedAVCC {
+		t.Run(tt.name, func(t *testing.T) {
+			var state codecState
+			if _, _, err := processVideoPacket(sequenceHeader(t), &state); err != nil {
+				t.Fatalf("sequence header: %v", err)
+			}
+
+			frame, config, err := processVideoPacket(naluPacket(true, tt.avcc), &state)
+			if !errors.Is(err, muxer.ErrInvalidNAL) {
+				t.Fatalf("error = %v, want ErrInvalidNAL", err)
+			}
+			if frame != nil || config != nil {
+				t.Errorf("got frame %v and config %v for invalid data", frame, config)
+			}
+		})
+	}
+}
+
+// TestOnVideoDropsInvalidNAL checks that truncated frames never reach
+// subscribers and are counted as dropped with reason invalid_nal, while the
+// publish carries on
+func TestOnVideoDropsInvalidNAL(t *testing.T) {
+	m := metrics.New(true)
+	manager := streammanager.New(m)
+	const streamKey = "truncated"
+	stream, err := manager.CreateStream(streamKey, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("CreateStream: %v", err)
+	}
+	frames, unsubscribe := manager.Subscribe(streamKey, streammanager.SubscribeOptions{BufferSize: 16})
+	defer unsubscribe()
+
+	h := &ConnHandler{
+		server:        New("", manager, nil, nil, m, Config{}),
+		streamManager: manager,
+		metrics:       m,
+		streamKey:     streamKey,
+		stream:        stream,
+	}
+	if err := h.OnVideo(0, bytes.NewReader(sequenceHeader(t))); err != nil {
+		t.Fatalf("OnVideo(sequence header): %v", err)
+	}
+
+	for i, tt := range truncatedAVCC {
+		if err := h.OnVideo(uint32(i*40), bytes.NewReader(naluPacket(i == 0, tt.avcc))); err != nil {
+			t.Fatalf("OnVideo(%s) = %v, want the packet skipped", tt.name, err)
+		}
+	}
+
+	dropped := m.FramesDropped.WithLabelValues(streamKey, "invalid_nal")
+	if got := testutil.ToFloat64(dropped); got != float64(len(truncatedAVCC)) {
+		t.Errorf("invalid_nal drops = %v, want %d", got, len(truncatedAVCC))
+	}
+
+	// A well-formed frame after the bad ones is the first to be published
+	valid := []byte{0x00, 0x00, 0x00, 0x03, 0x65, 0x88, 0x84}
+	if err := h.OnVideo(200, bytes.NewReader(naluPacket(true, valid))); err != nil {
+		t.Fatalf("OnVideo(valid): %v", err)
+	}
+	select {
+	case frame := <-frames:
+		if frame.Timestamp != 200 {
+			t.Errorf("first published frame has timestamp %d, want the valid frame at 200", frame.Timestamp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("valid frame was not published")
+	}
+}
@@ -0,0 +1,156 @@
+package segmenter
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"rapidrtmp/pkg/models"
+)
+
+// audioGroupID is the GROUP-ID of the audio renditions in master playlists
+const audioGroupID = "audio"
+
+// defaultAudioName is the NAME of a stream's own audio when it has no label
+const defaultAudioName = "Main"
+
+// AudioTrack labels a stream's audio as a rendition in master playlists
+type AudioTrack struct {
+	Name     string // Shown in players' audio menus, e.g. "Español"
+	Language string // RFC 5646 language tag, e.g. "es"; optional
+
+	// Of makes the stream an alternate audio rendition of another stream,
+	// e.g. a second language published separately: only its audio is
+	// segmented, and the other stream's master playlist lists it
+	Of string
+}
+
+// AudioTrackFromRequest converts the audio track of a publish request
+func AudioTrackFromRequest(req models.AudioTrackRequest) AudioTrack {
+	return AudioTrack{Name: req.Name, Language: req.Language, Of: req.Of}
+}
+
+// Validate checks that the track can be written as playlist attributes
+func (t AudioTrack) Validate() error {
+	if t.Name == "" {
+		return errors.New("audio track name must not be empty")
+	}
+	if strings.ContainsAny(t.Name, "\"\r\n") {
+		return fmt.Errorf("audio track name %q must not contain quotes or line breaks", t.Name)
+	}
+	if t.Language != "" {
+		for _, subtag := range strings.Split(t.Language, "-") {
+			if !validLanguageSubtag(subtag) {
+				return fmt.Errorf("audio track language %q is not a language tag such as \"en\" or \"pt-BR\"", t.Language)
+			}
+		}
+	}
+	return nil
+}
+
+// validLanguageSubtag reports whether s is 1-8 ASCII letters or digits
+func validLanguageSubtag(s string) bool {
+	if len(s) == 0 || len(s) > 8 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// SetAudioTrack labels a stream's audio in master playlists, or with Of set
+// makes it another stream's alternate audio rendition. Like SetStreamConfig
+// it applies the next time segmentation starts, until cleared or the
+// stream's media is cleaned up.
+func (s *Segmenter) SetAudioTrack(streamKey string, track AudioTrack) error {
+	if err := track.Validate(); err != nil {
+		return err
+	}
+	if track.Of == streamKey {
+		return fmt.Errorf("stream %s can't be an audio rendition of itself", streamKey)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audioTracks[streamKey] = track
+	return nil
+}
+
+// ClearAudioTrack returns a stream to the default label for its own audio
+// the next time segmentation starts for it
+func (s *Segmenter) ClearAudioTrack(streamKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.audioTracks, streamKey)
+}
+
+// streamAudioTrack returns the label of a stream's own audio
+func (s *Segmenter) streamAudioTrack(streamKey string) AudioTrack {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	track, exists := s.audioTracks[streamKey]
+	if !exists || track.Of != "" {
+		return AudioTrack{Name: defaultAudioName}
+	}
+	return track
+}
+
+// audioRendition is an alternate audio rendition listed in a master playlist
+type audioRendition struct {
+	streamKey string
+	track     AudioTrack
+	pm        *PlaylistManager
+}
+
+// alternateAudio returns the streams being segmented as alternate audio
+// renditions of streamKey, in stream key order
+func (s *Segmenter) alternateAudio(streamKey string) []audioRendition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var renditions []audioRendition
+	for key, pm := range s.playlists {
+		if pm.audioTrack.Of == streamKey {
+			renditions = append(renditions, audioRendition{streamKey: key, track: pm.audioTrack, pm: pm})
+		}
+	}
+	slices.SortFunc(renditions, func(a, b audioRendition) int {
+		return strings.Compare(a.streamKey, b.streamKey)
+	})
+	return renditions
+}
+
+// audioMediaTag returns an EXT-X-MEDIA tag for an audio rendition; uri is
+// empty for the audio carried in the variant stream itself
+func audioMediaTag(track AudioTrack, isDefault bool, uri string) string {
+	attrs := []string{
+		"TYPE=AUDIO",
+		fmt.Sprintf(`GROUP-ID="%s"`, audioGroupID),
+		fmt.Sprintf(`NAME="%s"`, track.Name),
+	}
+	if track.Language != "" {
+		attrs = append(attrs, fmt.Sprintf(`LANGUAGE="%s"`, track.Language))
+	}
+	if isDefault {
+		attrs = append(attrs, "DEFAULT=YES")
+	}
+	attrs = append(attrs, "AUTOSELECT=YES")
+	if uri != "" {
+		attrs = append(attrs, fmt.Sprintf(`URI="%s"`, uri))
+	}
+	return "#EXT-X-MEDIA:" + strings.Join(attrs, ",") + "\n"
+}
+
+// renditionURI is the URI of another stream's media playlist relative to
+// streamKey's master playlist, e.g. "../show-es/index.m3u8"
+func renditionURI(streamKey, other string) string {
+	return strings.Repeat("../", strings.Count(streamKey, "/")+1) + other + "/" + playlistName
+}
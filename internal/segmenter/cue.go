@@ -0,0 +1,113 @@
+package segmenter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"rapidrtmp/pkg/models"
+)
+
+// ErrCueConflict is returned for a splice-out during an ad break, or a
+// splice-in outside one
+var ErrCueConflict = errors.New("cue conflicts with the stream's ad break state")
+
+// adBreak tracks the ad break a stream is in
+type adBreak struct {
+	duration float64 // Seconds, as signalled by the splice-out
+	elapsed  float64 // Seconds of segments listed in the break so far
+}
+
+// InsertCue queues an ad marker for a live stream. It is applied to the
+// first segment that starts after now, so the splice falls on a segment
+// boundary. A break ends by itself once its duration has been listed, or
+// early with a splice-in.
+func (s *Segmenter) InsertCue(streamKey string, cue models.Cue) (models.Cue, error) {
+	switch cue.Type {
+	case models.CueOut:
+		if cue.Duration <= 0 {
+			return cue, fmt.Errorf("splice-out duration must be positive, got %v", cue.Duration)
+		}
+	case models.CueIn:
+		cue.Duration = 0
+	default:
+		return cue, fmt.Errorf("cue type must be %q or %q, got %q", models.CueOut, models.CueIn, cue.Type)
+	}
+
+	s.mu.RLock()
+	pm, exists := s.playlists[streamKey]
+	s.mu.RUnlock()
+
+	if !exists {
+		return cue, fmt.Errorf("%w: %s", ErrNotLive, streamKey)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.ended {
+		return cue, fmt.Errorf("%w: %s", ErrNotLive, streamKey)
+	}
+
+	// Check against the state the stream will be in once pending cues apply
+	inBreak := pm.adBreak != nil
+	if n := len(pm.pendingCues); n > 0 {
+		inBreak = pm.pendingCues[n-1].Type == models.CueOut
+	}
+	if inBreak == (cue.Type == models.CueOut) {
+		return cue, fmt.Errorf("%w: %s", ErrCueConflict, cue.Type)
+	}
+
+	cue.At = time.Now()
+	pm.pendingCues = append(pm.pendingCues, cue)
+	return cue, nil
+}
+
+// applyCues marks a segment being listed with the ad break it starts, ends
+// or continues (caller holds pm.mu)
+func (pm *PlaylistManager) applyCues(segment *models.Segment) {
+	// A break that has run its full length ends here
+	if pm.adBreak != nil && pm.adBreak.elapsed >= pm.adBreak.duration {
+		segment.CueIn = true
+		pm.adBreak = nil
+	}
+
+	for len(pm.pendingCues) > 0 && !segment.ProgramDateTime.Before(pm.pendingCues[0].At) {
+		cue := pm.pendingCues[0]
+		pm.pendingCues = pm.pendingCues[1:]
+
+		switch cue.Type {
+		case models.CueOut:
+			if pm.adBreak == nil {
+				segment.CueOut = true
+				pm.adBreak = &adBreak{duration: cue.Duration}
+			}
+		case models.CueIn:
+			if pm.adBreak != nil {
+				segment.CueIn = true
+				pm.adBreak = nil
+			}
+		}
+	}
+
+	if pm.adBreak != nil {
+		segment.CueDuration = pm.adBreak.duration
+		segment.CueElapsed = pm.adBreak.elapsed
+		pm.adBreak.elapsed += segment.Duration
+	}
+}
+
+// cueTags renders the ad break tags that precede a segment
+func cueTags(segment *models.Segment) string {
+	tags := ""
+	if segment.CueIn {
+		tags += "#EXT-X-CUE-IN\n"
+	}
+	switch {
+	case segment.CueOut:
+		tags += fmt.Sprintf("#EXT-X-CUE-OUT:DURATION=%.3f\n", segment.CueDuration)
+	case segment.CueDuration > 0:
+		tags += fmt.Sprintf("#EXT-X-CUE-OUT-CONT:ElapsedTime=%.3f,Duration=%.3f\n", segment.CueElapsed, segment.CueDuration)
+	}
+	return tags
+}
@@ -0,0 +1,101 @@
+package segmenter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"rapidrtmp/pkg/models"
+)
+
+// ErrSequenceTooFar is returned when a blocking reload asks for a segment
+// more than two beyond the newest listed one, which LL-HLS rejects outright
+var ErrSequenceTooFar = errors.New("requested media sequence is too far ahead")
+
+// skipUntilTargets is CAN-SKIP-UNTIL in target durations; LL-HLS requires
+// at least six
+const skipUntilTargets = 6
+
+// WaitForSegment blocks until the segment with media sequence msn is listed
+// in the stream's playlist, the playlist ends or ctx is done. It backs
+// LL-HLS blocking playlist reloads (_HLS_msn).
+func (s *Segmenter) WaitForSegment(ctx context.Context, streamKey string, msn uint64) error {
+	for {
+		s.mu.RLock()
+		pm, exists := s.playlists[streamKey]
+		s.mu.RUnlock()
+
+		if !exists {
+			return nil // Stopped; the final playlist is served as is
+		}
+
+		pm.mu.RLock()
+		listed, ended, updated := pm.mediaSequence, pm.ended, pm.updated
+		pm.mu.RUnlock()
+
+		if ended || msn < listed {
+			return nil
+		}
+		// The newest listed segment is listed-1
+		if msn > listed+1 {
+			return fmt.Errorf("%w: %d, newest is %d", ErrSequenceTooFar, msn, int64(listed)-1)
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notifyUpdate wakes blocking reloads waiting for the playlist to change
+// (caller holds pm.mu)
+func (pm *PlaylistManager) notifyUpdate() {
+	close(pm.updated)
+	pm.updated = make(chan struct{})
+}
+
+// lowLatency reports whether the playlist advertises LL-HLS server control
+func (pm *PlaylistManager) lowLatency() bool {
+	return pm.partTarget > 0
+}
+
+// canSkipUntil is how far behind the live edge segments may be skipped in a
+// delta update (caller holds pm.mu)
+func (pm *PlaylistManager) canSkipUntil() time.Duration {
+	return skipUntilTargets * time.Duration(pm.targetDuration) * time.Second
+}
+
+// serverControlTags renders the LL-HLS EXT-X-SERVER-CONTROL and
+// EXT-X-PART-INF tags (caller holds pm.mu)
+func (pm *PlaylistManager) serverControlTags() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=%.3f,PART-HOLD-BACK=%.3f\n",
+		pm.canSkipUntil().Seconds(), pm.partHoldBack.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", pm.partTarget.Seconds())
+	return b.String()
+}
+
+// skippableSegments counts the leading segments a delta update replaces
+// with EXT-X-SKIP: those ending more than CAN-SKIP-UNTIL before the live
+// edge (caller holds pm.mu)
+func (pm *PlaylistManager) skippableSegments(segments []*models.Segment) int {
+	var remaining float64
+	for _, seg := range segments {
+		remaining += seg.Duration
+	}
+
+	skipUntil := pm.canSkipUntil().Seconds()
+	skipped := 0
+	for _, seg := range segments {
+		remaining -= seg.Duration
+		if remaining <= skipUntil {
+			break
+		}
+		skipped++
+	}
+	return skipped
+}
@@ -0,0 +1,131 @@
+package segmenter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"rapidrtmp/pkg/models"
+)
+
+// ErrNotLive is returned when metadata is added to a stream that isn't being segmented
+var ErrNotLive = errors.New("stream is not live")
+
+// AddMetadata attaches timed metadata to a live stream's playlist, filling
+// in an ID and a start date of now when md has none. It is listed as an
+// EXT-X-DATERANGE tag until the segments it covers leave storage.
+func (s *Segmenter) AddMetadata(streamKey string, md models.TimedMetadata) (models.TimedMetadata, error) {
+	s.mu.RLock()
+	pm, exists := s.playlists[streamKey]
+	s.mu.RUnlock()
+
+	if !exists {
+		return md, fmt.Errorf("%w: %s", ErrNotLive, streamKey)
+	}
+	if md.Duration < 0 {
+		return md, fmt.Errorf("metadata duration must not be negative, got %v", md.Duration)
+	}
+	if md.StartDate.IsZero() {
+		md.StartDate = time.Now()
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.ended {
+		return md, fmt.Errorf("%w: %s", ErrNotLive, streamKey)
+	}
+
+	pm.metadataCount++
+	if md.ID == "" {
+		md.ID = fmt.Sprintf("%s-%d", md.StartDate.UTC().Format("20060102T150405"), pm.metadataCount)
+	}
+	for _, existing := range pm.metadata {
+		if existing.ID == md.ID {
+			return md, fmt.Errorf("metadata %s already exists in stream %s", md.ID, streamKey)
+		}
+	}
+
+	pm.metadata = append(pm.metadata, md)
+	pm.version++
+	return md, nil
+}
+
+// pruneMetadata drops metadata that ended before the oldest retained
+// segment began (caller holds pm.mu)
+func (pm *PlaylistManager) pruneMetadata() {
+	if len(pm.segments) == 0 {
+		return
+	}
+	start := pm.segments[0].ProgramDateTime
+
+	kept := pm.metadata[:0]
+	for _, md := range pm.metadata {
+		if !metadataEnd(md).Before(start) {
+			kept = append(kept, md)
+		}
+	}
+	clear(pm.metadata[len(kept):])
+	pm.metadata = kept
+}
+
+// metadataEnd returns when metadata stops applying
+func metadataEnd(md models.TimedMetadata) time.Time {
+	return md.StartDate.Add(time.Duration(md.Duration * float64(time.Second)))
+}
+
+// dateRangeTag renders metadata as an EXT-X-DATERANGE tag. Attributes become
+// client-defined X- attributes, with names reduced to the characters HLS
+// allows and values stripped of quotes and line breaks.
+func dateRangeTag(md models.TimedMetadata) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXT-X-DATERANGE:ID=\"%s\"", quotedValue(md.ID))
+	if md.Class != "" {
+		fmt.Fprintf(&b, ",CLASS=\"%s\"", quotedValue(md.Class))
+	}
+	fmt.Fprintf(&b, ",START-DATE=\"%s\"", md.StartDate.UTC().Format("2006-01-02T15:04:05.000Z"))
+	if md.Duration > 0 {
+		fmt.Fprintf(&b, ",DURATION=%.3f", md.Duration)
+	}
+
+	keys := make([]string, 0, len(md.Attributes))
+	for key := range md.Attributes {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, ",X-%s=\"%s\"", attributeName(key), quotedValue(md.Attributes[key]))
+	}
+
+	b.WriteString("\n")
+	return b.String()
+}
+
+// attributeName converts a key to an HLS attribute name: upper case
+// letters, digits and dashes
+func attributeName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, key)
+}
+
+// quotedValue removes characters an HLS quoted string may not contain
+func quotedValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
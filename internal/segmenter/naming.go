@@ -0,0 +1,242 @@
+package segmenter
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholders in segment patterns and path templates
+const (
+	// SequencePlaceholder marks where the sequence number goes in a segment pattern
+	SequencePlaceholder = "{seq}"
+	// StreamKeyPlaceholder starts a path template
+	StreamKeyPlaceholder = "{streamKey}"
+	// DatePlaceholder is replaced by the UTC date a segment was written, e.g. 2024-05-01
+	DatePlaceholder = "{date}"
+)
+
+// dateLayout formats DatePlaceholder
+const dateLayout = "2006-01-02"
+
+const (
+	// DefaultSegmentPattern names media segments segment_0.ts, segment_1.ts, ...
+	DefaultSegmentPattern = "segment_" + SequencePlaceholder + ".ts"
+	// DefaultInitSegmentName is the name of the init segment
+	DefaultInitSegmentName = "init.mp4"
+)
+
+// playlistName is the media playlist stored alongside the segments
+const playlistName = "index.m3u8"
+
+// SegmentNaming maps segment sequence numbers to file names and back. The
+// segmenter uses it to store segments and write playlists, and the HTTP
+// server to parse requested names, so the two can't drift apart.
+type SegmentNaming struct {
+	prefix   string // Segment name before the sequence number
+	suffix   string // Segment name after the sequence number
+	initName string
+	dir      string // Directory of media segments below the stream, e.g. "{date}/"; "" for none
+}
+
+// DefaultSegmentNaming returns the naming used unless configured otherwise
+func DefaultSegmentNaming() SegmentNaming {
+	naming, _ := NewSegmentNaming(DefaultSegmentPattern, DefaultInitSegmentName)
+	return naming
+}
+
+// NewSegmentNaming creates a naming from a segment pattern containing
+// SequencePlaceholder once, e.g. "seg-{seq}.ts", and an init segment name
+func NewSegmentNaming(pattern, initName string) (SegmentNaming, error) {
+	if strings.Count(pattern, SequencePlaceholder) != 1 {
+		return SegmentNaming{}, fmt.Errorf("segment pattern %q must contain %s exactly once", pattern, SequencePlaceholder)
+	}
+	if strings.Contains(pattern, "/") {
+		return SegmentNaming{}, fmt.Errorf("segment pattern %q must not contain '/'", pattern)
+	}
+	if initName == "" || strings.Contains(initName, "/") {
+		return SegmentNaming{}, fmt.Errorf("init segment name %q must be a non-empty file name", initName)
+	}
+
+	prefix, suffix, _ := strings.Cut(pattern, SequencePlaceholder)
+	n := SegmentNaming{
+		prefix:   prefix,
+		suffix:   suffix,
+		initName: initName,
+	}
+
+	// Every other stored file must be distinguishable from a media segment
+	for _, name := range []string{initName, n.InitNameVersion(1), playlistName} {
+		if _, ok := n.ParseSegmentName(name); ok {
+			return SegmentNaming{}, fmt.Errorf("segment pattern %q also matches %q", pattern, name)
+		}
+	}
+	if initName == playlistName {
+		return SegmentNaming{}, fmt.Errorf("init segment name must not be %q", playlistName)
+	}
+
+	return n, nil
+}
+
+// NewPathLayout creates a naming from a storage path template such as
+// "{streamKey}/{date}/segment_{seq}.m4s". The template starts with
+// StreamKeyPlaceholder, its last element is a segment pattern, and the
+// directories in between may use DatePlaceholder to partition segments by
+// day. The playlist and init segment stay directly under the stream key.
+func NewPathLayout(template, initName string) (SegmentNaming, error) {
+	rest, ok := strings.CutPrefix(template, StreamKeyPlaceholder+"/")
+	if !ok {
+		return SegmentNaming{}, fmt.Errorf("path template %q must start with %s/", template, StreamKeyPlaceholder)
+	}
+
+	var dir, pattern string
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		dir, pattern = rest[:i+1], rest[i+1:]
+	} else {
+		pattern = rest
+	}
+
+	if dir != "" {
+		for _, elem := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+			if elem == "" || elem == "." || elem == ".." {
+				return SegmentNaming{}, fmt.Errorf("path template %q has an empty or relative directory", template)
+			}
+			// Only the date may vary, so a directory can be matched back
+			if literal := strings.ReplaceAll(elem, DatePlaceholder, ""); strings.ContainsAny(literal, "{}") {
+				return SegmentNaming{}, fmt.Errorf("path template %q may only use %s in directories", template, DatePlaceholder)
+			}
+		}
+	}
+
+	n, err := NewSegmentNaming(pattern, initName)
+	if err != nil {
+		return SegmentNaming{}, err
+	}
+	n.dir = dir
+	return n, nil
+}
+
+// SegmentName returns the file name of a media segment
+func (n SegmentNaming) SegmentName(seq uint64) string {
+	return n.prefix + strconv.FormatUint(seq, 10) + n.suffix
+}
+
+// ParseSegmentName returns the sequence number of a media segment file name
+// Only the exact name SegmentName produces is accepted, so "segment_007.ts"
+// is not an alias for segment 7.
+func (n SegmentNaming) ParseSegmentName(name string) (uint64, bool) {
+	digits, ok := strings.CutPrefix(name, n.prefix)
+	if !ok {
+		return 0, false
+	}
+	digits, ok = strings.CutSuffix(digits, n.suffix)
+	if !ok {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil || n.SegmentName(seq) != name {
+		return 0, false
+	}
+	return seq, true
+}
+
+// SegmentURI returns the path of a media segment relative to the stream,
+// as listed in the playlist, for a segment written at t
+func (n SegmentNaming) SegmentURI(seq uint64, t time.Time) string {
+	dir := strings.ReplaceAll(n.dir, DatePlaceholder, t.UTC().Format(dateLayout))
+	return dir + n.SegmentName(seq)
+}
+
+// ParseSegmentURI returns the sequence number of a media segment from its
+// path relative to the stream. The directories must match the template, so
+// each segment is reachable under exactly one URI.
+func (n SegmentNaming) ParseSegmentURI(uri string) (uint64, bool) {
+	i := strings.LastIndex(uri, "/")
+	if !n.matchDir(uri[:i+1]) {
+		return 0, false
+	}
+	return n.ParseSegmentName(uri[i+1:])
+}
+
+// matchDir reports whether dir is the directory template with the date
+// placeholders filled in
+func (n SegmentNaming) matchDir(dir string) bool {
+	template := n.dir
+	for {
+		before, after, found := strings.Cut(template, DatePlaceholder)
+		rest, ok := strings.CutPrefix(dir, before)
+		if !ok {
+			return false
+		}
+		if !found {
+			return rest == ""
+		}
+		if len(rest) < len(dateLayout) {
+			return false
+		}
+		if _, err := time.Parse(dateLayout, rest[:len(dateLayout)]); err != nil {
+			return false
+		}
+		template, dir = after, rest[len(dateLayout):]
+	}
+}
+
+// InitName returns the file name of the init segment
+func (n SegmentNaming) InitName() string {
+	return n.initName
+}
+
+// InitNameVersion returns the file name of a version of the init segment.
+// Version 0 is InitName; later versions, stored when the codec parameters
+// change mid-stream, get a numeric suffix, e.g. init_1.mp4.
+func (n SegmentNaming) InitNameVersion(version uint64) string {
+	if version == 0 {
+		return n.initName
+	}
+	ext := path.Ext(n.initName)
+	return strings.TrimSuffix(n.initName, ext) + "_" + strconv.FormatUint(version, 10) + ext
+}
+
+// ParseInitName returns the version of an init segment file name
+func (n SegmentNaming) ParseInitName(name string) (uint64, bool) {
+	if name == n.initName {
+		return 0, true
+	}
+
+	ext := path.Ext(n.initName)
+	digits, ok := strings.CutPrefix(name, strings.TrimSuffix(n.initName, ext)+"_")
+	if !ok {
+		return 0, false
+	}
+	digits, ok = strings.CutSuffix(digits, ext)
+	if !ok {
+		return 0, false
+	}
+
+	version, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil || version == 0 || n.InitNameVersion(version) != name {
+		return 0, false
+	}
+	return version, true
+}
+
+// initPath is the storage path of a version of a stream's init segment
+func (n SegmentNaming) initPath(streamKey string, version uint64) string {
+	return streamKey + "/" + n.InitNameVersion(version)
+}
+
+// isSegmenterFile reports whether a stored file, named relative to the
+// stream, was written by the segmenter
+func (n SegmentNaming) isSegmenterFile(name string) bool {
+	if name == playlistName {
+		return true
+	}
+	if _, ok := n.ParseInitName(name); ok {
+		return true
+	}
+	_, ok := n.ParseSegmentURI(name)
+	return ok
+}
@@ -0,0 +1,295 @@
+package segmenter
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"slices"
+	"strings"
+
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/storage"
+)
+
+// recoverReadSize is how much of each end of a segment is read to find its
+// first and last timestamps
+const recoverReadSize = 64 * 1024
+
+// StoredStream is a stream with files in storage that isn't being
+// segmented, as found by Recover
+type StoredStream struct {
+	StreamKey     string
+	Tenant        string // "" for the shared root
+	Segments      int    // Media segments stored
+	FirstSequence uint64 // Sequence numbers of the oldest and newest segments
+	LastSequence  uint64
+	Ended         bool // A playlist ending with EXT-X-ENDLIST is stored
+
+	storage storage.Storage // The stream's storage, as StreamStorage returns it
+	files   []string        // Segmenter files, relative to the stream
+}
+
+// Recover lists the streams left in storage, e.g. by a previous run that
+// stopped before their playlists were written or their media cleaned up.
+// Each can be passed to FinalizeStored or CleanupStored, or left alone.
+// Run it before streams are accepted; streams already segmenting are skipped.
+func (s *Segmenter) Recover(ctx context.Context) ([]StoredStream, error) {
+	streams, err := s.listStored(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range streams {
+		stored := &streams[i]
+		if !slices.Contains(stored.files, playlistName) {
+			continue
+		}
+		data, err := stored.storage.Read(ctx, stored.StreamKey+"/"+playlistName)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read playlist for stream %s: %w", stored.StreamKey, err)
+		}
+		stored.Ended = bytes.Contains(data, []byte("#EXT-X-ENDLIST"))
+	}
+
+	slices.SortFunc(streams, func(a, b StoredStream) int {
+		return cmp.Or(cmp.Compare(a.Tenant, b.Tenant), cmp.Compare(a.StreamKey, b.StreamKey))
+	})
+	return streams, nil
+}
+
+// listStored lists the streams stored in the shared root and every tenant's
+// directory or backend that aren't being segmented
+func (s *Segmenter) listStored(ctx context.Context) ([]StoredStream, error) {
+	files, err := s.storage.List(ctx, "")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list storage: %w", err)
+	}
+	streams := s.storedStreams(s.storage, "", files)
+
+	for tenant, st := range s.tenantRoots(files) {
+		tenantFiles, err := st.List(ctx, "")
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list storage for tenant %s: %w", tenant, err)
+		}
+		streams = append(streams, s.storedStreams(st, tenant, tenantFiles)...)
+	}
+	return streams, nil
+}
+
+// storedStreams groups the segmenter files listed from st by stream
+func (s *Segmenter) storedStreams(st storage.Storage, tenant string, files []string) []StoredStream {
+	naming := s.Naming()
+
+	byKey := make(map[string]*StoredStream)
+	var keys []string
+	for _, file := range files {
+		if tenant == "" && strings.HasPrefix(file, tenantDirPrefix) {
+			continue // Tenant directories are listed on their own
+		}
+		streamKey, name, ok := splitStreamFile(naming, file)
+		if !ok {
+			continue
+		}
+
+		stored, exists := byKey[streamKey]
+		if !exists {
+			stored = &StoredStream{StreamKey: streamKey, Tenant: tenant, storage: st}
+			byKey[streamKey] = stored
+			keys = append(keys, streamKey)
+		}
+		stored.files = append(stored.files, name)
+
+		if seq, ok := naming.ParseSegmentURI(name); ok {
+			if stored.Segments == 0 || seq < stored.FirstSequence {
+				stored.FirstSequence = seq
+			}
+			stored.LastSequence = max(stored.LastSequence, seq)
+			stored.Segments++
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	streams := make([]StoredStream, 0, len(keys))
+	for _, streamKey := range keys {
+		_, active := s.playlists[streamKey]
+		_, stopping := s.previous[streamKey]
+		if active || stopping {
+			continue
+		}
+		streams = append(streams, *byKey[streamKey])
+	}
+	return streams
+}
+
+// splitStreamFile splits a stored path into its stream key and the
+// segmenter file below it. Keys namespaced by app span two directories, so
+// the key ends at the first directory below which a segmenter file follows.
+func splitStreamFile(naming SegmentNaming, file string) (streamKey, name string, ok bool) {
+	for i := strings.Index(file, "/"); i >= 0; {
+		if naming.isSegmenterFile(file[i+1:]) {
+			return file[:i], file[i+1:], true
+		}
+		next := strings.Index(file[i+1:], "/")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return "", "", false
+}
+
+// FinalizeStored writes a VOD playlist listing a stored stream's media
+// segments, so a recording cut short by a restart can be played back.
+// MPEG-TS segment durations are read from their timestamps; others are
+// listed at the target segment duration.
+func (s *Segmenter) FinalizeStored(ctx context.Context, stored StoredStream) error {
+	if stored.Ended {
+		return nil
+	}
+	if stored.Segments == 0 {
+		return fmt.Errorf("stream %s has no stored segments", stored.StreamKey)
+	}
+	if s.segmenting(stored.StreamKey) {
+		return fmt.Errorf("stream %s is being segmented again", stored.StreamKey)
+	}
+
+	naming := s.Naming()
+	type entry struct {
+		uri      string
+		sequence uint64
+		duration float64
+	}
+	var entries []entry
+	for _, name := range stored.files {
+		if seq, ok := naming.ParseSegmentURI(name); ok {
+			entries = append(entries, entry{uri: name, sequence: seq})
+		}
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmp.Compare(a.sequence, b.sequence)
+	})
+
+	targetDuration := s.config.SegmentDuration.Seconds()
+	longest := 0.0
+	estimated := 0
+	for i := range entries {
+		duration, ok := segmentDuration(ctx, stored.storage, stored.StreamKey+"/"+entries[i].uri)
+		if !ok {
+			duration = targetDuration
+			estimated++
+		}
+		entries[i].duration = duration
+		longest = max(longest, duration)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:7\n")
+	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	buf.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(longest))))
+	buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", entries[0].sequence))
+	// MPEG-TS streams store an init segment too, which players mustn't get
+	if s.Container() == muxer.ContainerFMP4 && slices.Contains(stored.files, naming.InitName()) {
+		buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", naming.InitName()))
+	}
+	for i, e := range entries {
+		// Missing segments were dropped or deleted, so timestamps jump
+		if i > 0 && e.sequence != entries[i-1].sequence+1 {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", e.duration))
+		buf.WriteString(e.uri + "\n")
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+
+	if err := stored.storage.Write(ctx, stored.StreamKey+"/"+playlistName, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write playlist for stream %s: %w", stored.StreamKey, err)
+	}
+
+	log.Printf("Wrote recovered playlist for stream %s with %d segments (%d at the target duration)", stored.StreamKey, len(entries), estimated)
+	return nil
+}
+
+// segmentDuration reads an MPEG-TS segment's duration, in seconds, from its
+// first and last timestamps
+func segmentDuration(ctx context.Context, st storage.Storage, path string) (float64, bool) {
+	size, err := st.Size(ctx, path)
+	if err != nil || size == 0 {
+		return 0, false
+	}
+	rs, err := st.ReadSeeker(ctx, path)
+	if err != nil {
+		return 0, false
+	}
+	if closer, ok := rs.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	head := make([]byte, min(size, recoverReadSize))
+	if _, err := io.ReadFull(rs, head); err != nil {
+		return 0, false
+	}
+	tail := head
+	if size > recoverReadSize {
+		if _, err := rs.Seek(size-recoverReadSize, io.SeekStart); err != nil {
+			return 0, false
+		}
+		tail = make([]byte, recoverReadSize)
+		if _, err := io.ReadFull(rs, tail); err != nil {
+			return 0, false
+		}
+	}
+
+	duration, ok := muxer.TSDuration(head, tail)
+	return duration.Seconds(), ok
+}
+
+// CleanupStored deletes a stored stream's playlist, init segments and media
+// segments, as CleanupStream does once a stream stops
+func (s *Segmenter) CleanupStored(ctx context.Context, stored StoredStream) error {
+	if err := s.deleteStored(ctx, stored); err != nil {
+		return err
+	}
+
+	log.Printf("Cleaned up %d stored files left by stream %s", len(stored.files), stored.StreamKey)
+	return nil
+}
+
+// deleteStored deletes a stored stream's files unless it is segmenting again
+func (s *Segmenter) deleteStored(ctx context.Context, stored StoredStream) error {
+	if s.segmenting(stored.StreamKey) {
+		return fmt.Errorf("stream %s is being segmented again", stored.StreamKey)
+	}
+
+	var errs []error
+	for _, name := range stored.files {
+		if err := stored.storage.Delete(ctx, stored.StreamKey+"/"+name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete %d files for stream %s: %w", len(errs), stored.StreamKey, errors.Join(errs...))
+	}
+	s.releaseUsage(stored.StreamKey)
+	return nil
+}
+
+// segmenting reports whether a stream is being segmented
+func (s *Segmenter) segmenting(streamKey string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, active := s.playlists[streamKey]
+	return active
+}
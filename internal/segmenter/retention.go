@@ -0,0 +1,104 @@
+package segmenter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// maxRetentionInterval caps how long StartRetention waits between sweeps
+const maxRetentionInterval = time.Hour
+
+// StartRetention deletes recordings older than retention from storage: once
+// now, then periodically until the segmenter shuts down. A recording's age is
+// taken from when its playlist, or failing that its newest segment, was last
+// written, so streams still segmenting are never touched.
+func (s *Segmenter) StartRetention(retention time.Duration) {
+	interval := min(retention, maxRetentionInterval)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.purgeExpired(s.ctx, retention); err != nil && s.ctx.Err() == nil {
+				log.Printf("Recording retention: %v", err)
+			}
+
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeExpired deletes every stored stream last written before retention ago
+func (s *Segmenter) purgeExpired(ctx context.Context, retention time.Duration) error {
+	streams, err := s.listStored(ctx)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for _, stored := range streams {
+		written, err := s.lastWritten(ctx, stored)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Recording retention: %v", err)
+			continue
+		}
+		if written.After(cutoff) {
+			continue
+		}
+
+		if err := s.deleteStored(ctx, stored); err != nil {
+			log.Printf("Recording retention: %v", err)
+			continue
+		}
+		if s.metrics != nil {
+			s.metrics.RecordRecordingPurged()
+		}
+		log.Printf("Purged recording of stream %s (%d files), last written %s", stored.StreamKey, len(stored.files), written.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// lastWritten returns when a stored stream's playlist, which is written when
+// the stream ends, or else its newest segment was last written
+func (s *Segmenter) lastWritten(ctx context.Context, stored StoredStream) (time.Time, error) {
+	name := playlistName
+	if !slices.Contains(stored.files, playlistName) {
+		name = s.newestSegment(stored)
+	}
+	if name == "" {
+		// Only an init segment is left, e.g. from a stream that never produced media
+		name = stored.files[0]
+	}
+
+	written, err := stored.storage.ModTime(ctx, stored.StreamKey+"/"+name)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat %s for stream %s: %w", name, stored.StreamKey, err)
+	}
+	return written, nil
+}
+
+// newestSegment returns the stored media segment with the highest sequence
+// number, or "" if there is none
+func (s *Segmenter) newestSegment(stored StoredStream) string {
+	naming := s.Naming()
+	for _, name := range stored.files {
+		if seq, ok := naming.ParseSegmentURI(name); ok && seq == stored.LastSequence {
+			return name
+		}
+	}
+	return ""
+}
@@ -2,12 +2,21 @@ package segmenter
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"math"
+	"strings"
 	"sync"
 	"time"
 
+	"rapidrtmp/internal/metrics"
 	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/requestid"
 	"rapidrtmp/internal/storage"
 	"rapidrtmp/internal/streammanager"
 	"rapidrtmp/pkg/models"
@@ -18,60 +27,340 @@ type Segmenter struct {
 	storage       storage.Storage
 	streamManager *streammanager.Manager
 	playlists     map[string]*PlaylistManager
-	muxer         *muxer.FFmpegMuxer
+	previous      map[string]*PlaylistManager // Stopped playlists a republish can continue, until cleanup
+	muxer         muxer.Muxer
+	newLive       muxer.StreamMuxerFactory
+	metrics       *metrics.Metrics // Optional, may be nil
+	naming        SegmentNaming    // Stored file names, shared with the HTTP server
+	container     muxer.Container  // Segment format
 	mu            sync.RWMutex
 
+	// Lifecycle
+	ctx        context.Context
+	cancel     context.CancelFunc
+	storageCtx context.Context // For background storage writes; not cancelled, so shutdown can flush
+	wg         sync.WaitGroup  // Tracks running processFrames goroutines
+
+	uploadSlots chan struct{} // Bounds concurrent segment writes across streams
+
+	// Media segments in storage, per stream and in total, guarded by usageMu
+	usage      map[string]storageUsage
+	totalUsage storageUsage
+	usageMu    sync.Mutex
+
 	// Config
-	segmentDuration time.Duration
-	maxSegments     int
+	config    Config
+	overrides map[string]Config // streamKey -> per-stream config
+
+	// Tenants, whose streams are stored under their own directory and
+	// optionally in their own backend
+	tenants       map[string]string          // streamKey -> tenant
+	tenantStorage map[string]storage.Storage // tenant -> dedicated backend
+
+	// Audio rendition labels for master playlists
+	audioTracks map[string]AudioTrack // streamKey -> label
 }
 
-// New creates a new segmenter
-func New(storage storage.Storage, streamManager *streammanager.Manager) *Segmenter {
-	// Check if FFmpeg is available
-	if err := muxer.CheckFFmpegAvailable(); err != nil {
-		log.Printf("WARNING: FFmpeg not available, segments will not be playable: %v", err)
+// MinPlaylistWindow is the smallest number of segments a live playlist may hold
+// Players need a few segments of headroom to buffer without stalling
+const MinPlaylistWindow = 3
+
+// Config controls segment length, the live playlist window and what happens
+// to a stream's media once it stops
+type Config struct {
+	SegmentDuration  time.Duration // Target duration of each segment
+	PlaylistWindow   int           // Segments advertised in the live playlist
+	StorageRetention int           // Segments kept in storage, at least PlaylistWindow (0 keeps just the playlist window)
+	DVRWindow        time.Duration // Media retained behind the live edge for ?dvr=1 playlists (0 disables)
+	Recording        bool          // Keep media in storage after the stream stops
+	CleanupGrace     time.Duration // Delay before a stopped stream's media is deleted
+
+	// ContinueOnReconnect resumes the previous playlist, marked with a
+	// discontinuity, when a stream is republished within CleanupGrace
+	ContinueOnReconnect bool
+
+	// PartTarget enables the LL-HLS server control tags, advertising this
+	// part target, blocking reloads and delta updates (0 disables)
+	PartTarget   time.Duration
+	PartHoldBack time.Duration // Distance from the live edge players start at, at least twice PartTarget (0: three parts)
+
+	// KeyFrameTimeout is how long a stream may go without its first keyframe
+	// before a warning is logged and counted (0 disables the warning)
+	KeyFrameTimeout time.Duration
+}
+
+// Validate checks that the config describes a playable playlist
+func (c Config) Validate() error {
+	if c.SegmentDuration <= 0 {
+		return fmt.Errorf("segment duration must be positive, got %s", c.SegmentDuration)
+	}
+	if c.PlaylistWindow < MinPlaylistWindow {
+		return fmt.Errorf("playlist window must be at least %d segments, got %d", MinPlaylistWindow, c.PlaylistWindow)
+	}
+	if c.CleanupGrace < 0 {
+		return fmt.Errorf("cleanup grace period must not be negative, got %s", c.CleanupGrace)
+	}
+	if c.DVRWindow < 0 {
+		return fmt.Errorf("DVR window must not be negative, got %s", c.DVRWindow)
+	}
+	if c.StorageRetention < 0 {
+		return fmt.Errorf("storage retention must not be negative, got %d", c.StorageRetention)
+	}
+	if c.PartTarget < 0 || (c.PartTarget > 0 && c.PartTarget >= c.SegmentDuration) {
+		return fmt.Errorf("part target must be shorter than the segment duration, got %s", c.PartTarget)
 	}
+	if c.KeyFrameTimeout < 0 {
+		return fmt.Errorf("keyframe timeout must not be negative, got %s", c.KeyFrameTimeout)
+	}
+	if c.PartHoldBack != 0 && c.PartHoldBack < 2*c.PartTarget {
+		return fmt.Errorf("part hold back must be at least twice the part target, got %s", c.PartHoldBack)
+	}
+	return nil
+}
+
+// partHoldBack returns PartHoldBack, defaulting to three parts
+func (c Config) partHoldBack() time.Duration {
+	if c.PartHoldBack == 0 {
+		return 3 * c.PartTarget
+	}
+	return c.PartHoldBack
+}
+
+// retainSegments is how many segments to keep in storage: the live window,
+// or the storage retention or enough to cover the DVR window if longer
+func (c Config) retainSegments() int {
+	dvrSegments := int(math.Ceil(float64(c.DVRWindow) / float64(c.SegmentDuration)))
+	return max(c.PlaylistWindow, c.StorageRetention, dvrSegments)
+}
+
+// ErrShuttingDown is returned when segmentation is requested after shutdown began
+var ErrShuttingDown = errors.New("segmenter is shutting down")
+
+// New creates a new segmenter that builds init segments with mux
+// Cancelling ctx finalizes all active segments and ends their playlists
+func New(ctx context.Context, store storage.Storage, mux muxer.Muxer, streamManager *streammanager.Manager, m *metrics.Metrics, cfg Config) *Segmenter {
+	ctx, cancel := context.WithCancel(ctx)
 
 	return &Segmenter{
-		storage:         storage,
-		streamManager:   streamManager,
-		playlists:       make(map[string]*PlaylistManager),
-		muxer:           muxer.NewFFmpegMuxer(),
-		segmentDuration: 1 * time.Second,
-		maxSegments:     10,
+		storage:       store,
+		streamManager: streamManager,
+		playlists:     make(map[string]*PlaylistManager),
+		previous:      make(map[string]*PlaylistManager),
+		muxer:         mux,
+		newLive:       muxer.NewStreamMuxer,
+		metrics:       m,
+		naming:        DefaultSegmentNaming(),
+		container:     muxer.ContainerTS,
+		ctx:           ctx,
+		cancel:        cancel,
+		storageCtx:    context.WithoutCancel(ctx),
+		config:        cfg,
+		overrides:     make(map[string]Config),
+		tenants:       make(map[string]string),
+		tenantStorage: make(map[string]storage.Storage),
+		audioTracks:   make(map[string]AudioTrack),
+		uploadSlots:   make(chan struct{}, DefaultUploadConcurrency),
+		usage:         make(map[string]storageUsage),
 	}
 }
 
+// SetNaming changes the file names of stored segments
+// Call it before any stream starts segmenting.
+func (s *Segmenter) SetNaming(naming SegmentNaming) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.naming = naming
+}
+
+// Naming returns the file names used for stored segments
+func (s *Segmenter) Naming() SegmentNaming {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.naming
+}
+
+// SetContainer selects MPEG-TS or fragmented MP4 segments
+// Call it before any stream starts segmenting, with a matching SetNaming.
+func (s *Segmenter) SetContainer(container muxer.Container) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.container = container
+}
+
+// SetStreamMuxerFactory replaces how each stream's segments are cut, e.g.
+// with a fake in tests. Call it before any stream starts segmenting.
+func (s *Segmenter) SetStreamMuxerFactory(factory muxer.StreamMuxerFactory) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.newLive = factory
+}
+
+// Container returns the segment format
+func (s *Segmenter) Container() muxer.Container {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.container
+}
+
+// DefaultConfig returns the config used by streams without an override
+func (s *Segmenter) DefaultConfig() Config {
+	return s.config
+}
+
+// PublishConfig returns the config for a publish requesting opts: the
+// defaults with its HLS overrides applied
+func (s *Segmenter) PublishConfig(opts models.PublishOptions) Config {
+	cfg := s.config
+	if opts.SegmentDuration != 0 {
+		cfg.SegmentDuration = time.Duration(opts.SegmentDuration * float64(time.Second))
+	}
+	if opts.PlaylistWindow != 0 {
+		cfg.PlaylistWindow = opts.PlaylistWindow
+	}
+	if opts.StorageRetention != 0 {
+		cfg.StorageRetention = opts.StorageRetention
+	}
+	return cfg
+}
+
+// SetStreamConfig overrides the segment duration and window for one stream,
+// e.g. shorter segments for a low-latency stream. It applies the next time
+// segmentation starts for the stream, until cleared or the stream's media
+// is cleaned up.
+func (s *Segmenter) SetStreamConfig(streamKey string, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.overrides[streamKey] = cfg
+	return nil
+}
+
+// ClearStreamConfig returns a stream to the default config the next time
+// segmentation starts for it
+func (s *Segmenter) ClearStreamConfig(streamKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.overrides, streamKey)
+}
+
+// forgetStreamLocked drops a stream's per-stream settings once its media is
+// gone, unless it has been republished (caller holds s.mu)
+func (s *Segmenter) forgetStreamLocked(streamKey string) {
+	if _, active := s.playlists[streamKey]; active {
+		return
+	}
+	if _, stopping := s.previous[streamKey]; stopping {
+		return
+	}
+	delete(s.overrides, streamKey)
+	delete(s.tenants, streamKey)
+	delete(s.audioTracks, streamKey)
+}
+
 // StartSegmenting starts segmentation for a stream
 func (s *Segmenter) StartSegmenting(streamKey string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.ctx.Err() != nil {
+		return ErrShuttingDown
+	}
+
 	// Check if already segmenting
 	if _, exists := s.playlists[streamKey]; exists {
 		return fmt.Errorf("already segmenting stream %s", streamKey)
 	}
 
+	cfg := s.config
+	if override, exists := s.overrides[streamKey]; exists {
+		cfg = override
+	}
+
 	// Create playlist manager
+	tenant := s.tenants[streamKey]
 	pm := &PlaylistManager{
-		streamKey:      streamKey,
-		segmenter:      s,
-		segments:       make([]*models.Segment, 0),
-		targetDuration: int(s.segmentDuration.Seconds()),
-		maxSegments:    s.maxSegments,
-		sequenceNumber: 0,
-		currentSegment: newSegmentBuffer(),
+		streamKey:       streamKey,
+		segmenter:       s,
+		tenant:          tenant,
+		storage:         s.tenantStorageLocked(tenant),
+		naming:          s.naming,
+		container:       s.container,
+		segments:        make([]*models.Segment, 0),
+		segmentDuration: cfg.SegmentDuration,
+		targetDuration:  int(math.Ceil(cfg.SegmentDuration.Seconds())),
+		playlistWindow:  cfg.PlaylistWindow,
+		retainSegments:  cfg.retainSegments(),
+		partTarget:      cfg.PartTarget,
+		partHoldBack:    cfg.partHoldBack(),
+		keyFrameTimeout: cfg.KeyFrameTimeout,
+		audioTrack:      s.audioTracks[streamKey],
+		createdAt:       time.Now(),
+		done:            make(chan struct{}),
+		updated:         make(chan struct{}),
+	}
+	pm.live = s.newLive(streamKey, s.container, cfg.SegmentDuration, pm.addSegment)
+	if pm.audioOnly() {
+		pm.live.SetAudioOnly()
+		pm.keyFrameTimeout = 0 // Video is dropped, so keyframes don't matter
+	}
+	if s.metrics != nil {
+		pm.live.SetResyncHandler(func(time.Duration) {
+			s.metrics.RecordAVResync()
+		})
+		pm.live.SetErrorHandler(func(error) {
+			s.metrics.RecordMuxError("segment")
+		})
+	}
+
+	// A publisher reconnecting picks up where its previous playlist ended, so
+	// players see a discontinuity instead of the media sequence starting over
+	var prev *PlaylistManager
+	if cfg.ContinueOnReconnect {
+		prev = s.previous[streamKey]
+		delete(s.previous, streamKey)
+		if prev != nil && prev.container == pm.container && prev.naming == pm.naming && prev.tenant == pm.tenant {
+			select {
+			case <-prev.done:
+				pm.continueFrom(prev)
+				prev = nil
+			default:
+				// Still flushing its final segment; continued once that is stored
+			}
+		} else {
+			prev = nil
+		}
 	}
 
 	s.playlists[streamKey] = pm
+	if s.metrics != nil {
+		s.metrics.StartSegmentProgress(streamKey)
+	}
 
-	// Subscribe to stream frames
-	frameChan, cleanup := s.streamManager.Subscribe(streamKey, 1000)
+	// Subscribe to stream frames, dropping whole GOPs if we fall behind so
+	// segments never contain frames that reference a missing keyframe
+	frameChan, cleanup := s.streamManager.Subscribe(streamKey, streammanager.SubscribeOptions{
+		Policy:  streammanager.DropGOP,
+		Kind:    streammanager.SubscriberInternal,
+		WithGOP: true, // Start muxing right away if the stream is already live
+	})
 	pm.cleanup = cleanup
 
 	// Start processing frames
-	go pm.processFrames(frameChan)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(pm.done)
+		if prev != nil {
+			<-prev.done
+			pm.continueFrom(prev)
+		}
+		pm.processFrames(s.ctx, frameChan)
+	}()
 
 	log.Printf("Started HLS segmentation for stream %s", streamKey)
 	return nil
@@ -87,13 +376,168 @@ func (s *Segmenter) StopSegmenting(streamKey string) {
 		return
 	}
 
-	// Cleanup
-	if pm.cleanup != nil {
-		pm.cleanup()
+	s.stopLocked(pm)
+}
+
+// stopLocked unsubscribes pm from its stream, removes it from the active set
+// and schedules storage cleanup. It runs at most once per PlaylistManager, so
+// StopSegmenting and an unexpectedly closed frame channel can race safely.
+// Caller holds s.mu.
+func (s *Segmenter) stopLocked(pm *PlaylistManager) {
+	pm.stopOnce.Do(func() {
+		if pm.cleanup != nil {
+			pm.cleanup()
+		}
+
+		// A restarted stream may already have a new PlaylistManager under this key
+		if s.playlists[pm.streamKey] == pm {
+			delete(s.playlists, pm.streamKey)
+			if s.metrics != nil {
+				s.metrics.StopSegmentProgress(pm.streamKey)
+			}
+		}
+		log.Printf("Stopped HLS segmentation for stream %s", pm.streamKey)
+
+		// Offer the playlist to a republish until cleanup would delete its media
+		if s.config.ContinueOnReconnect && s.ctx.Err() == nil {
+			streamKey := pm.streamKey
+			s.previous[streamKey] = pm
+			time.AfterFunc(s.config.CleanupGrace, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if s.previous[streamKey] == pm {
+					delete(s.previous, streamKey)
+				}
+			})
+		}
+
+		// Give viewers time to play out the ended playlist before deleting media
+		if !s.config.Recording {
+			streamKey := pm.streamKey
+			time.AfterFunc(s.config.CleanupGrace, func() {
+				<-pm.done
+				if pm.isHandedOff() {
+					return // The republished stream owns the media now
+				}
+				if err := s.CleanupStream(s.storageCtx, streamKey); err != nil {
+					log.Printf("Failed to clean up storage for stream %s: %v", streamKey, err)
+				}
+			})
+		}
+	})
+}
+
+// CleanupStream deletes a stopped stream's playlist, init segment and media
+// segments from storage. Streams that are segmenting again are left alone.
+func (s *Segmenter) CleanupStream(ctx context.Context, streamKey string) error {
+	s.mu.RLock()
+	_, active := s.playlists[streamKey]
+	naming := s.naming
+	st := s.tenantStorageLocked(s.tenants[streamKey])
+	s.mu.RUnlock()
+	if active {
+		return nil // Republished during the grace period
+	}
+
+	files, err := st.List(ctx, streamKey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to list files for stream %s: %w", streamKey, err)
+	}
+
+	deleted := 0
+	var errs []error
+	for _, name := range files {
+		if !naming.isSegmenterFile(name) {
+			continue
+		}
+		if err := st.Delete(ctx, streamKey+"/"+name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		deleted++
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete %d files for stream %s: %w", len(errs), streamKey, errors.Join(errs...))
 	}
+	s.releaseUsage(streamKey)
+
+	s.mu.Lock()
+	s.forgetStreamLocked(streamKey)
+	s.mu.Unlock()
+
+	log.Printf("Cleaned up %d stored files for stopped stream %s", deleted, streamKey)
+	return nil
+}
+
+// PurgeStream stops segmentation for a stream and deletes everything stored
+// under its prefix: playlist, init segment, media segments and thumbnails
+func (s *Segmenter) PurgeStream(ctx context.Context, streamKey string) error {
+	s.mu.RLock()
+	pm, active := s.playlists[streamKey]
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	delete(s.previous, streamKey)
+	s.mu.Unlock()
+
+	// Wait for the final segment to be flushed so it isn't written after the purge
+	s.StopSegmenting(streamKey)
+	if active {
+		<-pm.done
+	}
+
+	st := s.StreamStorage(streamKey)
+	defer func() {
+		s.mu.Lock()
+		s.forgetStreamLocked(streamKey)
+		s.mu.Unlock()
+	}()
+
+	files, err := st.List(ctx, streamKey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Nothing was ever written
+		}
+		return fmt.Errorf("failed to list files for stream %s: %w", streamKey, err)
+	}
+
+	var errs []error
+	for _, name := range files {
+		if err := st.Delete(ctx, streamKey+"/"+name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete %d of %d files for stream %s: %w", len(errs), len(files), streamKey, errors.Join(errs...))
+	}
+	s.releaseUsage(streamKey)
+
+	log.Printf("%sPurged %d stored files for stream %s", requestid.LogPrefix(ctx), len(files), streamKey)
+	return nil
+}
 
-	delete(s.playlists, streamKey)
-	log.Printf("Stopped HLS segmentation for stream %s", streamKey)
+// Shutdown finalizes the current segment of every active stream, writes a
+// final playlist with EXT-X-ENDLIST to storage, and waits for segmentation
+// goroutines to exit or ctx to expire
+func (s *Segmenter) Shutdown(ctx context.Context) error {
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("HLS segmenter shut down")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("segmenter shutdown: %w", ctx.Err())
+	}
 }
 
 // GetPlaylist returns the HLS playlist for a stream
@@ -106,205 +550,791 @@ func (s *Segmenter) GetPlaylist(streamKey string) (string, error) {
 		return "", fmt.Errorf("stream %s not found", streamKey)
 	}
 
-	return pm.generatePlaylist(), nil
+	return pm.generatePlaylist(PlaylistOptions{}), nil
 }
 
-// GetSegment returns a segment's data
-func (s *Segmenter) GetSegment(streamKey string, segmentNum uint64) ([]byte, error) {
-	path := fmt.Sprintf("%s/segment_%d.ts", streamKey, segmentNum)
-	return s.storage.Read(path)
+// PlaylistOptions selects which rendering of a media playlist to serve
+type PlaylistOptions struct {
+	DVR  bool // Cover the whole retained DVR window instead of the live window
+	Skip bool // LL-HLS delta update: replace older segments with EXT-X-SKIP
 }
 
-// GetInitSegment returns the initialization segment
-func (s *Segmenter) GetInitSegment(streamKey string) ([]byte, error) {
-	path := fmt.Sprintf("%s/init.mp4", streamKey)
-	return s.storage.Read(path)
+// GetPlaylistWithETag returns the current playlist and an ETag that changes
+// whenever the playlist does, for conditional requests
+func (s *Segmenter) GetPlaylistWithETag(ctx context.Context, streamKey string, opts PlaylistOptions) (playlist, etag string, err error) {
+	s.mu.RLock()
+	pm, exists := s.playlists[streamKey]
+	s.mu.RUnlock()
+
+	if !exists {
+		// A stopped stream keeps serving its ended playlist until cleanup
+		data, err := s.StreamStorage(streamKey).Read(ctx, streamKey+"/"+playlistName)
+		if err != nil {
+			return "", "", fmt.Errorf("stream %s not found", streamKey)
+		}
+		sum := sha256.Sum256(data)
+		return string(data), fmt.Sprintf(`"%x"`, sum[:8]), nil
+	}
+
+	playlist, etag = pm.snapshot(opts)
+	return playlist, etag, nil
 }
 
-// PlaylistManager manages playlist and segments for a stream
-type PlaylistManager struct {
-	streamKey      string
-	segmenter      *Segmenter
-	segments       []*models.Segment
-	targetDuration int
-	maxSegments    int
-	sequenceNumber uint64
-	currentSegment *SegmentBuffer
-	cleanup        func()
-	mu             sync.RWMutex
-	hasInit        bool
+// GetMasterPlaylist returns a multivariant playlist wrapping the stream's
+// single media playlist, described by the codec info captured at ingest.
+// Some players, notably AVPlayer, start faster and more reliably from one.
+func (s *Segmenter) GetMasterPlaylist(streamKey string) (string, error) {
+	stream, exists := s.streamManager.GetStream(streamKey)
+	if !exists {
+		return "", fmt.Errorf("stream %s not found", streamKey)
+	}
+
+	s.mu.RLock()
+	pm, active := s.playlists[streamKey]
+	s.mu.RUnlock()
+
+	// Prefer the bitrate of the segments actually served; BANDWIDTH is the peak
+	var peak, average int
+	if active {
+		peak, average = pm.bandwidth()
+	}
+	if peak == 0 {
+		peak = stream.GetStats().Bitrate
+		average = peak
+	}
+	if peak == 0 {
+		return "", fmt.Errorf("bandwidth of stream %s not known yet", streamKey)
+	}
+
+	// Alternate audio renditions, e.g. other languages, published as their
+	// own streams. BANDWIDTH has to cover the variant with any of them.
+	alternates := s.alternateAudio(streamKey)
+	codecs := stream.Codecs()
+	ownAudio := stream.GetAudioCodec()
+	var renditionPeak, renditionAverage int
+	for _, alt := range alternates {
+		altPeak, altAverage := alt.pm.bandwidth()
+		renditionPeak = max(renditionPeak, altPeak)
+		renditionAverage = max(renditionAverage, altAverage)
+
+		// A video-only stream gets its audio codec from the renditions
+		if ownAudio == nil && !strings.Contains(codecs, "mp4a") {
+			if altStream, exists := s.streamManager.GetStream(alt.streamKey); exists {
+				if audio := altStream.GetAudioCodec(); audio != nil && audio.CodecString != "" {
+					codecs = strings.Trim(codecs+","+audio.CodecString, ",")
+				}
+			}
+		}
+	}
+	peak += renditionPeak
+	average += renditionAverage
+
+	attrs := []string{
+		fmt.Sprintf("BANDWIDTH=%d", peak),
+		fmt.Sprintf("AVERAGE-BANDWIDTH=%d", average),
+	}
+
+	if codecs != "" {
+		attrs = append(attrs, fmt.Sprintf(`CODECS="%s"`, codecs))
+	}
+	if video := stream.GetVideoCodec(); video != nil {
+		if video.Width > 0 && video.Height > 0 {
+			attrs = append(attrs, fmt.Sprintf("RESOLUTION=%dx%d", video.Width, video.Height))
+		}
+		if video.FrameRate > 0 {
+			attrs = append(attrs, fmt.Sprintf("FRAME-RATE=%.3f", video.FrameRate))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:7\n")
+	buf.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if len(alternates) > 0 {
+		// The stream's own audio, if any, is the default and has no URI
+		// since it is muxed into the variant
+		if ownAudio != nil {
+			own := s.streamAudioTrack(streamKey)
+			buf.WriteString(audioMediaTag(own, true, ""))
+		}
+		for i, alt := range alternates {
+			buf.WriteString(audioMediaTag(alt.track, ownAudio == nil && i == 0, renditionURI(streamKey, alt.streamKey)))
+		}
+		attrs = append(attrs, fmt.Sprintf(`AUDIO="%s"`, audioGroupID))
+	}
+	buf.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:%s\n", strings.Join(attrs, ",")))
+	buf.WriteString(playlistName + "\n")
+
+	return buf.String(), nil
+}
+
+// PlaylistStats summarizes a stream's live playlist
+type PlaylistStats struct {
+	Segments       int    // Segments currently in the playlist window
+	TargetDuration int    // EXT-X-TARGETDURATION in seconds
+	LastSequence   uint64 // Sequence number of the newest segment, if Segments > 0
+	Ended          bool   // Playlist has been finalized with EXT-X-ENDLIST
+}
+
+// GetPlaylistStats returns playlist stats for a stream that is being segmented
+func (s *Segmenter) GetPlaylistStats(streamKey string) (PlaylistStats, bool) {
+	s.mu.RLock()
+	pm, exists := s.playlists[streamKey]
+	s.mu.RUnlock()
+
+	if !exists {
+		return PlaylistStats{}, false
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	stats := PlaylistStats{
+		Segments:       len(pm.liveSegments()),
+		TargetDuration: pm.targetDuration,
+		Ended:          pm.ended,
+	}
+	if len(pm.segments) > 0 {
+		stats.LastSequence = pm.segments[len(pm.segments)-1].SequenceNum
+	}
+	return stats, true
+}
+
+// ActiveStreams returns the keys of all streams currently being segmented
+func (s *Segmenter) ActiveStreams() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.playlists))
+	for streamKey := range s.playlists {
+		keys = append(keys, streamKey)
+	}
+	return keys
+}
+
+// healthProbePath is written and removed by CheckStorage; streams can't use
+// it since stream keys never start with a dot
+const healthProbePath = ".healthz"
+
+// CheckStorage verifies that segments can be written to, read from and
+// deleted from storage
+func (s *Segmenter) CheckStorage(ctx context.Context) error {
+	if err := storage.Probe(ctx, s.storage, healthProbePath); err != nil {
+		return err
+	}
+	for tenant, st := range s.dedicatedStorage() {
+		if err := storage.Probe(ctx, st, healthProbePath); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant, err)
+		}
+	}
+	return nil
+}
+
+// GetSegment returns a media segment by its URI relative to the stream
+func (s *Segmenter) GetSegment(ctx context.Context, streamKey, uri string) ([]byte, error) {
+	if _, ok := s.Naming().ParseSegmentURI(uri); !ok {
+		return nil, fmt.Errorf("%q is not a segment: %w", uri, fs.ErrNotExist)
+	}
+	return s.StreamStorage(streamKey).Read(ctx, streamKey+"/"+uri)
+}
+
+// GetInitSegment returns a version of the initialization segment by file name
+func (s *Segmenter) GetInitSegment(ctx context.Context, streamKey, name string) ([]byte, error) {
+	version, ok := s.Naming().ParseInitName(name)
+	if !ok {
+		return nil, fmt.Errorf("%q is not an init segment: %w", name, fs.ErrNotExist)
+	}
+	return s.StreamStorage(streamKey).Read(ctx, s.Naming().initPath(streamKey, version))
 }
 
-// SegmentBuffer buffers frames for a segment
-type SegmentBuffer struct {
-	frames      []*models.Frame
-	startTime   time.Time
-	hasKeyFrame bool
-	mu          sync.Mutex
+// OpenSegment returns a seekable reader for a segment, given its URI relative
+// to the stream, along with its creation time (zero if unknown), for serving
+// with Range and conditional request support.
+// The reader should be closed if it implements io.Closer.
+func (s *Segmenter) OpenSegment(ctx context.Context, streamKey, uri string) (io.ReadSeeker, time.Time, error) {
+	if _, ok := s.Naming().ParseSegmentURI(uri); !ok {
+		return nil, time.Time{}, fmt.Errorf("%q is not a segment: %w", uri, fs.ErrNotExist)
+	}
+
+	rs, err := s.StreamStorage(streamKey).ReadSeeker(ctx, streamKey+"/"+uri)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return rs, s.segmentCreatedAt(streamKey, uri), nil
 }
 
-func newSegmentBuffer() *SegmentBuffer {
-	return &SegmentBuffer{
-		frames:    make([]*models.Frame, 0),
-		startTime: time.Now(),
+// OpenInitSegment returns a seekable reader for a version of a stream's init
+// segment, by file name
+// The reader should be closed if it implements io.Closer.
+func (s *Segmenter) OpenInitSegment(ctx context.Context, streamKey, name string) (io.ReadSeeker, error) {
+	version, ok := s.Naming().ParseInitName(name)
+	if !ok {
+		return nil, fmt.Errorf("%q is not an init segment: %w", name, fs.ErrNotExist)
+	}
+	return s.StreamStorage(streamKey).ReadSeeker(ctx, s.Naming().initPath(streamKey, version))
+}
+
+// SegmentSize returns a segment's length and creation time (zero if unknown)
+// without reading it, for answering HEAD requests
+func (s *Segmenter) SegmentSize(ctx context.Context, streamKey, uri string) (int64, time.Time, error) {
+	if _, ok := s.Naming().ParseSegmentURI(uri); !ok {
+		return 0, time.Time{}, fmt.Errorf("%q is not a segment: %w", uri, fs.ErrNotExist)
+	}
+
+	size, err := s.StreamStorage(streamKey).Size(ctx, streamKey+"/"+uri)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return size, s.segmentCreatedAt(streamKey, uri), nil
+}
+
+// InitSegmentSize returns the length of a version of a stream's init segment
+// without reading it
+func (s *Segmenter) InitSegmentSize(ctx context.Context, streamKey, name string) (int64, error) {
+	version, ok := s.Naming().ParseInitName(name)
+	if !ok {
+		return 0, fmt.Errorf("%q is not an init segment: %w", name, fs.ErrNotExist)
+	}
+	return s.StreamStorage(streamKey).Size(ctx, s.Naming().initPath(streamKey, version))
+}
+
+// segmentCreatedAt looks up when a segment in the live window was written
+func (s *Segmenter) segmentCreatedAt(streamKey, uri string) time.Time {
+	s.mu.RLock()
+	pm, exists := s.playlists[streamKey]
+	s.mu.RUnlock()
+	if !exists {
+		return time.Time{}
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	for _, segment := range pm.segments {
+		if segment.URI == uri {
+			return segment.CreatedAt
+		}
 	}
+	return time.Time{}
 }
 
-// processFrames processes incoming frames and creates segments
-func (pm *PlaylistManager) processFrames(frameChan <-chan *models.Frame) {
-	ticker := time.NewTicker(pm.segmenter.segmentDuration)
-	defer ticker.Stop()
+// PlaylistManager manages playlist and segments for a stream
+type PlaylistManager struct {
+	streamKey       string
+	segmenter       *Segmenter
+	tenant          string          // Tenant the stream was started under, or ""
+	storage         storage.Storage // Where the stream's files are kept, per its tenant
+	naming          SegmentNaming
+	container       muxer.Container
+	segments        []*models.Segment
+	segmentDuration time.Duration
+	targetDuration  int               // Longest segment rounded up, as HLS requires
+	playlistWindow  int               // Segments advertised in the live playlist
+	retainSegments  int               // Segments kept in storage, at least playlistWindow
+	sequenceNumber  uint64            // Number of the next cut segment's file, guarded by addMu
+	mediaSequence   uint64            // Media sequence of the next listed segment
+	live            muxer.StreamMuxer // Cuts this stream's segments, normally with a persistent FFmpeg process
+	cleanup         func()
+	stopOnce        sync.Once     // Guards stopLocked
+	finishOnce      sync.Once     // Guards finish
+	done            chan struct{} // Closed once processFrames returns
+	mu              sync.RWMutex
+	hasInit         bool
+	ended           bool // Playlist is complete and carries EXT-X-ENDLIST
+	handedOff       bool // Segments were taken over by a republish of the stream
+
+	// Segment intake; addMu serializes addSegment, which can overlap across
+	// FFmpeg restarts, so sequence numbers stay contiguous
+	addMu       sync.Mutex
+	uploads     []*segmentUpload // Segments being written, in the order they were cut
+	uploadWG    sync.WaitGroup   // Tracks running uploads
+	storedInit  []byte           // fMP4 init segment last written to storage
+	initVersion uint64           // Version of storedInit; bumped when the init segment changes
+
+	// Discontinuities, guarded by mu
+	discontinuity    bool   // Mark the next segment as a discontinuity
+	discontinuitySeq uint64 // Discontinuities in segments removed from storage, for EXT-X-DISCONTINUITY-SEQUENCE
+
+	// Arrival and write times of keyframes sent to FFmpeg, guarded by mu
+	keyFrames []keyFrameArrival
+
+	// Waiting for the first keyframe; only touched by processFrames
+	keyFrameTimeout time.Duration
+	seenKeyFrame    bool
+	skippedFrames   int // Frames discarded before the first keyframe
+
+	// Timed metadata listed as EXT-X-DATERANGE, oldest first, guarded by mu
+	metadata      []models.TimedMetadata
+	metadataCount uint64 // Metadata ever added, for generated IDs
+
+	// Ad breaks, guarded by mu
+	pendingCues []models.Cue // Cues waiting for the next segment boundary
+	adBreak     *adBreak     // Break the stream is in, or nil
+
+	// Playlist identity for HTTP revalidation
+	createdAt time.Time     // Distinguishes restarts that reuse sequence numbers
+	version   uint64        // Bumped whenever the rendered playlist changes
+	updated   chan struct{} // Closed and replaced when segments are listed or the playlist ends, guarded by mu
+
+	// LL-HLS server control; partTarget is 0 unless enabled
+	partTarget   time.Duration
+	partHoldBack time.Duration
+
+	// Label of the stream's audio in master playlists; with Of set, only
+	// audio is segmented, as another stream's alternate rendition
+	audioTrack AudioTrack
+}
+
+// processFrames feeds incoming frames to the stream's FFmpeg process, which
+// cuts segments at keyframes and hands them back through addSegment
+func (pm *PlaylistManager) processFrames(ctx context.Context, frameChan <-chan *models.Frame) {
+	// Segments can only start at a keyframe, so a publisher with a long GOP,
+	// or one that never sends an IDR, leaves the playlist empty; say so
+	var keyFrameWait <-chan time.Time
+	if pm.keyFrameTimeout > 0 {
+		timer := time.NewTimer(pm.keyFrameTimeout)
+		defer timer.Stop()
+		keyFrameWait = timer.C
+	}
 
 	for {
 		select {
+		case <-keyFrameWait:
+			keyFrameWait = nil
+			if !pm.seenKeyFrame {
+				log.Printf("Warning: no keyframe from stream %s after %s (%d frames discarded), no segments can be cut; check the encoder's keyframe interval",
+					pm.streamKey, pm.keyFrameTimeout, pm.skippedFrames)
+				if pm.segmenter.metrics != nil {
+					pm.segmenter.metrics.RecordKeyFrameTimeout()
+				}
+			}
+
 		case frame, ok := <-frameChan:
 			if !ok {
-				// Channel closed, finalize current segment
-				pm.finalizeSegment()
+				// Channel closed, either by StopSegmenting or because the stream
+				// ended underneath us; flush the final segment and make sure the
+				// stream is no longer considered active
+				pm.finish()
+				pm.segmenter.mu.Lock()
+				pm.segmenter.stopLocked(pm)
+				pm.segmenter.mu.Unlock()
 				return
 			}
 
-			pm.addFrame(frame)
+			pm.writeFrame(frame)
 
-		case <-ticker.C:
-			// Time to create a segment
-			pm.finalizeSegment()
+		case <-ctx.Done():
+			// Shutting down, flush what we have and close out the playlist
+			pm.finish()
+			return
 		}
 	}
 }
 
-// addFrame adds a frame to the current segment
-func (pm *PlaylistManager) addFrame(frame *models.Frame) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+// writeFrame sends a frame to FFmpeg, creating the init segment from the first keyframe
+func (pm *PlaylistManager) writeFrame(frame *models.Frame) {
+	if pm.audioOnly() {
+		pm.writeAudioFrame(frame)
+		return
+	}
 
-	pm.currentSegment.mu.Lock()
-	defer pm.currentSegment.mu.Unlock()
+	// Nothing before the first IDR can be decoded, so the first segment, and
+	// its clock, starts there
+	if !pm.seenKeyFrame {
+		if !frame.IsVideo || !frame.IsKeyFrame {
+			pm.skippedFrames++
+			if pm.segmenter.metrics != nil {
+				pm.segmenter.metrics.RecordFrameDropped(pm.streamKey, "awaiting_keyframe")
+			}
+			return
+		}
+		pm.seenKeyFrame = true
+		if pm.skippedFrames > 0 {
+			log.Printf("First keyframe for stream %s after %s, %d frames discarded before it",
+				pm.streamKey, time.Since(pm.createdAt).Round(time.Millisecond), pm.skippedFrames)
+		}
+	}
 
-	// Track if we have a keyframe
 	if frame.IsVideo && frame.IsKeyFrame {
-		pm.currentSegment.hasKeyFrame = true
+		// Include audio once the publisher has sent its AAC sequence header
+		pm.live.SetAudioConfig(pm.audioConfig())
+
+		// New SPS/PPS make the init segment stale; the live muxer restarts on
+		// this keyframe, marking a discontinuity
+		if frame.CodecChanged && pm.hasInit {
+			log.Printf("Rebuilding init segment for stream %s after a codec change", pm.streamKey)
+			pm.hasInit = false
+		}
+
+		// fMP4 init segments come from FFmpeg's own output in addSegment
+		if !pm.hasInit && pm.container != muxer.ContainerFMP4 {
+			// FFmpeg and storage latency must not hold up frame intake
+			pm.hasInit = true
+			pm.segmenter.wg.Add(1)
+			go func() {
+				defer pm.segmenter.wg.Done()
+				pm.createInitSegment([]*models.Frame{frame})
+			}()
+		}
 	}
 
-	pm.currentSegment.frames = append(pm.currentSegment.frames, frame)
+	if err := pm.live.WriteFrame(frame); err != nil {
+		log.Printf("Failed to mux frame for stream %s: %v", pm.streamKey, err)
+		return
+	}
+
+	if frame.IsVideo && frame.IsKeyFrame {
+		pm.recordKeyFrameArrival(frame)
+	}
 }
 
-// finalizeSegment finalizes the current segment and creates a new one
-func (pm *PlaylistManager) finalizeSegment() {
+// writeAudioFrame sends an alternate audio rendition's audio to FFmpeg,
+// dropping its video
+func (pm *PlaylistManager) writeAudioFrame(frame *models.Frame) {
+	if frame.IsVideo {
+		return
+	}
+
+	pm.live.SetAudioConfig(pm.audioConfig())
+	if err := pm.live.WriteFrame(frame); err != nil {
+		log.Printf("Failed to mux frame for stream %s: %v", pm.streamKey, err)
+	}
+}
+
+// audioOnly reports whether the stream is segmented as another stream's
+// alternate audio rendition
+func (pm *PlaylistManager) audioOnly() bool {
+	return pm.audioTrack.Of != ""
+}
+
+// maxKeyFrameArrivals bounds the keyframes remembered while FFmpeg isn't
+// producing segments
+const maxKeyFrameArrivals = 64
+
+// keyFrameTolerance absorbs rounding between frame timestamps and the segment
+// durations FFmpeg reports
+const keyFrameTolerance = 50 // milliseconds
+
+// keyFrameArrival is when a keyframe, and so possibly a segment, started
+// arriving and when it was written to FFmpeg
+type keyFrameArrival struct {
+	dts        int64
+	receivedAt time.Time // Zero if the frame carries no arrival time
+	writtenAt  time.Time
+}
+
+// recordKeyFrameArrival remembers when a keyframe sent to FFmpeg arrived and was written
+func (pm *PlaylistManager) recordKeyFrameArrival(frame *models.Frame) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	pm.currentSegment.mu.Lock()
-	frameCount := len(pm.currentSegment.frames)
-	hasKeyFrame := pm.currentSegment.hasKeyFrame
-	frames := pm.currentSegment.frames
-	pm.currentSegment.mu.Unlock()
+	if len(pm.keyFrames) >= maxKeyFrameArrivals {
+		pm.keyFrames = pm.keyFrames[1:]
+	}
+	pm.keyFrames = append(pm.keyFrames, keyFrameArrival{dts: frame.DTS, receivedAt: frame.ReceivedAt, writtenAt: time.Now()})
+}
 
-	// Don't create segment if no frames or no keyframe
-	if frameCount == 0 || !hasKeyFrame {
-		return
+// segmentTiming returns when the oldest frame of the next segment arrived,
+// and how long FFmpeg took to deliver the segment once the keyframe ending it
+// was written; each is zero if unknown. Segments start at a keyframe, so that
+// is the oldest remembered keyframe; keyframes inside the segment are then
+// discarded so the one left first is the keyframe FFmpeg cut at, which
+// starts the next segment. The last segment, cut by closing FFmpeg's input,
+// has no such keyframe.
+func (pm *PlaylistManager) segmentTiming(duration time.Duration) (receivedAt time.Time, muxLatency time.Duration) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if len(pm.keyFrames) == 0 {
+		return time.Time{}, 0
 	}
 
-	// Create segment
-	segmentNum := pm.sequenceNumber
-	pm.sequenceNumber++
+	first := pm.keyFrames[0]
+	end := first.dts + duration.Milliseconds()
+	i := 1
+	for i < len(pm.keyFrames) && pm.keyFrames[i].dts < end-keyFrameTolerance {
+		i++
+	}
+	pm.keyFrames = pm.keyFrames[i:]
+	if len(pm.keyFrames) > 0 {
+		muxLatency = time.Since(pm.keyFrames[0].writtenAt)
+	}
+	return first.receivedAt, muxLatency
+}
+
+// audioConfig returns the stream's AAC AudioSpecificConfig, or nil if it has none
+func (pm *PlaylistManager) audioConfig() []byte {
+	stream, exists := pm.segmenter.streamManager.GetStream(pm.streamKey)
+	if !exists {
+		return nil
+	}
+	if audioCodec := stream.GetAudioCodec(); audioCodec != nil {
+		return audioCodec.AudioConfig
+	}
+	return nil
+}
 
-	// Convert frames to segment data (simplified for now)
-	segmentData := pm.framesToSegmentData(frames)
+// addSegment hands a segment produced by FFmpeg to the upload pool
+// Writes run without pm.mu held, and several at once, so slow storage (e.g.
+// GCS) neither stalls playlist requests nor falls behind real time. Each
+// segment is listed only once stored, in the order it was cut; one that
+// can't be stored is dropped and the next listed one marked as a
+// discontinuity.
+func (pm *PlaylistManager) addSegment(live muxer.LiveSegment) {
+	pm.addMu.Lock()
+	defer pm.addMu.Unlock()
+
+	if live.Duration <= 0 {
+		live.Duration = pm.segmentDuration
+	}
+	receivedAt, muxLatency := pm.segmentTiming(live.Duration)
 
-	// Save segment to storage
-	path := fmt.Sprintf("%s/segment_%d.ts", pm.streamKey, segmentNum)
-	if err := pm.segmenter.storage.Write(path, segmentData); err != nil {
-		log.Printf("Failed to write segment %d for stream %s: %v", segmentNum, pm.streamKey, err)
+	if len(live.Data) == 0 {
+		log.Printf("FFmpeg produced an empty segment for stream %s, skipping", pm.streamKey)
+		if pm.segmenter.metrics != nil {
+			pm.segmenter.metrics.RecordSegmentDropped("mux_error")
+			pm.segmenter.metrics.RecordMuxError("segment")
+		}
 		return
 	}
+	if muxLatency > 0 && pm.segmenter.metrics != nil {
+		pm.segmenter.metrics.RecordMux("segment", muxLatency.Seconds())
+	}
+
+	if live.Init != nil {
+		pm.storeInit(live.Init)
+	}
 
-	// Create segment metadata
+	segmentNum := pm.sequenceNumber
+	pm.sequenceNumber++
+
+	uri := pm.naming.SegmentURI(segmentNum, time.Now())
 	segment := &models.Segment{
 		StreamKey:   pm.streamKey,
-		SequenceNum: segmentNum,
-		Duration:    float64(pm.segmenter.segmentDuration.Seconds()),
-		FilePath:    path,
-		FileSize:    int64(len(segmentData)),
-		CreatedAt:   time.Now(),
+		Duration:    live.Duration.Seconds(),
+		FilePath:    pm.streamKey + "/" + uri,
+		URI:         uri,
+		FileSize:    int64(len(live.Data)),
 		IsAvailable: true,
 	}
+	if pm.container == muxer.ContainerFMP4 {
+		segment.InitURI = pm.naming.InitNameVersion(pm.initVersion)
+	}
+
+	pm.startUpload(&segmentUpload{
+		segment:       segment,
+		receivedAt:    receivedAt,
+		discontinuity: live.Discontinuity,
+	}, live.Data)
+}
+
+// listSegment adds a finished upload to the playlist. Caller holds pm.addMu.
+func (pm *PlaylistManager) listSegment(u *segmentUpload) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	segment := u.segment
+	if u.err != nil {
+		log.Printf("Failed to write segment %s for stream %s, dropping it: %v", segment.URI, pm.streamKey, u.err)
+		if pm.segmenter.metrics != nil {
+			pm.segmenter.metrics.RecordSegmentDropped("storage_error")
+		}
+		// Players must not expect the next segment to follow on seamlessly
+		pm.discontinuity = true
+		return
+	}
+
+	segment.SequenceNum = pm.mediaSequence
+	segment.CreatedAt = time.Now()
+	pm.mediaSequence++
+
+	// A GOP longer than the target forces a longer segment; the target must cover it
+	if target := int(math.Ceil(segment.Duration)); target > pm.targetDuration {
+		log.Printf("Segment %d for stream %s is %.2fs, raising target duration to %ds (keyframe interval exceeds segment duration)",
+			segment.SequenceNum, pm.streamKey, segment.Duration, target)
+		pm.targetDuration = target
+	}
+
+	// The first segment after a reconnect, FFmpeg restart or dropped segment
+	// may not continue the timestamps of the one before it
+	segment.Discontinuity = (pm.discontinuity || u.discontinuity) && len(pm.segments) > 0
+	pm.discontinuity = false
+
+	// Wall-clock time follows on from the previous segment, and is taken
+	// afresh from the ingest clock where the timeline restarts
+	if len(pm.segments) > 0 && !segment.Discontinuity {
+		prev := pm.segments[len(pm.segments)-1]
+		segment.ProgramDateTime = prev.ProgramDateTime.Add(time.Duration(prev.Duration * float64(time.Second)))
+	} else if !u.receivedAt.IsZero() {
+		segment.ProgramDateTime = u.receivedAt
+	} else {
+		segment.ProgramDateTime = segment.CreatedAt.Add(-time.Duration(segment.Duration * float64(time.Second)))
+	}
+	pm.applyCues(segment)
+
+	pm.segmenter.addUsage(pm.streamKey, 1, segment.FileSize)
+	if pm.segmenter.metrics != nil {
+		pm.segmenter.metrics.RecordSegment(segment.Duration, segment.FileSize)
+		pm.segmenter.metrics.RecordSegmentProgress(pm.streamKey, segment.SequenceNum)
+		if !u.receivedAt.IsZero() {
+			pm.segmenter.metrics.RecordIngestToSegment(segment.CreatedAt.Sub(u.receivedAt).Seconds())
+		}
+	}
 
 	// Add to segments list
 	pm.segments = append(pm.segments, segment)
+	pm.version++
+	pm.notifyUpdate()
 
-	// Maintain sliding window
-	if len(pm.segments) > pm.maxSegments {
+	// Maintain the storage window; segments behind the live window stay for DVR
+	if len(pm.segments) > pm.retainSegments {
 		// Remove oldest segment
 		oldSegment := pm.segments[0]
 		pm.segments = pm.segments[1:]
+		if oldSegment.Discontinuity {
+			pm.discontinuitySeq++
+		}
 
 		// Delete old segment file
-		go pm.segmenter.storage.Delete(oldSegment.FilePath)
+		go pm.storage.Delete(pm.segmenter.storageCtx, oldSegment.FilePath)
+		pm.segmenter.addUsage(pm.streamKey, -1, -oldSegment.FileSize)
+
+		pm.pruneMetadata()
 	}
 
-	// Create init segment on first segment
-	if !pm.hasInit {
-		pm.createInitSegment(frames)
-		pm.hasInit = true
+	log.Printf("Created segment %d for stream %s (%.2fs, %.2f KB)",
+		segment.SequenceNum, pm.streamKey, segment.Duration, float64(segment.FileSize)/1024)
+}
+
+// storeInit writes the fMP4 init segment when it first appears or changes,
+// e.g. when FFmpeg restarts with audio. A changed init segment is stored as
+// a new version, so segments already listed keep the one they were cut
+// with. Caller holds pm.addMu.
+func (pm *PlaylistManager) storeInit(init []byte) {
+	if bytes.Equal(init, pm.storedInit) {
+		return
+	}
+
+	version := pm.initVersion
+	if pm.storedInit != nil {
+		version++
 	}
 
-	// Reset current segment
-	pm.currentSegment = newSegmentBuffer()
+	path := pm.naming.initPath(pm.streamKey, version)
+	if err := pm.storage.Write(pm.segmenter.storageCtx, path, init); err != nil {
+		// Retried with the next segment
+		log.Printf("Failed to write init segment for stream %s: %v", pm.streamKey, err)
+		return
+	}
+	pm.storedInit = init
+	pm.initVersion = version
 
-	log.Printf("Created segment %d for stream %s (%d frames, %.2f KB)",
-		segmentNum, pm.streamKey, frameCount, float64(len(segmentData))/1024)
+	log.Printf("Stored init segment %s for stream %s (%d bytes)", pm.naming.InitNameVersion(version), pm.streamKey, len(init))
 }
 
-// framesToSegmentData converts frames to segment data
-// framesToSegmentData converts frames to fMP4 segment using FFmpeg
-func (pm *PlaylistManager) framesToSegmentData(frames []*models.Frame) []byte {
-	// Use FFmpeg muxer to create proper fMP4 segment
-	segmentData, err := pm.segmenter.muxer.MuxFramesToMP4(frames)
-	if err != nil {
-		log.Printf("Failed to mux frames for stream %s: %v", pm.streamKey, err)
-		// Fallback to raw concatenation (won't play but better than nothing)
-		var buf bytes.Buffer
-		for _, frame := range frames {
-			buf.Write(frame.Payload)
-		}
-		return buf.Bytes()
-	}
-
-	// Modern HLS players can handle full MP4 segments with ftyp/moov boxes
-	return segmentData
-}
-
-// stripMP4HeaderBoxes removes ftyp and moov boxes, keeping only moof and mdat
-func stripMP4HeaderBoxes(data []byte) []byte {
-	if len(data) < 8 {
-		return data
-	}
-
-	// Simple approach: scan for 'moof' signature and return from there
-	// This avoids complex MP4 box parsing edge cases
-	moofSignature := []byte{'m', 'o', 'o', 'f'}
-
-	for i := 4; i < len(data)-4; i++ {
-		if data[i] == moofSignature[0] &&
-			data[i+1] == moofSignature[1] &&
-			data[i+2] == moofSignature[2] &&
-			data[i+3] == moofSignature[3] {
-			// Found 'moof', check if it's at a box type position (offset+4)
-			// The box size should be 4 bytes before this
-			if i >= 4 {
-				boxStart := i - 4
-				trimmedSize := len(data) - boxStart
-				log.Printf("stripMP4HeaderBoxes: Found moof at offset %d, trimming %d -> %d bytes",
-					boxStart, len(data), trimmedSize)
-				return data[boxStart:]
-			}
-		}
+// continueFrom takes over the segments of the stream's previous playlist, so
+// the media sequence carries on and the first new segment is marked as a
+// discontinuity. prev must be done.
+func (pm *PlaylistManager) continueFrom(prev *PlaylistManager) {
+	prev.addMu.Lock()
+	storedInit, initVersion := prev.storedInit, prev.initVersion
+	sequenceNumber := prev.sequenceNumber
+	prev.addMu.Unlock()
+
+	prev.mu.Lock()
+	segments := prev.segments
+	mediaSequence := prev.mediaSequence
+	targetDuration := prev.targetDuration
+	discontinuitySeq := prev.discontinuitySeq
+	metadata, metadataCount := prev.metadata, prev.metadataCount
+	pendingCues, adBreak := prev.pendingCues, prev.adBreak
+	prev.segments = nil
+	prev.metadata = nil
+	prev.pendingCues, prev.adBreak = nil, nil
+	prev.handedOff = true
+	prev.mu.Unlock()
+
+	pm.addMu.Lock()
+	defer pm.addMu.Unlock()
+	pm.storedInit = storedInit
+	pm.initVersion = initVersion
+	pm.sequenceNumber = sequenceNumber
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.segments = append(segments, pm.segments...)
+	pm.mediaSequence = mediaSequence
+	pm.targetDuration = max(pm.targetDuration, targetDuration)
+	pm.discontinuitySeq = discontinuitySeq
+	pm.metadata = append(metadata, pm.metadata...)
+	pm.metadataCount += metadataCount
+	pm.pendingCues = append(pendingCues, pm.pendingCues...)
+	if pm.adBreak == nil {
+		pm.adBreak = adBreak
 	}
+	pm.discontinuity = len(segments) > 0
+	pm.version++
+	pm.notifyUpdate()
 
-	// If no moof found, return original data
-	log.Printf("stripMP4HeaderBoxes: No moof found, returning original %d bytes", len(data))
-	return data
+	log.Printf("Continuing playlist for stream %s at segment %d", pm.streamKey, mediaSequence)
+}
+
+// isHandedOff reports whether a republish took over pm's segments
+func (pm *PlaylistManager) isHandedOff() bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.handedOff
+}
+
+// finish flushes the final segment and ends the playlist, exactly once
+func (pm *PlaylistManager) finish() {
+	pm.finishOnce.Do(func() {
+		pm.live.Close()
+		pm.uploadWG.Wait() // The final segments must be listed before the playlist ends
+		pm.endPlaylist()
+	})
+}
+
+// endPlaylist marks the playlist as complete and persists it to storage
+func (pm *PlaylistManager) endPlaylist() {
+	pm.mu.Lock()
+	pm.ended = true
+	pm.version++
+	pm.notifyUpdate()
+	pm.mu.Unlock()
+
+	path := pm.streamKey + "/" + playlistName
+	// The ended playlist keeps everything still in storage, DVR window included
+	if err := pm.storage.Write(pm.segmenter.storageCtx, path, []byte(pm.generatePlaylist(PlaylistOptions{DVR: true}))); err != nil {
+		log.Printf("Failed to write final playlist for stream %s: %v", pm.streamKey, err)
+		return
+	}
+
+	log.Printf("Wrote final playlist for stream %s", pm.streamKey)
+}
+
+// minMuxTimeout is the shortest deadline given to a one-shot FFmpeg run
+const minMuxTimeout = 5 * time.Second
+
+// muxTimeout bounds a one-shot FFmpeg run for this stream
+// Muxing with copy codecs runs far faster than real time, so a run that takes
+// longer than two segments' worth of media is stuck
+func (pm *PlaylistManager) muxTimeout() time.Duration {
+	return max(2*pm.segmentDuration, minMuxTimeout)
+}
+
+// recordDropped counts a segment lost to an FFmpeg failure
+func (pm *PlaylistManager) recordDropped(err error) {
+	if pm.segmenter.metrics == nil {
+		return
+	}
+	if errors.Is(err, muxer.ErrFFmpegTimeout) {
+		pm.segmenter.metrics.RecordSegmentDropped("timeout")
+	} else {
+		pm.segmenter.metrics.RecordSegmentDropped("mux_error")
+	}
 }
 
 // createInitSegment creates the initialization segment
@@ -325,21 +1355,31 @@ func (pm *PlaylistManager) createInitSegment(frames []*models.Frame) {
 	if len(initFrameData) == 0 {
 		log.Printf("No keyframe found for init segment, using placeholder")
 		initData := []byte("fMP4 init segment placeholder")
-		path := fmt.Sprintf("%s/init.mp4", pm.streamKey)
-		pm.segmenter.storage.Write(path, initData)
+		path := pm.naming.initPath(pm.streamKey, 0)
+		pm.storage.Write(pm.segmenter.storageCtx, path, initData)
 		return
 	}
 
 	// Use FFmpeg to create proper fMP4 init segment from real H.264 data
-	initData, err := pm.segmenter.muxer.CreateInitSegment(initFrameData, nil)
+	ctx, cancel := context.WithTimeout(pm.segmenter.ctx, pm.muxTimeout())
+	defer cancel()
+	start := time.Now()
+	initData, err := pm.segmenter.muxer.CreateInitSegment(ctx, initFrameData, nil)
+	if pm.segmenter.metrics != nil {
+		pm.segmenter.metrics.RecordMux("init", time.Since(start).Seconds())
+		if err != nil {
+			pm.segmenter.metrics.RecordMuxError("init")
+		}
+	}
 	if err != nil {
 		log.Printf("Failed to create init segment for stream %s: %v", pm.streamKey, err)
+		pm.recordDropped(err)
 		// Fallback to placeholder
 		initData = []byte("fMP4 init segment placeholder")
 	}
 
-	path := fmt.Sprintf("%s/init.mp4", pm.streamKey)
-	if err := pm.segmenter.storage.Write(path, initData); err != nil {
+	path := pm.naming.initPath(pm.streamKey, 0)
+	if err := pm.storage.Write(pm.segmenter.storageCtx, path, initData); err != nil {
 		log.Printf("Failed to write init segment for stream %s: %v", pm.streamKey, err)
 		return
 	}
@@ -347,36 +1387,172 @@ func (pm *PlaylistManager) createInitSegment(frames []*models.Frame) {
 	log.Printf("Created init segment for stream %s (%d bytes)", pm.streamKey, len(initData))
 }
 
+// bandwidth returns the peak and average bitrate in bps of the segments in
+// the playlist window, or zeros before the first segment
+func (pm *PlaylistManager) bandwidth() (peak, average int) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	var totalBytes int64
+	var totalSeconds float64
+	for _, seg := range pm.segments {
+		if seg.Duration <= 0 {
+			continue
+		}
+		if bps := int(float64(seg.FileSize*8) / seg.Duration); bps > peak {
+			peak = bps
+		}
+		totalBytes += seg.FileSize
+		totalSeconds += seg.Duration
+	}
+
+	if totalSeconds > 0 {
+		average = int(float64(totalBytes*8) / totalSeconds)
+	}
+	return peak, average
+}
+
 // generatePlaylist generates the HLS playlist
-func (pm *PlaylistManager) generatePlaylist() string {
+func (pm *PlaylistManager) generatePlaylist(opts PlaylistOptions) string {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
+	return pm.renderPlaylist(opts)
+}
+
+// snapshot renders the playlist together with an ETag identifying this version of it
+func (pm *PlaylistManager) snapshot(opts PlaylistOptions) (playlist, etag string) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	suffix := ""
+	if opts.DVR {
+		suffix += "-dvr"
+	}
+	if opts.Skip && pm.lowLatency() {
+		suffix += "-skip"
+	}
+	etag = fmt.Sprintf(`"%x-%d%s"`, pm.createdAt.UnixNano(), pm.version, suffix)
+	return pm.renderPlaylist(opts), etag
+}
+
+// liveSegments returns the segments advertised in the live playlist: the most
+// recent playlistWindow of those retained (caller holds pm.mu)
+func (pm *PlaylistManager) liveSegments() []*models.Segment {
+	if len(pm.segments) > pm.playlistWindow {
+		return pm.segments[len(pm.segments)-pm.playlistWindow:]
+	}
+	return pm.segments
+}
+
+// renderPlaylist builds the M3U8 text, covering the DVR window or the live
+// window as opts select (caller holds pm.mu)
+func (pm *PlaylistManager) renderPlaylist(opts PlaylistOptions) string {
+	segments := pm.liveSegments()
+	if opts.DVR {
+		segments = pm.segments
+	}
+
 	var buf bytes.Buffer
 
-	// HLS playlist header
+	// HLS playlist header; delta updates need version 9
 	buf.WriteString("#EXTM3U\n")
-	buf.WriteString("#EXT-X-VERSION:7\n")
+	if pm.lowLatency() {
+		buf.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		buf.WriteString("#EXT-X-VERSION:7\n")
+	}
+	// The live muxer only cuts at keyframes and starts FFmpeg on one, so every
+	// segment begins with an IDR frame and can be decoded on its own
 	buf.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
 	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", pm.targetDuration))
+	if pm.lowLatency() {
+		buf.WriteString(pm.serverControlTags())
+	}
 
 	// Media sequence (first segment number in playlist)
-	if len(pm.segments) > 0 {
-		buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", pm.segments[0].SequenceNum))
+	if len(segments) > 0 {
+		buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].SequenceNum))
 	} else {
 		buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
 	}
 
-	// MPEG-TS doesn't need an init segment (EXT-X-MAP)
-	// Each .ts segment is self-contained with PAT/PMT tables
+	// Discontinuities before the first listed segment, so players can line
+	// up timelines across playlist reloads
+	discontinuitySeq := pm.discontinuitySeq
+	for _, seg := range pm.segments[:len(pm.segments)-len(segments)] {
+		if seg.Discontinuity {
+			discontinuitySeq++
+		}
+	}
+	if discontinuitySeq > 0 {
+		buf.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySeq))
+	}
+
+	// MPEG-TS segments are self-contained with PAT/PMT tables; fMP4
+	// segments need the init segment they were cut with
+	initURI := ""
+	if pm.container == muxer.ContainerFMP4 && len(segments) == 0 {
+		buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", pm.naming.InitName()))
+	}
+
+	// Metadata is listed ahead of the segment it starts in; anything that
+	// ended before the first listed segment is left out
+	metadata := pm.metadata
+	if len(segments) > 0 {
+		for len(metadata) > 0 && metadataEnd(metadata[0]).Before(segments[0].ProgramDateTime) {
+			metadata = metadata[1:]
+		}
+	}
+
+	// A delta update stands in for segments far behind the live edge
+	skipped := 0
+	if opts.Skip && pm.lowLatency() {
+		skipped = pm.skippableSegments(segments)
+	}
+	if skipped > 0 {
+		buf.WriteString(fmt.Sprintf("#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped))
+	}
 
 	// Segments
-	for _, seg := range pm.segments {
+	for i, seg := range segments {
+		if i < skipped {
+			continue
+		}
+		if seg.Discontinuity {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		buf.WriteString(cueTags(seg))
+		// Wall-clock anchor for each segment, which EXT-X-DATERANGE relies on
+		buf.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + seg.ProgramDateTime.UTC().Format("2006-01-02T15:04:05.000Z") + "\n")
+		segmentEnd := seg.ProgramDateTime.Add(time.Duration(seg.Duration * float64(time.Second)))
+		for len(metadata) > 0 && metadata[0].StartDate.Before(segmentEnd) {
+			buf.WriteString(dateRangeTag(metadata[0]))
+			metadata = metadata[1:]
+		}
+		if pm.container == muxer.ContainerFMP4 {
+			uri := seg.InitURI
+			if uri == "" {
+				uri = pm.naming.InitName()
+			}
+			if uri != initURI {
+				buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", uri))
+				initURI = uri
+			}
+		}
 		buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", seg.Duration))
-		buf.WriteString(fmt.Sprintf("segment_%d.ts\n", seg.SequenceNum))
+		buf.WriteString(seg.URI + "\n")
 	}
 
-	// Note: We don't add #EXT-X-ENDLIST because it's a live stream
+	// Metadata that starts after the newest segment
+	for _, md := range metadata {
+		buf.WriteString(dateRangeTag(md))
+	}
+
+	// Live playlists stay open until the stream is finalized
+	if pm.ended {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
 
 	return buf.String()
 }
@@ -0,0 +1,362 @@
+package segmenter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/storage"
+	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/pkg/models"
+)
+
+// fakeMuxer returns a fixed init segment without running FFmpeg
+type fakeMuxer struct{}
+
+func (fakeMuxer) CreateInitSegment(ctx context.Context, videoCodecData, audioCodecData []byte) ([]byte, error) {
+	return []byte("init"), nil
+}
+
+// fakeStreamMuxer records the frames the segmenter writes instead of cutting
+// segments, and flushes one final segment when closed
+type fakeStreamMuxer struct {
+	onSegment func(muxer.LiveSegment)
+
+	mu     sync.Mutex
+	frames []*models.Frame
+	closes int
+}
+
+func (m *fakeStreamMuxer) WriteFrame(frame *models.Frame) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.frames = append(m.frames, frame)
+	return nil
+}
+
+func (m *fakeStreamMuxer) SetAudioConfig(config []byte)                  {}
+func (m *fakeStreamMuxer) SetAudioOnly()                                 {}
+func (m *fakeStreamMuxer) SetResyncHandler(fn func(drift time.Duration)) {}
+func (m *fakeStreamMuxer) SetErrorHandler(fn func(err error))            {}
+
+func (m *fakeStreamMuxer) Close() {
+	m.mu.Lock()
+	m.closes++
+	first := m.closes == 1
+	m.mu.Unlock()
+
+	if first {
+		m.onSegment(muxer.LiveSegment{Data: []byte("final"), Duration: time.Second})
+	}
+}
+
+// closeCount returns how many times Close was called
+func (m *fakeStreamMuxer) closeCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closes
+}
+
+// written returns a copy of the frames written so far
+func (m *fakeStreamMuxer) written() []*models.Frame {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*models.Frame(nil), m.frames...)
+}
+
+// testSegmenter is a segmenter wired to fakes, recording the stream muxers it creates
+type testSegmenter struct {
+	*Segmenter
+	manager *streammanager.Manager
+	storage *storage.MockStorage
+
+	mu      sync.Mutex
+	muxers  []*fakeStreamMuxer
+	created chan struct{}
+}
+
+func newTestSegmenter(t *testing.T) *testSegmenter {
+	t.Helper()
+
+	ts := &testSegmenter{
+		manager: streammanager.New(nil),
+		storage: storage.NewMockStorage(),
+		created: make(chan struct{}, 1024),
+	}
+	ts.Segmenter = New(context.Background(), ts.storage, fakeMuxer{}, ts.manager, nil, Config{
+		SegmentDuration: 2 * time.Second,
+		PlaylistWindow:  MinPlaylistWindow,
+	})
+	ts.SetStreamMuxerFactory(func(name string, container muxer.Container, segmentDuration time.Duration, onSegment func(muxer.LiveSegment)) muxer.StreamMuxer {
+		m := &fakeStreamMuxer{onSegment: onSegment}
+		ts.mu.Lock()
+		ts.muxers = append(ts.muxers, m)
+		ts.mu.Unlock()
+		ts.created <- struct{}{}
+		return m
+	})
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := ts.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return ts
+}
+
+// lastMuxer returns the most recently created stream muxer
+func (ts *testSegmenter) lastMuxer(t *testing.T) *fakeStreamMuxer {
+	t.Helper()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.muxers) == 0 {
+		t.Fatal("no stream muxer was created")
+	}
+	return ts.muxers[len(ts.muxers)-1]
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testFrame builds a video frame with a payload long enough for the init segment
+func testFrame(streamKey string, dts int64, cts int32, keyFrame bool) *models.Frame {
+	return &models.Frame{
+		StreamKey:       streamKey,
+		IsVideo:         true,
+		DTS:             dts,
+		CompositionTime: cts,
+		Payload:         make([]byte, 128),
+		Codec:           "h264",
+		IsKeyFrame:      keyFrame,
+	}
+}
+
+// TestSegmenterPreservesCompositionTime checks that B-frame sequences reach
+// the muxer in decode order with their composition time intact
+func TestSegmenterPreservesCompositionTime(t *testing.T) {
+	type frame struct {
+		name     string
+		dts      int64
+		cts      int32
+		keyFrame bool
+	}
+	tests := []struct {
+		name    string
+		frames  []frame // In decode order
+		wantPTS []int64
+	}{
+		{
+			name: "IPBB",
+			frames: []frame{
+				{"I", 0, 40, true},
+				{"P", 40, 120, false},
+				{"B1", 80, 0, false},
+				{"B2", 120, 0, false},
+			},
+			wantPTS: []int64{40, 160, 80, 120},
+		},
+		{
+			name: "leading B-frames before the keyframe are dropped",
+			frames: []frame{
+				{"B0", 0, 0, false},
+				{"I", 40, 80, true},
+				{"P", 80, 120, false},
+				{"B1", 120, 0, false},
+				{"B2", 160, 0, false},
+			},
+			wantPTS: []int64{120, 200, 120, 160},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestSegmenter(t)
+			const streamKey = "ipbb"
+			if _, err := ts.manager.CreateStream(streamKey, "127.0.0.1"); err != nil {
+				t.Fatalf("CreateStream: %v", err)
+			}
+			if err := ts.StartSegmenting(streamKey); err != nil {
+				t.Fatalf("StartSegmenting: %v", err)
+			}
+
+			for _, f := range tt.frames {
+				if err := ts.manager.PublishFrame(testFrame(streamKey, f.dts, f.cts, f.keyFrame)); err != nil {
+					t.Fatalf("PublishFrame(%s): %v", f.name, err)
+				}
+			}
+
+			m := ts.lastMuxer(t)
+			waitFor(t, "frames to reach the muxer", func() bool {
+				return len(m.written()) == len(tt.wantPTS)
+			})
+
+			written := m.written()
+			for i, frame := range written {
+				if got := frame.PTS(); got != tt.wantPTS[i] {
+					t.Errorf("frame %d: PTS = %d, want %d", i, got, tt.wantPTS[i])
+				}
+				if i > 0 && frame.DTS < written[i-1].DTS {
+					t.Errorf("frame %d: DTS %d decreases from %d", i, frame.DTS, written[i-1].DTS)
+				}
+			}
+			if !written[0].IsKeyFrame {
+				t.Error("first frame written is not a keyframe")
+			}
+		})
+	}
+}
+
+// TestSegmenterRapidStartStop races StopSegmenting against the stream ending
+// underneath the segmenter, which closes its frame channel. Run with -race.
+func TestSegmenterRapidStartStop(t *testing.T) {
+	ts := newTestSegmenter(t)
+	const streamKey = "churn"
+	const sessions = 50
+
+	for i := 0; i < sessions; i++ {
+		if _, err := ts.manager.CreateStream(streamKey, "127.0.0.1"); err != nil {
+			t.Fatalf("session %d: CreateStream: %v", i, err)
+		}
+		if err := ts.StartSegmenting(streamKey); err != nil {
+			t.Fatalf("session %d: StartSegmenting: %v", i, err)
+		}
+		<-ts.created
+
+		for j := 0; j < 5; j++ {
+			ts.manager.PublishFrame(testFrame(streamKey, int64(j*40), 0, j == 0))
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ts.StopSegmenting(streamKey)
+		}()
+		go func() {
+			defer wg.Done()
+			ts.manager.StopStream(streamKey)
+		}()
+		wg.Wait()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if active := ts.ActiveStreams(); len(active) != 0 {
+		t.Errorf("streams still segmenting after stop: %v", active)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.muxers) != sessions {
+		t.Fatalf("created %d stream muxers, want %d", len(ts.muxers), sessions)
+	}
+	for i, m := range ts.muxers {
+		if n := m.closeCount(); n != 1 {
+			t.Errorf("session %d: muxer closed %d times, want exactly once", i, n)
+		}
+	}
+}
+
+// TestSegmenterStopUnknownStream checks that stopping a stream that isn't
+// segmenting, or stopping one twice, is harmless
+func TestSegmenterStopUnknownStream(t *testing.T) {
+	ts := newTestSegmenter(t)
+	const streamKey = "once"
+
+	ts.StopSegmenting("missing")
+
+	if _, err := ts.manager.CreateStream(streamKey, "127.0.0.1"); err != nil {
+		t.Fatalf("CreateStream: %v", err)
+	}
+	if err := ts.StartSegmenting(streamKey); err != nil {
+		t.Fatalf("StartSegmenting: %v", err)
+	}
+	if err := ts.StartSegmenting(streamKey); err == nil {
+		t.Error("second StartSegmenting for a segmenting stream succeeded")
+	}
+
+	ts.StopSegmenting(streamKey)
+	ts.StopSegmenting(streamKey)
+
+	m := ts.lastMuxer(t)
+	waitFor(t, "the muxer to close", func() bool { return m.closeCount() > 0 })
+	if n := m.closeCount(); n != 1 {
+		t.Errorf("muxer closed %d times, want exactly once", n)
+	}
+}
+
+func TestSegmenterStartAfterShutdown(t *testing.T) {
+	ts := newTestSegmenter(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if _, err := ts.manager.CreateStream("late", "127.0.0.1"); err != nil {
+		t.Fatalf("CreateStream: %v", err)
+	}
+	if err := ts.StartSegmenting("late"); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("StartSegmenting after Shutdown = %v, want ErrShuttingDown", err)
+	}
+}
+
+// TestSegmenterForgetsStreamSettings checks that per-stream settings are
+// dropped with the stream's media, so stream keys don't accumulate
+func TestSegmenterForgetsStreamSettings(t *testing.T) {
+	ts := newTestSegmenter(t)
+	ctx := context.Background()
+
+	cfg := ts.PublishConfig(models.PublishOptions{SegmentDuration: 1})
+	for _, streamKey := range []string{"cleaned", "purged"} {
+		if err := ts.SetStreamConfig(streamKey, cfg); err != nil {
+			t.Fatalf("SetStreamConfig(%s): %v", streamKey, err)
+		}
+		if err := ts.SetStreamTenant(streamKey, "acme"); err != nil {
+			t.Fatalf("SetStreamTenant(%s): %v", streamKey, err)
+		}
+		if err := ts.SetAudioTrack(streamKey, AudioTrack{Name: "Español", Language: "es"}); err != nil {
+			t.Fatalf("SetAudioTrack(%s): %v", streamKey, err)
+		}
+	}
+
+	if err := ts.CleanupStream(ctx, "cleaned"); err != nil {
+		t.Fatalf("CleanupStream: %v", err)
+	}
+	if err := ts.PurgeStream(ctx, "purged"); err != nil {
+		t.Fatalf("PurgeStream: %v", err)
+	}
+
+	ts.Segmenter.mu.RLock()
+	defer ts.Segmenter.mu.RUnlock()
+	if len(ts.overrides) != 0 {
+		t.Errorf("config overrides left after cleanup: %v", ts.overrides)
+	}
+	if len(ts.tenants) != 0 {
+		t.Errorf("tenant assignments left after cleanup: %v", ts.tenants)
+	}
+	if len(ts.audioTracks) != 0 {
+		t.Errorf("audio tracks left after cleanup: %v", ts.audioTracks)
+	}
+}
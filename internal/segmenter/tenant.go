@@ -0,0 +1,124 @@
+package segmenter
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"rapidrtmp/internal/storage"
+	"rapidrtmp/pkg/models"
+)
+
+// ErrTenantInUse is returned when moving a stream to another tenant while
+// its media is still live or awaiting cleanup under the current one
+var ErrTenantInUse = errors.New("stream is in use under another tenant")
+
+// tenantDirPrefix starts the storage directory of each tenant. Stream keys
+// can't contain '=', so a tenant directory never collides with a stream's.
+const tenantDirPrefix = "tenant="
+
+// TenantDir is the storage directory a tenant's streams are kept under
+func TenantDir(tenant string) string {
+	return tenantDirPrefix + tenant
+}
+
+// SetTenantStorage routes a tenant's streams to their own backend, e.g. a
+// separate bucket, instead of the shared one. Their files are still kept
+// under the tenant's directory. Call it before any stream starts segmenting.
+func (s *Segmenter) SetTenantStorage(tenant string, st storage.Storage) error {
+	if err := models.ValidateTenant(tenant); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenantStorage[tenant] = st
+	return nil
+}
+
+// SetStreamTenant assigns a stream to a tenant, whose directory, and backend
+// if it has one, the stream's files are stored in. An empty tenant returns
+// the stream to the shared root. Like SetStreamConfig it applies the next
+// time segmentation starts; the assignment is kept until the stream's media
+// is cleaned up, so a stopped stream is still served from the right place.
+func (s *Segmenter) SetStreamTenant(streamKey, tenant string) error {
+	if tenant != "" {
+		if err := models.ValidateTenant(tenant); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current := s.tenants[streamKey]; current != tenant {
+		// Playlists and cleanup would look for the media in the wrong place
+		_, active := s.playlists[streamKey]
+		_, stopping := s.previous[streamKey]
+		if active || stopping {
+			return fmt.Errorf("%w: %s", ErrTenantInUse, streamKey)
+		}
+	}
+
+	if tenant == "" {
+		delete(s.tenants, streamKey)
+	} else {
+		s.tenants[streamKey] = tenant
+	}
+	return nil
+}
+
+// StreamTenant returns the tenant a stream is assigned to, or "" for none
+func (s *Segmenter) StreamTenant(streamKey string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tenants[streamKey]
+}
+
+// StreamStorage returns the storage a stream's files are kept in. Paths in
+// it start with the stream key, as in the shared storage.
+func (s *Segmenter) StreamStorage(streamKey string) storage.Storage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tenantStorageLocked(s.tenants[streamKey])
+}
+
+// tenantStorageLocked resolves a tenant's storage (caller holds s.mu)
+func (s *Segmenter) tenantStorageLocked(tenant string) storage.Storage {
+	if tenant == "" {
+		return s.storage
+	}
+
+	base := s.storage
+	if dedicated, ok := s.tenantStorage[tenant]; ok {
+		base = dedicated
+	}
+	return storage.WithPrefix(base, TenantDir(tenant))
+}
+
+// tenantRoots returns the storage of every tenant with files in the shared
+// storage, going by its listing, or with a dedicated backend
+func (s *Segmenter) tenantRoots(sharedFiles []string) map[string]storage.Storage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roots := make(map[string]storage.Storage)
+	for _, file := range sharedFiles {
+		dir, _, _ := strings.Cut(file, "/")
+		if tenant, ok := strings.CutPrefix(dir, tenantDirPrefix); ok {
+			roots[tenant] = s.tenantStorageLocked(tenant)
+		}
+	}
+	for tenant := range s.tenantStorage {
+		roots[tenant] = s.tenantStorageLocked(tenant)
+	}
+	return roots
+}
+
+// dedicatedStorage returns the tenants' own backends
+func (s *Segmenter) dedicatedStorage() map[string]storage.Storage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.tenantStorage)
+}
@@ -0,0 +1,95 @@
+package segmenter
+
+import (
+	"log"
+	"time"
+
+	"rapidrtmp/internal/storage"
+	"rapidrtmp/pkg/models"
+)
+
+// DefaultUploadConcurrency is how many segment writes may run at once, across
+// all streams, unless configured otherwise
+const DefaultUploadConcurrency = 4
+
+// uploadAttempts is how many times a segment write is tried before the
+// segment is dropped
+const uploadAttempts = 3
+
+// uploadRetryDelay is the wait before the first retry, doubled for each one after
+const uploadRetryDelay = 500 * time.Millisecond
+
+// segmentUpload is a cut segment being written to storage. Uploads run in
+// parallel but are added to the playlist in the order they were cut.
+type segmentUpload struct {
+	segment       *models.Segment // SequenceNum is assigned once it is listed
+	receivedAt    time.Time       // Arrival of the segment's oldest frame
+	discontinuity bool            // Cut by a restarted FFmpeg process
+	done          bool
+	err           error
+}
+
+// SetUploadConcurrency bounds how many segment writes run at once
+// Call it before any stream starts segmenting.
+func (s *Segmenter) SetUploadConcurrency(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploadSlots = make(chan struct{}, max(n, 1))
+}
+
+// writeSegment writes a segment to storage, retrying failures, while holding
+// one of the upload slots for each attempt
+func (s *Segmenter) writeSegment(st storage.Storage, path string, data []byte) error {
+	s.mu.RLock()
+	slots := s.uploadSlots
+	s.mu.RUnlock()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		slots <- struct{}{}
+		start := time.Now()
+		err = st.Write(s.storageCtx, path, data)
+		<-slots
+
+		if err == nil {
+			if s.metrics != nil {
+				s.metrics.RecordSegmentUpload(time.Since(start).Seconds())
+			}
+			return nil
+		}
+		if attempt == uploadAttempts {
+			return err
+		}
+
+		log.Printf("Failed to write segment %s (attempt %d of %d), retrying: %v", path, attempt, uploadAttempts, err)
+		time.Sleep(uploadRetryDelay << (attempt - 1))
+	}
+}
+
+// startUpload queues a segment for the playlist and writes it in the
+// background. Caller holds pm.addMu.
+func (pm *PlaylistManager) startUpload(u *segmentUpload, data []byte) {
+	pm.uploads = append(pm.uploads, u)
+
+	pm.uploadWG.Add(1)
+	go func() {
+		defer pm.uploadWG.Done()
+		err := pm.segmenter.writeSegment(pm.storage, u.segment.FilePath, data)
+		pm.completeUpload(u, err)
+	}()
+}
+
+// completeUpload records a finished write and lists every segment at the
+// head of the queue that has finished, so a slow upload holds back the
+// segments cut after it rather than letting them skip ahead
+func (pm *PlaylistManager) completeUpload(u *segmentUpload, err error) {
+	pm.addMu.Lock()
+	defer pm.addMu.Unlock()
+
+	u.done, u.err = true, err
+	for len(pm.uploads) > 0 && pm.uploads[0].done {
+		next := pm.uploads[0]
+		pm.uploads = pm.uploads[1:]
+		pm.listSegment(next)
+	}
+}
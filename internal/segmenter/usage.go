@@ -0,0 +1,116 @@
+package segmenter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"rapidrtmp/internal/storage"
+)
+
+// storageUsage is the media segments the segmenter has in storage
+type storageUsage struct {
+	bytes    int64
+	segments int
+}
+
+// addUsage records media segments written (positive) or deleted (negative)
+// for a stream and updates the storage gauges
+func (s *Segmenter) addUsage(streamKey string, segments int, bytes int64) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	u := s.usage[streamKey]
+	u.segments += segments
+	u.bytes += bytes
+	if u.segments <= 0 && u.bytes <= 0 {
+		delete(s.usage, streamKey)
+	} else {
+		s.usage[streamKey] = u
+	}
+
+	s.totalUsage.segments += segments
+	s.totalUsage.bytes += bytes
+	if s.metrics != nil {
+		s.metrics.SetStorageUsage(s.totalUsage.bytes, s.totalUsage.segments)
+	}
+}
+
+// releaseUsage forgets a stream's usage once its media has been deleted
+func (s *Segmenter) releaseUsage(streamKey string) {
+	s.usageMu.Lock()
+	u := s.usage[streamKey]
+	s.usageMu.Unlock()
+
+	s.addUsage(streamKey, -u.segments, -u.bytes)
+}
+
+// StorageUsage returns the bytes and number of media segments stored for a stream
+func (s *Segmenter) StorageUsage(streamKey string) (bytes int64, segments int) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	u := s.usage[streamKey]
+	return u.bytes, u.segments
+}
+
+// TotalStorageUsage returns the bytes and number of media segments stored across all streams
+func (s *Segmenter) TotalStorageUsage() (bytes int64, segments int) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	return s.totalUsage.bytes, s.totalUsage.segments
+}
+
+// ScanStorageUsage counts the media segments already in storage, e.g. left
+// by recordings or a previous run, so usage is accurate after a restart.
+// Run it before streams are accepted; it doesn't account for concurrent writes.
+func (s *Segmenter) ScanStorageUsage(ctx context.Context) error {
+	files, err := s.storage.List(ctx, "")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to list storage: %w", err)
+	}
+	if err := s.scanUsage(ctx, s.storage, files); err != nil {
+		return err
+	}
+
+	for tenant, st := range s.tenantRoots(files) {
+		tenantFiles, err := st.List(ctx, "")
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("failed to list storage for tenant %s: %w", tenant, err)
+		}
+		if err := s.scanUsage(ctx, st, tenantFiles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanUsage counts the media segments among files listed from st
+func (s *Segmenter) scanUsage(ctx context.Context, st storage.Storage, files []string) error {
+	naming := s.Naming()
+	for _, file := range files {
+		streamKey, name, ok := strings.Cut(file, "/")
+		if !ok || strings.HasPrefix(streamKey, tenantDirPrefix) {
+			continue // Tenant directories are scanned on their own
+		}
+		if _, ok := naming.ParseSegmentURI(name); !ok {
+			continue
+		}
+
+		size, err := st.Size(ctx, file)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // Deleted since it was listed
+			}
+			return fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		s.addUsage(streamKey, 1, size)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"fmt"
+	"mime"
+	"path"
+)
+
+// ContentTypes are the media types HLS files are stored with in object
+// storage and served with over HTTP, so caches see the same type on both paths
+type ContentTypes struct {
+	Playlist    string // .m3u8 playlists
+	TSSegment   string // MPEG-TS media segments
+	FMP4Segment string // fMP4 media segments
+	Init        string // fMP4 init segments
+}
+
+// DefaultContentTypes returns the types used unless configured otherwise.
+// fMP4 segments are video/mp4, which every player and CDN accepts; some
+// CDNs prefer video/iso.segment.
+func DefaultContentTypes() ContentTypes {
+	return ContentTypes{
+		Playlist:    "application/vnd.apple.mpegurl",
+		TSSegment:   "video/mp2t",
+		FMP4Segment: "video/mp4",
+		Init:        "video/mp4",
+	}
+}
+
+// Validate checks that each type is a well-formed media type
+func (t ContentTypes) Validate() error {
+	for _, contentType := range []string{t.Playlist, t.TSSegment, t.FMP4Segment, t.Init} {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return fmt.Errorf("invalid content type %q: %w", contentType, err)
+		}
+	}
+	return nil
+}
+
+// ForPath returns the content type of a stored file by its extension, as
+// written by the segmenter and thumbnailer
+func (t ContentTypes) ForPath(name string) string {
+	switch path.Ext(name) {
+	case ".m3u8":
+		return t.Playlist
+	case ".ts":
+		return t.TSSegment
+	case ".m4s":
+		return t.FMP4Segment
+	case ".mp4":
+		return t.Init
+	case ".jpg":
+		return "image/jpeg"
+	}
+	return "application/octet-stream"
+}
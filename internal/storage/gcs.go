@@ -2,27 +2,47 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"time"
 
+	"rapidrtmp/internal/requestid"
+
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
 )
 
+// Retry policy for GCS operations
+const (
+	gcsMaxAttempts      = 4
+	gcsInitialBackoff   = 100 * time.Millisecond
+	gcsMaxBackoff       = 2 * time.Second
+	defaultGCSOpTimeout = 10 * time.Second
+)
+
 // GCSStorage implements Storage using Google Cloud Storage
 type GCSStorage struct {
 	client     *storage.Client
 	bucketName string
 	baseDir    string
-	ctx        context.Context
+	opTimeout  time.Duration // Deadline for each individual attempt
+
+	contentTypes ContentTypes // Object Content-Type by file extension
 }
 
 // NewGCSStorage creates a new GCS storage instance
 // projectID: Your GCP project ID
 // bucketName: The GCS bucket name
 // baseDir: Base directory/prefix within the bucket (e.g., "streams")
-func NewGCSStorage(ctx context.Context, projectID, bucketName, baseDir string) (*GCSStorage, error) {
+// opTimeout: Deadline for each attempt of an operation (0 uses a default)
+func NewGCSStorage(ctx context.Context, projectID, bucketName, baseDir string, opTimeout time.Duration) (*GCSStorage, error) {
+	if opTimeout <= 0 {
+		opTimeout = defaultGCSOpTimeout
+	}
+
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GCS client: %w", err)
@@ -35,144 +55,205 @@ func NewGCSStorage(ctx context.Context, projectID, bucketName, baseDir string) (
 	}
 
 	return &GCSStorage{
-		client:     client,
-		bucketName: bucketName,
-		baseDir:    baseDir,
-		ctx:        ctx,
+		client:       client,
+		bucketName:   bucketName,
+		baseDir:      baseDir,
+		opTimeout:    opTimeout,
+		contentTypes: DefaultContentTypes(),
 	}, nil
 }
 
+// SetContentTypes sets the Content-Type objects are written with, which
+// should match what the HTTP server serves them as. Call it before writing.
+func (s *GCSStorage) SetContentTypes(types ContentTypes) {
+	s.contentTypes = types
+}
+
 // Write writes data to GCS
-func (s *GCSStorage) Write(path string, data []byte) error {
+func (s *GCSStorage) Write(ctx context.Context, path string, data []byte) error {
 	objectPath := s.fullPath(path)
-	
 	obj := s.client.Bucket(s.bucketName).Object(objectPath)
-	w := obj.NewWriter(s.ctx)
-	
-	// Set metadata
-	w.ContentType = s.getContentType(path)
-	w.CacheControl = s.getCacheControl(path)
-	
-	// Write data
-	if _, err := w.Write(data); err != nil {
-		w.Close()
-		return fmt.Errorf("failed to write to GCS: %w", err)
-	}
-	
-	if err := w.Close(); err != nil {
-		return fmt.Errorf("failed to close GCS writer: %w", err)
-	}
-	
-	return nil
+
+	return s.withRetry(ctx, "write "+objectPath, func(ctx context.Context) error {
+		w := obj.NewWriter(ctx)
+
+		// Set metadata
+		w.ContentType = s.contentTypes.ForPath(path)
+		w.CacheControl = s.getCacheControl(path)
+
+		// Write data
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return fmt.Errorf("failed to write to GCS: %w", err)
+		}
+
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("failed to close GCS writer: %w", err)
+		}
+
+		return nil
+	})
 }
 
 // Read reads data from GCS
-func (s *GCSStorage) Read(path string) ([]byte, error) {
+func (s *GCSStorage) Read(ctx context.Context, path string) ([]byte, error) {
 	objectPath := s.fullPath(path)
-	
 	obj := s.client.Bucket(s.bucketName).Object(objectPath)
-	r, err := obj.NewReader(s.ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from GCS: %w", err)
-	}
-	defer r.Close()
-	
-	data, err := io.ReadAll(r)
+
+	var data []byte
+	err := s.withRetry(ctx, "read "+objectPath, func(ctx context.Context) error {
+		r, err := obj.NewReader(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read from GCS: %w", err)
+		}
+		defer r.Close()
+
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read data: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read data: %w", err)
+		return nil, err
 	}
-	
+
 	return data, nil
 }
 
 // ReadSeeker returns a ReadSeeker for GCS object
-func (s *GCSStorage) ReadSeeker(path string) (io.ReadSeeker, error) {
-	objectPath := s.fullPath(path)
-	
-	obj := s.client.Bucket(s.bucketName).Object(objectPath)
-	
+func (s *GCSStorage) ReadSeeker(ctx context.Context, path string) (io.ReadSeeker, error) {
 	// For GCS, we need to wrap the reader to support seeking
 	// This is a simplified implementation - for production, consider using
 	// signed URLs or byte-range requests
-	r, err := obj.NewReader(s.ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open GCS object: %w", err)
-	}
-	
 	// Read all data into memory (for seeking support)
 	// For large files, consider implementing a custom seeker with byte-range requests
-	data, err := io.ReadAll(r)
-	r.Close()
+	data, err := s.Read(ctx, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read GCS object: %w", err)
+		return nil, err
 	}
-	
+
 	return &bytesReadSeeker{data: data}, nil
 }
 
 // Delete deletes a file from GCS
-func (s *GCSStorage) Delete(path string) error {
+func (s *GCSStorage) Delete(ctx context.Context, path string) error {
 	objectPath := s.fullPath(path)
-	
 	obj := s.client.Bucket(s.bucketName).Object(objectPath)
-	if err := obj.Delete(s.ctx); err != nil && err != storage.ErrObjectNotExist {
-		return fmt.Errorf("failed to delete from GCS: %w", err)
-	}
-	
-	return nil
+
+	return s.withRetry(ctx, "delete "+objectPath, func(ctx context.Context) error {
+		if err := obj.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return fmt.Errorf("failed to delete from GCS: %w", err)
+		}
+		return nil
+	})
 }
 
 // Exists checks if a file exists in GCS
-func (s *GCSStorage) Exists(path string) (bool, error) {
+func (s *GCSStorage) Exists(ctx context.Context, path string) (bool, error) {
 	objectPath := s.fullPath(path)
-	
 	obj := s.client.Bucket(s.bucketName).Object(objectPath)
-	_, err := obj.Attrs(s.ctx)
-	if err == storage.ErrObjectNotExist {
-		return false, nil
-	}
-	if err != nil {
-		return false, fmt.Errorf("failed to check GCS object: %w", err)
-	}
-	
-	return true, nil
+
+	exists := false
+	err := s.withRetry(ctx, "stat "+objectPath, func(ctx context.Context) error {
+		_, err := obj.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			exists = false
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check GCS object: %w", err)
+		}
+		exists = true
+		return nil
+	})
+
+	return exists, err
 }
 
-// List lists files in a directory in GCS
-func (s *GCSStorage) List(dir string) ([]string, error) {
+// Size returns an object's length in bytes from its attributes
+func (s *GCSStorage) Size(ctx context.Context, path string) (int64, error) {
+	objectPath := s.fullPath(path)
+	obj := s.client.Bucket(s.bucketName).Object(objectPath)
+
+	var size int64
+	err := s.withRetry(ctx, "stat "+objectPath, func(ctx context.Context) error {
+		attrs, err := obj.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return fmt.Errorf("failed to stat GCS object %s: %w", objectPath, fs.ErrNotExist)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check GCS object: %w", err)
+		}
+		size = attrs.Size
+		return nil
+	})
+
+	return size, err
+}
+
+// ModTime returns when an object was last written, from its attributes
+func (s *GCSStorage) ModTime(ctx context.Context, path string) (time.Time, error) {
+	objectPath := s.fullPath(path)
+	obj := s.client.Bucket(s.bucketName).Object(objectPath)
+
+	var updated time.Time
+	err := s.withRetry(ctx, "stat "+objectPath, func(ctx context.Context) error {
+		attrs, err := obj.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return fmt.Errorf("failed to stat GCS object %s: %w", objectPath, fs.ErrNotExist)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check GCS object: %w", err)
+		}
+		updated = attrs.Updated
+		return nil
+	})
+
+	return updated, err
+}
+
+// List lists objects under a directory in GCS
+func (s *GCSStorage) List(ctx context.Context, dir string) ([]string, error) {
 	prefix := s.fullPath(dir)
 	if prefix != "" && prefix[len(prefix)-1] != '/' {
 		prefix += "/"
 	}
-	
+
 	query := &storage.Query{
 		Prefix: prefix,
 	}
-	
-	it := s.client.Bucket(s.bucketName).Objects(s.ctx, query)
-	
+
 	var files []string
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to list GCS objects: %w", err)
-		}
-		
-		// Extract filename from full path
-		name := attrs.Name
-		if len(name) > len(prefix) {
-			name = name[len(prefix):]
-		}
-		
-		// Skip directories (objects ending with /)
-		if name != "" && name[len(name)-1] != '/' {
-			files = append(files, name)
+	err := s.withRetry(ctx, "list "+prefix, func(ctx context.Context) error {
+		files = nil
+		it := s.client.Bucket(s.bucketName).Objects(ctx, query)
+
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list GCS objects: %w", err)
+			}
+
+			// Extract filename from full path
+			name := attrs.Name
+			if len(name) > len(prefix) {
+				name = name[len(prefix):]
+			}
+
+			// Skip directories (objects ending with /)
+			if name != "" && name[len(name)-1] != '/' {
+				files = append(files, name)
+			}
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
-	
+
 	return files, nil
 }
 
@@ -184,42 +265,66 @@ func (s *GCSStorage) Close() error {
 // GetSignedURL generates a signed URL for public access
 func (s *GCSStorage) GetSignedURL(path string, expiration time.Duration) (string, error) {
 	objectPath := s.fullPath(path)
-	
+
 	opts := &storage.SignedURLOptions{
 		Scheme:  storage.SigningSchemeV4,
 		Method:  "GET",
 		Expires: time.Now().Add(expiration),
 	}
-	
+
 	url, err := s.client.Bucket(s.bucketName).SignedURL(objectPath, opts)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate signed URL: %w", err)
 	}
-	
+
 	return url, nil
 }
 
 // Helper functions
 
-func (s *GCSStorage) fullPath(path string) string {
-	if s.baseDir == "" {
-		return path
+// withRetry runs op with a per-attempt deadline, retrying transient failures
+// with exponential backoff until ctx is done
+func (s *GCSStorage) withRetry(ctx context.Context, desc string, op func(ctx context.Context) error) error {
+	backoff := gcsInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, s.opTimeout)
+		err := op(attemptCtx)
+		cancel()
+
+		if err == nil || attempt == gcsMaxAttempts || !isRetryableGCSError(err) {
+			return err
+		}
+
+		log.Printf("%sGCS %s failed (attempt %d/%d), retrying in %s: %v", requestid.LogPrefix(ctx), desc, attempt, gcsMaxAttempts, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+
+		backoff *= 2
+		if backoff > gcsMaxBackoff {
+			backoff = gcsMaxBackoff
+		}
 	}
-	return s.baseDir + "/" + path
 }
 
-func (s *GCSStorage) getContentType(path string) string {
-	// Determine content type based on file extension
-	if len(path) >= 5 && path[len(path)-5:] == ".m3u8" {
-		return "application/vnd.apple.mpegurl"
-	}
-	if len(path) >= 4 && path[len(path)-4:] == ".m4s" {
-		return "video/iso.segment"
+// isRetryableGCSError reports whether an error is transient: 429/5xx
+// responses, dropped connections, or an attempt hitting its deadline
+func isRetryableGCSError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
 	}
-	if len(path) >= 4 && path[len(path)-4:] == ".mp4" {
-		return "video/mp4"
+	return storage.ShouldRetry(err)
+}
+
+func (s *GCSStorage) fullPath(path string) string {
+	if s.baseDir == "" {
+		return path
 	}
-	return "application/octet-stream"
+	return s.baseDir + "/" + path
 }
 
 func (s *GCSStorage) getCacheControl(path string) string {
@@ -261,12 +366,11 @@ func (b *bytesReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	default:
 		return 0, fmt.Errorf("invalid whence")
 	}
-	
+
 	if newPos < 0 {
 		return 0, fmt.Errorf("negative position")
 	}
-	
+
 	b.pos = newPos
 	return newPos, nil
 }
-
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage implements Storage in RAM with a size cap and LRU eviction
+// Suited to low-latency live where segments are short-lived and read often
+type MemoryStorage struct {
+	maxBytes  int64
+	usedBytes int64
+	files     map[string]*list.Element // path -> element in lru
+	lru       *list.List               // Front is most recently used
+	mu        sync.Mutex
+}
+
+// memoryFile is a stored file tracked in the LRU list
+type memoryFile struct {
+	path    string
+	data    []byte
+	written time.Time
+}
+
+// NewMemoryStorage creates a new in-memory storage capped at maxBytes
+func NewMemoryStorage(maxBytes int64) (*MemoryStorage, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("memory storage size must be positive, got %d", maxBytes)
+	}
+
+	return &MemoryStorage{
+		maxBytes: maxBytes,
+		files:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}, nil
+}
+
+// Write stores a copy of data, evicting least recently used files if needed
+func (s *MemoryStorage) Write(ctx context.Context, p string, data []byte) error {
+	size := int64(len(data))
+	if size > s.maxBytes {
+		return fmt.Errorf("file %s (%d bytes) exceeds memory storage capacity (%d bytes)", p, size, s.maxBytes)
+	}
+
+	p = cleanMemoryPath(p)
+	stored := make([]byte, len(data))
+	copy(stored, data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Replace any existing file
+	if elem, exists := s.files[p]; exists {
+		s.removeElement(elem)
+	}
+
+	// Evict until the new file fits
+	for s.usedBytes+size > s.maxBytes {
+		oldest := s.lru.Back()
+		if oldest == nil {
+			break
+		}
+		s.removeElement(oldest)
+	}
+
+	s.files[p] = s.lru.PushFront(&memoryFile{path: p, data: stored, written: time.Now()})
+	s.usedBytes += size
+
+	return nil
+}
+
+// Read returns a file's data
+// The returned slice is shared with the store and must not be modified
+func (s *MemoryStorage) Read(ctx context.Context, p string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, exists := s.files[cleanMemoryPath(p)]
+	if !exists {
+		return nil, fmt.Errorf("failed to read file %s: %w", p, fs.ErrNotExist)
+	}
+
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*memoryFile).data, nil
+}
+
+// ReadSeeker returns a ReadSeeker for the file
+func (s *MemoryStorage) ReadSeeker(ctx context.Context, p string) (io.ReadSeeker, error) {
+	data, err := s.Read(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &bytesReadSeeker{data: data}, nil
+}
+
+// Delete deletes a file
+func (s *MemoryStorage) Delete(ctx context.Context, p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, exists := s.files[cleanMemoryPath(p)]; exists {
+		s.removeElement(elem)
+	}
+	return nil
+}
+
+// Exists checks if a file exists
+func (s *MemoryStorage) Exists(ctx context.Context, p string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.files[cleanMemoryPath(p)]
+	return exists, nil
+}
+
+// Size returns a file's length in bytes
+func (s *MemoryStorage) Size(ctx context.Context, p string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, exists := s.files[cleanMemoryPath(p)]
+	if !exists {
+		return 0, fmt.Errorf("failed to stat file %s: %w", p, fs.ErrNotExist)
+	}
+	return int64(len(elem.Value.(*memoryFile).data)), nil
+}
+
+// ModTime returns when a file was written
+func (s *MemoryStorage) ModTime(ctx context.Context, p string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, exists := s.files[cleanMemoryPath(p)]
+	if !exists {
+		return time.Time{}, fmt.Errorf("failed to stat file %s: %w", p, fs.ErrNotExist)
+	}
+	return elem.Value.(*memoryFile).written, nil
+}
+
+// List lists files under a directory, including those in subdirectories
+func (s *MemoryStorage) List(ctx context.Context, dir string) ([]string, error) {
+	prefix := cleanMemoryPath(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []string
+	for p := range s.files {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		files = append(files, p[len(prefix):])
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// UsedBytes returns the number of bytes currently stored
+func (s *MemoryStorage) UsedBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usedBytes
+}
+
+// removeElement drops a file from the store (caller holds s.mu)
+func (s *MemoryStorage) removeElement(elem *list.Element) {
+	file := s.lru.Remove(elem).(*memoryFile)
+	delete(s.files, file.path)
+	s.usedBytes -= int64(len(file.data))
+}
+
+// cleanMemoryPath normalizes a path so "a/b", "/a/b" and "a//b" refer to the same file
+func cleanMemoryPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
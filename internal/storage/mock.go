@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op names a Storage operation, for failure injection in MockStorage
+type Op string
+
+const (
+	OpWrite   Op = "write"
+	OpRead    Op = "read" // Read and ReadSeeker
+	OpDelete  Op = "delete"
+	OpExists  Op = "exists"
+	OpSize    Op = "size"
+	OpModTime Op = "modtime"
+	OpList    Op = "list"
+)
+
+// FailFunc decides whether an operation on a path fails; a nil return lets it proceed
+type FailFunc func(op Op, path string) error
+
+// MockStorage implements Storage in an unbounded map, for tests of code
+// built on Storage. Unlike MemoryStorage it never evicts, counts calls per
+// operation and can be made to fail on demand.
+type MockStorage struct {
+	files    map[string][]byte
+	modTimes map[string]time.Time
+	calls    map[Op]int
+	fail     FailFunc
+	mu       sync.Mutex
+}
+
+// NewMockStorage creates an empty mock storage
+func NewMockStorage() *MockStorage {
+	return &MockStorage{
+		files:    make(map[string][]byte),
+		modTimes: make(map[string]time.Time),
+		calls:    make(map[Op]int),
+	}
+}
+
+// SetFailFunc installs fn to inject errors into subsequent operations; nil clears it
+func (s *MockStorage) SetFailFunc(fn FailFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = fn
+}
+
+// FailOn makes every op on path return err; an empty path matches all paths
+func (s *MockStorage) FailOn(op Op, path string, err error) {
+	path = cleanMemoryPath(path)
+	s.SetFailFunc(func(o Op, p string) error {
+		if o == op && (path == "" || p == path) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Calls returns how many times op has been called, including failed calls
+func (s *MockStorage) Calls(op Op) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[op]
+}
+
+// Paths returns every stored path, sorted
+func (s *MockStorage) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := make([]string, 0, len(s.files))
+	for p := range s.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// begin counts a call and runs the fail hook (caller holds s.mu)
+func (s *MockStorage) begin(op Op, p string) error {
+	s.calls[op]++
+	if s.fail == nil {
+		return nil
+	}
+	return s.fail(op, p)
+}
+
+// Write stores a copy of data
+func (s *MockStorage) Write(ctx context.Context, p string, data []byte) error {
+	p = cleanMemoryPath(p)
+	stored := make([]byte, len(data))
+	copy(stored, data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.begin(OpWrite, p); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", p, err)
+	}
+
+	s.files[p] = stored
+	s.modTimes[p] = time.Now()
+	return nil
+}
+
+// Read returns a copy of a file's data
+func (s *MockStorage) Read(ctx context.Context, p string) ([]byte, error) {
+	p = cleanMemoryPath(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.begin(OpRead, p); err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", p, err)
+	}
+
+	data, exists := s.files[p]
+	if !exists {
+		return nil, fmt.Errorf("failed to read file %s: %w", p, fs.ErrNotExist)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// ReadSeeker returns a ReadSeeker over a copy of the file
+func (s *MockStorage) ReadSeeker(ctx context.Context, p string) (io.ReadSeeker, error) {
+	data, err := s.Read(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &bytesReadSeeker{data: data}, nil
+}
+
+// Delete deletes a file
+func (s *MockStorage) Delete(ctx context.Context, p string) error {
+	p = cleanMemoryPath(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.begin(OpDelete, p); err != nil {
+		return fmt.Errorf("failed to delete file %s: %w", p, err)
+	}
+
+	delete(s.files, p)
+	delete(s.modTimes, p)
+	return nil
+}
+
+// Exists checks if a file exists
+func (s *MockStorage) Exists(ctx context.Context, p string) (bool, error) {
+	p = cleanMemoryPath(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.begin(OpExists, p); err != nil {
+		return false, fmt.Errorf("failed to check file %s: %w", p, err)
+	}
+
+	_, exists := s.files[p]
+	return exists, nil
+}
+
+// Size returns a file's length in bytes
+func (s *MockStorage) Size(ctx context.Context, p string) (int64, error) {
+	p = cleanMemoryPath(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.begin(OpSize, p); err != nil {
+		return 0, fmt.Errorf("failed to stat file %s: %w", p, err)
+	}
+
+	data, exists := s.files[p]
+	if !exists {
+		return 0, fmt.Errorf("failed to stat file %s: %w", p, fs.ErrNotExist)
+	}
+	return int64(len(data)), nil
+}
+
+// ModTime returns when a file was written, or as set by SetModTime
+func (s *MockStorage) ModTime(ctx context.Context, p string) (time.Time, error) {
+	p = cleanMemoryPath(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.begin(OpModTime, p); err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat file %s: %w", p, err)
+	}
+
+	modTime, exists := s.modTimes[p]
+	if !exists {
+		return time.Time{}, fmt.Errorf("failed to stat file %s: %w", p, fs.ErrNotExist)
+	}
+	return modTime, nil
+}
+
+// SetModTime backdates or postdates a stored file, e.g. to test expiry
+func (s *MockStorage) SetModTime(p string, modTime time.Time) {
+	p = cleanMemoryPath(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.files[p]; exists {
+		s.modTimes[p] = modTime
+	}
+}
+
+// List lists files under a directory, including those in subdirectories
+func (s *MockStorage) List(ctx context.Context, dir string) ([]string, error) {
+	prefix := cleanMemoryPath(dir)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.begin(OpList, prefix); err != nil {
+		return nil, fmt.Errorf("failed to list directory %s: %w", dir, err)
+	}
+
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var files []string
+	for p := range s.files {
+		if strings.HasPrefix(p, prefix) {
+			files = append(files, p[len(prefix):])
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"path"
+	"time"
+)
+
+// PrefixedStorage confines another Storage to a directory, e.g. to keep one
+// tenant's streams apart from another's in a shared bucket. Paths are
+// relative to the directory, and List never sees outside it.
+type PrefixedStorage struct {
+	base   Storage
+	prefix string
+}
+
+// WithPrefix returns a Storage whose paths are resolved under dir in base
+func WithPrefix(base Storage, dir string) *PrefixedStorage {
+	return &PrefixedStorage{base: base, prefix: cleanMemoryPath(dir)}
+}
+
+// Prefix returns the directory the storage is confined to
+func (p *PrefixedStorage) Prefix() string {
+	return p.prefix
+}
+
+// resolve maps a path to the underlying storage; cleaning first keeps ".."
+// from climbing out of the prefix
+func (p *PrefixedStorage) resolve(name string) string {
+	return path.Join(p.prefix, cleanMemoryPath(name))
+}
+
+// Write writes data under the prefix
+func (p *PrefixedStorage) Write(ctx context.Context, name string, data []byte) error {
+	return p.base.Write(ctx, p.resolve(name), data)
+}
+
+// Read reads a file under the prefix
+func (p *PrefixedStorage) Read(ctx context.Context, name string) ([]byte, error) {
+	return p.base.Read(ctx, p.resolve(name))
+}
+
+// ReadSeeker returns a ReadSeeker for a file under the prefix
+func (p *PrefixedStorage) ReadSeeker(ctx context.Context, name string) (io.ReadSeeker, error) {
+	return p.base.ReadSeeker(ctx, p.resolve(name))
+}
+
+// Delete deletes a file under the prefix
+func (p *PrefixedStorage) Delete(ctx context.Context, name string) error {
+	return p.base.Delete(ctx, p.resolve(name))
+}
+
+// Exists checks if a file exists under the prefix
+func (p *PrefixedStorage) Exists(ctx context.Context, name string) (bool, error) {
+	return p.base.Exists(ctx, p.resolve(name))
+}
+
+// Size returns the length of a file under the prefix
+func (p *PrefixedStorage) Size(ctx context.Context, name string) (int64, error) {
+	return p.base.Size(ctx, p.resolve(name))
+}
+
+// ModTime returns when a file under the prefix was last written
+func (p *PrefixedStorage) ModTime(ctx context.Context, name string) (time.Time, error) {
+	return p.base.ModTime(ctx, p.resolve(name))
+}
+
+// List lists files under a directory below the prefix, relative to that directory
+func (p *PrefixedStorage) List(ctx context.Context, dir string) ([]string, error) {
+	return p.base.List(ctx, p.resolve(dir))
+}
@@ -1,31 +1,49 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// tempFilePrefix marks in-progress writes so they can be skipped by List
+const tempFilePrefix = ".tmp-"
+
 // Storage interface for storing and retrieving stream segments
+// Every operation takes the caller's context; remote backends stop retrying
+// and abandon the request once it is done.
 type Storage interface {
 	// Write writes data to a file path
-	Write(path string, data []byte) error
+	Write(ctx context.Context, path string, data []byte) error
 
 	// Read reads data from a file path
-	Read(path string) ([]byte, error)
+	Read(ctx context.Context, path string) ([]byte, error)
 
 	// ReadSeeker returns a ReadSeeker for the file (useful for http.ServeContent)
-	ReadSeeker(path string) (io.ReadSeeker, error)
+	ReadSeeker(ctx context.Context, path string) (io.ReadSeeker, error)
 
 	// Delete deletes a file
-	Delete(path string) error
+	Delete(ctx context.Context, path string) error
 
 	// Exists checks if a file exists
-	Exists(path string) (bool, error)
+	Exists(ctx context.Context, path string) (bool, error)
+
+	// Size returns a file's length in bytes without reading it
+	Size(ctx context.Context, path string) (int64, error)
+
+	// ModTime returns when a file was last written
+	ModTime(ctx context.Context, path string) (time.Time, error)
 
-	// List lists files in a directory
-	List(dir string) ([]string, error)
+	// List lists files under a directory, including those in subdirectories,
+	// as slash-separated paths relative to it
+	List(ctx context.Context, dir string) ([]string, error)
 }
 
 // LocalStorage implements Storage using local filesystem
@@ -45,8 +63,10 @@ func NewLocalStorage(baseDir string) (*LocalStorage, error) {
 	}, nil
 }
 
-// Write writes data to a file
-func (s *LocalStorage) Write(path string, data []byte) error {
+// Write writes data to a file atomically
+// Data goes to a temp file in the same directory which is then renamed into
+// place, so concurrent readers never see a partially written file
+func (s *LocalStorage) Write(ctx context.Context, path string, data []byte) error {
 	fullPath := filepath.Join(s.baseDir, path)
 
 	// Create parent directories
@@ -55,16 +75,38 @@ func (s *LocalStorage) Write(path string, data []byte) error {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	// Write file
-	if err := os.WriteFile(fullPath, data, 0644); err != nil {
+	// Write to a temp file alongside the destination
+	tmp, err := os.CreateTemp(dir, tempFilePrefix+filepath.Base(fullPath)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
 		return fmt.Errorf("failed to write file: %w", err)
 	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+
+	// Rename is atomic on the same filesystem
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
 
 	return nil
 }
 
 // Read reads data from a file
-func (s *LocalStorage) Read(path string) ([]byte, error) {
+func (s *LocalStorage) Read(ctx context.Context, path string) ([]byte, error) {
 	fullPath := filepath.Join(s.baseDir, path)
 
 	data, err := os.ReadFile(fullPath)
@@ -76,7 +118,7 @@ func (s *LocalStorage) Read(path string) ([]byte, error) {
 }
 
 // ReadSeeker returns a ReadSeeker for the file
-func (s *LocalStorage) ReadSeeker(path string) (io.ReadSeeker, error) {
+func (s *LocalStorage) ReadSeeker(ctx context.Context, path string) (io.ReadSeeker, error) {
 	fullPath := filepath.Join(s.baseDir, path)
 
 	file, err := os.Open(fullPath)
@@ -88,7 +130,7 @@ func (s *LocalStorage) ReadSeeker(path string) (io.ReadSeeker, error) {
 }
 
 // Delete deletes a file
-func (s *LocalStorage) Delete(path string) error {
+func (s *LocalStorage) Delete(ctx context.Context, path string) error {
 	fullPath := filepath.Join(s.baseDir, path)
 
 	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
@@ -99,7 +141,7 @@ func (s *LocalStorage) Delete(path string) error {
 }
 
 // Exists checks if a file exists
-func (s *LocalStorage) Exists(path string) (bool, error) {
+func (s *LocalStorage) Exists(ctx context.Context, path string) (bool, error) {
 	fullPath := filepath.Join(s.baseDir, path)
 
 	_, err := os.Stat(fullPath)
@@ -113,20 +155,52 @@ func (s *LocalStorage) Exists(path string) (bool, error) {
 	return true, nil
 }
 
-// List lists files in a directory
-func (s *LocalStorage) List(dir string) ([]string, error) {
-	fullPath := filepath.Join(s.baseDir, dir)
+// Size returns a file's length in bytes
+func (s *LocalStorage) Size(ctx context.Context, path string) (int64, error) {
+	fullPath := filepath.Join(s.baseDir, path)
 
-	entries, err := os.ReadDir(fullPath)
+	info, err := os.Stat(fullPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list directory: %w", err)
+		return 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	return info.Size(), nil
+}
+
+// ModTime returns a file's modification time
+func (s *LocalStorage) ModTime(ctx context.Context, path string) (time.Time, error) {
+	fullPath := filepath.Join(s.baseDir, path)
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	files := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			files = append(files, entry.Name())
+	return info.ModTime(), nil
+}
+
+// List lists files under a directory, including those in subdirectories
+func (s *LocalStorage) List(ctx context.Context, dir string) ([]string, error) {
+	fullPath := filepath.Join(s.baseDir, dir)
+
+	var files []string
+	err := filepath.WalkDir(fullPath, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			return nil
 		}
+
+		rel, err := filepath.Rel(fullPath, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory: %w", err)
 	}
 
 	return files, nil
@@ -136,3 +210,26 @@ func (s *LocalStorage) List(dir string) ([]string, error) {
 func (s *LocalStorage) GetFullPath(path string) string {
 	return filepath.Join(s.baseDir, path)
 }
+
+// Probe checks that s is usable by writing a small file at path, reading it
+// back and deleting it
+func Probe(ctx context.Context, s Storage, path string) error {
+	data := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	if err := s.Write(ctx, path, data); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+
+	got, err := s.Read(ctx, path)
+	if err != nil {
+		return fmt.Errorf("read failed: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read back %d bytes, want %d", len(got), len(data))
+	}
+
+	if err := s.Delete(ctx, path); err != nil {
+		return fmt.Errorf("delete failed: %w", err)
+	}
+	return nil
+}
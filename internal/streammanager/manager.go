@@ -2,8 +2,11 @@ package streammanager
 
 import (
 	"fmt"
+	"rapidrtmp/internal/metrics"
+	"rapidrtmp/internal/webhook"
 	"rapidrtmp/pkg/models"
 	"sync"
+	"time"
 )
 
 // Manager handles stream lifecycle and maintains in-memory registry
@@ -12,27 +15,83 @@ type Manager struct {
 	mu      sync.RWMutex
 
 	// Channels for pub/sub
-	subscribers map[string][]chan *models.Frame // streamKey -> list of subscriber channels
+	subscribers map[string][]*subscriber // streamKey -> list of subscribers
+	bufferSizes map[SubscriberKind]int   // Default channel capacity per subscriber kind
 	subMu       sync.RWMutex
+
+	// GOP cache: frames since the most recent keyframe, per stream
+	gopCache map[string][]*models.Frame // streamKey -> frames starting at latest keyframe
+	gopMu    sync.RWMutex
+
+	// Last H.264 decoder configuration per stream, kept across publisher reconnects
+	videoConfigs map[string]VideoConfig // streamKey -> SPS/PPS from the last sequence header
+	videoMu      sync.RWMutex
+
+	metrics   *metrics.Metrics  // Optional, may be nil
+	webhook   *webhook.Notifier // Optional lifecycle notifications, may be nil
+	announced map[string]bool   // Streams whose start was sent to the webhook, guarded by mu
 }
 
+// VideoConfig is the H.264 decoder configuration from a stream's AVC sequence header
+type VideoConfig struct {
+	SPS        [][]byte // Sequence Parameter Sets
+	PPS        [][]byte // Picture Parameter Sets
+	NALULength int      // NALU length size from AVCC
+}
+
+// maxGOPCacheFrames bounds the GOP cache for streams with very long keyframe intervals
+const maxGOPCacheFrames = 1000
+
 // New creates a new stream manager
-func New() *Manager {
+func New(m *metrics.Metrics) *Manager {
 	return &Manager{
-		streams:     make(map[string]*models.Stream),
-		subscribers: make(map[string][]chan *models.Frame),
+		streams:      make(map[string]*models.Stream),
+		subscribers:  make(map[string][]*subscriber),
+		bufferSizes:  make(map[SubscriberKind]int),
+		gopCache:     make(map[string][]*models.Frame),
+		videoConfigs: make(map[string]VideoConfig),
+		announced:    make(map[string]bool),
+		metrics:      m,
 	}
 }
 
+// SetWebhook enables lifecycle notifications for stream start and stop
+func (m *Manager) SetWebhook(notifier *webhook.Notifier) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.webhook = notifier
+}
+
+// SetSubscriberBuffer sets the channel capacity for subscriptions of a kind
+// that don't choose their own, e.g. smaller for low-latency viewers
+func (m *Manager) SetSubscriberBuffer(kind SubscriberKind, size int) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.bufferSizes[kind] = size
+}
+
+// subscriberBuffer returns the channel capacity for a kind of subscriber
+// Caller holds subMu
+func (m *Manager) subscriberBuffer(kind SubscriberKind) int {
+	if kind == "" {
+		kind = SubscriberInternal
+	}
+	if size, ok := m.bufferSizes[kind]; ok && size > 0 {
+		return size
+	}
+	return DefaultSubscriberBuffer
+}
+
 // CreateStream creates or retrieves a stream
 func (m *Manager) CreateStream(streamKey string, publisherIP string) (*models.Stream, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	// Check if stream already exists
-	if stream, exists := m.streams[streamKey]; exists {
+	previous, exists := m.streams[streamKey]
+	if exists {
 		// If stream is already live, don't allow another publisher
-		if stream.GetState() == models.StreamStateLive {
+		if previous.GetState() == models.StreamStateLive {
 			return nil, fmt.Errorf("stream %s is already live", streamKey)
 		}
 	}
@@ -40,15 +99,44 @@ func (m *Manager) CreateStream(streamKey string, publisherIP string) (*models.St
 	// Create new stream
 	stream := &models.Stream{
 		Key:         streamKey,
-		State:       models.StreamStateConnecting,
+		State:       models.StreamStateIdle,
 		PublisherIP: publisherIP,
 		Metadata:    make(map[string]interface{}),
 	}
 
+	// Keep one timeline per stream key across reconnects
+	if exists {
+		stream.State = previous.GetState()
+		stream.InheritHistory(previous)
+		stream.InheritObservers(previous)
+	}
+	stream.SetState(models.StreamStateConnecting)
+
 	m.streams[streamKey] = stream
+
 	return stream, nil
 }
 
+// AnnounceStream sends the stream started webhook. Call it once the stream
+// is fully up, e.g. segmenting, so integrators never hear of a stream that
+// failed to start. Only announced streams get a stream stopped webhook.
+func (m *Manager) AnnounceStream(streamKey string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stream, exists := m.streams[streamKey]
+	if !exists || m.webhook == nil || m.announced[streamKey] {
+		return
+	}
+	m.announced[streamKey] = true
+
+	m.webhook.Notify(webhook.Payload{
+		StreamKey:   streamKey,
+		Event:       webhook.EventStreamStarted,
+		PublisherIP: stream.PublisherIP,
+	})
+}
+
 // GetStream retrieves a stream by key
 func (m *Manager) GetStream(streamKey string) (*models.Stream, bool) {
 	m.mu.RLock()
@@ -100,19 +188,72 @@ func (m *Manager) StopStream(streamKey string) error {
 
 	// Close all subscriber channels
 	m.closeSubscribers(streamKey)
+	m.clearGOPCache(streamKey)
+	m.deleteStreamMetrics(streamKey)
+
+	if m.webhook != nil && m.announced[streamKey] {
+		delete(m.announced, streamKey)
+		m.webhook.Notify(stoppedPayload(stream))
+	}
 
 	return nil
 }
 
+// stoppedPayload builds the webhook payload for a stopped stream
+func stoppedPayload(stream *models.Stream) webhook.Payload {
+	stats := stream.GetStats()
+
+	duration := 0
+	if startedAt := stream.GetStartedAt(); !startedAt.IsZero() {
+		duration = int(time.Since(startedAt).Seconds())
+	}
+
+	return webhook.Payload{
+		StreamKey:   stream.Key,
+		Event:       webhook.EventStreamStopped,
+		PublisherIP: stream.PublisherIP,
+		Stats: &webhook.Stats{
+			BytesReceived:     stats.BytesReceived,
+			FramesReceived:    stats.FramesReceived,
+			KeyFramesReceived: stats.KeyFramesReceived,
+			DroppedFrames:     stats.DroppedFrames,
+			DurationSeconds:   duration,
+		},
+	}
+}
+
 // DeleteStream removes a stream from the registry
 func (m *Manager) DeleteStream(streamKey string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	m.closeSubscribers(streamKey)
+	m.clearGOPCache(streamKey)
+	m.clearVideoConfig(streamKey)
+	m.deleteStreamMetrics(streamKey)
+	delete(m.announced, streamKey)
 	delete(m.streams, streamKey)
 }
 
+// deleteStreamMetrics drops per-stream metric series once a stream ends
+func (m *Manager) deleteStreamMetrics(streamKey string) {
+	if m.metrics != nil {
+		m.metrics.DeleteStreamMetrics(streamKey)
+	}
+}
+
+// WatchStream registers an observer on a stream's stats and state changes.
+// Returns a channel signalled on every change and a function to stop watching.
+func (m *Manager) WatchStream(streamKey string) (<-chan struct{}, func(), error) {
+	stream, exists := m.GetStream(streamKey)
+	if !exists {
+		return nil, nil, fmt.Errorf("stream %s not found", streamKey)
+	}
+
+	updates, unwatch := stream.AddObserver()
+	return updates, unwatch, nil
+}
+
 // PublishFrame publishes a frame to all subscribers
 func (m *Manager) PublishFrame(frame *models.Frame) error {
 	// Update stream stats
@@ -123,10 +264,14 @@ func (m *Manager) PublishFrame(frame *models.Frame) error {
 
 	stream.UpdateStats(frame)
 
-	// Send frame to all subscribers
+	// Caching and taking the subscriber snapshot together under gopMu means a
+	// subscriber primed with the GOP sees each frame exactly once
+	m.gopMu.Lock()
+	m.cacheFrame(frame)
 	m.subMu.RLock()
 	subscribers, exists := m.subscribers[frame.StreamKey]
 	m.subMu.RUnlock()
+	m.gopMu.Unlock()
 
 	if !exists || len(subscribers) == 0 {
 		// No subscribers, frame is dropped
@@ -134,13 +279,13 @@ func (m *Manager) PublishFrame(frame *models.Frame) error {
 	}
 
 	// Send to all subscribers (non-blocking)
-	for _, ch := range subscribers {
-		select {
-		case ch <- frame:
-			// Frame sent successfully
-		default:
-			// Channel is full, drop frame
+	for _, sub := range subscribers {
+		dropped := sub.deliver(frame)
+		for i := 0; i < dropped; i++ {
 			stream.IncrementDroppedFrames()
+			if m.metrics != nil {
+				m.metrics.RecordFrameDropped(frame.StreamKey, string(sub.policy))
+			}
 		}
 	}
 
@@ -149,29 +294,65 @@ func (m *Manager) PublishFrame(frame *models.Frame) error {
 
 // Subscribe creates a subscription to a stream's frames
 // Returns a channel that will receive frames and a cleanup function
-func (m *Manager) Subscribe(streamKey string, bufferSize int) (<-chan *models.Frame, func()) {
+func (m *Manager) Subscribe(streamKey string, opts SubscribeOptions) (<-chan *models.Frame, func()) {
+	// Hold gopMu so no frame is published between priming and registering
+	m.gopMu.RLock()
+	defer m.gopMu.RUnlock()
 	m.subMu.Lock()
 	defer m.subMu.Unlock()
 
-	// Create subscriber channel
-	ch := make(chan *models.Frame, bufferSize)
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = m.subscriberBuffer(opts.Kind)
+	}
+	sub := newSubscriber(opts)
+
+	// Frames are immutable once published, so the cached pointers can be shared
+	if opts.WithGOP {
+		for _, frame := range m.gopCache[streamKey] {
+			sub.deliver(frame)
+		}
+	}
 
 	// Add to subscribers list
 	if m.subscribers[streamKey] == nil {
-		m.subscribers[streamKey] = make([]chan *models.Frame, 0)
+		m.subscribers[streamKey] = make([]*subscriber, 0)
 	}
-	m.subscribers[streamKey] = append(m.subscribers[streamKey], ch)
+	m.subscribers[streamKey] = append(m.subscribers[streamKey], sub)
 
 	// Return cleanup function
 	cleanup := func() {
-		m.unsubscribe(streamKey, ch)
+		m.unsubscribe(streamKey, sub)
 	}
 
-	return ch, cleanup
+	return sub.ch, cleanup
 }
 
-// unsubscribe removes a subscriber channel
-func (m *Manager) unsubscribe(streamKey string, ch chan *models.Frame) {
+// SubscriberCount returns the number of frame subscribers for a stream,
+// including internal pipeline consumers
+func (m *Manager) SubscriberCount(streamKey string) int {
+	m.subMu.RLock()
+	defer m.subMu.RUnlock()
+
+	return len(m.subscribers[streamKey])
+}
+
+// ViewerSubscriberCount returns the number of viewer subscribers for a stream,
+// excluding internal consumers such as the segmenter
+func (m *Manager) ViewerSubscriberCount(streamKey string) int {
+	m.subMu.RLock()
+	defer m.subMu.RUnlock()
+
+	count := 0
+	for _, sub := range m.subscribers[streamKey] {
+		if sub.kind == SubscriberViewer {
+			count++
+		}
+	}
+	return count
+}
+
+// unsubscribe removes a subscriber
+func (m *Manager) unsubscribe(streamKey string, sub *subscriber) {
 	m.subMu.Lock()
 	defer m.subMu.Unlock()
 
@@ -180,12 +361,14 @@ func (m *Manager) unsubscribe(streamKey string, ch chan *models.Frame) {
 		return
 	}
 
-	// Find and remove the channel
-	for i, subCh := range subscribers {
-		if subCh == ch {
-			// Remove from slice
-			m.subscribers[streamKey] = append(subscribers[:i], subscribers[i+1:]...)
-			close(ch)
+	// Find and remove the subscriber
+	for i, s := range subscribers {
+		if s == sub {
+			// Remove into a new slice; PublishFrame may be iterating the old one
+			remaining := make([]*subscriber, 0, len(subscribers)-1)
+			remaining = append(remaining, subscribers[:i]...)
+			m.subscribers[streamKey] = append(remaining, subscribers[i+1:]...)
+			sub.close()
 			break
 		}
 	}
@@ -207,13 +390,87 @@ func (m *Manager) closeSubscribers(streamKey string) {
 	}
 
 	// Close all channels
-	for _, ch := range subscribers {
-		close(ch)
+	for _, sub := range subscribers {
+		sub.close()
 	}
 
 	delete(m.subscribers, streamKey)
 }
 
+// cacheFrame records a frame in the stream's GOP cache (caller holds gopMu).
+// A video keyframe starts a new GOP; frames before the first keyframe are not cached.
+func (m *Manager) cacheFrame(frame *models.Frame) {
+	if frame.IsVideo && frame.IsKeyFrame {
+		m.gopCache[frame.StreamKey] = []*models.Frame{frame}
+		return
+	}
+
+	gop, exists := m.gopCache[frame.StreamKey]
+	if !exists || len(gop) >= maxGOPCacheFrames {
+		return
+	}
+
+	m.gopCache[frame.StreamKey] = append(gop, frame)
+}
+
+// clearGOPCache drops the cached GOP for a stream
+func (m *Manager) clearGOPCache(streamKey string) {
+	m.gopMu.Lock()
+	defer m.gopMu.Unlock()
+
+	delete(m.gopCache, streamKey)
+}
+
+// GetGOPCache returns a copy of the frames since the stream's latest keyframe
+func (m *Manager) GetGOPCache(streamKey string) []*models.Frame {
+	m.gopMu.RLock()
+	defer m.gopMu.RUnlock()
+
+	gop := m.gopCache[streamKey]
+	frames := make([]*models.Frame, len(gop))
+	copy(frames, gop)
+	return frames
+}
+
+// GetLatestKeyFrame returns the most recent keyframe received for a stream
+func (m *Manager) GetLatestKeyFrame(streamKey string) (*models.Frame, bool) {
+	m.gopMu.RLock()
+	defer m.gopMu.RUnlock()
+
+	gop, exists := m.gopCache[streamKey]
+	if !exists || len(gop) == 0 {
+		return nil, false
+	}
+	return gop[0], true
+}
+
+// Stats returns aggregate statistics across all streams
+func (m *Manager) Stats() models.ServerStats {
+	var stats models.ServerStats
+
+	m.mu.RLock()
+	stats.TotalStreams = len(m.streams)
+	for _, stream := range m.streams {
+		if stream.GetState() == models.StreamStateLive {
+			stats.LiveStreams++
+		}
+
+		streamStats := stream.GetStats()
+		stats.BytesReceived += streamStats.BytesReceived
+		stats.FramesReceived += streamStats.FramesReceived
+		stats.DroppedFrames += streamStats.DroppedFrames
+	}
+	m.mu.RUnlock()
+
+	m.subMu.RLock()
+	for _, subscribers := range m.subscribers {
+		stats.Subscribers += len(subscribers)
+	}
+	m.subMu.RUnlock()
+
+	return stats
+}
+
 // GetStreamCount returns the total number of streams
 func (m *Manager) GetStreamCount() int {
 	m.mu.RLock()
@@ -234,3 +491,30 @@ func (m *Manager) GetLiveStreamCount() int {
 	}
 	return count
 }
+
+// SetVideoConfig records the latest AVC sequence header for a stream so a
+// reconnecting publisher can keep prepending SPS/PPS to keyframes even if its
+// encoder doesn't resend the sequence header
+func (m *Manager) SetVideoConfig(streamKey string, config VideoConfig) {
+	m.videoMu.Lock()
+	defer m.videoMu.Unlock()
+
+	m.videoConfigs[streamKey] = config
+}
+
+// GetVideoConfig returns the last AVC sequence header seen for a stream
+func (m *Manager) GetVideoConfig(streamKey string) (VideoConfig, bool) {
+	m.videoMu.RLock()
+	defer m.videoMu.RUnlock()
+
+	config, exists := m.videoConfigs[streamKey]
+	return config, exists
+}
+
+// clearVideoConfig forgets a stream's cached decoder configuration
+func (m *Manager) clearVideoConfig(streamKey string) {
+	m.videoMu.Lock()
+	defer m.videoMu.Unlock()
+
+	delete(m.videoConfigs, streamKey)
+}
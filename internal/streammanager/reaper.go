@@ -0,0 +1,116 @@
+package streammanager
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// StartReaper periodically stops live streams that haven't received a frame
+// within idleTimeout, e.g. when a publisher vanished without closing its
+// connection. onReap (may be nil) runs before each stream is stopped so
+// callers can tear down per-stream work such as segmentation.
+func (m *Manager) StartReaper(ctx context.Context, idleTimeout time.Duration, onReap func(streamKey string)) {
+	go func() {
+		ticker := time.NewTicker(idleTimeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.reapIdleStreams(idleTimeout, onReap)
+			}
+		}
+	}()
+}
+
+// publishLimitInterval is how often StartPublishLimit checks stream ages
+const publishLimitInterval = time.Second
+
+// StartPublishLimit periodically stops live streams that have been publishing
+// for longer than maxDuration. onStop (may be nil) runs before each stream is
+// stopped, like StartReaper's onReap.
+func (m *Manager) StartPublishLimit(ctx context.Context, maxDuration time.Duration, onStop func(streamKey string)) {
+	go func() {
+		ticker := time.NewTicker(publishLimitInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.stopLongStreams(maxDuration, onStop)
+			}
+		}
+	}()
+}
+
+// stopLongStreams stops every live stream that went live more than maxDuration ago
+func (m *Manager) stopLongStreams(maxDuration time.Duration, onStop func(streamKey string)) {
+	cutoff := time.Now().Add(-maxDuration)
+
+	for _, stream := range m.GetLiveStreams() {
+		startedAt := stream.GetStartedAt()
+		if startedAt.IsZero() || startedAt.After(cutoff) {
+			continue
+		}
+
+		// The publisher may have reconnected since the snapshot was taken
+		if current, exists := m.GetStream(stream.Key); !exists || current != stream {
+			continue
+		}
+
+		log.Printf("Stopping stream %s after reaching the maximum publish duration of %s", stream.Key, maxDuration)
+
+		if onStop != nil {
+			onStop(stream.Key)
+		}
+
+		if err := m.StopStream(stream.Key); err != nil {
+			log.Printf("Failed to stop stream %s: %v", stream.Key, err)
+			continue
+		}
+
+		if m.metrics != nil {
+			m.metrics.RecordStreamDurationCapped()
+		}
+	}
+}
+
+// reapIdleStreams stops every live stream idle for longer than idleTimeout
+func (m *Manager) reapIdleStreams(idleTimeout time.Duration, onReap func(streamKey string)) {
+	cutoff := time.Now().Add(-idleTimeout)
+
+	for _, stream := range m.GetLiveStreams() {
+		lastActivity := stream.GetStats().LastFrameTime
+		if lastActivity.IsZero() {
+			lastActivity = stream.GetStartedAt()
+		}
+		if lastActivity.After(cutoff) {
+			continue
+		}
+
+		// The publisher may have reconnected since the snapshot was taken
+		if current, exists := m.GetStream(stream.Key); !exists || current != stream {
+			continue
+		}
+
+		log.Printf("Reaping idle stream %s (no frames for %s)", stream.Key, time.Since(lastActivity).Round(time.Second))
+
+		if onReap != nil {
+			onReap(stream.Key)
+		}
+
+		if err := m.StopStream(stream.Key); err != nil {
+			log.Printf("Failed to stop idle stream %s: %v", stream.Key, err)
+			continue
+		}
+
+		if m.metrics != nil {
+			m.metrics.RecordStreamReaped()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package streammanager
+
+import (
+	"sync"
+
+	"rapidrtmp/pkg/models"
+)
+
+// BackpressurePolicy decides which frames a subscriber loses when it falls behind
+type BackpressurePolicy string
+
+const (
+	// DropNewest discards the incoming frame when the buffer is full
+	DropNewest BackpressurePolicy = "drop-newest"
+	// DropOldest discards the oldest buffered frame to make room for the incoming one
+	DropOldest BackpressurePolicy = "drop-oldest"
+	// DropGOP discards frames until the next video keyframe so decoders never see a partial GOP
+	DropGOP BackpressurePolicy = "drop-gop"
+)
+
+// SubscriberKind distinguishes pipeline consumers from audience members
+type SubscriberKind string
+
+const (
+	// SubscriberInternal is a pipeline consumer such as the segmenter
+	SubscriberInternal SubscriberKind = "internal"
+	// SubscriberViewer is a real viewer, e.g. an RTMP or WebRTC player
+	SubscriberViewer SubscriberKind = "viewer"
+)
+
+// DefaultSubscriberBuffer is the channel capacity used when neither the
+// subscription nor SetSubscriberBuffer picks one
+const DefaultSubscriberBuffer = 1000
+
+// MinSubscriberBuffer is the smallest sensible channel capacity. A 60 fps
+// stream with AAC audio delivers over 100 frames a second, so anything smaller
+// drops frames (with drop-newest, constantly) on the briefest consumer stall.
+const MinSubscriberBuffer = 128
+
+// SubscribeOptions configures a frame subscription
+type SubscribeOptions struct {
+	BufferSize int                // Channel capacity; 0 uses the manager's size for Kind
+	Policy     BackpressurePolicy // Defaults to DropNewest
+	Kind       SubscriberKind     // Defaults to SubscriberInternal
+	WithGOP    bool               // Start with the cached GOP so playback can begin at once
+}
+
+// subscriber is a single consumer of a stream's frames
+type subscriber struct {
+	ch       chan *models.Frame
+	kind     SubscriberKind
+	policy   BackpressurePolicy
+	skipping bool // DropGOP: discarding frames until the next keyframe
+	closed   bool // ch has been closed; guarded by mu so deliver never sends on it
+	mu       sync.Mutex
+}
+
+func newSubscriber(opts SubscribeOptions) *subscriber {
+	policy := opts.Policy
+	if policy == "" {
+		policy = DropNewest
+	}
+
+	kind := opts.Kind
+	if kind == "" {
+		kind = SubscriberInternal
+	}
+
+	return &subscriber{
+		ch:     make(chan *models.Frame, opts.BufferSize),
+		kind:   kind,
+		policy: policy,
+	}
+}
+
+// deliver sends a frame without blocking, applying the subscriber's policy
+// when the buffer is full. Returns the number of frames dropped.
+func (sub *subscriber) deliver(frame *models.Frame) int {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	// PublishFrame works from a snapshot of the subscriber list, so the
+	// subscription may have been torn down since
+	if sub.closed {
+		return 0
+	}
+
+	switch sub.policy {
+	case DropOldest:
+		if sub.trySend(frame) {
+			return 0
+		}
+
+		// Make room by discarding the oldest buffered frame
+		dropped := 0
+		select {
+		case <-sub.ch:
+			dropped++
+		default:
+		}
+
+		if sub.trySend(frame) {
+			return dropped
+		}
+		return dropped + 1
+
+	case DropGOP:
+		if sub.skipping {
+			if !frame.IsVideo || !frame.IsKeyFrame {
+				return 1
+			}
+			sub.skipping = false
+		}
+
+		if sub.trySend(frame) {
+			return 0
+		}
+
+		// The rest of this GOP is undecodable without this frame
+		sub.skipping = true
+		return 1
+
+	default:
+		if sub.trySend(frame) {
+			return 0
+		}
+		return 1
+	}
+}
+
+// close closes the subscriber's channel, at most once. Holding mu ensures no
+// deliver is mid-send when the channel is closed.
+func (sub *subscriber) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	close(sub.ch)
+}
+
+// trySend performs a non-blocking send
+func (sub *subscriber) trySend(frame *models.Frame) bool {
+	select {
+	case sub.ch <- frame:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,205 @@
+package streammanager
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rapidrtmp/pkg/models"
+)
+
+func testFrame(streamKey string, n int) *models.Frame {
+	return &models.Frame{
+		StreamKey:  streamKey,
+		IsVideo:    n%3 != 2,
+		DTS:        int64(n) * 20,
+		Payload:    []byte{0x00, 0x00, 0x00, 0x01, 0x65},
+		Codec:      "h264",
+		IsKeyFrame: n%30 == 0,
+	}
+}
+
+// TestPublishWhileUnsubscribing publishes frames from several goroutines
+// while subscribers come and go, then stops the stream mid-publish. Sending
+// on a torn-down subscription would panic; run with -race to catch data races.
+func TestPublishWhileUnsubscribing(t *testing.T) {
+	policies := []BackpressurePolicy{DropNewest, DropOldest, DropGOP}
+
+	for _, policy := range policies {
+		t.Run(string(policy), func(t *testing.T) {
+			m := New(nil)
+			const streamKey = "stress"
+			if _, err := m.CreateStream(streamKey, "127.0.0.1"); err != nil {
+				t.Fatalf("CreateStream: %v", err)
+			}
+
+			stop := make(chan struct{})
+			var published atomic.Int64
+			var publishers sync.WaitGroup
+			for p := 0; p < 4; p++ {
+				publishers.Add(1)
+				go func() {
+					defer publishers.Done()
+					for n := 0; ; n++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						// Fails once the stream is deleted; keep racing until told to stop
+						if m.PublishFrame(testFrame(streamKey, n)) == nil {
+							published.Add(1)
+						}
+					}
+				}()
+			}
+
+			var subscribers sync.WaitGroup
+			for s := 0; s < 8; s++ {
+				subscribers.Add(1)
+				go func() {
+					defer subscribers.Done()
+					for i := 0; i < 50; i++ {
+						frames, unsubscribe := m.Subscribe(streamKey, SubscribeOptions{
+							BufferSize: 4,
+							Policy:     policy,
+							Kind:       SubscriberViewer,
+							WithGOP:    i%2 == 0,
+						})
+						// Read a few frames, or none, then leave while frames are in flight
+					read:
+						for j := 0; j < i%4; j++ {
+							select {
+							case _, ok := <-frames:
+								if !ok {
+									break read
+								}
+							case <-time.After(10 * time.Millisecond):
+							}
+						}
+						unsubscribe()
+						unsubscribe() // Unsubscribing twice must be harmless
+					}
+				}()
+			}
+			subscribers.Wait()
+
+			// Subscribers left over when the stream stops are closed under the publishers
+			var remaining []<-chan *models.Frame
+			for i := 0; i < 4; i++ {
+				frames, _ := m.Subscribe(streamKey, SubscribeOptions{BufferSize: 1, Policy: policy})
+				remaining = append(remaining, frames)
+			}
+			time.Sleep(10 * time.Millisecond)
+			if err := m.StopStream(streamKey); err != nil {
+				t.Fatalf("StopStream: %v", err)
+			}
+			m.DeleteStream(streamKey)
+
+			close(stop)
+			publishers.Wait()
+
+			if published.Load() == 0 {
+				t.Fatal("no frames were published")
+			}
+			for i, frames := range remaining {
+				timeout := time.After(time.Second)
+				for open := true; open; {
+					select {
+					case _, open = <-frames:
+					case <-timeout:
+						t.Fatalf("subscription %d still open after StopStream", i)
+					}
+				}
+			}
+			if n := m.SubscriberCount(streamKey); n != 0 {
+				t.Errorf("SubscriberCount = %d after stop, want 0", n)
+			}
+		})
+	}
+}
+
+// TestSubscribeWithGOP checks that a WithGOP subscriber first receives the
+// cached GOP, starting at its keyframe, and then the live frames in order
+func TestSubscribeWithGOP(t *testing.T) {
+	m := New(nil)
+	const streamKey = "gop"
+	if _, err := m.CreateStream(streamKey, "127.0.0.1"); err != nil {
+		t.Fatalf("CreateStream: %v", err)
+	}
+
+	// Frames before the keyframe at 30 are not part of the cached GOP
+	for n := 25; n < 36; n++ {
+		if err := m.PublishFrame(testFrame(streamKey, n)); err != nil {
+			t.Fatalf("PublishFrame(%d): %v", n, err)
+		}
+	}
+
+	frames, unsubscribe := m.Subscribe(streamKey, SubscribeOptions{BufferSize: 32, WithGOP: true})
+	defer unsubscribe()
+
+	for n := 36; n < 40; n++ {
+		if err := m.PublishFrame(testFrame(streamKey, n)); err != nil {
+			t.Fatalf("PublishFrame(%d): %v", n, err)
+		}
+	}
+
+	for n := 30; n < 40; n++ {
+		select {
+		case frame := <-frames:
+			if frame.DTS != int64(n)*20 {
+				t.Fatalf("got frame with DTS %d, want frame %d (DTS %d)", frame.DTS, n, n*20)
+			}
+			if n == 30 && !frame.IsKeyFrame {
+				t.Error("first frame is not a keyframe")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("frame %d was not delivered", n)
+		}
+	}
+
+	select {
+	case frame := <-frames:
+		t.Errorf("unexpected extra frame with DTS %d", frame.DTS)
+	default:
+	}
+}
+
+// BenchmarkPublishFrameFanout publishes frames to 100 subscribers that
+// drain their channels as fast as they can
+func BenchmarkPublishFrameFanout(b *testing.B) {
+	m := New(nil)
+	const streamKey = "fanout"
+	if _, err := m.CreateStream(streamKey, "127.0.0.1"); err != nil {
+		b.Fatalf("CreateStream: %v", err)
+	}
+
+	var readers sync.WaitGroup
+	var unsubscribes []func()
+	for i := 0; i < 100; i++ {
+		frames, unsubscribe := m.Subscribe(streamKey, SubscribeOptions{BufferSize: 64, Policy: DropOldest})
+		unsubscribes = append(unsubscribes, unsubscribe)
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for range frames {
+			}
+		}()
+	}
+
+	frame := testFrame(streamKey, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.PublishFrame(frame); err != nil {
+			b.Fatalf("PublishFrame: %v", err)
+		}
+	}
+	b.StopTimer()
+
+	for _, unsubscribe := range unsubscribes {
+		unsubscribe()
+	}
+	readers.Wait()
+}
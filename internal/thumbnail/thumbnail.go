@@ -0,0 +1,157 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/storage"
+	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/pkg/models"
+)
+
+// thumbnailTimeout bounds a single FFmpeg thumbnail render
+const thumbnailTimeout = 10 * time.Second
+
+// ErrNoThumbnail is returned when a stream has not produced a thumbnail yet
+var ErrNoThumbnail = errors.New("thumbnail not available")
+
+// Thumbnailer periodically renders JPEG previews of live streams
+type Thumbnailer struct {
+	storageFor    func(streamKey string) storage.Storage // Where each stream's files are kept
+	streamManager *streammanager.Manager
+	muxer         *muxer.FFmpegMuxer
+	interval      time.Duration
+
+	lastKeyFrames map[string]*models.Frame // streamKey -> keyframe used for the current thumbnail
+	mu            sync.RWMutex
+
+	ctx    context.Context // Cancelled by Stop, killing any running FFmpeg
+	cancel context.CancelFunc
+}
+
+// New creates a new thumbnailer that stores each stream's thumbnail in the
+// storage storageFor returns for it
+func New(storageFor func(streamKey string) storage.Storage, streamManager *streammanager.Manager, interval time.Duration) *Thumbnailer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Thumbnailer{
+		storageFor:    storageFor,
+		streamManager: streamManager,
+		muxer:         muxer.NewFFmpegMuxer(), // Separate muxer so thumbnails don't block segment muxing
+		interval:      interval,
+		lastKeyFrames: make(map[string]*models.Frame),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// Start begins generating thumbnails in the background
+func (t *Thumbnailer) Start() {
+	go t.run()
+}
+
+// Stop stops the background thumbnail loop
+func (t *Thumbnailer) Stop() {
+	t.cancel()
+}
+
+// run generates thumbnails for all live streams on every tick
+func (t *Thumbnailer) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			live := make(map[string]bool)
+			for _, stream := range t.streamManager.GetLiveStreams() {
+				live[stream.Key] = true
+				t.generate(stream.Key)
+			}
+			t.removeStopped(live)
+
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// generate renders the latest keyframe of a stream to {streamKey}/thumb.jpg
+func (t *Thumbnailer) generate(streamKey string) {
+	keyFrame, ok := t.streamManager.GetLatestKeyFrame(streamKey)
+	if !ok {
+		return // No keyframe yet
+	}
+
+	// Skip if the keyframe hasn't changed since the last thumbnail
+	t.mu.RLock()
+	last := t.lastKeyFrames[streamKey]
+	t.mu.RUnlock()
+	if last == keyFrame {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, thumbnailTimeout)
+	defer cancel()
+
+	jpeg, err := t.muxer.CreateThumbnail(ctx, keyFrame.Payload)
+	if err != nil {
+		log.Printf("Failed to create thumbnail for stream %s: %v", streamKey, err)
+		return
+	}
+
+	if err := t.storageFor(streamKey).Write(t.ctx, thumbnailPath(streamKey), jpeg); err != nil {
+		log.Printf("Failed to write thumbnail for stream %s: %v", streamKey, err)
+		return
+	}
+
+	t.mu.Lock()
+	t.lastKeyFrames[streamKey] = keyFrame
+	t.mu.Unlock()
+}
+
+// removeStopped forgets and deletes the thumbnails of streams that are no
+// longer live, so neither outlives its stream
+func (t *Thumbnailer) removeStopped(live map[string]bool) {
+	var stopped []string
+	t.mu.Lock()
+	for streamKey := range t.lastKeyFrames {
+		if !live[streamKey] {
+			stopped = append(stopped, streamKey)
+			delete(t.lastKeyFrames, streamKey)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, streamKey := range stopped {
+		if err := t.storageFor(streamKey).Delete(t.ctx, thumbnailPath(streamKey)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to delete thumbnail for stream %s: %v", streamKey, err)
+		}
+	}
+}
+
+// HasThumbnail reports whether a thumbnail has been generated for a stream
+func (t *Thumbnailer) HasThumbnail(streamKey string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	_, exists := t.lastKeyFrames[streamKey]
+	return exists
+}
+
+// GetThumbnail returns the latest JPEG thumbnail for a stream
+func (t *Thumbnailer) GetThumbnail(ctx context.Context, streamKey string) ([]byte, error) {
+	if !t.HasThumbnail(streamKey) {
+		return nil, ErrNoThumbnail
+	}
+	return t.storageFor(streamKey).Read(ctx, thumbnailPath(streamKey))
+}
+
+func thumbnailPath(streamKey string) string {
+	return fmt.Sprintf("%s/thumb.jpg", streamKey)
+}
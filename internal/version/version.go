@@ -0,0 +1,59 @@
+// Package version exposes build information injected at link time, e.g.
+//
+//	go build -ldflags "-X rapidrtmp/internal/version.Version=v1.2.0 \
+//	  -X rapidrtmp/internal/version.Commit=$(git rev-parse HEAD) \
+//	  -X rapidrtmp/internal/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Set via -ldflags at build time
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build information, falling back to the VCS stamp Go
+// embeds in the binary when the ldflags variables were not set
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "unknown" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "unknown" {
+					info.BuildTime = setting.Value
+				}
+			}
+		}
+	}
+
+	return info
+}
+
+// String returns a one-line summary for logging
+func (i Info) String() string {
+	return i.Version + " (commit " + i.Commit + ", built " + i.BuildTime + ", " + i.GoVersion + ")"
+}
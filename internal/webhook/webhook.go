@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body
+const SignatureHeader = "X-RapidRTMP-Signature"
+
+// Delivery settings
+const (
+	queueSize      = 256
+	maxAttempts    = 5
+	initialBackoff = 1 * time.Second
+	requestTimeout = 10 * time.Second
+)
+
+// Event identifies a stream lifecycle event
+type Event string
+
+const (
+	EventStreamStarted Event = "stream.started"
+	EventStreamStopped Event = "stream.stopped"
+)
+
+// Stats is a snapshot of stream statistics included in webhook payloads
+type Stats struct {
+	BytesReceived     uint64 `json:"bytesReceived"`
+	FramesReceived    uint64 `json:"framesReceived"`
+	KeyFramesReceived uint64 `json:"keyFramesReceived"`
+	DroppedFrames     uint64 `json:"droppedFrames"`
+	DurationSeconds   int    `json:"durationSeconds"`
+}
+
+// Payload is the JSON body POSTed to the webhook URL
+type Payload struct {
+	StreamKey   string `json:"streamKey"`
+	Event       Event  `json:"event"`
+	Timestamp   string `json:"timestamp"` // RFC3339
+	PublisherIP string `json:"publisherIp,omitempty"`
+	Stats       *Stats `json:"stats,omitempty"`
+}
+
+// Notifier delivers lifecycle events to an external URL in the background
+type Notifier struct {
+	url    string
+	secret string
+	client *http.Client
+	queue  chan Payload
+}
+
+// New creates a notifier and starts its delivery worker
+// If secret is non-empty, each request is signed with HMAC-SHA256
+func New(url, secret string) *Notifier {
+	n := &Notifier{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: requestTimeout},
+		queue:  make(chan Payload, queueSize),
+	}
+
+	go n.run()
+	return n
+}
+
+// Notify queues an event for delivery without blocking
+// Events are dropped if the queue is full so ingest is never held up
+func (n *Notifier) Notify(payload Payload) {
+	if payload.Timestamp == "" {
+		payload.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	select {
+	case n.queue <- payload:
+	default:
+		log.Printf("Webhook queue full, dropping %s event for stream %s", payload.Event, payload.StreamKey)
+	}
+}
+
+// run delivers queued events in order
+func (n *Notifier) run() {
+	for payload := range n.queue {
+		n.deliver(payload)
+	}
+}
+
+// deliver POSTs an event, retrying with exponential backoff on failure
+func (n *Notifier) deliver(payload Payload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook payload: %v", err)
+		return
+	}
+
+	backoff := initialBackoff
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err := n.post(body)
+		if err == nil {
+			return
+		}
+
+		if attempt == maxAttempts {
+			log.Printf("Webhook %s for stream %s failed after %d attempts: %v", payload.Event, payload.StreamKey, attempt, err)
+			return
+		}
+
+		log.Printf("Webhook %s for stream %s failed (attempt %d/%d), retrying in %s: %v",
+			payload.Event, payload.StreamKey, attempt, maxAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends a single request, treating any non-2xx status as an error
+func (n *Notifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body using secret
+// Receivers can use it to verify the signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,370 @@
+package whep
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+
+	"rapidrtmp/internal/metrics"
+	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/pkg/models"
+)
+
+// ErrStreamNotLive is returned when an offer is made for a stream that
+// isn't being published
+var ErrStreamNotLive = errors.New("stream is not live")
+
+// ErrInvalidOffer is returned when an offer can't be negotiated
+var ErrInvalidOffer = errors.New("invalid SDP offer")
+
+// ErrSessionNotFound is returned when ending a session that doesn't exist
+var ErrSessionNotFound = errors.New("session not found")
+
+// connectTimeout bounds how long a negotiated session may take to connect
+const connectTimeout = 30 * time.Second
+
+// defaultProfileLevelID is offered when the stream's SPS isn't known yet
+// (Constrained Baseline, level 3.1)
+const defaultProfileLevelID = "42e01f"
+
+// Server plays live streams to WebRTC clients negotiating over WHEP. Each
+// session gets its own subscription and track, so a slow viewer only loses
+// its own frames. Only H.264 video is sent; audio isn't transcoded to Opus.
+type Server struct {
+	streamManager *streammanager.Manager
+	metrics       *metrics.Metrics
+	api           *webrtc.API
+	config        webrtc.Configuration
+
+	sessions map[string]*session // Session ID -> session
+	mu       sync.Mutex
+	closed   bool // Set by Shutdown; no new sessions are accepted
+
+	wg sync.WaitGroup // Tracks running forwarders
+}
+
+// New creates a WHEP server that uses iceServers (STUN or TURN URLs, none
+// for host candidates only) to reach viewers behind NAT
+func New(streamManager *streammanager.Manager, m *metrics.Metrics, iceServers []string) (*Server, error) {
+	if err := ValidateICEServers(iceServers); err != nil {
+		return nil, err
+	}
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("failed to register codecs: %w", err)
+	}
+
+	// NACK, RTCP reports and TWCC, as a plain PeerConnection would get
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+
+	config := webrtc.Configuration{}
+	if len(iceServers) > 0 {
+		config.ICEServers = []webrtc.ICEServer{{URLs: iceServers}}
+	}
+
+	return &Server{
+		streamManager: streamManager,
+		metrics:       m,
+		api:           webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry)),
+		config:        config,
+		sessions:      make(map[string]*session),
+	}, nil
+}
+
+// ValidateICEServers checks that each ICE server is a stun:, turn: or
+// turns: URL
+func ValidateICEServers(urls []string) error {
+	for _, url := range urls {
+		scheme, rest, _ := strings.Cut(url, ":")
+		switch scheme {
+		case "stun", "stuns", "turn", "turns":
+		default:
+			return fmt.Errorf("ICE server %q: scheme must be stun, stuns, turn or turns", url)
+		}
+		if rest == "" {
+			return fmt.Errorf("ICE server %q: missing host", url)
+		}
+	}
+	return nil
+}
+
+// Offer answers a viewer's SDP offer for a live stream, returning the
+// session ID and the answer. Candidates are gathered before answering, as
+// WHEP clients don't need to support trickle ICE.
+func (s *Server) Offer(ctx context.Context, streamKey, offer string) (string, string, error) {
+	stream, exists := s.streamManager.GetStream(streamKey)
+	if !exists || stream.GetState() != models.StreamStateLive {
+		return "", "", fmt.Errorf("%w: %s", ErrStreamNotLive, streamKey)
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + s.profileLevelID(streamKey),
+	}, "video", "rapidrtmp")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create track: %w", err)
+	}
+
+	pc, err := s.api.NewPeerConnection(s.config)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+
+	answer, err := negotiate(ctx, pc, track, offer)
+	if err != nil {
+		pc.Close()
+		return "", "", err
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		pc.Close()
+		return "", "", err
+	}
+
+	sess := &session{
+		id:        id,
+		streamKey: streamKey,
+		pc:        pc,
+		track:     track,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		pc.Close()
+		return "", "", errors.New("WHEP server is shut down")
+	}
+	s.sessions[id] = sess
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			sess.connectOnce.Do(func() { close(sess.connected) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.endSession(sess)
+		}
+	})
+
+	go s.forward(sess)
+
+	log.Printf("WHEP session %s started for stream %s", id, streamKey)
+	return id, answer, nil
+}
+
+// negotiate applies the offer and returns the answer with its candidates
+func negotiate(ctx context.Context, pc *webrtc.PeerConnection, track *webrtc.TrackLocalStaticSample, offer string) (string, error) {
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return "", fmt.Errorf("failed to add track: %w", err)
+	}
+
+	// RTCP has to be read for the interceptors, e.g. NACK, to see it
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return "", fmt.Errorf("ICE gathering: %w", ctx.Err())
+	}
+
+	return pc.LocalDescription().SDP, nil
+}
+
+// profileLevelID returns the stream's H.264 profile-level-id, taken from the
+// three bytes after the SPS NAL header
+func (s *Server) profileLevelID(streamKey string) string {
+	config, exists := s.streamManager.GetVideoConfig(streamKey)
+	if !exists || len(config.SPS) == 0 || len(config.SPS[0]) < 4 {
+		return defaultProfileLevelID
+	}
+	return hex.EncodeToString(config.SPS[0][1:4])
+}
+
+// newSessionID returns a random ID for a session's resource URL
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Close ends a viewer's session, as when the client deletes its resource
+func (s *Server) Close(streamKey, id string) error {
+	s.mu.Lock()
+	sess, exists := s.sessions[id]
+	s.mu.Unlock()
+
+	if !exists || sess.streamKey != streamKey {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	s.endSession(sess)
+	return nil
+}
+
+// SessionCount returns the number of open sessions
+func (s *Server) SessionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// endSession stops a session's forwarder and closes its peer connection
+func (s *Server) endSession(sess *session) {
+	sess.closeOnce.Do(func() {
+		s.mu.Lock()
+		delete(s.sessions, sess.id)
+		s.mu.Unlock()
+
+		close(sess.done)
+		// Closing from the state change callback would deadlock pion
+		go sess.pc.Close()
+	})
+}
+
+// Shutdown closes every session and waits for the forwarders to exit or
+// ctx to be done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		s.endSession(sess)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("WHEP shutdown: %w", ctx.Err())
+	}
+}
+
+// session is one viewer's peer connection
+type session struct {
+	id        string
+	streamKey string
+	pc        *webrtc.PeerConnection
+	track     *webrtc.TrackLocalStaticSample
+
+	connected   chan struct{} // Closed once ICE and DTLS complete
+	connectOnce sync.Once
+	done        chan struct{} // Closed when the session ends
+	closeOnce   sync.Once
+}
+
+// forward waits for the session to connect, then writes the stream's video
+// to its track until either ends
+func (s *Server) forward(sess *session) {
+	defer s.wg.Done()
+	defer s.endSession(sess)
+
+	// Subscribe only once connected: samples written earlier are discarded,
+	// and the cached GOP lets playback start without waiting for a keyframe
+	timer := time.NewTimer(connectTimeout)
+	defer timer.Stop()
+	select {
+	case <-sess.connected:
+	case <-timer.C:
+		log.Printf("WHEP session %s for stream %s did not connect within %s", sess.id, sess.streamKey, connectTimeout)
+		return
+	case <-sess.done:
+		return
+	}
+
+	frames, unsubscribe := s.streamManager.Subscribe(sess.streamKey, streammanager.SubscribeOptions{
+		Policy:  streammanager.DropGOP,
+		Kind:    streammanager.SubscriberViewer,
+		WithGOP: true,
+	})
+	defer unsubscribe()
+
+	if s.metrics != nil {
+		s.metrics.RecordViewerStart()
+		defer s.metrics.RecordViewerStop()
+	}
+
+	// A sample's duration is the gap to the next frame, so each frame is
+	// held until the next one arrives
+	var pending *models.Frame
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				log.Printf("WHEP session %s ended: stream %s stopped", sess.id, sess.streamKey)
+				return
+			}
+			if !frame.IsVideo || frame.Codec != "h264" {
+				continue
+			}
+			if pending == nil {
+				if frame.IsKeyFrame {
+					pending = frame
+				}
+				continue
+			}
+
+			duration := time.Duration(max(frame.DTS-pending.DTS, 0)) * time.Millisecond
+			if err := sess.track.WriteSample(media.Sample{Data: pending.Payload, Duration: duration}); err != nil {
+				log.Printf("WHEP session %s: failed to write sample: %v", sess.id, err)
+				return
+			}
+			pending = frame
+		case <-sess.done:
+			log.Printf("WHEP session %s for stream %s closed", sess.id, sess.streamKey)
+			return
+		}
+	}
+}
@@ -2,25 +2,62 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"rapidrtmp/config"
 	"rapidrtmp/httpServer"
 	"rapidrtmp/internal/auth"
 	"rapidrtmp/internal/metrics"
+	"rapidrtmp/internal/muxer"
+	"rapidrtmp/internal/relay"
 	"rapidrtmp/internal/rtmp"
 	"rapidrtmp/internal/segmenter"
 	"rapidrtmp/internal/storage"
 	"rapidrtmp/internal/streammanager"
+	"rapidrtmp/internal/thumbnail"
+	"rapidrtmp/internal/version"
+	"rapidrtmp/internal/webhook"
+	"rapidrtmp/internal/whep"
 )
 
 func main() {
-	log.Println("Starting RapidRTMP Server...")
+	configPath := flag.String("config", "", "Path to a YAML or JSON config file (flags and environment variables take precedence)")
+	flags := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	log.Printf("Starting RapidRTMP Server %s", version.Get())
+
+	// Cancelled on SIGINT/SIGTERM to begin graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Load configuration
-	cfg := config.Load()
+	cfg, err := flags.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if *configPath != "" {
+		log.Printf("Loaded configuration from %s", *configPath)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 	log.Printf("HTTP Server: %s", cfg.HTTPAddr)
-	log.Printf("RTMP Server: %s (not yet implemented)", cfg.RTMPAddr)
+	if cfg.RTMPSOnly {
+		log.Println("RTMP Server: disabled (RTMPS only)")
+	} else {
+		log.Printf("RTMP Server: %s", cfg.RTMPAddr)
+	}
+	if cfg.RTMPSEnabled() {
+		log.Printf("RTMPS Server: %s", cfg.RTMPSAddr)
+	}
 	log.Printf("Storage Directory: %s", cfg.StorageDir)
 
 	// Initialize storage
@@ -28,18 +65,22 @@ func main() {
 	
 	if cfg.StorageType == "gcs" {
 		// Initialize GCS storage
-		if cfg.GCSProjectID == "" || cfg.GCSBucketName == "" {
-			log.Fatal("GCS_PROJECT_ID and GCS_BUCKET_NAME must be set when STORAGE_TYPE=gcs")
-		}
-		
-		ctx := context.Background()
-		gcsStorage, err := storage.NewGCSStorage(ctx, cfg.GCSProjectID, cfg.GCSBucketName, cfg.GCSBaseDir)
+		gcsStorage, err := storage.NewGCSStorage(context.Background(), cfg.GCSProjectID, cfg.GCSBucketName, cfg.GCSBaseDir, cfg.GCSOpTimeout)
 		if err != nil {
 			log.Fatalf("Failed to initialize GCS storage: %v", err)
 		}
+		gcsStorage.SetContentTypes(cfg.ContentTypes())
 		storageBackend = gcsStorage
 		log.Printf("Storage initialized: GCS bucket=%s, project=%s, baseDir=%s", 
 			cfg.GCSBucketName, cfg.GCSProjectID, cfg.GCSBaseDir)
+	} else if cfg.StorageType == "memory" {
+		// Initialize in-memory storage
+		memoryStorage, err := storage.NewMemoryStorage(int64(cfg.MemoryMaxMB) * 1024 * 1024)
+		if err != nil {
+			log.Fatalf("Failed to initialize memory storage: %v", err)
+		}
+		storageBackend = memoryStorage
+		log.Printf("Storage initialized: Memory (max %d MB)", cfg.MemoryMaxMB)
 	} else {
 		// Initialize local storage (default)
 		localStorage, err := storage.NewLocalStorage(cfg.StorageDir)
@@ -51,26 +92,206 @@ func main() {
 	}
 
 	// Initialize metrics
-	m := metrics.New()
-	log.Println("Prometheus metrics initialized")
+	m := metrics.New(cfg.MetricsPerStream)
+	log.Printf("Prometheus metrics initialized (per-stream labels=%v)", cfg.MetricsPerStream)
 
 	// Initialize managers
-	streamManager := streammanager.New()
+	streamManager := streammanager.New(m)
+	streamManager.SetSubscriberBuffer(streammanager.SubscriberInternal, cfg.SubscriberBuffer)
+	streamManager.SetSubscriberBuffer(streammanager.SubscriberViewer, cfg.ViewerSubscriberBuffer)
+	if cfg.WebhookURL != "" {
+		streamManager.SetWebhook(webhook.New(cfg.WebhookURL, cfg.WebhookSecret))
+		log.Printf("Stream lifecycle webhooks enabled: %s", cfg.WebhookURL)
+	}
 	authManager := auth.New()
+	authManager.SetExpiration(cfg.DefaultTokenExpiration, cfg.MaxTokenExpiration)
+	// Revoking a token with disconnect stops its stream, which drops the publisher
+	authManager.SetDisconnectFunc(func(streamKey string) {
+		if err := streamManager.StopStream(streamKey); err != nil {
+			log.Printf("Failed to stop stream %s after token revocation: %v", streamKey, err)
+		}
+	})
+	if cfg.PublishAuthURL != "" {
+		authManager.SetPublishWebhook(cfg.PublishAuthURL, cfg.PublishAuthTimeout)
+		log.Printf("Publish authorization webhook enabled: %s (timeout=%s)", cfg.PublishAuthURL, cfg.PublishAuthTimeout)
+	}
 	log.Println("Stream manager and auth manager initialized")
 
+	// Segments are muxed by FFmpeg; without it no segment is ever produced
+	if err := muxer.CheckFFmpegAvailable(); err != nil {
+		log.Fatalf("FFmpeg is required for HLS segmenting but is not usable: %v (install ffmpeg and make sure it is on PATH)", err)
+	}
+	log.Println("FFmpeg is available and working")
+
 	// Initialize segmenter
-	seg := segmenter.New(storageBackend, streamManager)
-	log.Println("HLS segmenter initialized")
+	var partTarget time.Duration
+	if cfg.LLHLS {
+		partTarget = cfg.LLPartDuration
+		log.Printf("LL-HLS server control enabled (part target %s)", partTarget)
+	}
+	seg := segmenter.New(ctx, storageBackend, muxer.NewFFmpegMuxer(), streamManager, m, segmenter.Config{
+		SegmentDuration:     cfg.HLSSegmentDuration,
+		PlaylistWindow:      cfg.HLSMaxSegments,
+		StorageRetention:    cfg.HLSStorageRetention,
+		DVRWindow:           cfg.HLSDVRWindow,
+		Recording:           cfg.RecordingEnabled,
+		CleanupGrace:        cfg.CleanupGrace,
+		ContinueOnReconnect: cfg.HLSContinueOnReconnect,
+		PartTarget:          partTarget,
+		PartHoldBack:        cfg.LLPartHoldBack,
+		KeyFrameTimeout:     cfg.HLSKeyFrameTimeout,
+	})
+	// A path template lays segments out in directories; otherwise they sit
+	// directly under the stream key
+	pathTemplate := cfg.HLSPathTemplate
+	if pathTemplate == "" {
+		pathTemplate = segmenter.StreamKeyPlaceholder + "/" + cfg.HLSSegmentPattern
+	}
+	naming, err := segmenter.NewPathLayout(pathTemplate, cfg.HLSInitSegmentName)
+	if err != nil {
+		log.Fatalf("Invalid segment naming: %v", err)
+	}
+	seg.SetNaming(naming)
+	seg.SetContainer(muxer.Container(cfg.HLSContainer))
+	seg.SetUploadConcurrency(cfg.HLSUploadConcurrency)
+
+	// Tenants with their own directory or bucket; others share the main storage
+	tenantLocations, _ := cfg.TenantStorageLocations() // Checked by Validate
+	for tenant, location := range tenantLocations {
+		var tenantStorage storage.Storage
+		if cfg.StorageType == "gcs" {
+			tenantStorage, err = storage.NewGCSStorage(context.Background(), cfg.GCSProjectID, location, cfg.GCSBaseDir, cfg.GCSOpTimeout)
+		} else {
+			tenantStorage, err = storage.NewLocalStorage(location)
+		}
+		if err != nil {
+			log.Fatalf("Failed to initialize storage for tenant %s: %v", tenant, err)
+		}
+		if gcsStorage, ok := tenantStorage.(*storage.GCSStorage); ok {
+			gcsStorage.SetContentTypes(cfg.ContentTypes())
+		}
+		if err := seg.SetTenantStorage(tenant, tenantStorage); err != nil {
+			log.Fatalf("Failed to set storage for tenant %s: %v", tenant, err)
+		}
+		log.Printf("Tenant %s stored in %s", tenant, location)
+	}
+	if cfg.StorageScan {
+		if err := seg.ScanStorageUsage(ctx); err != nil {
+			log.Printf("Failed to scan storage usage: %v", err)
+		} else {
+			bytes, segments := seg.TotalStorageUsage()
+			log.Printf("Found %d media segments (%d bytes) in storage", segments, bytes)
+		}
+	}
+	// Streams a previous run left behind: finish recordings, or delete the
+	// media its cleanup would have
+	if cfg.StorageRecovery != "off" {
+		stored, err := seg.Recover(ctx)
+		if err != nil {
+			log.Printf("Failed to recover streams from storage: %v", err)
+		}
+		for _, st := range stored {
+			log.Printf("Found stream %s in storage (tenant=%q, segments=%d, sequence=%d-%d, ended=%t)",
+				st.StreamKey, st.Tenant, st.Segments, st.FirstSequence, st.LastSequence, st.Ended)
+			if cfg.StorageRecovery != "auto" {
+				continue
+			}
+
+			if cfg.RecordingEnabled {
+				err = seg.FinalizeStored(ctx, st)
+			} else {
+				err = seg.CleanupStored(ctx, st)
+			}
+			if err != nil {
+				log.Printf("Failed to recover stream %s: %v", st.StreamKey, err)
+			}
+		}
+	}
+	log.Printf("HLS segmenter initialized (container=%s, segment=%s, window=%d, retention=%d, dvr=%s, paths=%s, continue_on_reconnect=%t, uploads=%d)", cfg.HLSContainer, cfg.HLSSegmentDuration, cfg.HLSMaxSegments, cfg.HLSStorageRetention, cfg.HLSDVRWindow, pathTemplate, cfg.HLSContinueOnReconnect, cfg.HLSUploadConcurrency)
+
+	// Delete recordings once they are older than the retention period
+	if cfg.RecordingRetention > 0 {
+		seg.StartRetention(cfg.RecordingRetention)
+		log.Printf("Recording retention enabled (retention=%s)", cfg.RecordingRetention)
+	}
+
+	// Reap streams whose publisher disappeared without closing the connection
+	if cfg.StreamIdleTimeout > 0 {
+		streamManager.StartReaper(ctx, cfg.StreamIdleTimeout, seg.StopSegmenting)
+		log.Printf("Idle stream reaper started (timeout=%s)", cfg.StreamIdleTimeout)
+	}
+
+	// Cap how long a single publish may run
+	if cfg.MaxPublishDuration > 0 {
+		streamManager.StartPublishLimit(ctx, cfg.MaxPublishDuration, seg.StopSegmenting)
+		log.Printf("Maximum publish duration set to %s", cfg.MaxPublishDuration)
+	}
+
+	// Initialize thumbnailer
+	var thumbnailer *thumbnail.Thumbnailer
+	if cfg.ThumbnailInterval > 0 {
+		thumbnailer = thumbnail.New(seg.StreamStorage, streamManager, cfg.ThumbnailInterval)
+		thumbnailer.Start()
+		log.Printf("Thumbnailer initialized (interval=%s)", cfg.ThumbnailInterval)
+	}
 
 	// Initialize HTTP server
-	httpSrv := httpServer.New(streamManager, authManager, seg, m, cfg.RTMPIngestAddr)
+	httpSrv := httpServer.New(cfg, streamManager, authManager, seg, thumbnailer, m)
 	log.Printf("HTTP server ready to start on %s", cfg.HTTPAddr)
 
 	// Initialize RTMP ingest server
-	rtmpSrv := rtmp.New(cfg.RTMPAddr, streamManager, authManager, seg)
+	rtmpAddr := cfg.RTMPAddr
+	if cfg.RTMPSOnly {
+		rtmpAddr = "" // Plaintext ingest disabled
+	}
+	// Validated with the rest of the config
+	maxWidth, maxHeight, _ := cfg.MaxIngestDimensions()
+	rtmpSrv := rtmp.New(rtmpAddr, streamManager, authManager, seg, m, rtmp.Config{
+		ChunkSize:       uint32(cfg.RTMPChunkSize),
+		BandwidthWindow: int32(cfg.RTMPBandwidthWindow),
+		MaxBitrate:      cfg.MaxIngestBitrate,
+		MaxWidth:        maxWidth,
+		MaxHeight:       maxHeight,
+		MaxConnections:  cfg.RTMPMaxConnections,
+		PublishTimeout:  cfg.RTMPPublishTimeout,
+	})
+	rtmpSrv.SetAppInStreamKey(cfg.AppInStreamKey)
+	log.Printf("RTMP connection limits: max=%d, publish timeout=%s (0 is unlimited)", cfg.RTMPMaxConnections, cfg.RTMPPublishTimeout)
+	if cfg.MaxIngestBitrate > 0 || maxWidth > 0 {
+		log.Printf("Ingest limits: bitrate=%d bps, resolution=%s (0/empty is unlimited)", cfg.MaxIngestBitrate, cfg.MaxIngestResolution)
+	}
+
+	// Forward streams to upstream RTMP servers as well
+	var relayer *relay.Relay
+	if len(cfg.RelayTargets) > 0 || cfg.RelayAllowPublishTargets {
+		relayer, err = relay.New(streamManager, cfg.RelayTargets)
+		if err != nil {
+			log.Fatalf("Invalid RELAY_TARGETS: %v", err)
+		}
+		rtmpSrv.SetRelay(relayer)
+		if cfg.RelayAllowPublishTargets {
+			httpSrv.SetRelay(relayer)
+		}
+		log.Printf("Relay enabled (%d default targets, per-publish targets=%t)", len(cfg.RelayTargets), cfg.RelayAllowPublishTargets)
+	}
+
+	// Low-latency WebRTC playback
+	var whepSrv *whep.Server
+	if cfg.WHEPEnabled {
+		whepSrv, err = whep.New(streamManager, m, cfg.WHEPICEServers)
+		if err != nil {
+			log.Fatalf("Invalid WHEP_ICE_SERVERS: %v", err)
+		}
+		httpSrv.SetWHEP(whepSrv)
+		log.Printf("WHEP playback enabled (experimental, H.264 video only, %d ICE servers)", len(cfg.WHEPICEServers))
+	}
+	if cfg.RTMPSEnabled() {
+		if err := rtmpSrv.EnableTLS(cfg.RTMPSAddr, cfg.RTMPSCert, cfg.RTMPSKey); err != nil {
+			log.Fatalf("Failed to enable RTMPS: %v", err)
+		}
+	}
 	go func() {
-		log.Printf("Starting RTMP ingest server on %s...", cfg.RTMPAddr)
+		log.Println("Starting RTMP ingest server...")
 		if err := rtmpSrv.ListenAndServe(); err != nil {
 			log.Fatalf("RTMP server failed: %v", err)
 		}
@@ -80,14 +301,84 @@ func main() {
 	log.Println("---")
 	log.Println("API Endpoints:")
 	log.Println("  GET  /api/ping")
+	log.Println("  GET  /api/v1/version")
 	log.Println("  POST /api/v1/publish")
+	log.Println("  POST /api/v1/playback-token")
+	log.Println("  GET  /api/v1/stats")
 	log.Println("  GET  /api/v1/streams")
 	log.Println("  GET  /api/v1/streams/:streamKey")
+	log.Println("  GET  /api/v1/streams/:streamKey/events")
+	log.Println("  GET  /api/v1/streams/:streamKey/history")
+	log.Println("  GET  /api/v1/streams/:streamKey/metrics")
 	log.Println("  POST /api/v1/streams/:streamKey/stop")
+	log.Println("  DELETE /api/v1/streams/:streamKey")
+	if cfg.Debug {
+		log.Println("  GET  /debug/streams")
+	}
 	log.Println("---")
+	if cfg.RequireAdminAPI {
+		log.Println("Admin API key required for stream listing and management")
+	}
+	if cfg.AccessLog {
+		log.Printf("Access logging enabled (format=%s)", cfg.AccessLogFormat)
+	}
+
+	// Start HTTP server
+	go func() {
+		var err error
+		switch {
+		case cfg.TLSCert != "":
+			log.Printf("Serving HTTPS on %s", cfg.HTTPAddr)
+			err = httpSrv.RunTLS(cfg.HTTPAddr, cfg.TLSCert, cfg.TLSKey)
+		case len(cfg.TLSAutocertDomains) > 0:
+			log.Printf("Serving HTTPS on %s with Let's Encrypt certificates for %v", cfg.HTTPAddr, cfg.TLSAutocertDomains)
+			err = httpSrv.RunAutocert(cfg.HTTPAddr, cfg.TLSAutocertDomains, cfg.TLSAutocertCacheDir)
+		default:
+			err = httpSrv.Run(cfg.HTTPAddr)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("HTTP server failed: %v", err)
+		}
+	}()
+
+	// Wait for a shutdown signal
+	<-ctx.Done()
+	stop() // A second signal kills the process immediately
+	log.Println("Shutting down RapidRTMP server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting new publishers first so no new streams start mid-drain
+	if err := rtmpSrv.Close(); err != nil {
+		log.Printf("Error closing RTMP server: %v", err)
+	}
+
+	// Finalize in-flight segments and end playlists
+	if err := seg.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down segmenter: %v", err)
+	}
 
-	// Start HTTP server (blocking)
-	if err := httpSrv.Run(cfg.HTTPAddr); err != nil {
-		log.Fatalf("HTTP server failed: %v", err)
+	if thumbnailer != nil {
+		thumbnailer.Stop()
 	}
+
+	if relayer != nil {
+		if err := relayer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down relay: %v", err)
+		}
+	}
+
+	if whepSrv != nil {
+		if err := whepSrv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down WHEP: %v", err)
+		}
+	}
+
+	// Let in-flight HTTP requests complete
+	if err := httpSrv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+
+	log.Println("RapidRTMP server stopped")
 }
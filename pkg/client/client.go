@@ -0,0 +1,123 @@
+// Package client calls the RapidRTMP HTTP API from Go programs that publish
+// to the server, e.g. to get a publish token and the RTMP URL to stream to.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"rapidrtmp/pkg/models"
+)
+
+// defaultTimeout bounds requests made by the package-level helpers
+const defaultTimeout = 10 * time.Second
+
+// maxErrorBody caps how much of an error response is read
+const maxErrorBody = 64 << 10
+
+// APIError is returned when the server answers with a non-2xx status
+type APIError struct {
+	StatusCode int
+	Code       models.ErrorCode // Empty if the body was not an error envelope
+	Message    string           // The server's error message, or the raw body
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("rapidrtmp API returned %d (%s): %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("rapidrtmp API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Client calls a RapidRTMP server's HTTP API
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// New creates a client for the server at baseURL, e.g. "http://localhost:8080"
+// A nil httpClient uses http.DefaultClient.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: httpClient,
+	}
+}
+
+// RequestPublishToken asks the server for a token to publish req.StreamKey
+func (c *Client) RequestPublishToken(ctx context.Context, req models.PublishRequest) (*models.PublishResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode publish request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/publish", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create publish request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request publish token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, readAPIError(resp)
+	}
+
+	var result models.PublishResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode publish token response: %w", err)
+	}
+	return &result, nil
+}
+
+// RequestPublishToken asks the server at baseURL for a token to publish
+// streamKey, valid for expiresIn seconds (0 for the server default)
+func RequestPublishToken(baseURL, streamKey string, expiresIn int) (*models.PublishResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	return New(baseURL, nil).RequestPublishToken(ctx, models.PublishRequest{
+		StreamKey: streamKey,
+		ExpiresIn: expiresIn,
+	})
+}
+
+// PublishURL builds the URL to publish streamKey with token, e.g.
+// rtmp://host:1935/live/mystream?token=abc. rtmpBase is the server's ingest
+// address, such as "rtmp://host:1935"; app defaults to "live".
+func PublishURL(rtmpBase, app, streamKey, token string) string {
+	if app == "" {
+		app = "live"
+	}
+	return fmt.Sprintf("%s/%s/%s?token=%s", strings.TrimRight(rtmpBase, "/"), app, streamKey, url.QueryEscape(token))
+}
+
+// readAPIError turns a failed response into an APIError
+func readAPIError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	var body models.ErrorResponse
+	if json.Unmarshal(data, &body) == nil && body.Error.Code != "" {
+		apiErr.Code = body.Error.Code
+		apiErr.Message = body.Error.Message
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
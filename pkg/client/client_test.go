@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"rapidrtmp/pkg/models"
+)
+
+// publishServer answers POST /api/v1/publish with handler after checking the request
+func publishServer(t *testing.T, handler func(w http.ResponseWriter, req models.PublishRequest)) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/publish" {
+			t.Errorf("request = %s %s, want POST /api/v1/publish", r.Method, r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+
+		var req models.PublishRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		handler(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRequestPublishToken(t *testing.T) {
+	srv := publishServer(t, func(w http.ResponseWriter, req models.PublishRequest) {
+		if req.StreamKey != "mystream" || req.ExpiresIn != 600 || req.SegmentDuration != 1 {
+			t.Errorf("request = %+v, want stream key, expiry and segment duration passed through", req)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(models.PublishResponse{
+			PublishURL: "rtmp://localhost:1935/live/mystream?token=abc",
+			StreamKey:  req.StreamKey,
+			Token:      "abc",
+			ExpiresIn:  req.ExpiresIn,
+		})
+	})
+
+	// A trailing slash on the base URL is ignored
+	c := New(srv.URL+"/", srv.Client())
+	resp, err := c.RequestPublishToken(context.Background(), models.PublishRequest{
+		StreamKey:      "mystream",
+		ExpiresIn:      600,
+		PublishOptions: models.PublishOptions{SegmentDuration: 1},
+	})
+	if err != nil {
+		t.Fatalf("RequestPublishToken: %v", err)
+	}
+	if resp.Token != "abc" || resp.StreamKey != "mystream" || resp.ExpiresIn != 600 {
+		t.Errorf("response = %+v", resp)
+	}
+}
+
+func TestRequestPublishTokenErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantCode    models.ErrorCode
+		wantMessage string
+	}{
+		{
+			name:        "error envelope",
+			status:      http.StatusBadRequest,
+			body:        `{"error":{"code":"invalid_stream_key","message":"stream key must not contain /"}}`,
+			wantCode:    models.ErrorInvalidStreamKey,
+			wantMessage: "stream key must not contain /",
+		},
+		{
+			name:        "plain text body",
+			status:      http.StatusBadGateway,
+			body:        "upstream unavailable\n",
+			wantMessage: "upstream unavailable",
+		},
+		{
+			name:        "JSON without an error code",
+			status:      http.StatusInternalServerError,
+			body:        `{"message":"boom"}`,
+			wantMessage: `{"message":"boom"}`,
+		},
+		{
+			name:        "empty body",
+			status:      http.StatusTooManyRequests,
+			wantMessage: "Too Many Requests",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := publishServer(t, func(w http.ResponseWriter, req models.PublishRequest) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			resp, err := New(srv.URL, srv.Client()).RequestPublishToken(context.Background(), models.PublishRequest{StreamKey: "mystream"})
+			if resp != nil {
+				t.Errorf("got response %+v with an error status", resp)
+			}
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want an *APIError", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Code != tt.wantCode || apiErr.Message != tt.wantMessage {
+				t.Errorf("APIError = %+v, want status %d, code %q, message %q", apiErr, tt.status, tt.wantCode, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestRequestPublishTokenBadResponse(t *testing.T) {
+	srv := publishServer(t, func(w http.ResponseWriter, req models.PublishRequest) {
+		w.Write([]byte("not json"))
+	})
+
+	_, err := New(srv.URL, srv.Client()).RequestPublishToken(context.Background(), models.PublishRequest{StreamKey: "mystream"})
+	if err == nil || !strings.Contains(err.Error(), "decode") {
+		t.Errorf("error = %v, want a decode error", err)
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		t.Errorf("a 200 response with a bad body returned APIError %v", apiErr)
+	}
+}
+
+func TestRequestPublishTokenUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close() // Nothing listens at the URL any more
+
+	if _, err := RequestPublishToken(srv.URL, "mystream", 0); err == nil {
+		t.Error("expected an error for an unreachable server")
+	}
+}
+
+func TestRequestPublishTokenContextCanceled(t *testing.T) {
+	srv := publishServer(t, func(w http.ResponseWriter, req models.PublishRequest) {
+		t.Error("request sent with a canceled context")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := New(srv.URL, srv.Client()).RequestPublishToken(ctx, models.PublishRequest{StreamKey: "mystream"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+}
+
+func TestPackageRequestPublishToken(t *testing.T) {
+	srv := publishServer(t, func(w http.ResponseWriter, req models.PublishRequest) {
+		if req.StreamKey != "mystream" || req.ExpiresIn != 0 {
+			t.Errorf("request = %+v, want stream key with the default expiry", req)
+		}
+		json.NewEncoder(w).Encode(models.PublishResponse{StreamKey: req.StreamKey, Token: "abc"})
+	})
+
+	resp, err := RequestPublishToken(srv.URL, "mystream", 0)
+	if err != nil {
+		t.Fatalf("RequestPublishToken: %v", err)
+	}
+	if resp.Token != "abc" {
+		t.Errorf("token = %q, want abc", resp.Token)
+	}
+}
+
+func TestPublishURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		rtmpBase  string
+		app       string
+		streamKey string
+		token     string
+		want      string
+	}{
+		{"default app", "rtmp://host:1935", "", "mystream", "abc", "rtmp://host:1935/live/mystream?token=abc"},
+		{"custom app", "rtmp://host:1935", "ingest", "mystream", "abc", "rtmp://host:1935/ingest/mystream?token=abc"},
+		{"trailing slash", "rtmp://host:1935/", "live", "mystream", "abc", "rtmp://host:1935/live/mystream?token=abc"},
+		{"token is escaped", "rtmps://host", "live", "mystream", "a+b/c=", "rtmps://host/live/mystream?token=a%2Bb%2Fc%3D"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PublishURL(tt.rtmpBase, tt.app, tt.streamKey, tt.token); got != tt.want {
+				t.Errorf("PublishURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIErrorMessage(t *testing.T) {
+	withCode := &APIError{StatusCode: 401, Code: models.ErrorInvalidToken, Message: "token expired"}
+	if got, want := withCode.Error(), "rapidrtmp API returned 401 (invalid_token): token expired"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	withoutCode := &APIError{StatusCode: 502, Message: "Bad Gateway"}
+	if got, want := withoutCode.Error(), "rapidrtmp API returned 502: Bad Gateway"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
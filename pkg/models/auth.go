@@ -2,14 +2,26 @@ package models
 
 import "time"
 
-// PublishToken represents a token for publishing to a stream
+// TokenType distinguishes what a token authorizes
+type TokenType string
+
+const (
+	TokenTypePublish  TokenType = "publish"
+	TokenTypePlayback TokenType = "playback"
+)
+
+// PublishToken represents a token for publishing to (or playing back) a stream
 type PublishToken struct {
 	Token       string    // The actual token string
+	Type        TokenType // What the token authorizes
 	StreamKey   string    // Stream key this token is valid for
 	CreatedAt   time.Time // When token was created
 	ExpiresAt   time.Time // When token expires
 	PublisherIP string    // IP address that requested the token
 	IsUsed      bool      // Whether token has been used
+
+	// Per-stream settings applied to the publish this token authorizes
+	Options PublishOptions
 }
 
 // IsValid checks if the token is still valid
@@ -20,7 +32,43 @@ func (t *PublishToken) IsValid() bool {
 // PublishRequest represents a request to create a publish token
 type PublishRequest struct {
 	StreamKey string `json:"streamKey" binding:"required"`
-	ExpiresIn int    `json:"expiresIn"` // Seconds until expiration (default 3600)
+	ExpiresIn int    `json:"expiresIn"` // Seconds until expiration (default DEFAULT_TOKEN_EXPIRATION, capped at MAX_TOKEN_EXPIRATION)
+
+	PublishOptions
+}
+
+// PublishOptions are per-stream settings requested with a publish token.
+// They are attached to the token and applied only to the publish it
+// authorizes; a publish without them gets the server defaults.
+type PublishOptions struct {
+	// Optional per-stream HLS overrides (server defaults when zero)
+	SegmentDuration  float64 `json:"segmentDuration,omitempty"`  // Seconds, e.g. 1 for low latency
+	PlaylistWindow   int     `json:"playlistWindow,omitempty"`   // Segments listed in the live playlist
+	StorageRetention int     `json:"storageRetention,omitempty"` // Segments kept in storage, e.g. for DVR
+
+	// Tenant whose storage directory, and backend if it has its own, the
+	// stream's files are kept in
+	Tenant string `json:"tenant,omitempty"`
+
+	// Upstream RTMP URLs to forward the stream to, replacing the server's
+	// defaults (requires RELAY_ALLOW_PUBLISH_TARGETS)
+	RelayTargets []string `json:"relayTargets,omitempty"`
+
+	// Label for the stream's audio in master playlists, or with "of", publish
+	// the stream as another stream's alternate audio, e.g. a second language
+	AudioTrack *AudioTrackRequest `json:"audioTrack,omitempty"`
+}
+
+// HasHLSOverrides reports whether any HLS setting differs from the server default
+func (o PublishOptions) HasHLSOverrides() bool {
+	return o.SegmentDuration != 0 || o.PlaylistWindow != 0 || o.StorageRetention != 0
+}
+
+// AudioTrackRequest describes a stream's audio as a master playlist rendition
+type AudioTrackRequest struct {
+	Name     string `json:"name"`               // Shown in players' audio menus, e.g. "Español"
+	Language string `json:"language,omitempty"` // RFC 5646 tag, e.g. "es"
+	Of       string `json:"of,omitempty"`       // Stream whose master playlist lists this one's audio; its video is dropped
 }
 
 // PublishResponse represents the response to a publish request
@@ -29,21 +77,61 @@ type PublishResponse struct {
 	StreamKey  string `json:"streamKey"`
 	Token      string `json:"token"`
 	ExpiresAt  string `json:"expiresAt"`
+	ExpiresIn  int    `json:"expiresIn"` // Effective lifetime in seconds, after defaulting and capping
+}
+
+// RotateTokenRequest represents a request to replace a stream's publish token
+type RotateTokenRequest struct {
+	Token       string `json:"token,omitempty"`       // Token to replace (default: the live publisher's)
+	ExpiresIn   int    `json:"expiresIn"`             // Seconds until the new token expires (default and cap as for publish)
+	RevokeAfter *int   `json:"revokeAfter,omitempty"` // Seconds until the old token is revoked (default 30)
+}
+
+// RotateTokenResponse represents the new token issued by a rotation
+type RotateTokenResponse struct {
+	PublishResponse
+	PreviousRevokesAt string `json:"previousRevokesAt,omitempty"`
+}
+
+// RevokeTokenRequest represents a request to revoke a token
+type RevokeTokenRequest struct {
+	Token      string `json:"token" binding:"required"`
+	Disconnect bool   `json:"disconnect"` // Also stop a live stream published with the token
+}
+
+// PlaybackRequest represents a request to create a playback token
+type PlaybackRequest struct {
+	StreamKey string `json:"streamKey" binding:"required"`
+	ExpiresIn int    `json:"expiresIn"` // Seconds until expiration (default 300, capped at MAX_TOKEN_EXPIRATION)
+}
+
+// PlaybackResponse represents the response to a playback request
+type PlaybackResponse struct {
+	PlaybackURL string `json:"playbackUrl"`
+	StreamKey   string `json:"streamKey"`
+	Token       string `json:"token"`
+	ExpiresAt   string `json:"expiresAt"`
+	ExpiresIn   int    `json:"expiresIn"` // Effective lifetime in seconds, after defaulting and capping
 }
 
 // StreamInfo represents stream metadata returned by the API
 type StreamInfo struct {
-	StreamKey  string                 `json:"streamKey"`
-	Active     bool                   `json:"active"`
-	State      string                 `json:"state"`
-	Viewers    int                    `json:"viewers"`
-	StartedAt  string                 `json:"startedAt,omitempty"`
-	Duration   int                    `json:"duration,omitempty"` // seconds
-	VideoCodec string                 `json:"videoCodec,omitempty"`
-	AudioCodec string                 `json:"audioCodec,omitempty"`
-	Resolution string                 `json:"resolution,omitempty"` // e.g., "1920x1080"
-	Bitrate    int                    `json:"bitrate,omitempty"`
-	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	StreamKey    string                 `json:"streamKey"`
+	Active       bool                   `json:"active"`
+	State        string                 `json:"state"`
+	Viewers      int                    `json:"viewers"`
+	StartedAt    string                 `json:"startedAt,omitempty"`
+	Duration     int                    `json:"duration,omitempty"` // seconds
+	Uptime       int                    `json:"uptime"`             // Seconds live, summed across reconnects
+	Reconnects   int                    `json:"reconnects"`         // Times the publisher went live again after stopping
+	VideoCodec   string                 `json:"videoCodec,omitempty"`
+	AudioCodec   string                 `json:"audioCodec,omitempty"`
+	Codecs       string                 `json:"codecs,omitempty"`     // RFC 6381, e.g. "avc1.64001f,mp4a.40.2"
+	Resolution   string                 `json:"resolution,omitempty"` // e.g., "1920x1080"
+	FrameRate    float64                `json:"frameRate,omitempty"`
+	Bitrate      int                    `json:"bitrate,omitempty"`
+	ThumbnailURL string                 `json:"thumbnailUrl,omitempty"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
 }
 
 // StreamListResponse represents a list of streams
@@ -51,3 +139,57 @@ type StreamListResponse struct {
 	Streams []StreamInfo `json:"streams"`
 	Total   int          `json:"total"`
 }
+
+// StreamHistoryResponse represents a stream's recent state transitions
+type StreamHistoryResponse struct {
+	StreamKey string        `json:"streamKey"`
+	History   []StateChange `json:"history"`
+}
+
+// StreamMetricsResponse is a JSON snapshot of one stream's live numbers
+type StreamMetricsResponse struct {
+	StreamKey         string `json:"streamKey"`
+	State             string `json:"state"`
+	BytesReceived     uint64 `json:"bytesReceived"`
+	FramesReceived    uint64 `json:"framesReceived"`
+	KeyFramesReceived uint64 `json:"keyFramesReceived"`
+	DroppedFrames     uint64 `json:"droppedFrames"`
+	LastFrameTime     string `json:"lastFrameTime,omitempty"`
+	Bitrate           int    `json:"bitrate"` // bps over the last 5 seconds of ingest
+	Segments          int    `json:"segments"`
+	TargetDuration    int    `json:"targetDuration,omitempty"` // seconds
+	StoredSegments    int    `json:"storedSegments"`           // Media segments in storage, DVR and recordings included
+	StoredBytes       int64  `json:"storedBytes"`
+}
+
+// DebugStream is one stream's internal state as dumped by /debug/streams
+type DebugStream struct {
+	StreamKey           string  `json:"streamKey"`
+	State               string  `json:"state"` // Empty if only the segmenter knows the stream
+	BytesReceived       uint64  `json:"bytesReceived"`
+	FramesReceived      uint64  `json:"framesReceived"`
+	DroppedFrames       uint64  `json:"droppedFrames"`
+	LastFrameTime       string  `json:"lastFrameTime,omitempty"`
+	Bitrate             int     `json:"bitrate"`
+	Subscribers         int     `json:"subscribers"`
+	HasSPSPPS           bool    `json:"hasSpsPps"`
+	Segmenting          bool    `json:"segmenting"`
+	Segments            int     `json:"segments"`
+	LastSegmentSequence *uint64 `json:"lastSegmentSequence,omitempty"`
+	PlaylistEnded       bool    `json:"playlistEnded,omitempty"`
+}
+
+// DebugStreamsResponse is the /debug/streams payload
+type DebugStreamsResponse struct {
+	Streams []DebugStream `json:"streams"`
+}
+
+// ServerStats represents aggregate statistics across all streams
+type ServerStats struct {
+	TotalStreams   int    `json:"totalStreams"`
+	LiveStreams    int    `json:"liveStreams"`
+	BytesReceived  uint64 `json:"bytesReceived"`
+	FramesReceived uint64 `json:"framesReceived"`
+	DroppedFrames  uint64 `json:"droppedFrames"`
+	Subscribers    int    `json:"subscribers"`
+}
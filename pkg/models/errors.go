@@ -0,0 +1,32 @@
+package models
+
+// ErrorCode identifies the kind of failure in an API error response, so
+// clients can handle errors without matching on messages
+type ErrorCode string
+
+const (
+	ErrorInvalidRequest   ErrorCode = "invalid_request"    // Malformed body or parameters
+	ErrorInvalidStreamKey ErrorCode = "invalid_stream_key" // Stream key fails validation
+	ErrorStreamNotFound   ErrorCode = "stream_not_found"   // No live stream with that key
+	ErrorNotFound         ErrorCode = "not_found"          // Playlist, segment or other resource unavailable
+	ErrorTokenRequired    ErrorCode = "token_required"     // Request needs a token and carried none
+	ErrorInvalidToken     ErrorCode = "invalid_token"      // Unknown token, or not valid for this stream
+	ErrorTokenExpired     ErrorCode = "token_expired"      // Token expired or was already used
+	ErrorTokenNotFound    ErrorCode = "token_not_found"    // Token to revoke does not exist
+	ErrorUnauthorized     ErrorCode = "unauthorized"       // Admin endpoint called without the admin API key
+	ErrorForbidden        ErrorCode = "forbidden"          // Admin API key is wrong
+	ErrorRateLimited      ErrorCode = "rate_limited"       // Client exceeded its request rate
+	ErrorUnavailable      ErrorCode = "unavailable"        // Not ready within the time allowed; retry
+	ErrorInternal         ErrorCode = "internal_error"     // Server-side failure
+)
+
+// ErrorResponse is the body of every API error response
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes an API error
+type ErrorDetail struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
@@ -1,19 +1,31 @@
 package models
 
+import "time"
+
 // Frame represents a single audio or video frame from RTMP ingest
 type Frame struct {
-	StreamKey  string                 // Unique identifier for the stream
-	IsVideo    bool                   // true for video, false for audio
-	Timestamp  uint32                 // PTS/DTS timestamp in milliseconds
-	Payload    []byte                 // Raw NAL units (H.264) or AAC frames
-	Codec      string                 // "h264", "h265", "aac", "mp3"
-	IsKeyFrame bool                   // true if this is an IDR frame (video only)
-	Metadata   map[string]interface{} // Additional codec-specific metadata
+	StreamKey       string                 // Unique identifier for the stream
+	IsVideo         bool                   // true for video, false for audio
+	Timestamp       uint32                 // Raw RTMP timestamp in milliseconds (may wrap or start at an offset)
+	DTS             int64                  // Normalized decode timestamp in milliseconds, monotonic from 0
+	CompositionTime int32                  // PTS - DTS offset in milliseconds (non-zero with B-frames)
+	Payload         []byte                 // Raw NAL units (H.264) or AAC frames
+	Codec           string                 // "h264", "h265", "aac", "mp3"
+	IsKeyFrame      bool                   // true if this is an IDR frame (video only)
+	CodecChanged    bool                   // First keyframe after the publisher changed SPS/PPS mid-stream
+	Metadata        map[string]interface{} // Additional codec-specific metadata
+	ReceivedAt      time.Time              // Wall-clock arrival at the server, for latency metrics
+}
+
+// PTS returns the presentation timestamp in milliseconds
+func (f *Frame) PTS() int64 {
+	return f.DTS + int64(f.CompositionTime)
 }
 
 // CodecInfo contains initialization data for a codec
 type CodecInfo struct {
 	Codec       string  // "h264", "aac", etc.
+	CodecString string  // RFC 6381 identifier for HLS CODECS, e.g. "avc1.64001f" or "mp4a.40.2"
 	SPS         []byte  // H.264 Sequence Parameter Set (video)
 	PPS         []byte  // H.264 Picture Parameter Set (video)
 	VPS         []byte  // H.265 Video Parameter Set (optional)
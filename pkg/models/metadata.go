@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// TimedMetadata is a point or span on a stream's timeline carrying
+// publisher or operator data, e.g. an ad break or now-playing info. It is
+// signalled to players as an EXT-X-DATERANGE tag in the media playlist.
+type TimedMetadata struct {
+	ID         string            `json:"id"`                 // Unique within the stream
+	Class      string            `json:"class,omitempty"`    // Kind of metadata, e.g. "onCuePoint" or "com.example.ad"
+	StartDate  time.Time         `json:"startDate"`          // Wall-clock time the metadata applies from
+	Duration   float64           `json:"duration,omitempty"` // Seconds it applies for; 0 if unknown or instantaneous
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// MetadataRequest represents a request to insert timed metadata into a live stream
+type MetadataRequest struct {
+	ID         string            `json:"id,omitempty"`       // Defaults to a generated ID
+	Class      string            `json:"class,omitempty"`    // Kind of metadata
+	Duration   float64           `json:"duration,omitempty"` // Seconds the metadata applies for
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// CueType is the kind of ad marker
+type CueType string
+
+const (
+	CueOut CueType = "splice-out" // Splice out of the program into an ad break
+	CueIn  CueType = "splice-in"  // Splice back into the program, ending a break early
+)
+
+// Cue is an ad marker inserted at the next segment boundary
+type Cue struct {
+	Type     CueType   `json:"type" binding:"required"`
+	Duration float64   `json:"duration,omitempty"` // Seconds of the break; required for splice-out
+	At       time.Time `json:"at"`                 // Set by the server; the cue applies to the first segment starting from then
+}
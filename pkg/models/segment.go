@@ -8,9 +8,20 @@ type Segment struct {
 	SequenceNum uint64    // Segment sequence number
 	Duration    float64   // Duration in seconds
 	FilePath    string    // Path to segment file (local or S3)
+	URI         string    // Path relative to the stream, as listed in the playlist
 	FileSize    int64     // Size in bytes
 	CreatedAt   time.Time // When segment was created
 	IsAvailable bool      // Whether segment is ready for serving
+
+	Discontinuity   bool      // Timestamps or encoding don't follow on from the previous segment
+	InitURI         string    // fMP4 only: the init segment needed to decode this one
+	ProgramDateTime time.Time // Wall-clock time of the segment's first frame, for EXT-X-PROGRAM-DATE-TIME
+
+	// Ad breaks, signalled with EXT-X-CUE-OUT, EXT-X-CUE-OUT-CONT and EXT-X-CUE-IN
+	CueOut      bool    // An ad break starts with this segment
+	CueIn       bool    // An ad break ended before this segment
+	CueDuration float64 // Length of the break this segment is in; 0 outside breaks
+	CueElapsed  float64 // Seconds of the break before this segment
 }
 
 // Playlist represents an HLS playlist state
@@ -1,10 +1,69 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
 
+// MaxStreamKeyLength bounds stream keys, which become storage paths and URL segments
+const MaxStreamKeyLength = 128
+
+// ErrInvalidStreamKey is returned for stream keys that are unsafe as storage paths
+var ErrInvalidStreamKey = errors.New("invalid stream key")
+
+// ValidateStreamKey checks a stream key (or one component of an app-namespaced
+// key) against an allowlist of ASCII letters, digits, '-' and '_'.
+// Keys flow into filesystem paths and object names, so anything else is rejected.
+func ValidateStreamKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: must not be empty", ErrInvalidStreamKey)
+	}
+	if len(key) > MaxStreamKeyLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidStreamKey, MaxStreamKeyLength)
+	}
+
+	if !safeName(key) {
+		return fmt.Errorf("%w: only letters, digits, '-' and '_' are allowed", ErrInvalidStreamKey)
+	}
+	return nil
+}
+
+// MaxTenantLength bounds tenant names, which become storage prefixes
+const MaxTenantLength = 64
+
+// ErrInvalidTenant is returned for tenant names that are unsafe as storage prefixes
+var ErrInvalidTenant = errors.New("invalid tenant")
+
+// ValidateTenant checks a tenant name against the same allowlist as stream keys
+func ValidateTenant(tenant string) error {
+	if tenant == "" {
+		return fmt.Errorf("%w: must not be empty", ErrInvalidTenant)
+	}
+	if len(tenant) > MaxTenantLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidTenant, MaxTenantLength)
+	}
+	if !safeName(tenant) {
+		return fmt.Errorf("%w: only letters, digits, '-' and '_' are allowed", ErrInvalidTenant)
+	}
+	return nil
+}
+
+// safeName reports whether s only holds ASCII letters, digits, '-' and '_'
+func safeName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // StreamState represents the current state of a stream
 type StreamState string
 
@@ -16,6 +75,16 @@ const (
 	StreamStateStopped    StreamState = "stopped"
 )
 
+// maxStateHistory bounds the number of state changes kept per stream key
+const maxStateHistory = 100
+
+// StateChange records a single stream state transition
+type StateChange struct {
+	From StreamState `json:"from"`
+	To   StreamState `json:"to"`
+	At   time.Time   `json:"at"`
+}
+
 // Stream represents a live stream
 type Stream struct {
 	Key         string                 // Unique stream key
@@ -31,9 +100,32 @@ type Stream struct {
 	// Stats
 	Stats StreamStats
 
+	observers *observerSet // Signalled on stats/state changes, shared across reconnects
+
+	history []StateChange // Most recent state transitions, oldest first
+
+	// Live time across sessions of this stream key
+	uptime     time.Duration // Sum of finished live intervals
+	liveSince  time.Time     // Start of the current live interval; zero when not live
+	everLive   bool          // Whether any session has gone live
+	reconnects int           // Times the stream went live again after stopping
+
+	done chan struct{} // Closed once the stream is stopped
+
+	// Rolling bitrate: bytes received per wall-clock second over the last bitrateBuckets seconds
+	bitrateBytes   [bitrateBuckets]uint64
+	bitrateSeconds [bitrateBuckets]int64 // Unix second each bucket currently holds
+	bitrateStart   time.Time             // First frame, for the provisional startup value
+
 	mu sync.RWMutex // Protects concurrent access
 }
 
+// bitrateBuckets is the length of the rolling bitrate window in seconds
+const bitrateBuckets = 5
+
+// minBitrateSpan is how much data is needed before a provisional bitrate is reported
+const minBitrateSpan = 500 * time.Millisecond
+
 // StreamStats tracks stream statistics
 type StreamStats struct {
 	BytesReceived     uint64    // Total bytes received from publisher
@@ -41,7 +133,7 @@ type StreamStats struct {
 	KeyFramesReceived uint64    // Total keyframes received
 	DroppedFrames     uint64    // Frames dropped due to errors/backpressure
 	LastFrameTime     time.Time // Time of last frame received
-	Bitrate           int       // Current bitrate in bps (rolling average)
+	Bitrate           int       // Current bitrate in bps, averaged over the last 5 seconds
 }
 
 // UpdateStats updates stream statistics
@@ -49,13 +141,53 @@ func (s *Stream) UpdateStats(frame *Frame) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := time.Now()
 	s.Stats.FramesReceived++
 	s.Stats.BytesReceived += uint64(len(frame.Payload))
-	s.Stats.LastFrameTime = time.Now()
+	s.Stats.LastFrameTime = now
+
+	s.updateBitrate(now, len(frame.Payload))
 
 	if frame.IsKeyFrame {
 		s.Stats.KeyFramesReceived++
 	}
+
+	s.notifyObservers()
+}
+
+// updateBitrate adds size bytes to the rolling window and recomputes Stats.Bitrate
+// Until the window has filled, the rate is provisional: bytes so far over the
+// time since the first frame. Caller holds s.mu.
+func (s *Stream) updateBitrate(now time.Time, size int) {
+	if s.bitrateStart.IsZero() {
+		s.bitrateStart = now
+	}
+
+	sec := now.Unix()
+	idx := sec % bitrateBuckets
+	if s.bitrateSeconds[idx] != sec {
+		s.bitrateSeconds[idx] = sec
+		s.bitrateBytes[idx] = 0
+	}
+	s.bitrateBytes[idx] += uint64(size)
+
+	// The window spans the previous full seconds plus the current partial one
+	windowStart := time.Unix(sec-bitrateBuckets+1, 0)
+	if s.bitrateStart.After(windowStart) {
+		windowStart = s.bitrateStart
+	}
+	span := now.Sub(windowStart)
+	if span < minBitrateSpan {
+		return
+	}
+
+	var total uint64
+	for i, bucketSec := range s.bitrateSeconds {
+		if bucketSec > sec-bitrateBuckets {
+			total += s.bitrateBytes[i]
+		}
+	}
+	s.Stats.Bitrate = int(float64(total*8) / span.Seconds())
 }
 
 // IncrementViewers atomically increments the viewer count
@@ -63,6 +195,7 @@ func (s *Stream) IncrementViewers() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.ViewerCount++
+	s.notifyObservers()
 }
 
 // DecrementViewers atomically decrements the viewer count
@@ -72,6 +205,7 @@ func (s *Stream) DecrementViewers() {
 	if s.ViewerCount > 0 {
 		s.ViewerCount--
 	}
+	s.notifyObservers()
 }
 
 // GetViewerCount safely returns the current viewer count
@@ -81,10 +215,26 @@ func (s *Stream) GetViewerCount() int {
 	return s.ViewerCount
 }
 
+// GetStartedAt safely returns when the stream went live, or the zero time
+// if it hasn't yet
+func (s *Stream) GetStartedAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.StartedAt
+}
+
 // SetState safely updates the stream state
 func (s *Stream) SetState(state StreamState) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+
+	if state != s.State {
+		s.history = append(s.history, StateChange{From: s.State, To: state, At: time.Now()})
+		if len(s.history) > maxStateHistory {
+			s.history = s.history[len(s.history)-maxStateHistory:]
+		}
+	}
+	s.trackUptime(state)
 	s.State = state
 
 	if state == StreamStateLive && s.StartedAt.IsZero() {
@@ -92,7 +242,104 @@ func (s *Stream) SetState(state StreamState) {
 	} else if state == StreamStateStopped {
 		now := time.Now()
 		s.StoppedAt = &now
+		s.closeDone()
+	}
+
+	s.notifyObservers()
+}
+
+// trackUptime opens or closes a live interval for a transition to state
+// Caller holds s.mu.
+func (s *Stream) trackUptime(state StreamState) {
+	now := time.Now()
+	if state == StreamStateLive && s.State != StreamStateLive {
+		if s.everLive {
+			s.reconnects++
+		}
+		s.everLive = true
+		s.liveSince = now
+	} else if state != StreamStateLive && !s.liveSince.IsZero() {
+		s.uptime += now.Sub(s.liveSince)
+		s.liveSince = time.Time{}
+	}
+}
+
+// Uptime returns the total time the stream has been live, summed over every
+// session of its key, so gaps while the publisher reconnects don't count
+func (s *Stream) Uptime() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	uptime := s.uptime
+	if !s.liveSince.IsZero() {
+		uptime += time.Since(s.liveSince)
+	}
+	return uptime
+}
+
+// Reconnects returns how many times the stream went live again after stopping
+func (s *Stream) Reconnects() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reconnects
+}
+
+// Done returns a channel that is closed when the stream is stopped, so the
+// publisher's connection can be told when the stream is ended from elsewhere
+func (s *Stream) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done == nil {
+		s.done = make(chan struct{})
+		if s.State == StreamStateStopped {
+			close(s.done)
+		}
 	}
+	return s.done
+}
+
+// closeDone closes the done channel if it isn't already (caller holds s.mu)
+func (s *Stream) closeDone() {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// GetStateHistory returns a copy of the stream's recent state transitions
+func (s *Stream) GetStateHistory() []StateChange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history := make([]StateChange, len(s.history))
+	copy(history, s.history)
+	return history
+}
+
+// InheritHistory carries over the state history, uptime and reconnect count
+// of a previous session for the same stream key, so reconnects show up in a
+// single timeline
+func (s *Stream) InheritHistory(prev *Stream) {
+	history := prev.GetStateHistory()
+
+	prev.mu.RLock()
+	uptime, everLive, reconnects := prev.uptime, prev.everLive, prev.reconnects
+	prev.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(history, s.history...)
+	if len(s.history) > maxStateHistory {
+		s.history = s.history[len(s.history)-maxStateHistory:]
+	}
+	s.uptime += uptime
+	s.everLive = s.everLive || everLive
+	s.reconnects += reconnects
 }
 
 // GetState safely returns the current stream state
@@ -102,9 +349,133 @@ func (s *Stream) GetState() StreamState {
 	return s.State
 }
 
+// GetStats safely returns a snapshot of the stream statistics
+func (s *Stream) GetStats() StreamStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Stats
+}
+
+// SetVideoCodec records the stream's video codec information
+func (s *Stream) SetVideoCodec(codec *CodecInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.VideoCodec = codec
+	s.notifyObservers()
+}
+
+// GetVideoCodec returns the stream's video codec information, if known
+func (s *Stream) GetVideoCodec() *CodecInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.VideoCodec
+}
+
+// SetAudioCodec records the stream's audio codec information
+func (s *Stream) SetAudioCodec(codec *CodecInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.AudioCodec = codec
+	s.notifyObservers()
+}
+
+// GetAudioCodec returns the stream's audio codec information, if known
+func (s *Stream) GetAudioCodec() *CodecInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.AudioCodec
+}
+
+// Codecs returns the RFC 6381 codec identifiers of the stream's video and
+// audio as a comma-separated HLS CODECS value, or "" if neither is known
+func (s *Stream) Codecs() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var codecs []string
+	for _, codec := range []*CodecInfo{s.VideoCodec, s.AudioCodec} {
+		if codec != nil && codec.CodecString != "" {
+			codecs = append(codecs, codec.CodecString)
+		}
+	}
+	return strings.Join(codecs, ",")
+}
+
 // IncrementDroppedFrames atomically increments the dropped frames counter
 func (s *Stream) IncrementDroppedFrames() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.Stats.DroppedFrames++
+	s.notifyObservers()
+}
+
+// observerSet holds the observers of one stream key. Sessions of the same key
+// share a set, so watchers keep receiving updates when a publisher reconnects.
+type observerSet struct {
+	mu     sync.Mutex
+	chans  map[int]chan struct{}
+	nextID int
+}
+
+// AddObserver registers an observer that is signalled whenever the stream's
+// stats or state change. Signals are coalesced, so a slow observer only ever
+// sees one pending notification. Returns the signal channel and a function
+// that removes the observer.
+func (s *Stream) AddObserver() (<-chan struct{}, func()) {
+	s.mu.Lock()
+	if s.observers == nil {
+		s.observers = &observerSet{chans: make(map[int]chan struct{})}
+	}
+	set := s.observers
+	s.mu.Unlock()
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	id := set.nextID
+	set.nextID++
+
+	ch := make(chan struct{}, 1)
+	set.chans[id] = ch
+
+	remove := func() {
+		set.mu.Lock()
+		defer set.mu.Unlock()
+		delete(set.chans, id)
+	}
+
+	return ch, remove
+}
+
+// InheritObservers moves the observers of a previous session for the same
+// stream key onto this stream and signals them about the new session
+func (s *Stream) InheritObservers(prev *Stream) {
+	prev.mu.RLock()
+	set := prev.observers
+	prev.mu.RUnlock()
+	if set == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = set
+	s.notifyObservers()
+}
+
+// notifyObservers signals all observers without blocking (caller must hold s.mu)
+func (s *Stream) notifyObservers() {
+	if s.observers == nil {
+		return
+	}
+
+	s.observers.mu.Lock()
+	defer s.observers.mu.Unlock()
+	for _, ch := range s.observers.chans {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// Notification already pending
+		}
+	}
 }
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateStreamKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"letters", "mystream", false},
+		{"mixed case, digits, dash and underscore", "My-Stream_01", false},
+		{"single character", "a", false},
+		{"maximum length", strings.Repeat("k", MaxStreamKeyLength), false},
+		{"empty", "", true},
+		{"too long", strings.Repeat("k", MaxStreamKeyLength+1), true},
+		{"dot dot", "..", true},
+		{"parent traversal", "../etc", true},
+		{"single dot", ".", true},
+		{"forward slash", "live/stream", true},
+		{"leading slash", "/stream", true},
+		{"backslash", `live\stream`, true},
+		{"space", "my stream", true},
+		{"newline", "stream\n", true},
+		{"NUL byte", "stream\x00", true},
+		{"tab", "my\tstream", true},
+		{"DEL", "stream\x7f", true},
+		{"query string", "stream?token=abc", true},
+		{"percent encoded", "stream%2F", true},
+		{"unicode letter", "strëam", true},
+		{"unicode digit", "stream٣", true},
+		{"emoji", "stream🎥", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateStreamKey(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateStreamKey(%q) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidStreamKey) {
+				t.Errorf("error %v does not wrap ErrInvalidStreamKey", err)
+			}
+		})
+	}
+}